@@ -3,7 +3,7 @@ package cert
 import "sync/atomic"
 
 type NebulaCertificate struct {
-	//Details   NebulaCertificateDetails
+	Details   NebulaCertificateDetails
 	Signature []byte
 
 	// the cached hex string of the calculated sha256sum
@@ -14,3 +14,21 @@ type NebulaCertificate struct {
 	// for VerifyWithCache
 	signatureVerified atomic.Pointer[[]byte]
 }
+
+// NebulaCertificateDetails 证书中描述节点身份的字段，防火墙规则的 name、groups 与 ca_name 据此匹配
+type NebulaCertificateDetails struct {
+	Name   string
+	Groups []string
+	// Issuer 签发该证书的 CA 的名称
+	Issuer string
+}
+
+// InGroup 证书是否属于 group
+func (d NebulaCertificateDetails) InGroup(group string) bool {
+	for _, g := range d.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
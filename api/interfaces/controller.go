@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/am6737/nexus/api"
 	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/transport/buffer"
 	"github.com/am6737/nexus/transport/packet"
 	"github.com/am6737/nexus/transport/protocol/udp"
 	"github.com/am6737/nexus/transport/protocol/udp/header"
@@ -26,6 +27,9 @@ type Writer interface {
 type OutsideWriter interface {
 	WriteToAddr(p []byte, addr net.Addr) error
 	WriteToVIP(p []byte, addr api.VpnIP) error
+	// WriteBatchToVIP 通过第 q 个队列的套接字批量发送数据包，bufs[i] 发往 addrs[i]，
+	// 数据包会在缓冲区中就地加密，缓冲区由调用方释放
+	WriteBatchToVIP(q int, bufs []*buffer.Buffer, addrs []api.VpnIP) error
 }
 
 type InsideWriter interface {
@@ -36,7 +40,8 @@ type InsideWriter interface {
 type InboundController interface {
 	Runnable
 	OutsideWriter
-	Listen(internalWriter InsideWriter)
+	// Listen 读取第 q 个队列的套接字，解密后的数据包写入 internalWriter
+	Listen(q int, internalWriter InsideWriter)
 	//Send(out []byte, vip api.VpnIP) error
 	//SendToRemote(out []byte, addr *udp.Addr) error
 	Close() error
@@ -45,7 +50,8 @@ type InboundController interface {
 // OutboundController 入站控制器接口
 type OutboundController interface {
 	Runnable
-	Listen(externalWriter OutsideWriter)
+	// Listen 读取第 q 个 tun 队列，数据包通过 externalWriter 发送
+	Listen(q int, externalWriter OutsideWriter)
 	Send(p []byte) (n int, err error)
 	Close() error
 }
@@ -1,7 +1,6 @@
 package api
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/am6737/nexus/config"
@@ -88,26 +87,49 @@ type FindOptions struct {
 	IsLighthouse bool
 }
 
-type VpnIP uint32
+// VpnIP 表示一个 overlay 地址。IPv4 地址以 IPv4-mapped IPv6 的形式存储，
+// 因此同一个类型可以同时承载 IPv4 与 IPv6，并且可以直接作为 map 的键使用。
+type VpnIP [16]byte
+
+var v4InV6Prefix = [12]byte{10: 0xff, 11: 0xff}
 
 const maxIPv4StringLen = len("255.255.255.255")
 
+// Is4 reports whether ip is an IPv4 address.
+func (ip VpnIP) Is4() bool {
+	return [12]byte(ip[:12]) == v4InV6Prefix
+}
+
+// Is6 reports whether ip is an IPv6 address that is not IPv4-mapped.
+func (ip VpnIP) Is6() bool {
+	return !ip.Is4()
+}
+
+// IsZero reports whether ip is the zero value.
+func (ip VpnIP) IsZero() bool {
+	return ip == VpnIP{}
+}
+
 func (ip VpnIP) String() string {
+	if !ip.Is4() {
+		return netip.AddrFrom16(ip).String()
+	}
+
 	b := make([]byte, maxIPv4StringLen)
 
-	n := ubtoa(b, 0, byte(ip>>24))
+	n := ubtoa(b, 0, ip[12])
 	b[n] = '.'
 	n++
 
-	n += ubtoa(b, n, byte(ip>>16&255))
+	n += ubtoa(b, n, ip[13])
 	b[n] = '.'
 	n++
 
-	n += ubtoa(b, n, byte(ip>>8&255))
+	n += ubtoa(b, n, ip[14])
 	b[n] = '.'
 	n++
 
-	n += ubtoa(b, n, byte(ip&255))
+	n += ubtoa(b, n, ip[15])
 	return string(b[:n])
 }
 
@@ -115,28 +137,46 @@ func (ip VpnIP) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%s\"", ip.String())), nil
 }
 
+// MarshalText 使 VpnIP 可以作为 JSON 对象的键
+func (ip VpnIP) MarshalText() ([]byte, error) {
+	return []byte(ip.String()), nil
+}
+
+// ToIP 返回 4 字节（IPv4）或 16 字节（IPv6）的 net.IP
 func (ip VpnIP) ToIP() net.IP {
-	nip := make(net.IP, 4)
-	binary.BigEndian.PutUint32(nip, uint32(ip))
+	if ip.Is4() {
+		nip := make(net.IP, 4)
+		copy(nip, ip[12:])
+		return nip
+	}
+	nip := make(net.IP, 16)
+	copy(nip, ip[:])
 	return nip
 }
 
 func (ip VpnIP) ToNetIpAddr() netip.Addr {
-	var nip [4]byte
-	binary.BigEndian.PutUint32(nip[:], uint32(ip))
-	return netip.AddrFrom4(nip)
+	return netip.AddrFrom16(ip).Unmap()
 }
 
 func (ip VpnIP) ToNetIP() net.IP {
-	ipStr := fmt.Sprintf("%d.%d.%d.%d", byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
-	return net.ParseIP(ipStr)
+	return ip.ToIP()
 }
 
+// Ip2VpnIp 将 4 字节或 16 字节的地址转换为 VpnIP
 func Ip2VpnIp(ip []byte) VpnIP {
+	var vip VpnIP
 	if len(ip) == 16 {
-		return VpnIP(binary.BigEndian.Uint32(ip[12:16]))
+		copy(vip[:], ip)
+		return vip
 	}
-	return VpnIP(binary.BigEndian.Uint32(ip))
+	copy(vip[:12], v4InV6Prefix[:])
+	copy(vip[12:], ip)
+	return vip
+}
+
+// AddrToVpnIp 将 netip.Addr 转换为 VpnIP
+func AddrToVpnIp(addr netip.Addr) VpnIP {
+	return addr.As16()
 }
 
 func ToNetIpAddr(ip net.IP) (netip.Addr, error) {
@@ -148,15 +188,14 @@ func ToNetIpAddr(ip net.IP) (netip.Addr, error) {
 }
 
 func ParseVpnIp(str string) (VpnIP, error) {
-	ip := net.ParseIP(str)
-	if ip == nil {
-		return 0, fmt.Errorf("invalid IP address: %s", str)
+	addr, err := netip.ParseAddr(str)
+	if err != nil {
+		return VpnIP{}, fmt.Errorf("invalid IP address: %s", str)
 	}
-	ipBytes := ip.To4()
-	if ipBytes == nil {
-		return 0, fmt.Errorf("invalid IPv4 address: %s", str)
+	if addr.Zone() != "" {
+		return VpnIP{}, fmt.Errorf("invalid IP address, zone not allowed: %s", str)
 	}
-	return VpnIP(binary.BigEndian.Uint32(ipBytes)), nil
+	return AddrToVpnIp(addr), nil
 }
 
 func ToNetIpPrefix(ipNet net.IPNet) (netip.Prefix, error) {
@@ -168,9 +207,20 @@ func ToNetIpPrefix(ipNet net.IPNet) (netip.Prefix, error) {
 	if ones == 0 && bits == 0 {
 		return netip.Prefix{}, fmt.Errorf("invalid net.IP: %v", ipNet)
 	}
+	if bits == 8*net.IPv4len {
+		addr = addr.Unmap()
+	}
 	return netip.PrefixFrom(addr, ones), nil
 }
 
+// PrefixToIPNet 将 netip.Prefix 转换为 net.IPNet
+func PrefixToIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
 // ubtoa encodes the string form of the integer v to dst[start:] and
 // returns the number of bytes written to dst. The caller must ensure
 // that dst has sufficient length.
@@ -204,3 +254,13 @@ func (ip *VpnIP) UnmarshalJSON(data []byte) error {
 	*ip = parsedIp
 	return nil
 }
+
+func (ip *VpnIP) UnmarshalText(data []byte) error {
+	parsedIp, err := ParseVpnIp(string(data))
+	if err != nil {
+		return err
+	}
+
+	*ip = parsedIp
+	return nil
+}
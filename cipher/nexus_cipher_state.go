@@ -1,23 +1,42 @@
 package cipher
 
 import (
+	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/gopenpgp/v2/helper"
 	"golang.org/x/crypto/chacha20poly1305"
 	"strings"
+	"sync/atomic"
 )
 
 var chacha20poly1305Key = []byte("1234567890abcdef1234567890abcdef")
 
 //var chacha20poly1305Key = GenerateRandomKey(chacha20poly1305.KeySize)
 
+const (
+	// NonceSize Seal 在数据前写入的 nonce 长度
+	NonceSize = chacha20poly1305.NonceSize
+	// TagSize Seal 在数据后写入的认证标签长度
+	TagSize = chacha20poly1305.Overhead
+)
+
+var ErrMessageTooShort = errors.New("message too short")
+
 type NexusCipherState struct {
 	p Cipher
 	c Cipher
 
+	// aead 数据消息就地加解密使用的 AEAD
+	aead cipher.AEAD
+	// nonceSalt 与 nonceCounter 组成数据消息的 nonce，salt 随机生成，避免不同节点使用相同的 nonce
+	nonceSalt    uint32
+	nonceCounter atomic.Uint64
+
 	keyPair *KeyPair
 }
 
@@ -58,12 +77,34 @@ func NewNexusCipherState(name, email, passphrase string) (*NexusCipherState, err
 	}
 
 	return &NexusCipherState{
-		p:       NewPgpCipher(),
-		c:       c,
-		keyPair: keyPair,
+		p:         NewPgpCipher(),
+		c:         c,
+		aead:      aead,
+		nonceSalt: binary.BigEndian.Uint32(GenerateRandomKey(4)),
+		keyPair:   keyPair,
 	}, nil
 }
 
+// Seal 就地加密数据消息，b 的布局为 nonce（NonceSize）| 明文 | 认证标签（TagSize），
+// Seal 写入 nonce 并用密文与认证标签覆盖明文之后的部分，不分配内存
+func (s *NexusCipherState) Seal(b []byte) {
+	nonce := b[:NonceSize]
+	binary.BigEndian.PutUint32(nonce[:4], s.nonceSalt)
+	binary.BigEndian.PutUint64(nonce[4:], s.nonceCounter.Add(1))
+
+	plaintext := b[NonceSize : len(b)-TagSize]
+	s.aead.Seal(plaintext[:0], nonce, plaintext, nil)
+}
+
+// Open 就地解密 Seal 生成的数据消息，返回的明文与 b 共享内存
+func (s *NexusCipherState) Open(b []byte) ([]byte, error) {
+	if len(b) < NonceSize+TagSize {
+		return nil, ErrMessageTooShort
+	}
+	ciphertext := b[NonceSize:]
+	return s.aead.Open(ciphertext[:0], b[:NonceSize], ciphertext, nil)
+}
+
 func (s *NexusCipherState) Encrypt(plaintext []byte, publicKey string) ([]byte, error) {
 	// 生成一个随机 nonce 作为 ChaCha20-Poly1305 的 nonce
 	nonce := GenerateRandomKey(chacha20poly1305.NonceSize)
@@ -5,6 +5,7 @@ import (
 	"github.com/am6737/nexus/api"
 	"github.com/am6737/nexus/transport/packet"
 	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
 )
@@ -71,3 +72,62 @@ func Test1(t *testing.T) {
 
 	fmt.Println("h2解密后的明文 => ", string(cleartext[20:]))
 }
+
+func TestNexusCipherState_SealOpen(t *testing.T) {
+	h1, err := NewNexusCipherState("h1", "h1@qq.com", "123")
+	assert.NoError(t, err)
+	h2, err := NewNexusCipherState("h2", "h2@qq.com", "321")
+	assert.NoError(t, err)
+
+	message := []byte("hello world")
+	b := make([]byte, NonceSize+len(message)+TagSize)
+	copy(b[NonceSize:], message)
+
+	h1.Seal(b)
+	assert.NotEqual(t, message, b[NonceSize:NonceSize+len(message)])
+
+	// 每个数据消息的 nonce 都不同
+	nonce := append([]byte{}, b[:NonceSize]...)
+	c := make([]byte, len(b))
+	copy(c[NonceSize:], message)
+	h1.Seal(c)
+	assert.NotEqual(t, nonce, c[:NonceSize])
+
+	cleartext, err := h2.Open(b)
+	assert.NoError(t, err)
+	assert.Equal(t, message, cleartext)
+
+	b[len(b)-1] ^= 0xff
+	_, err = h2.Open(b)
+	assert.Error(t, err)
+
+	_, err = h2.Open(b[:NonceSize])
+	assert.ErrorIs(t, err, ErrMessageTooShort)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		copy(c[NonceSize:], message)
+		h1.Seal(c)
+		if _, err := h2.Open(c); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkNexusCipherState_SealOpen(b *testing.B) {
+	s, err := NewNexusCipherState("h1", "h1@qq.com", "123")
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := make([]byte, NonceSize+1400+TagSize)
+
+	b.ReportAllocs()
+	b.SetBytes(1400)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Seal(p)
+		if _, err := s.Open(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
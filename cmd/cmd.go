@@ -66,5 +66,17 @@ var App = &cli.App{
 			},
 			Action: enroll,
 		},
+		{
+			Name:  "rules",
+			Usage: "firewall rules",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "test",
+					Usage:  "evaluate a synthetic packet against the firewall rules",
+					Flags:  rulesTestFlags,
+					Action: rulesTest,
+				},
+			},
+		},
 	},
 }
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/api/cert"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/rules"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/urfave/cli/v2"
+	"strconv"
+)
+
+var rulesTestFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "config",
+		Usage: "config file path",
+		Value: "config.yaml",
+	},
+	&cli.StringFlag{
+		Name:  "direction",
+		Usage: "inbound or outbound",
+		Value: rules.DirectionInbound,
+	},
+	&cli.StringFlag{
+		Name:  "proto",
+		Usage: "protocol name or number",
+		Value: "tcp",
+	},
+	&cli.StringFlag{
+		Name:     "src",
+		Usage:    "source address",
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "dst",
+		Usage:    "destination address",
+		Required: true,
+	},
+	&cli.UintFlag{
+		Name:  "sport",
+		Usage: "source port",
+	},
+	&cli.UintFlag{
+		Name:  "dport",
+		Usage: "destination port",
+	},
+	&cli.UintFlag{
+		Name:  "icmp-type",
+		Usage: "icmp type",
+	},
+	&cli.UintFlag{
+		Name:  "icmp-code",
+		Usage: "icmp code",
+	},
+	&cli.BoolFlag{
+		Name:  "fragment",
+		Usage: "the packet is a later fragment without ports",
+	},
+	&cli.StringFlag{
+		Name:  "name",
+		Usage: "peer certificate name",
+	},
+	&cli.StringSliceFlag{
+		Name:  "groups",
+		Usage: "peer certificate groups",
+	},
+	&cli.StringFlag{
+		Name:  "ca-name",
+		Usage: "peer certificate issuer",
+	},
+	&cli.StringFlag{
+		Name:  "expect",
+		Usage: "exit with status 1 unless the action is allow, deny or reject",
+	},
+}
+
+// rulesTest 按配置文件中的规则检查命令行描述的数据包，输出匹配的规则、动作与之前每条规则不匹配的原因
+func rulesTest(c *cli.Context) error {
+	cfg, err := config.Load(c.String("config"))
+	if err != nil {
+		return err
+	}
+	for _, action := range []string{cfg.Firewall.InboundAction, cfg.Firewall.OutboundAction, c.String("expect")} {
+		if !rules.ValidAction(action) {
+			return fmt.Errorf("invalid action %q", action)
+		}
+	}
+
+	direction := c.String("direction")
+	if direction != rules.DirectionInbound && direction != rules.DirectionOutbound {
+		return fmt.Errorf("invalid direction %q", direction)
+	}
+	src, err := api.ParseVpnIp(c.String("src"))
+	if err != nil {
+		return fmt.Errorf("invalid src: %v", err)
+	}
+	dst, err := api.ParseVpnIp(c.String("dst"))
+	if err != nil {
+		return fmt.Errorf("invalid dst: %v", err)
+	}
+	if src.Is4() != dst.Is4() {
+		return fmt.Errorf("src and dst must be the same address family")
+	}
+	proto, err := parseProto(c.String("proto"), src.Is4())
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"sport", "dport"} {
+		if c.Uint(name) > 65535 {
+			return fmt.Errorf("invalid %s %d", name, c.Uint(name))
+		}
+	}
+	for _, name := range []string{"icmp-type", "icmp-code"} {
+		if c.Uint(name) > 255 {
+			return fmt.Errorf("invalid %s %d", name, c.Uint(name))
+		}
+	}
+
+	// 与数据路径一样以本节点为视角：入站数据包的目标地址是本节点，出站数据包的源地址是本节点
+	p := &packet.Packet{
+		LocalIP:    src,
+		RemoteIP:   dst,
+		LocalPort:  uint16(c.Uint("sport")),
+		RemotePort: uint16(c.Uint("dport")),
+		Protocol:   proto,
+		Fragment:   c.Bool("fragment"),
+		ICMPType:   uint8(c.Uint("icmp-type")),
+		ICMPCode:   uint8(c.Uint("icmp-code")),
+	}
+	if direction == rules.DirectionInbound {
+		p.LocalIP, p.RemoteIP = p.RemoteIP, p.LocalIP
+		p.LocalPort, p.RemotePort = p.RemotePort, p.LocalPort
+	}
+	if p.Fragment {
+		p.Fragmented, p.LocalPort, p.RemotePort = true, 0, 0
+	}
+
+	var peer *host.HostInfo
+	if c.IsSet("name") || c.IsSet("groups") || c.IsSet("ca-name") {
+		peer = &host.HostInfo{Cert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+			Name:   c.String("name"),
+			Groups: c.StringSlice("groups"),
+			Issuer: c.String("ca-name"),
+		}}}
+	}
+
+	r := rules.NewRules(cfg.Outbound, cfg.Inbound,
+		rules.WithInboundAction(cfg.Firewall.InboundAction),
+		rules.WithOutboundAction(cfg.Firewall.OutboundAction),
+	)
+	tr := r.Trace(p, peer, direction)
+
+	w := c.App.Writer
+	for _, m := range tr.Mismatches {
+		fmt.Fprintf(w, "rule %d: %s\n  no match: %s\n", m.Rule, m.Desc, m.Reason)
+	}
+	if tr.Rule < 0 {
+		fmt.Fprintf(w, "no rule matched, using default %s action\n", direction)
+	} else {
+		fmt.Fprintf(w, "rule %d: %s\n  matched\n", tr.Rule, tr.Desc)
+	}
+	fmt.Fprintf(w, "action: %s\n", tr.Action)
+
+	if expect := c.String("expect"); expect != "" && expect != tr.Action {
+		return cli.Exit(fmt.Sprintf("expected action %s, got %s", expect, tr.Action), 1)
+	}
+	return nil
+}
+
+// parseProto 解析协议名称或协议号，IPv6 地址的 icmp 为 ICMPv6
+func parseProto(s string, v4 bool) (uint8, error) {
+	if s == "icmp" && !v4 {
+		return packet.ProtoICMPv6, nil
+	}
+	for proto := 1; proto < 256; proto++ {
+		if packet.TypeName(uint8(proto)) == s {
+			return uint8(proto), nil
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < 256 {
+		return uint8(n), nil
+	}
+	return 0, fmt.Errorf("invalid proto %q", s)
+}
@@ -21,7 +21,11 @@ func run(c *cli.Context) error {
 
 	logger := logrus.New()
 	logger.Out = os.Stdout
-	logger.SetLevel(logrus.DebugLevel)
+	level, err := controllers.ParseLogLevel(cfg.Logging.Level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(level)
 	// 启用调用者报告
 	logger.SetReportCaller(true)
 	logger.SetFormatter(&logrus.TextFormatter{
@@ -44,6 +48,7 @@ func run(c *cli.Context) error {
 
 	ctx := c.Context
 	ctrl := controllers.NewControllersManager(ctx, cfg, logger, tunDevice)
+	ctrl.ConfigFile = configFile
 	if err := ctrl.Start(ctx); err != nil {
 		panic(err)
 	}
@@ -15,6 +15,152 @@ type Config struct {
 	Handshake     HandshakeConfig     `yaml:"handshake"`
 	Outbound      []OutboundRule      `yaml:"outbound"`
 	Inbound       []InboundRule       `yaml:"inbound"`
+	// Routes 静态路由，只影响数据包发送给哪个节点，不会修改系统路由表
+	Routes      []StaticRoute     `yaml:"routes"`
+	ExitNode    ExitNodeConfig    `yaml:"exit_node"`
+	SplitTunnel SplitTunnelConfig `yaml:"split_tunnel"`
+	PMTU        PMTUConfig        `yaml:"pmtu"`
+	// Compression 发给其他节点的消息载荷的压缩算法，"zstd" 或 "s2"，为空时不压缩。
+	// 只有对端在握手时通告支持该算法时才会压缩
+	Compression string `yaml:"compression"`
+	// Shaping 流量整形，没有配置任何速率时不限制
+	Shaping ShapingConfig `yaml:"shaping"`
+	// QoS 按 DSCP 划分发送优先级，默认开启
+	QoS QoSConfig `yaml:"qos"`
+	// Conntrack 防火墙的连接跟踪，规则允许的连接的回复流量不再检查规则
+	Conntrack ConntrackConfig `yaml:"conntrack"`
+	// Firewall 没有规则匹配时的默认动作
+	Firewall FirewallConfig `yaml:"firewall"`
+	Logging  LoggingConfig  `yaml:"logging"`
+}
+
+// LoggingConfig 日志配置
+type LoggingConfig struct {
+	// Level 日志级别 panic、fatal、error、warn、info、debug 或 trace，默认为 debug
+	Level string `yaml:"level"`
+}
+
+// FirewallConfig 两个方向的默认动作："deny" 静默丢弃（默认），"allow" 放行，"reject" 丢弃并向发送方回复
+// TCP RST 或 ICMP 不可达，应用可以立即失败而不是等到超时
+type FirewallConfig struct {
+	InboundAction  string `yaml:"inbound_action"`
+	OutboundAction string `yaml:"outbound_action"`
+	// Events 被拒绝的数据包的事件
+	Events FirewallEventsConfig `yaml:"events"`
+}
+
+// FirewallEventsConfig 防火墙事件配置。每个事件包含方向、五元组、匹配的规则序号与动作，
+// 同一个流的事件在 FlowInterval 内只输出一次，期间被抑制的事件数量记录在下一个事件中
+type FirewallEventsConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// FlowInterval 同一个流两次输出事件的最小间隔，默认为 10s
+	FlowInterval time.Duration `yaml:"flow_interval"`
+	// MaxFlows 限速时记录的流的数量上限，默认为 4096
+	MaxFlows int `yaml:"max_flows"`
+	// SampleRate 通过限速的事件中输出的比例，0 到 1 之间，为 0 时输出全部事件
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+// ConntrackConfig 连接跟踪配置，连接在超时时间内没有数据包时被删除
+type ConntrackConfig struct {
+	// TCPTimeout 默认为 12m，UDPTimeout 默认为 3m，也用于 TCP、UDP、ICMP 以外的协议，ICMPTimeout 默认为 30s
+	TCPTimeout  time.Duration `yaml:"tcp_timeout"`
+	UDPTimeout  time.Duration `yaml:"udp_timeout"`
+	ICMPTimeout time.Duration `yaml:"icmp_timeout"`
+	// MaxEntries 跟踪的连接数量上限，超过时删除任意一个连接，默认为 65536
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// QoSConfig 按内层数据包的 DSCP 划分优先级，套接字拥塞时先发送高优先级的数据包
+type QoSConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// High 与 Bulk 覆盖默认的分类，默认 EF、CS5-CS7、AF4x 与 AF2x（交互式 SSH）为高优先级，CS1 与 LE 为低优先级，其余为普通优先级
+	High []int `yaml:"high"`
+	Bulk []int `yaml:"bulk"`
+	// OuterDSCP 外层 UDP 数据包的 DSCP："preserve" 复制内层数据包的 DSCP（默认），"none" 不设置，
+	// 或者 0-63 之间的固定值。目前仅支持 Linux
+	OuterDSCP string `yaml:"outer_dscp"`
+	// Remap preserve 时把内层 DSCP 映射为其他值后设置到外层
+	Remap map[int]int `yaml:"remap"`
+}
+
+// ShapingConfig 流量整形配置，速率例如 "20mbit"、"500kbit"，或者以字节为单位的 "2mb"、"100kb"
+type ShapingConfig struct {
+	// Mode 超出速率的数据包的处理方式，"drop" 直接丢弃（默认），"queue" 等待令牌，等待超过 MaxDelay 时丢弃
+	Mode     string        `yaml:"mode"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// Egress 与 Ingress 本节点发出与收到的 overlay 流量的总速率
+	Egress  ShapingLimit `yaml:"egress"`
+	Ingress ShapingLimit `yaml:"ingress"`
+	// Peers 与每个节点之间的速率，键为节点的 overlay 地址，发出与收到的流量分别计算。
+	// 经过该节点转发的、发往或者来自它通告的网段的流量也计入该节点的限额
+	Peers map[string]ShapingLimit `yaml:"peers"`
+	// Groups 与证书中属于同一组的主机之间的总速率，组内所有主机共享同一个限额
+	Groups []ShapingGroup `yaml:"groups"`
+}
+
+// ShapingLimit 令牌桶的速率与突发大小，Burst 为空时使用 100ms 的流量
+type ShapingLimit struct {
+	Rate  string `yaml:"rate"`
+	Burst string `yaml:"burst"`
+}
+
+// ShapingGroup 一组主机，Groups 与防火墙规则的 groups 相同，按对端主机证书中的组匹配，
+// 对端需要属于其中所有的组，没有证书的对端不匹配。Name 用于指标的名称，为空时使用组名
+type ShapingGroup struct {
+	Name         string   `yaml:"name"`
+	Groups       []string `yaml:"groups"`
+	ShapingLimit `yaml:",inline"`
+}
+
+// PMTUConfig 路径 MTU 探测配置，探测的上限为 tun 设备的 MTU
+type PMTUConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// Interval 重新探测每个节点的间隔，默认为 10m
+	Interval time.Duration `yaml:"interval"`
+	// Min 探测的下限，默认为 1280
+	Min int `yaml:"min"`
+}
+
+// SplitTunnelConfig 分流配置，只有 include 中的目标地址（排除 exclude 后）会进入 overlay 网络
+type SplitTunnelConfig struct {
+	// Via 承载分流流量的节点的 overlay 地址，例如办公室网关或出口节点
+	Via     string          `yaml:"via"`
+	Include SplitTunnelList `yaml:"include"`
+	Exclude SplitTunnelList `yaml:"exclude"`
+	// Metric 安装到系统路由表的路由的 metric
+	Metric int `yaml:"metric"`
+	// Refresh 重新解析域名的间隔，默认为 5m
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// Enabled 是否配置了分流
+func (c SplitTunnelConfig) Enabled() bool {
+	return len(c.Include.CIDRs) > 0 || len(c.Include.Domains) > 0
+}
+
+// SplitTunnelList 分流的目标，域名会被定期解析，解析出的地址作为 /32 或 /128 路由
+type SplitTunnelList struct {
+	CIDRs   []string `yaml:"cidrs"`
+	Domains []string `yaml:"domains"`
+}
+
+// ExitNodeConfig 出口节点配置
+type ExitNodeConfig struct {
+	// Advertise 作为出口节点，把其他节点发往互联网的流量通过 NAT 从本机的物理网卡转发出去，目前仅支持 Linux
+	Advertise bool `yaml:"advertise"`
+	// NATAddress NAT 使用的出口地址，为空时使用默认路由所在网卡的 IPv4 地址
+	NATAddress string `yaml:"nat_address"`
+	// NATPorts NAT 分配的端口范围，需要避开系统的临时端口范围（net.ipv4.ip_local_port_range）
+	NATPorts string `yaml:"nat_ports"`
+	// Use 使用的出口节点的 overlay 地址，设置后发往互联网的 IPv4 流量都会经过该节点
+	Use string `yaml:"use"`
+}
+
+// StaticRoute 发往 Route 网段的数据包发送给 Via 节点
+type StaticRoute struct {
+	Route string `yaml:"route"`
+	Via   string `yaml:"via"`
 }
 
 type LighthouseConfig struct {
@@ -22,6 +168,15 @@ type LighthouseConfig struct {
 	Interval       int            `yaml:"interval"`
 	Hosts          []string       `yaml:"hosts"`
 	LocalAllowList LocalAllowList `yaml:"local_allow_list"`
+	// AdvertiseRoutes 通过灯塔向其他节点通告本节点可以转发的网段，例如本节点所在的局域网
+	AdvertiseRoutes []string `yaml:"advertise_routes"`
+	// AcceptRoutes 是否使用其他节点通告的路由
+	AcceptRoutes bool `yaml:"accept_routes"`
+	// AllowedRoutes 灯塔只接受节点通告这里为它列出的网段或者其中的子网段，键为节点的 overlay 地址，
+	// 没有列出的节点通告的路由都被忽略
+	AllowedRoutes map[string][]string `yaml:"allowed_routes"`
+	// ExitNodes 灯塔只接受这些节点通告自己为出口节点
+	ExitNodes []string `yaml:"exit_nodes"`
 }
 
 type LocalAllowList struct {
@@ -29,6 +184,7 @@ type LocalAllowList struct {
 }
 
 type ListenConfig struct {
+	// Host 监听地址，"[::]" 会创建同时支持 IPv4 与 IPv6 的双栈套接字，"0.0.0.0" 仅支持 IPv4
 	Host        string `yaml:"host"`
 	Port        int    `yaml:"port"`
 	Batch       int    `yaml:"batch"`
@@ -49,6 +205,22 @@ type TunConfig struct {
 	DropMulticast      bool   `yaml:"drop_multicast"`
 	TxQueue            int    `yaml:"tx_queue"`
 	MTU                int    `yaml:"mtu"`
+	// UnsafeRoutes 通过网络中的节点访问 overlay 网络之外的网段，例如无法运行 nexus 的办公室局域网
+	UnsafeRoutes []UnsafeRoute `yaml:"unsafe_routes"`
+}
+
+// UnsafeRoute 发往 Route 网段的数据包会被发送给 Via 节点，由 Via 节点转发到它所在的局域网。
+// Via 节点需要开启内核转发（net.ipv4.ip_forward），并且局域网需要有回到 overlay 网络的路由或者在 Via 节点上做 SNAT
+type UnsafeRoute struct {
+	// Route 目标网段，例如 10.0.0.0/24
+	Route string `yaml:"route"`
+	// Via 网关节点的 overlay 地址
+	Via string `yaml:"via"`
+	// MTU 路由的 MTU，为 0 时使用 tun 设备的 MTU
+	MTU    int `yaml:"mtu"`
+	Metric int `yaml:"metric"`
+	// Install 是否在系统路由表中安装该路由，默认安装
+	Install *bool `yaml:"install"`
 }
 
 // HandshakeConfig 握手配置
@@ -62,27 +234,79 @@ type HandshakeConfig struct {
 }
 
 type OutboundRule struct {
-	Port  string   `yaml:"port"`
+	// Port 端口、端口范围（例如 1000-2000）或者逗号分隔的列表，any 匹配所有端口，
+	// fragment 匹配分片数据包的后续分片，后续分片默认使用同一个数据包的第一个分片的结果
+	Port string `yaml:"port"`
+	// Proto 协议名称 tcp、udp、icmp、icmpv6、gre、esp、ah、any，或者 0-255 之间的协议号
 	Proto string   `yaml:"proto"`
 	Host  []string `yaml:"host"`
-	// "allow" or "deny"
+	// ICMPType 与 ICMPCode 只匹配 ICMP 与 ICMPv6 报文，类型可以是名称（例如 echo-request、redirect）或者数字，为空时不限制
+	ICMPType string `yaml:"icmp_type"`
+	ICMPCode string `yaml:"icmp_code"`
+	// Name、Groups 与 CAName 按对端主机证书中的身份匹配，不随地址变化。Groups 要求对端属于其中所有的组，
+	// 对端没有证书时配置了这些字段的规则不匹配
+	Name   string   `yaml:"name"`
+	Groups []string `yaml:"groups"`
+	CAName string   `yaml:"ca_name"`
+	// LocalCIDR 本节点一侧的地址（入站为目标地址，出站为源地址）所在的网段，为空时不限制。
+	// 本节点为其他网段转发流量时，用于限制对端可以访问哪些本地网段
+	LocalCIDR string `yaml:"local_cidr"`
+	// "allow"、"deny" 或 "reject"
 	Action string `yaml:"action"`
 }
 
 type InboundRule struct {
-	Port  string   `yaml:"port"`
+	// Port 端口、端口范围（例如 1000-2000）或者逗号分隔的列表，any 匹配所有端口，
+	// fragment 匹配分片数据包的后续分片，后续分片默认使用同一个数据包的第一个分片的结果
+	Port string `yaml:"port"`
+	// Proto 协议名称 tcp、udp、icmp、icmpv6、gre、esp、ah、any，或者 0-255 之间的协议号
 	Proto string   `yaml:"proto"`
 	Host  []string `yaml:"host"`
-	// "allow" or "deny"
+	// ICMPType 与 ICMPCode 只匹配 ICMP 与 ICMPv6 报文，类型可以是名称（例如 echo-request、redirect）或者数字，为空时不限制
+	ICMPType string `yaml:"icmp_type"`
+	ICMPCode string `yaml:"icmp_code"`
+	// Name、Groups 与 CAName 按对端主机证书中的身份匹配，不随地址变化。Groups 要求对端属于其中所有的组，
+	// 对端没有证书时配置了这些字段的规则不匹配
+	Name   string   `yaml:"name"`
+	Groups []string `yaml:"groups"`
+	CAName string   `yaml:"ca_name"`
+	// LocalCIDR 本节点一侧的地址（入站为目标地址，出站为源地址）所在的网段，为空时不限制。
+	// 本节点为其他网段转发流量时，用于限制对端可以访问哪些本地网段
+	LocalCIDR string `yaml:"local_cidr"`
+	// "allow"、"deny" 或 "reject"
 	Action string `yaml:"action"`
 }
 
 func (r OutboundRule) String() string {
-	return fmt.Sprintf("port=%v proto=%s hosts=%v action=%s", r.Port, r.Proto, r.Host, r.Action)
+	return ruleString(r.Port, r.Proto, r.ICMPType, r.ICMPCode, r.Host, r.LocalCIDR, r.Name, r.Groups, r.CAName, r.Action)
 }
 
 func (r InboundRule) String() string {
-	return fmt.Sprintf("port=%v proto=%s hosts=%v action=%s", r.Port, r.Proto, r.Host, r.Action)
+	return ruleString(r.Port, r.Proto, r.ICMPType, r.ICMPCode, r.Host, r.LocalCIDR, r.Name, r.Groups, r.CAName, r.Action)
+}
+
+func ruleString(port, proto, icmpType, icmpCode string, hosts []string, localCIDR string, name string, groups []string, caName string, action string) string {
+	s := fmt.Sprintf("port=%v proto=%s", port, proto)
+	if icmpType != "" {
+		s += " icmp_type=" + icmpType
+	}
+	if icmpCode != "" {
+		s += " icmp_code=" + icmpCode
+	}
+	s += fmt.Sprintf(" hosts=%v", hosts)
+	if localCIDR != "" {
+		s += " local_cidr=" + localCIDR
+	}
+	if name != "" {
+		s += " name=" + name
+	}
+	if len(groups) > 0 {
+		s += fmt.Sprintf(" groups=%v", groups)
+	}
+	if caName != "" {
+		s += " ca_name=" + caName
+	}
+	return s + " action=" + action
 }
 
 func Load(filename string) (*Config, error) {
@@ -101,7 +325,7 @@ func Load(filename string) (*Config, error) {
 
 var (
 	defaultListen = ListenConfig{
-		Host:        "0.0.0.0",
+		Host:        "[::]",
 		Port:        7777,
 		Batch:       64,
 		ReadBuffer:  10485760,
@@ -7,13 +7,19 @@ import (
 	"github.com/am6737/nexus/cipher"
 	"github.com/am6737/nexus/config"
 	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/nat"
+	"github.com/am6737/nexus/qos"
+	"github.com/am6737/nexus/route"
 	"github.com/am6737/nexus/rules"
+	"github.com/am6737/nexus/shaping"
+	"github.com/am6737/nexus/transport/buffer"
+	"github.com/am6737/nexus/transport/compress"
+	"github.com/am6737/nexus/transport/fragment"
 	"github.com/am6737/nexus/transport/protocol/udp"
 	"github.com/am6737/nexus/tun"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"io"
-	"net"
 	"os"
 	"os/signal"
 	"strconv"
@@ -23,8 +29,9 @@ import (
 type ControllersManager struct {
 	logger *logrus.Logger
 
-	hostMap        *host.HostMap
-	internalWriter io.Writer
+	hostMap *host.HostMap
+	// readers tun 的各个队列，每个队列对应一对读取 tun 与读取套接字的协程
+	readers []io.ReadWriteCloser
 
 	Handshake  interfaces.HandshakeController
 	Inbound    interfaces.OutboundController
@@ -35,6 +42,17 @@ type ControllersManager struct {
 	CipherState *cipher.NexusCipherState
 
 	runnables runnables
+
+	// ConfigFile 配置文件路径，收到 SIGHUP 时重新加载
+	ConfigFile string
+	// cfg 当前生效的配置，用于重新加载时比较哪些配置发生了变化
+	cfg     config.Config
+	writers []udp.Conn
+	rules   *rules.Rules
+
+	handshakeController  *HandshakeController
+	lighthouseController *LighthouseController
+	outboundController   *InboundControllers
 }
 
 func NewControllersManager(ctx context.Context, config *config.Config, logger *logrus.Logger, tun tun.Device) *ControllersManager {
@@ -48,14 +66,87 @@ func NewControllersManager(ctx context.Context, config *config.Config, logger *l
 		panic(err)
 	}
 
-	// 设置 UDP 服务器
-	udpServer, err := udp.NewListener(logger, listenHost.IP, config.Listen.Port, config.Listen.Routines > 1, config.Listen.Batch)
+	// 每个队列打开一个 tun 队列与一个 SO_REUSEPORT 套接字
+	routines := config.Listen.Routines
+	if routines < 1 {
+		routines = 1
+	}
+	readers := []io.ReadWriteCloser{tun}
+	for i := 1; i < routines; i++ {
+		reader, err := tun.NewMultiQueueReader()
+		if err != nil {
+			logger.WithError(err).WithField("routines", len(readers)).Warn("Failed to open tun queue, using fewer routines")
+			break
+		}
+		readers = append(readers, reader)
+	}
+	routines = len(readers)
+
+	// 设置 UDP 服务器，路径 MTU 探测使用单独的套接字，同样需要复用端口
+	multi := routines > 1 || !config.PMTU.Disabled
+	udpServer, err := udp.NewListener(logger, listenHost.IP, config.Listen.Port, multi, config.Listen.Batch)
 	if err != nil {
 		panic(err)
 	}
 	udpServer.ReloadConfig(config)
+	writers := []udp.Conn{udpServer}
+	var probe udp.Conn
+	if multi {
+		// 动态端口时其余套接字复用第一个套接字分配到的端口
+		addr, err := udpServer.LocalAddr()
+		if err != nil {
+			panic(err)
+		}
+		for i := 1; i < routines; i++ {
+			w, err := udp.NewListener(logger, listenHost.IP, int(addr.Port), true, config.Listen.Batch)
+			if err != nil {
+				panic(err)
+			}
+			w.ReloadConfig(config)
+			writers = append(writers, w)
+		}
+		if !config.PMTU.Disabled {
+			if probe, err = udp.NewListener(logger, listenHost.IP, int(addr.Port), true, config.Listen.Batch); err != nil {
+				panic(err)
+			}
+			probe.ReloadConfig(config)
+		}
+	}
+
+	for _, action := range []string{config.Firewall.InboundAction, config.Firewall.OutboundAction} {
+		if !rules.ValidAction(action) {
+			panic(fmt.Errorf("invalid firewall action %q", action))
+		}
+	}
+	ruleOpts := []rules.RuleOption{
+		rules.WithInboundAction(config.Firewall.InboundAction),
+		rules.WithOutboundAction(config.Firewall.OutboundAction),
+		rules.WithConntrack(rules.NewConntrack(config.Conntrack)),
+	}
+	if !config.Firewall.Events.Disabled {
+		ruleOpts = append(ruleOpts, rules.WithEvents(rules.NewEvents(config.Firewall.Events, rules.LogEvents(logger))))
+	}
+	rulesEngine := rules.NewRules(config.Outbound, config.Inbound, ruleOpts...)
+
+	routeTable, err := route.NewTableFromConfig(config, tun.Cidr(), tun.UnsafeRoutes())
+	if err != nil {
+		panic(err)
+	}
+
+	splitTunnel, err := route.NewSplitTunnel(config.SplitTunnel, logger, tun, routeTable)
+	if err != nil {
+		panic(err)
+	}
+
+	advertiseRoutes, err := route.ParseAdvertisedRoutes(config.Lighthouse.AdvertiseRoutes, tun.Cidr())
+	if err != nil {
+		panic(err)
+	}
 
-	rulesEngine := rules.NewRules(config.Outbound, config.Inbound)
+	allowedRoutes, allowedExitNodes, err := parseLighthouseAllowList(config.Lighthouse, tun.Cidr())
+	if err != nil {
+		panic(err)
+	}
 
 	index, err := generateIndex()
 	if err != nil {
@@ -69,53 +160,73 @@ func NewControllersManager(ctx context.Context, config *config.Config, logger *l
 		panic(err)
 	}
 
+	compression, err := compress.Parse(config.Compression)
+	if err != nil {
+		panic(err)
+	}
+
+	shaper, err := shaping.New(config.Shaping)
+	if err != nil {
+		panic(err)
+	}
+
+	classifier, err := qos.NewClassifier(config.QoS)
+	if err != nil {
+		panic(err)
+	}
+
+	var exitNode *nat.Forwarder
+	if config.ExitNode.Advertise {
+		if exitNode, err = newExitNodeForwarder(config.ExitNode, logger); err != nil {
+			panic(err)
+		}
+	}
+
 	// Initialize inbound controller
 	inboundLogger := logger.WithField("controller", "Inbound")
 	inboundController := &OutboundController{
 		cfg:        config,
 		mtu:        tun.MTU(),
+		batch:      config.Listen.Batch,
 		localVpnIP: localVpnIP,
 		inside:     tun,
 		logger:     inboundLogger.Logger,
 		rules:      rulesEngine,
+
+		splitTunnel: splitTunnel,
+		readers:     readers,
+		hosts:       hosts,
+		routes:      routeTable,
+		shaper:      shaper,
+		qos:         classifier,
 	}
 
 	// Initialize outbound controller
 	outboundLogger := logger.WithField("controller", "Outbound")
 	outboundController := &InboundControllers{
 		localVpnIP:  localVpnIP,
+		vpnNetwork:  tun.Cidr(),
+		routes:      routeTable,
+		exitNode:    exitNode,
 		logger:      outboundLogger.Logger,
 		cfg:         config,
 		hosts:       hosts,
 		outside:     udpServer,
+		writers:     writers,
+		localIndex:  index,
+		msgs:        make([][]udp.Message, len(writers)),
+		frags:       make([][]*buffer.Buffer, len(writers)),
+		reassembler: fragment.NewReassembler(fragment.DefaultBudget, fragment.DefaultTimeout),
+		compression: compression,
+		shaper:      shaper,
+		qos:         classifier,
 		rules:       rulesEngine,
 		CipherState: cipherState,
 	}
 
-	lighthouses := map[api.VpnIP]*host.HostInfo{}
-	for _, ip := range config.Lighthouse.Hosts {
-		if addr, ok := config.StaticHostMap[ip]; ok {
-			udpAddr, err := net.ResolveUDPAddr("udp", addr[0])
-			if err != nil {
-				fmt.Println("解析地址出错：", err)
-				continue
-			}
-			vpnIp, err := api.ParseVpnIp(ip)
-			if err != nil {
-				fmt.Println("解析地址出错：", err)
-				continue
-			}
-			r := &udp.Addr{
-				IP:   udpAddr.IP,
-				Port: uint16(udpAddr.Port),
-			}
-			lighthouses[vpnIp] = &host.HostInfo{
-				Remote: r,
-				VpnIp:  vpnIp,
-			}
-			hosts.AddHost(vpnIp, r, nil)
-		}
-	}
+	inboundController.outside = outboundController
+
+	lighthouses := resolveLighthouses(config, hosts)
 
 	handshakeController := NewHandshakeController(
 		logger.WithField("controller", "Handshake").Logger,
@@ -137,6 +248,20 @@ func NewControllersManager(ctx context.Context, config *config.Config, logger *l
 		localVpnIP,
 		cipherState,
 	)
+	lighthouseController.lighthouses = lighthouseVpnIPs(lighthouses)
+	lighthouseController.advertiseRoutes = advertiseRoutes
+	lighthouseController.acceptRoutes = config.Lighthouse.AcceptRoutes
+	lighthouseController.routes = routeTable
+	lighthouseController.inside = tun
+	lighthouseController.advertiseExitNode = config.ExitNode.Advertise
+	lighthouseController.localIndex = index
+	lighthouseController.allowedRoutes = allowedRoutes
+	lighthouseController.allowedExitNodes = allowedExitNodes
+	if config.ExitNode.Use != "" {
+		if lighthouseController.exitNode, err = api.ParseVpnIp(config.ExitNode.Use); err != nil {
+			panic(err)
+		}
+	}
 	outboundController.handshake = handshakeController
 	outboundController.lighthouse = lighthouseController
 	handshakeController.lighthouse = lighthouseController
@@ -150,21 +275,80 @@ func NewControllersManager(ctx context.Context, config *config.Config, logger *l
 		},
 	}
 
+	if probe != nil {
+		// 探测不能被内核在本地分片，否则超过路径 MTU 的探测仍然能到达对端。
+		// 只有探测套接字设置 DF，普通数据包超过路径 MTU 时仍然由内核分片
+		if err := probe.EnablePMTUProbe(); err != nil {
+			logger.WithError(err).Warn("Failed to disable local fragmentation, path MTU probes may overestimate")
+		}
+		outboundController.probe = probe
+		outboundController.pmtu = newPMTUProber(config.PMTU, logger.WithField("controller", "PMTU").Logger, hosts, tun, localVpnIP, probe.WriteTo)
+		rs.runnables = append(rs.runnables, outboundController.pmtu)
+	}
+
 	// Initialize controllers manager
 	controllersManager := &ControllersManager{
-		logger:         logger,
-		internalWriter: tun,
-		lighthouse:     lighthouseController,
-		Handshake:      handshakeController,
-		Inbound:        inboundController,
-		Outbound:       outboundController,
-		runnables:      rs,
-		CipherState:    cipherState,
+		logger:  logger,
+		cfg:     *config,
+		hostMap: hosts,
+		readers: readers,
+		writers: outboundController.conns(),
+		rules:   rulesEngine,
+
+		handshakeController:  handshakeController,
+		lighthouseController: lighthouseController,
+		outboundController:   outboundController,
+
+		lighthouse:  lighthouseController,
+		Handshake:   handshakeController,
+		Inbound:     inboundController,
+		Outbound:    outboundController,
+		runnables:   rs,
+		CipherState: cipherState,
 	}
 
 	return controllersManager
 }
 
+// resolveLighthouses 解析灯塔在静态主机映射中的地址并添加到主机地图，返回灯塔的第一个地址
+func resolveLighthouses(cfg *config.Config, hosts *host.HostMap) map[api.VpnIP]*host.HostInfo {
+	lighthouses := map[api.VpnIP]*host.HostInfo{}
+	for _, ip := range cfg.Lighthouse.Hosts {
+		if rawAddrs, ok := cfg.StaticHostMap[ip]; ok {
+			vpnIp, err := api.ParseVpnIp(ip)
+			if err != nil {
+				fmt.Println("解析地址出错：", err)
+				continue
+			}
+			for _, rawAddr := range rawAddrs {
+				addrs, err := resolveRemoteAddrs(rawAddr)
+				if err != nil {
+					fmt.Println("解析地址出错：", err)
+					continue
+				}
+				for _, r := range addrs {
+					if _, ok := lighthouses[vpnIp]; !ok {
+						lighthouses[vpnIp] = &host.HostInfo{
+							Remote: r,
+							VpnIp:  vpnIp,
+						}
+					}
+					hosts.AddRemote(vpnIp, r)
+				}
+			}
+		}
+	}
+	return lighthouses
+}
+
+func lighthouseVpnIPs(lighthouses map[api.VpnIP]*host.HostInfo) []api.VpnIP {
+	vpnIPs := make([]api.VpnIP, 0, len(lighthouses))
+	for vpnIp := range lighthouses {
+		vpnIPs = append(vpnIPs, vpnIp)
+	}
+	return vpnIPs
+}
+
 type runnables struct {
 	runnables []interfaces.Runnable
 }
@@ -197,8 +381,14 @@ func (c *ControllersManager) Start(ctx context.Context) error {
 		//}(r)
 	}
 
-	go c.Inbound.Listen(c.Outbound)
-	go c.Outbound.Listen(c.internalWriter)
+	for i, reader := range c.readers {
+		go c.Inbound.Listen(i, c.Outbound)
+		go c.Outbound.Listen(i, reader)
+	}
+	if c.outboundController.probe != nil {
+		go c.outboundController.listenProbe(c.readers[0])
+	}
+	c.logger.WithField("routines", len(c.readers)).Info("Started listeners")
 	return nil
 }
 
@@ -213,13 +403,22 @@ func (c *ControllersManager) Stop() {
 	c.logger.Info("Goodbye")
 }
 
+// Shutdown 等待 SIGTERM 或 SIGINT 后关闭，期间收到 SIGHUP 时重新加载配置文件
 func (c *ControllersManager) Shutdown() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM)
 	signal.Notify(sigChan, syscall.SIGINT)
+	signal.Notify(sigChan, syscall.SIGHUP)
 
-	rawSig := <-sigChan
-	sig := rawSig.String()
-	c.logger.WithField("signal", sig).Info("Caught signal, shutting down")
+	for rawSig := range sigChan {
+		sig := rawSig.String()
+		if rawSig == syscall.SIGHUP {
+			c.logger.WithField("signal", sig).Info("Caught signal, reloading config")
+			c.reloadConfigFile()
+			continue
+		}
+		c.logger.WithField("signal", sig).Info("Caught signal, shutting down")
+		break
+	}
 	c.Stop()
 }
@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"encoding/binary"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/cipher"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/route"
+	"github.com/am6737/nexus/rules"
+	"github.com/am6737/nexus/transport/buffer"
+	"github.com/am6737/nexus/transport/fragment"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/am6737/nexus/transport/protocol/udp"
+	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// loopConn 把发送的消息直接交给接收端处理
+type loopConn struct {
+	udp.NoopConn
+	recv func(addr *udp.Addr, p []byte)
+	// n 发送的消息数量
+	n int
+}
+
+func (c *loopConn) WriteTo(b []byte, addr *udp.Addr) error {
+	c.n++
+	c.recv(addr, b)
+	return nil
+}
+
+func (c *loopConn) WriteBatch(msgs []udp.Message) (int, error) {
+	for _, m := range msgs {
+		c.n++
+		c.recv(m.Addr, m.Buf)
+	}
+	return len(msgs), nil
+}
+
+// countWriter 模拟 tun，记录写入的数据包
+type countWriter struct {
+	n    int
+	last []byte
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n++
+	w.last = append(w.last[:0], p...)
+	return len(p), nil
+}
+
+type dataPath struct {
+	tx     *InboundControllers
+	inside *OutboundController
+	hosts  *host.HostMap
+	tun    *countWriter
+	packet []byte
+}
+
+func newDataPath(t testing.TB) *dataPath {
+	logger := logrus.New()
+	_, network, _ := net.ParseCIDR("192.168.100.0/24")
+	txIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 1).To4())
+	rxIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+
+	cs, err := cipher.NewNexusCipherState("test", "test@nexus", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := rules.NewRules(
+		[]config.OutboundRule{{Port: "any", Proto: "any", Action: "allow"}},
+		[]config.InboundRule{{Port: "any", Proto: "any", Action: "allow"}},
+		rules.WithConntrack(rules.NewConntrack(config.ConntrackConfig{})),
+	)
+	table := route.NewTable()
+	if err := table.Insert(route.Entry{Prefix: netip.MustParsePrefix("192.168.100.0/24"), Source: route.SourceLocal}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 两端在握手中交换 index，tx 的 index 为 1，rx 的 index 为 2
+	tun := &countWriter{}
+	rxHosts := host.NewHostMap(logger, network, nil)
+	if err := rxHosts.SetRemoteIndex(txIP, 1); err != nil {
+		t.Fatal(err)
+	}
+	rx := &InboundControllers{
+		CipherState: cs,
+		localIndex:  2,
+		localVpnIP:  rxIP,
+		vpnNetwork:  network,
+		routes:      table,
+		hosts:       rxHosts,
+		logger:      logger,
+		rules:       allow,
+		reassembler: fragment.NewReassembler(0, 0),
+	}
+	h := &header.Header{}
+	pk := &packet.Packet{}
+	rxAddr := &udp.Addr{IP: net.IPv4(10, 0, 0, 2), Port: 4242}
+	rx.outside = &loopConn{}
+
+	hosts := host.NewHostMap(logger, network, nil)
+	hosts.AddHost(rxIP, rxAddr, []byte("public key"))
+	if err := hosts.SetRemoteIndex(rxIP, 2); err != nil {
+		t.Fatal(err)
+	}
+	txConn := &loopConn{recv: func(addr *udp.Addr, p []byte) {
+		rx.handlePacket(addr, p, h, pk, tun)
+	}}
+	tx := &InboundControllers{
+		CipherState: cs,
+		localIndex:  1,
+		localVpnIP:  txIP,
+		vpnNetwork:  network,
+		routes:      table,
+		hosts:       hosts,
+		logger:      logger,
+		rules:       allow,
+		outside:     txConn,
+		writers:     []udp.Conn{txConn},
+		msgs:        make([][]udp.Message, 1),
+		frags:       make([][]*buffer.Buffer, 1),
+	}
+	inside := &OutboundController{
+		localVpnIP: txIP,
+		logger:     logger,
+		rules:      allow,
+		hosts:      hosts,
+		routes:     table,
+		outside:    tx,
+	}
+
+	// 192.168.100.1:5000 -> 192.168.100.2:6000 的 UDP 数据包
+	p := make([]byte, packet.Len+8+1200)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+	p[8] = 64
+	p[9] = packet.ProtoUDP
+	copy(p[12:16], []byte{192, 168, 100, 1})
+	copy(p[16:20], []byte{192, 168, 100, 2})
+	binary.BigEndian.PutUint16(p[20:22], 5000)
+	binary.BigEndian.PutUint16(p[22:24], 6000)
+	binary.BigEndian.PutUint16(p[24:26], uint16(len(p)-packet.Len))
+
+	return &dataPath{tx: tx, inside: inside, hosts: hosts, tun: tun, packet: p}
+}
+
+// rx 返回 tx 的主机地图中 rx 的记录，用于模拟 rx 发给 tx 的消息
+func (d *dataPath) rx() *host.HostInfo {
+	return d.hosts.QueryIndex(2)
+}
+
+// send 模拟一个数据包从 tun 读取、检查规则、加密、发送，到对端解密、检查规则、写入 tun 的完整过程
+func (d *dataPath) send(t testing.TB, bufs []*buffer.Buffer, vips []api.VpnIP, pk *packet.Packet) {
+	b := buffer.Get()
+	b.SetLen(copy(b.Space(), d.packet))
+	vip, ok := d.inside.consumeInsidePacket(b.Bytes(), pk, nil)
+	if !ok {
+		t.Fatal("packet was dropped")
+	}
+	bufs = append(bufs[:0], b)
+	vips = append(vips[:0], vip)
+	if err := d.tx.WriteBatchToVIP(0, bufs, vips); err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+}
+
+func TestDataPath(t *testing.T) {
+	d := newDataPath(t)
+	pk := &packet.Packet{}
+	bufs := make([]*buffer.Buffer, 0, 1)
+	vips := make([]api.VpnIP, 0, 1)
+
+	d.send(t, bufs, vips, pk)
+	assert.Equal(t, 1, d.tun.n)
+	assert.Equal(t, d.packet, d.tun.last)
+
+	// 稳定状态下每个数据包不分配内存
+	allocs := testing.AllocsPerRun(100, func() {
+		d.send(t, bufs, vips, pk)
+	})
+	assert.Zero(t, allocs)
+	assert.Equal(t, 102, d.tun.n)
+}
+
+// TestDataPath_Fragment 超过路径 MTU 的数据包分片发送，对端重组后写入 tun。
+// 各项功能的行为由各自的包与控制器的测试覆盖，这里只保留完整经过隧道的测试
+func TestDataPath_Fragment(t *testing.T) {
+	d := newDataPath(t)
+	pk := &packet.Packet{}
+	bufs := make([]*buffer.Buffer, 0, 1)
+	vips := make([]api.VpnIP, 0, 1)
+	rxIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+	conn := d.tx.outside.(*loopConn)
+
+	d.hosts.SetMTU(rxIP, 1000)
+	d.send(t, bufs, vips, pk)
+	assert.Equal(t, 2, conn.n)
+	assert.Equal(t, 1, d.tun.n)
+	assert.Equal(t, d.packet, d.tun.last)
+
+	d.hosts.SetMTU(rxIP, 500)
+	d.send(t, bufs, vips, pk)
+	assert.Equal(t, 5, conn.n)
+	assert.Equal(t, 2, d.tun.n)
+	assert.Equal(t, d.packet, d.tun.last)
+
+	// 不需要分片的数据包仍然作为一个消息发送
+	assert.NoError(t, d.tx.WriteToVIP(d.packet[:400], rxIP))
+	assert.Equal(t, 6, conn.n)
+	assert.Equal(t, d.packet[:400], d.tun.last)
+}
+
+func BenchmarkDataPath(b *testing.B) {
+	d := newDataPath(b)
+	pk := &packet.Packet{}
+	bufs := make([]*buffer.Buffer, 0, 1)
+	vips := make([]api.VpnIP, 0, 1)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(d.packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.send(b, bufs, vips, pk)
+	}
+}
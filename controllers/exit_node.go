@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/nat"
+	"github.com/am6737/nexus/tun"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/netip"
+)
+
+// exitRoutes 使用出口节点时安装到 tun 的路由，两条 /1 路由比默认路由更精确，
+// 不需要修改原有的默认路由，底层连接通过绑定物理网卡绕过它们
+var exitRoutes = []string{"0.0.0.0/1", "128.0.0.0/1"}
+
+// newExitNodeForwarder 创建出口节点的 NAT 转发器
+func newExitNodeForwarder(cfg config.ExitNodeConfig, logger *logrus.Logger) (*nat.Forwarder, error) {
+	var (
+		external netip.Addr
+		err      error
+	)
+	if cfg.NATAddress != "" {
+		if external, err = netip.ParseAddr(cfg.NATAddress); err != nil {
+			return nil, fmt.Errorf("exit_node.nat_address failed to parse: %v", err)
+		}
+	} else if external, err = defaultRouteAddr(); err != nil {
+		return nil, fmt.Errorf("failed to find the exit node nat address: %v", err)
+	}
+
+	min, max, err := nat.ParsePorts(cfg.NATPorts)
+	if err != nil {
+		return nil, err
+	}
+	table, err := nat.NewTable(external.Unmap(), min, max)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.
+		WithField("natAddress", external).
+		WithField("natPorts", fmt.Sprintf("%d-%d", min, max)).
+		Info("Exit node enabled")
+	return nat.NewForwarder(logger, table)
+}
+
+// defaultRouteAddr 返回默认路由所在网卡的第一个 IPv4 地址
+func defaultRouteAddr() (netip.Addr, error) {
+	ifi, err := tun.DefaultRouteInterface()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			addr, _ := netip.AddrFromSlice(ipNet.IP.To4())
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, errors.New("no IPv4 address on " + ifi.Name)
+}
+
+// isInternet 判断目标地址是否需要经过出口节点的 NAT，私有网段交给内核转发到局域网
+func isInternet(ip api.VpnIP) bool {
+	addr := ip.ToNetIpAddr()
+	return addr.Is4() && addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
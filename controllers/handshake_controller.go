@@ -13,12 +13,14 @@ import (
 	"github.com/am6737/nexus/config"
 	"github.com/am6737/nexus/host"
 	pmetrics "github.com/am6737/nexus/metrics"
+	"github.com/am6737/nexus/transport/compress"
 	"github.com/am6737/nexus/transport/packet"
 	"github.com/am6737/nexus/transport/protocol/udp"
 	"github.com/am6737/nexus/transport/protocol/udp/header"
 	"github.com/rcrowley/go-metrics"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -57,20 +59,25 @@ type HandshakeController struct {
 
 	handshakeHostsRwMutex sync.RWMutex
 	localVIP              api.VpnIP
-	handshakeHosts        map[api.VpnIP]*HandshakeHostInfo // 主机信息列表
-	config                *config.HandshakeConfig          // 握手配置
-	outboundTimer         *time.Timer                      // 发送握手消息的定时器
-	outboundTrigger       chan HandshakeRequest            // 触发发送握手消息的通道
-	logger                *logrus.Logger                   // 日志记录器
-	messageMetrics        *pmetrics.MessageMetrics         // 消息统计
+	handshakeHosts        map[api.VpnIP]*HandshakeHostInfo       // 主机信息列表
+	config                atomic.Pointer[config.HandshakeConfig] // 握手配置，重新加载时整体替换
+	outboundTimer         *time.Timer                            // 发送握手消息的定时器
+	outboundTrigger       chan HandshakeRequest                  // 触发发送握手消息的通道
+	logger                *logrus.Logger                         // 日志记录器
+	messageMetrics        *pmetrics.MessageMetrics               // 消息统计
 	ow                    interfaces.OutsideWriter
 	// 外部连接
 	mainHostMap     *host.HostMap // 主机地图
+	lightHousesMu   sync.RWMutex
 	lightHouses     map[api.VpnIP]*host.HostInfo
 	lighthouse      interfaces.LighthouseController
 	metricInitiated metrics.Counter // 握手初始化计数器
 	metricTimedOut  metrics.Counter // 握手超时计数器
 	localIndexID    uint32          // 本地节点标识
+
+	// handshakeTicker 与 syncTicker 定期重新握手与同步灯塔，在 Start 中创建
+	handshakeTicker *time.Ticker
+	syncTicker      *time.Ticker
 }
 
 type HandshakeRequest struct {
@@ -80,10 +87,9 @@ type HandshakeRequest struct {
 
 // NewHandshakeController 创建一个新的 HandshakeController 实例
 func NewHandshakeController(logger *logrus.Logger, mainHostMap *host.HostMap, lightHouse *struct{}, ow interfaces.OutsideWriter, config config.HandshakeConfig, localVIP api.VpnIP, lightHouses map[api.VpnIP]*host.HostInfo, index uint32, CipherState *cipher.NexusCipherState) *HandshakeController {
-	return &HandshakeController{
+	hc := &HandshakeController{
 		localVIP:        localVIP,
 		handshakeHosts:  make(map[api.VpnIP]*HandshakeHostInfo),
-		config:          ApplyDefaultHandshakeConfig(&config),
 		outboundTimer:   time.NewTimer(config.TryInterval),
 		outboundTrigger: make(chan HandshakeRequest, config.TriggerBuffer),
 		metricInitiated: metrics.GetOrRegisterCounter("handshake_manager.initiated", nil),
@@ -95,10 +101,29 @@ func NewHandshakeController(logger *logrus.Logger, mainHostMap *host.HostMap, li
 		localIndexID:    index,
 		CipherState:     CipherState,
 	}
+	hc.config.Store(ApplyDefaultHandshakeConfig(&config))
+	return hc
+}
+
+// Reload 替换握手配置，同步灯塔与重新握手的间隔立即生效。TriggerBuffer 需要重启才能生效
+func (hc *HandshakeController) Reload(c config.HandshakeConfig) {
+	cfg := ApplyDefaultHandshakeConfig(&c)
+	hc.config.Store(cfg)
+	if hc.handshakeTicker != nil {
+		hc.handshakeTicker.Reset(cfg.HandshakeHost)
+		hc.syncTicker.Reset(cfg.SyncLighthouse)
+	}
+}
+
+// SetLighthouses 替换灯塔列表，下一次同步时使用
+func (hc *HandshakeController) SetLighthouses(lighthouses map[api.VpnIP]*host.HostInfo) {
+	hc.lightHousesMu.Lock()
+	defer hc.lightHousesMu.Unlock()
+	hc.lightHouses = lighthouses
 }
 
 func (hc *HandshakeController) HandleRequest(rAddr *udp.Addr, pk *packet.Packet, h *header.Header, p []byte) {
-	publicKey := p[header.Len+packet.Len:]
+	publicKey := p[header.Len+packet.HeaderLen(p[header.Len:]):]
 
 	hc.logger.
 		WithField("vpnIP", pk.RemoteIP).
@@ -108,12 +133,22 @@ func (hc *HandshakeController) HandleRequest(rAddr *udp.Addr, pk *packet.Packet,
 		//WithField("publicKey", string(publicKey)).
 		Debug("Handle handshake requests")
 
+	// 握手头部的 index 是对端的 index，之后对端发送的数据消息携带该值，据此找到发送方
+	if h.MessageSubtype == header.HostHandshakeRequest || h.MessageSubtype == header.HostHandshakeReply {
+		if err := hc.mainHostMap.SetRemoteIndex(pk.RemoteIP, h.RemoteIndex); err != nil {
+			hc.logger.WithError(err).WithField("vpnIP", pk.RemoteIP).Debug("Ignoring handshake with a conflicting index")
+			return
+		}
+	}
+
 	hc.mainHostMap.AddHost(pk.RemoteIP, rAddr, publicKey)
 
 	switch h.MessageSubtype {
 	case header.HostHandshakeRequest:
+		hc.mainHostMap.SetCompression(pk.RemoteIP, h.Reserved)
 		hc.handleHostHandshakeRequest(rAddr, pk.RemoteIP)
 	case header.HostHandshakeReply:
+		hc.mainHostMap.SetCompression(pk.RemoteIP, h.Reserved)
 		hc.handleHostHandshakeReply(rAddr, pk.RemoteIP)
 	}
 }
@@ -204,27 +239,28 @@ func (hc *HandshakeController) Start(ctx context.Context) error {
 	hc.handshakeAllHosts(ctx)
 	hc.syncLighthouse(ctx)
 
+	hc.handshakeTicker = time.NewTicker(hc.config.Load().HandshakeHost)
+	hc.syncTicker = time.NewTicker(hc.config.Load().SyncLighthouse)
+
 	go func() {
-		handshakeHostTicker := time.NewTicker(hc.config.SyncLighthouse)
-		defer handshakeHostTicker.Stop()
+		defer hc.handshakeTicker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-handshakeHostTicker.C:
+			case <-hc.handshakeTicker.C:
 				hc.handshakeAllHosts(ctx)
 			}
 		}
 	}()
 
 	go func() {
-		syncLighthouseTicker := time.NewTicker(hc.config.SyncLighthouse)
-		defer syncLighthouseTicker.Stop()
+		defer hc.syncTicker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-syncLighthouseTicker.C:
+			case <-hc.syncTicker.C:
 				for k, v := range hc.mainHostMap.GetAllHostMap() {
 					fmt.Printf("host: %s info%v\n", k, v)
 				}
@@ -263,7 +299,10 @@ func (hc *HandshakeController) handshakeAllHosts(ctx context.Context) {
 }
 
 func (hc *HandshakeController) syncLighthouse(ctx context.Context) {
-	for _, lightHouse := range hc.lightHouses {
+	hc.lightHousesMu.RLock()
+	lightHouses := hc.lightHouses
+	hc.lightHousesMu.RUnlock()
+	for _, lightHouse := range lightHouses {
 		if lightHouse.VpnIp == hc.localVIP {
 			hc.logger.Warn("Lighthouse is localhost")
 			continue
@@ -310,7 +349,7 @@ func (hc *HandshakeController) Handshake(vip api.VpnIP, packet []byte) error {
 			WithField("LastCompleteTime", hh.LastCompleteTime).
 			Debugf("Handshake for %s already complete, skipping", vip)
 
-		if hh.Ready && time.Since(hh.LastCompleteTime) < hc.config.HandshakeHost {
+		if hh.Ready && time.Since(hh.LastCompleteTime) < hc.config.Load().HandshakeHost {
 			fmt.Println("sfjbsjfb")
 			return nil
 		}
@@ -351,7 +390,7 @@ func (hc *HandshakeController) handleOutbound(hr HandshakeRequest, lighthouseTri
 	defer handshakeHostInfo.Unlock()
 
 	// 如果已经超过重试次数，则终止握手过程
-	if handshakeHostInfo.Counter >= hc.config.Retries {
+	if handshakeHostInfo.Counter >= hc.config.Load().Retries {
 		//fmt.Println("握手超时次数 => ", handshakeHostInfo.Counter)
 		//hc.metricTimedOut.Inc(1)
 		//hc.deleteHandshakeInfo(hr.VIP)
@@ -424,7 +463,7 @@ func (hc *HandshakeController) handleOutboundTimerTick() {
 		default:
 		}
 	}
-	hc.outboundTimer.Reset(hc.config.TryInterval)
+	hc.outboundTimer.Reset(hc.config.Load().TryInterval)
 }
 
 // deleteHandshakeInfo 删除指定 VPN IP 的握手信息
@@ -518,7 +557,7 @@ func (hc *HandshakeController) buildLightHouseAndHostSyncPacket(vip api.VpnIP) (
 	if err != nil {
 		return nil, err
 	}
-	pk, err := packet.BuildIPv4Packet(hc.localVIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
+	pk, err := packet.BuildIPPacket(hc.localVIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
 	if err != nil {
 		return nil, err
 	}
@@ -537,7 +576,9 @@ func (hc *HandshakeController) buildHandshakePacket(vip api.VpnIP, ms header.Mes
 	if err != nil {
 		return nil, err
 	}
-	pk, err := packet.BuildIPv4Packet(hc.localVIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
+	// 通告本节点可以解压的算法
+	header.SetReserved(h, compress.Supported)
+	pk, err := packet.BuildIPPacket(hc.localVIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
 	if err != nil {
 		return nil, err
 	}
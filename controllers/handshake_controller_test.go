@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/am6737/nexus/transport/protocol/udp"
+	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// TestHandshakeController_RemoteIndex 握手回复登记对端的 index，已经属于其他主机的 index 不会被覆盖
+func TestHandshakeController_RemoteIndex(t *testing.T) {
+	logger := logrus.New()
+	_, network, _ := net.ParseCIDR("192.168.100.0/24")
+	local := api.Ip2VpnIp(net.IPv4(192, 168, 100, 1).To4())
+	hosts := host.NewHostMap(logger, network, nil)
+	hc := NewHandshakeController(logger, hosts, &struct{}{}, nil, config.HandshakeConfig{}, local, nil, 1, nil)
+
+	reply := func(remote net.IP, index uint32) {
+		h, _ := header.BuildHandshake(index, header.HostHandshakeReply, 0)
+		ip, err := packet.BuildIPPacket(remote, local.ToIP(), packet.ProtoUDP, false)
+		assert.NoError(t, err)
+		p := append(append(h, ip...), "public key"...)
+
+		hd := &header.Header{}
+		assert.NoError(t, hd.Decode(p))
+		pk := &packet.Packet{}
+		assert.NoError(t, packet.ParsePacket(p[header.Len:], true, pk))
+		hc.HandleRequest(&udp.Addr{IP: net.IPv4(10, 0, 0, 2), Port: 4242}, pk, hd, p)
+	}
+
+	peer := net.IPv4(192, 168, 100, 2).To4()
+	reply(peer, 7)
+	assert.Equal(t, api.Ip2VpnIp(peer), hosts.QueryIndex(7).VpnIp)
+
+	other := net.IPv4(192, 168, 100, 3).To4()
+	reply(other, 7)
+	assert.Equal(t, api.Ip2VpnIp(peer), hosts.QueryIndex(7).VpnIp)
+	assert.Nil(t, hosts.QueryVpnIp(api.Ip2VpnIp(other)))
+}
@@ -9,14 +9,25 @@ import (
 	"github.com/am6737/nexus/cipher"
 	"github.com/am6737/nexus/config"
 	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/nat"
+	"github.com/am6737/nexus/qos"
+	"github.com/am6737/nexus/route"
+	"github.com/am6737/nexus/rules"
+	"github.com/am6737/nexus/shaping"
+	"github.com/am6737/nexus/transport/buffer"
+	"github.com/am6737/nexus/transport/compress"
+	"github.com/am6737/nexus/transport/fragment"
 	"github.com/am6737/nexus/transport/packet"
 	"github.com/am6737/nexus/transport/protocol/udp"
 	"github.com/am6737/nexus/transport/protocol/udp/header"
-	"github.com/am6737/nexus/utils"
+	"github.com/am6737/nexus/tun"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"net/netip"
 	"runtime"
+	"sync/atomic"
+	"time"
 )
 
 var _ interfaces.InboundController = &InboundControllers{}
@@ -25,24 +36,48 @@ var _ interfaces.InboundController = &InboundControllers{}
 type InboundControllers struct {
 	CipherState *cipher.NexusCipherState
 
-	outside     udp.Conn
+	outside udp.Conn
+	writers []udp.Conn
+	// localIndex 本节点的 index，在握手时发送给对端，数据消息的头部携带该值
+	localIndex  uint32
+	msgs        [][]udp.Message
+	frags       [][]*buffer.Buffer
 	hosts       *host.HostMap
-	lighthouses []*host.HostInfo
+	lighthouses atomic.Pointer[[]*host.HostInfo]
 	localVpnIP  api.VpnIP
+	vpnNetwork  *net.IPNet
+	routes      *route.Table
 	logger      *logrus.Logger
 	cfg         *config.Config
 	lighthouse  interfaces.LighthouseController
 	handshake   interfaces.HandshakeController
 	rules       interfaces.RulesEngine
+
+	// exitNode 本节点作为出口节点时的 NAT 转发器
+	exitNode *nat.Forwarder
+	// pmtu 路径 MTU 探测，关闭时为 nil
+	pmtu *pmtuProber
+	// probe 发送路径 MTU 探测的套接字，与 writers 通过 SO_REUSEPORT 共用同一个端口，只有它设置 DF 且不在本地分片，
+	// 普通数据包仍然由内核按路径 MTU 分片。关闭探测时为 nil
+	probe udp.Conn
+	// fragmentID 发送的分片编号，reassembler 重组收到的分片
+	fragmentID  atomic.Uint32
+	reassembler *fragment.Reassembler
+	// compression 发送时使用的压缩算法，只用于在握手时通告支持该算法的节点
+	compression compress.Algorithm
+	// shaper 流量整形，没有配置时为 nil
+	shaper *shaping.Shaper
+	// qos 按内层数据包的 DSCP 标记外层 UDP 数据包，关闭时为 nil
+	qos *qos.Classifier
 }
 
 func (oc *InboundControllers) WriteToAddr(p []byte, addr net.Addr) error {
 	parseIPAndPort := func(addr net.Addr) (net.IP, uint16) {
 		switch a := addr.(type) {
 		case *net.TCPAddr:
-			return a.IP.To4(), uint16(a.Port)
+			return a.IP, uint16(a.Port)
 		case *net.UDPAddr:
-			return a.IP.To4(), uint16(a.Port)
+			return a.IP, uint16(a.Port)
 		case *udp.Addr:
 			return a.IP, a.Port
 		default:
@@ -59,51 +94,170 @@ func (oc *InboundControllers) WriteToAddr(p []byte, addr net.Addr) error {
 }
 
 func (oc *InboundControllers) WriteToVIP(p []byte, vip api.VpnIP) error {
-	messagePacket, err := header.BuildMessage(9527, 111)
-	if err != nil {
+	b := buffer.Get()
+	defer b.Release()
+	if err := b.Set(p); err != nil {
 		return err
 	}
 
-	tp := p
-
-	key, err := oc.hosts.GetVpnIpPublicKey(vip)
+	msgs, frags, err := oc.appendSealed(nil, nil, b, vip)
+	defer releaseAll(frags)
 	if err != nil {
-		oc.logger.WithField("vip", vip).Error("获取公钥失败")
 		return err
 	}
+	for _, m := range msgs {
+		if err := oc.outside.WriteTo(m.Buf, m.Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	ciphertext, err := oc.CipherState.Encrypt(p, key)
+// WriteBatchToVIP 就地加密全部数据包后通过第 q 个套接字批量写发送，bufs[i] 发往 vips[i]，
+// 加密失败的数据包会被跳过，返回遇到的第一个错误。缓冲区由调用方释放
+func (oc *InboundControllers) WriteBatchToVIP(q int, bufs []*buffer.Buffer, vips []api.VpnIP) error {
+	var firstErr error
+	msgs, frags := oc.msgs[q][:0], oc.frags[q][:0]
+	for i, b := range bufs {
+		var err error
+		if msgs, frags, err = oc.appendSealed(msgs, frags, b, vips[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	oc.msgs[q] = msgs
+	if len(msgs) > 0 {
+		if _, err := oc.writers[q].WriteBatch(msgs); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	releaseAll(frags)
+	oc.frags[q] = frags[:0]
+	return firstErr
+}
+
+// appendSealed 就地加密 b 中发往 vip 的数据包并追加到 msgs。超过下一跳路径 MTU 的数据包被切分为多个分片消息，
+// 分片使用的缓冲区追加到 frags，调用方在发送后释放
+func (oc *InboundControllers) appendSealed(msgs []udp.Message, frags []*buffer.Buffer, b *buffer.Buffer, vip api.VpnIP) ([]udp.Message, []*buffer.Buffer, error) {
+	hop, remote, err := oc.nextHop(vip)
 	if err != nil {
-		return err
+		return msgs, frags, err
 	}
 
-	// 创建新的数据包，将头部和数据包拼接
-	p = append(messagePacket, ciphertext...)
+	// 压缩和加密之前读取内层数据包的 DSCP，分片消息使用相同的标记
+	var tos uint8
+	if oc.qos != nil {
+		tos = oc.qos.OuterTOS(packet.DSCP(b.Bytes()))
+	}
 
-	host := oc.hosts.QueryVpnIp(vip)
-	if host == nil {
-		for _, lighthouse := range oc.lighthouses {
-			if lighthouse != nil {
-				oc.logger.WithField("目标地址", vip).
-					WithField("灯塔地址", lighthouse.Remote).
-					Info("出站流量转发到灯塔")
-				return oc.outside.WriteTo(p, lighthouse.Remote)
+	// 先压缩再决定是否分片，压缩算法记录在每个消息头部的 Reserved 中
+	var reserved uint16
+	if oc.compression != compress.None {
+		if a := oc.compression.Negotiate(oc.hosts.Compression(hop)); compress.Compress(a, b) {
+			reserved = uint16(a)
+		}
+	}
+
+	if mtu := oc.hosts.MTU(hop); mtu > 0 && b.Len() > mtu {
+		p := b.Bytes()
+		count, size, err := fragment.Split(len(p), mtu-fragment.HeaderLen)
+		if err != nil {
+			return msgs, frags, err
+		}
+		id := oc.fragmentID.Add(1)
+		for i := 0; i < count; i++ {
+			end := (i + 1) * size
+			if end > len(p) {
+				end = len(p)
+			}
+			f := buffer.Get()
+			frags = append(frags, f)
+			if err := f.Set(p[i*size : end]); err != nil {
+				return msgs, frags, err
 			}
+			fragment.Header{ID: id, Index: uint8(i), Count: uint8(count)}.Encode(f.Prepend(fragment.HeaderLen))
+			oc.seal(f, header.Fragment, reserved)
+			msgs = append(msgs, udp.Message{Buf: f.Bytes(), Addr: remote, TOS: tos})
 		}
-		return fmt.Errorf("host %s not found", vip)
+		return msgs, frags, nil
 	}
 
-	pk := &packet.Packet{}
-	if err := utils.ParsePacket(tp, false, pk); err != nil {
-		oc.logger.WithField("packet", pk).Debugf("Error while validating outbound packet: %s", err)
-		return err
+	oc.seal(b, header.Message, reserved)
+	return append(msgs, udp.Message{Buf: b.Bytes(), Addr: remote, TOS: tos}), frags, nil
+}
+
+// tunnelPeer 返回与 vip 之间的流量经过的隧道另一端的节点地址及其主机信息，vip 可以是节点本身，也可以是节点通告的网段中的地址，
+// 防火墙按该节点的身份匹配规则，流量整形按该节点计算限额。没有路由时返回 vip 本身，没有路由或者还不认识该节点时主机信息为 nil
+func tunnelPeer(routes *route.Table, hosts *host.HostMap, vip api.VpnIP) (api.VpnIP, *host.HostInfo) {
+	e, ok := routes.Lookup(vip)
+	if !ok {
+		return vip, nil
+	}
+	next := e.NextHop(vip)
+	return next, hosts.QueryVpnIp(next)
+}
+
+// nextHop 查找发往 vip 的数据包的下一跳节点及其远程地址
+func (oc *InboundControllers) nextHop(vip api.VpnIP) (api.VpnIP, *udp.Addr, error) {
+	// 通过路由表最长前缀匹配找到下一跳节点，overlay 网络内的地址下一跳就是目标本身
+	e, ok := oc.routes.Lookup(vip)
+	if !ok {
+		return vip, nil, fmt.Errorf("no route to %s", vip)
+	}
+	vip = e.NextHop(vip)
+
+	// 握手完成之前不发送数据
+	if _, err := oc.hosts.GetVpnIpPublicKey(vip); err != nil {
+		oc.logger.WithField("vip", vip).Error("获取公钥失败")
+		return vip, nil, err
+	}
+
+	remote := oc.remoteFor(vip)
+	if remote == nil {
+		return vip, nil, fmt.Errorf("host %s not found", vip)
+	}
+
+	if oc.logger.IsLevelEnabled(logrus.DebugLevel) {
+		oc.logger.WithField("目标地址", vip).
+			WithField("目标远程地址", remote).
+			Debug("出站流量")
+	}
+	return vip, remote, nil
+}
+
+// seal 就地加密 b，b 变为类型为 mt 的完整消息
+func (oc *InboundControllers) seal(b *buffer.Buffer, mt header.MessageType, reserved uint16) {
+	// 消息布局为 头部 | nonce | 密文 | 认证标签，都在缓冲区预留的空间中就地写入
+	b.Prepend(cipher.NonceSize)
+	b.Append(cipher.TagSize)
+	oc.CipherState.Seal(b.Bytes())
+	h := header.Encode(b.Prepend(header.Len), header.Version, mt, 0, oc.localIndex, 111)
+	header.SetReserved(h, reserved)
+}
+
+// releaseAll 释放全部缓冲区
+func releaseAll(bufs []*buffer.Buffer) {
+	for _, b := range bufs {
+		b.Release()
 	}
+}
 
-	oc.logger.WithField("目标地址", vip).
-		WithField("目标远程地址", host.Remote).
-		WithField("数据包", pk).
-		Info("出站流量")
-	return oc.outside.WriteTo(p, host.Remote)
+// remoteFor 返回 vip 的远程地址，未知的主机转发到灯塔
+func (oc *InboundControllers) remoteFor(vip api.VpnIP) *udp.Addr {
+	if host := oc.hosts.QueryVpnIp(vip); host != nil {
+		return host.Remote
+	}
+	for _, lighthouse := range oc.getLighthouseHosts() {
+		if lighthouse != nil {
+			if oc.logger.IsLevelEnabled(logrus.DebugLevel) {
+				oc.logger.WithField("目标地址", vip).
+					WithField("灯塔地址", lighthouse.Remote).
+					Debug("出站流量转发到灯塔")
+			}
+			return lighthouse.Remote
+		}
+	}
+	return nil
 }
 
 func (oc *InboundControllers) SendToRemote(out []byte, addr *udp.Addr) error {
@@ -137,10 +291,30 @@ func (oc *InboundControllers) Start(ctx context.Context) error {
 	}
 
 	// 配置静态主机映射
-	oc.configureStaticHostMap()
+	oc.configureStaticHostMap(oc.cfg.StaticHostMap)
 
 	// 获取灯塔信息
-	oc.lighthouses = oc.getLighthouses()
+	oc.setLighthouseHosts(oc.getLighthouses(oc.cfg.Lighthouse.Hosts))
+
+	// 使用出口节点或分流时底层连接绑定物理网卡，避免发往其他节点的数据包被路由回 tun
+	if oc.cfg.ExitNode.Use != "" || oc.cfg.SplitTunnel.Enabled() {
+		ifi, err := tun.DefaultRouteInterface()
+		if err != nil {
+			return err
+		}
+		for _, w := range oc.conns() {
+			if err := w.BindToInterface(ifi); err != nil {
+				return fmt.Errorf("failed to bind underlay socket to %s: %v", ifi.Name, err)
+			}
+		}
+		oc.logger.WithField("interface", ifi.Name).Info("Underlay socket bound to the physical interface")
+	}
+
+	if oc.exitNode != nil {
+		oc.exitNode.Start(func(peer api.VpnIP, p []byte) error {
+			return oc.WriteToVIP(p, peer)
+		})
+	}
 
 	addr, err := oc.outside.LocalAddr()
 	if err != nil {
@@ -158,29 +332,53 @@ func resolveListenHost(rawListenHost string) (*net.IPAddr, error) {
 	return net.ResolveIPAddr("ip", rawListenHost)
 }
 
-func (oc *InboundControllers) configureStaticHostMap() {
-	for k, v := range oc.cfg.StaticHostMap {
-		ip := net.ParseIP(k)
-		if ip == nil {
+// resolveRemoteAddrs 解析 static_host_map 中的地址，域名会解析出全部 IPv4 与 IPv6 地址
+func resolveRemoteAddrs(rawAddr string) ([]*udp.Addr, error) {
+	rawHost, rawPort, err := net.SplitHostPort(rawAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("udp", rawPort)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(rawHost)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]*udp.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, &udp.Addr{IP: ip, Port: uint16(port)})
+	}
+	return addrs, nil
+}
+
+// configureStaticHostMap 将静态主机映射中的地址添加到主机地图，已有的地址不会被删除
+func (oc *InboundControllers) configureStaticHostMap(staticHostMap map[string][]string) {
+	for k, v := range staticHostMap {
+		vpnIp, err := api.ParseVpnIp(k)
+		if err != nil {
 			oc.logger.WithField("ip", k).Error("Invalid IP address")
 			continue
 		}
-		udpAddr, err := net.ResolveUDPAddr("udp", v[0])
-		if err != nil {
-			oc.logger.WithError(err).WithField("ip", k).Error("Error resolving UDP address")
-			continue
+		// 每个主机可以配置多个地址，IPv4 与 IPv6 地址都会作为候选地址
+		for _, rawAddr := range v {
+			addrs, err := resolveRemoteAddrs(rawAddr)
+			if err != nil {
+				oc.logger.WithError(err).WithField("ip", k).Error("Error resolving UDP address")
+				continue
+			}
+			for _, addr := range addrs {
+				oc.hosts.AddRemote(vpnIp, addr)
+			}
 		}
-		vpnIp := api.Ip2VpnIp(ip)
-		oc.hosts.AddHost(vpnIp, &udp.Addr{
-			IP:   udpAddr.IP,
-			Port: uint16(udpAddr.Port),
-		}, nil)
 	}
 }
 
-func (oc *InboundControllers) getLighthouses() []*host.HostInfo {
+func (oc *InboundControllers) getLighthouses(hosts []string) []*host.HostInfo {
 	var lighthouses []*host.HostInfo
-	for _, ip := range oc.cfg.Lighthouse.Hosts {
+	for _, ip := range hosts {
 		vpnIp, err := api.ParseVpnIp(ip)
 		if err != nil {
 			oc.logger.WithError(err).WithField("lighthouse", ip).Error("解析VPN地址失败")
@@ -196,9 +394,20 @@ func (oc *InboundControllers) getLighthouses() []*host.HostInfo {
 	return lighthouses
 }
 
-func (oc *InboundControllers) handlePacket(addr *udp.Addr, p []byte, h *header.Header, internalWriter interfaces.InsideWriter) {
-	pk := &packet.Packet{}
+// getLighthouseHosts 返回当前的灯塔列表，重新加载配置时整体替换
+func (oc *InboundControllers) getLighthouseHosts() []*host.HostInfo {
+	if lighthouses := oc.lighthouses.Load(); lighthouses != nil {
+		return *lighthouses
+	}
+	return nil
+}
 
+func (oc *InboundControllers) setLighthouseHosts(lighthouses []*host.HostInfo) {
+	oc.lighthouses.Store(&lighthouses)
+}
+
+// handlePacket 处理从套接字读取的消息，addr 与 p 只在调用期间有效，需要保存时必须复制
+func (oc *InboundControllers) handlePacket(addr *udp.Addr, p []byte, h *header.Header, pk *packet.Packet, internalWriter interfaces.InsideWriter) {
 	if err := h.Decode(p); err != nil {
 		oc.logger.WithError(err).Debug("解析数据包头出错")
 		return
@@ -212,23 +421,30 @@ func (oc *InboundControllers) handlePacket(addr *udp.Addr, p []byte, h *header.H
 
 	switch h.MessageType {
 	case header.Test:
-		oc.handleTest(addr, pk, h, p)
+		oc.handleTest(addr.Copy(), pk, h, p)
 	case header.Handshake:
-		oc.handleHandshake(addr, pk, h, p)
+		oc.handleHandshake(addr.Copy(), pk, h, p)
 	case header.Message:
 		oc.handleInboundPacket(h, p, pk, addr, internalWriter)
+	case header.Fragment:
+		oc.handleFragment(h, p, pk, addr, internalWriter)
 	case header.LightHouse:
 		fmt.Println("header.LightHouse")
-		oc.handleLighthouses(addr, pk, h, p)
+		oc.handleLighthouses(addr.Copy(), pk, h, p)
 	default:
 
 	}
 }
 
 func (oc *InboundControllers) handleInboundPacket(h *header.Header, p []byte, pk *packet.Packet, addr *udp.Addr, internalWriter io.Writer) {
-	out := p
+	from := oc.hosts.QueryIndex(h.RemoteIndex)
+	if from == nil {
+		oc.logger.WithField("index", h.RemoteIndex).WithField("addr", addr).Debug("未知的发送方")
+		return
+	}
 
-	cleartext, err := oc.CipherState.Decrypt(p[header.Len:])
+	// 就地解密，cleartext 与 p 共享内存
+	cleartext, err := oc.CipherState.Open(p[header.Len:])
 	if err != nil {
 		oc.logger.WithError(err).Debug("handleInboundPacket 解密数据包出错")
 		return
@@ -242,43 +458,178 @@ func (oc *InboundControllers) handleInboundPacket(h *header.Header, p []byte, pk
 	//	"cleartext":  cleartext,
 	//}).Info("handleInboundPacket")
 
-	// 解析数据包
-	// 将incoming参数设置为true
-	if err := packet.ParsePacket(cleartext, false, pk); err != nil {
+	oc.consumePayload(h, from, cleartext, p, pk, addr, internalWriter)
+}
+
+// handleFragment 解密分片并交给 reassembler，收齐全部分片后按普通消息处理重组的数据包
+func (oc *InboundControllers) handleFragment(h *header.Header, p []byte, pk *packet.Packet, addr *udp.Addr, internalWriter io.Writer) {
+	from := oc.hosts.QueryIndex(h.RemoteIndex)
+	if from == nil {
+		oc.logger.WithField("index", h.RemoteIndex).WithField("addr", addr).Debug("未知的发送方")
+		return
+	}
+
+	cleartext, err := oc.CipherState.Open(p[header.Len:])
+	if err != nil {
+		oc.logger.WithError(err).Debug("handleFragment 解密数据包出错")
+		return
+	}
+	fh, err := fragment.Decode(cleartext)
+	if err != nil {
+		oc.logger.WithError(err).Debug("解析分片头部出错")
+		return
+	}
+
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	data, done, err := oc.reassembler.Add(netip.AddrPortFrom(ip.Unmap(), addr.Port), fh, cleartext[fragment.HeaderLen:])
+	if err != nil {
+		oc.logger.WithError(err).WithField("addr", addr).Debug("重组分片出错")
+		return
+	}
+	if done {
+		oc.consumePayload(h, from, data, nil, pk, addr, internalWriter)
+	}
+}
+
+// consumePayload 按头部 Reserved 中记录的压缩算法解压载荷后交给 consumeCleartext
+func (oc *InboundControllers) consumePayload(h *header.Header, from *host.HostInfo, payload []byte, p []byte, pk *packet.Packet, addr *udp.Addr, internalWriter io.Writer) {
+	if a := compress.Algorithm(h.Reserved & header.CompressionMask); a != compress.None {
+		b := buffer.Get()
+		defer b.Release()
+		if err := compress.Decompress(a, b, payload); err != nil {
+			oc.logger.WithError(err).Debug("解压数据包出错")
+			return
+		}
+		payload = b.Bytes()
+	}
+	oc.consumeCleartext(from, payload, p, pk, addr, internalWriter)
+}
+
+// consumeCleartext 处理解密后的数据包，from 为按消息头部的 index 找到的发送方，
+// p 为解密前的完整消息，重组的数据包没有对应的消息，p 为 nil
+func (oc *InboundControllers) consumeCleartext(from *host.HostInfo, cleartext []byte, p []byte, pk *packet.Packet, addr *udp.Addr, internalWriter io.Writer) {
+	// 解析数据包，与防火墙一致以本节点为视角，LocalIP 为目标地址，RemoteIP 为发送方
+	if err := packet.ParsePacket(cleartext, true, pk); err != nil {
 		oc.logger.WithError(err).Debug("解析数据包出错")
 		return
 	}
 
-	if err := oc.rules.Inbound(pk); err != nil {
-		oc.logger.WithError(err).Error("规则拒绝")
+	// 防火墙按发送消息的节点匹配身份，内层数据包的源地址必须属于该节点，否则任何节点都可以冒充其他节点
+	if !oc.fromPeer(from, pk.RemoteIP) {
+		oc.logger.WithField("vpnIP", from.VpnIp).WithField("源地址", pk.RemoteIP).Debug("数据包的源地址不属于发送方")
 		return
 	}
 
-	oc.logger.WithField("远程地址", addr).
-		WithField("源地址", pk.LocalIP).
-		WithField("目标地址", pk.RemoteIP).
-		WithField("数据包", pk).
-		Info("入站消息流量")
+	// 消息已经通过解密认证，刷新对端当前路径的时间，路径是否失效不再取决于灯塔同步
+	if addr != nil {
+		from.Seen(addr)
+	}
+
+	// 被拒绝的数据包由防火墙事件记录
+	if err := oc.rules.Inbound(pk, from); err != nil {
+		if rules.IsReject(err) {
+			oc.reject(cleartext, pk)
+		}
+		return
+	}
+
+	// 流量整形，queue 模式下需要等待的数据包复制一份后延迟处理，不阻塞读取套接字的协程
+	if oc.shaper != nil {
+		wait, ok := oc.shaper.Ingress(from.VpnIp, from, len(cleartext))
+		if !ok {
+			return
+		}
+		if wait > 0 {
+			oc.delayCleartext(wait, cleartext, pk, addr, internalWriter)
+			return
+		}
+	}
 
-	p = p[header.Len:]
+	oc.deliverCleartext(cleartext, p, pk, addr, internalWriter)
+}
+
+// fromPeer 判断源地址 src 是否属于节点 from：from 自己的地址，或者路由表中下一跳为 from 的网段
+func (oc *InboundControllers) fromPeer(from *host.HostInfo, src api.VpnIP) bool {
+	if src == from.VpnIp {
+		return true
+	}
+	e, ok := oc.routes.Lookup(src)
+	return ok && !e.Via.IsZero() && e.Via == from.VpnIp
+}
 
-	if pk.RemoteIP == oc.localVpnIP {
-		replaceAddresses(cleartext, pk.LocalIP, pk.RemoteIP)
+// delayCleartext 在 wait 之后处理整形延迟的数据包，延迟的数据包不再对应原来的消息
+func (oc *InboundControllers) delayCleartext(wait time.Duration, cleartext []byte, pk *packet.Packet, addr *udp.Addr, internalWriter io.Writer) {
+	b := buffer.Get()
+	if err := b.Set(cleartext); err != nil {
+		b.Release()
+		return
+	}
+	delayed := *pk
+	var from *udp.Addr
+	if addr != nil {
+		from = &udp.Addr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port}
+	}
+	oc.shaper.Delay(wait, func() {
+		defer b.Release()
+		oc.deliverCleartext(b.Bytes(), nil, &delayed, from, internalWriter)
+	})
+}
+
+// deliverCleartext 把通过检查的数据包写入 tun、转发给出口节点或者其他节点
+func (oc *InboundControllers) deliverCleartext(cleartext []byte, p []byte, pk *packet.Packet, addr *udp.Addr, internalWriter io.Writer) {
+	if oc.logger.IsLevelEnabled(logrus.DebugLevel) {
+		oc.logger.WithField("远程地址", addr).
+			WithField("源地址", pk.RemoteIP).
+			WithField("目标地址", pk.LocalIP).
+			WithField("数据包", pk).
+			Debug("入站消息流量")
+	}
+
+	if pk.LocalIP == oc.localVpnIP {
+		replaceAddresses(cleartext, pk.RemoteIP, pk.LocalIP)
 		oc.handleLocalVpnAddress(cleartext, pk, internalWriter)
 		return
 	}
 
-	if oc.localVpnIP == pk.LocalIP {
+	// 目标在 overlay 网络之外，本节点是 unsafe route 的网关，写入 tun 后由内核转发到局域网
+	if !oc.vpnNetwork.Contains(pk.LocalIP.ToIP()) {
+		// 出口节点把发往互联网的流量经过 NAT 从物理网卡转发出去
+		if oc.exitNode != nil && isInternet(pk.LocalIP) {
+			if err := oc.exitNode.Send(pk.RemoteIP, cleartext); err != nil {
+				oc.logger.WithError(err).WithField("remoteIP", pk.LocalIP).Debug("出口节点转发失败")
+			}
+			return
+		}
+		oc.handleLocalVpnAddress(cleartext, pk, internalWriter)
+		return
+	}
+
+	if oc.localVpnIP == pk.RemoteIP {
 		if pk.Protocol != packet.ProtoICMP {
 			oc.handleLocalVpnAddress(cleartext, pk, internalWriter)
 		}
-		fmt.Println("out => ", out)
-		if err := oc.outside.WriteTo(out, addr); err != nil {
+		if p == nil {
+			return
+		}
+		// 解密覆盖了原来的密文，重新加密后发回
+		oc.CipherState.Seal(p[header.Len:])
+		if err := oc.outside.WriteTo(p, addr); err != nil {
 			oc.logger.WithError(err).WithField("addr", addr).Error("数据转发到远程")
 		}
 	}
 }
 
+// reject 通过隧道向发送方回复拒绝数据包的 TCP RST 或 ICMP 不可达
+func (oc *InboundControllers) reject(cleartext []byte, pk *packet.Packet) {
+	reply, ok := packet.Reject(cleartext, pk)
+	if !ok {
+		return
+	}
+	if err := oc.WriteToVIP(reply, pk.RemoteIP); err != nil {
+		oc.logger.WithError(err).WithField("remoteIP", pk.RemoteIP).Debug("发送拒绝报文失败")
+	}
+}
+
 func (oc *InboundControllers) handleHandshake(addr *udp.Addr, pk *packet.Packet, h *header.Header, p []byte) {
 	// 握手不加密
 	//cleartext, err := oc.CipherState.Decrypt(p[header.Len:])
@@ -294,8 +645,7 @@ func (oc *InboundControllers) handleHandshake(addr *udp.Addr, pk *packet.Packet,
 		return
 	}
 
-	if err := oc.rules.Inbound(pk); err != nil {
-		oc.logger.WithError(err).Error("规则拒绝")
+	if err := oc.rules.Inbound(pk, oc.hosts.QueryVpnIp(pk.RemoteIP)); err != nil {
 		return
 	}
 
@@ -307,7 +657,7 @@ func (oc *InboundControllers) buildHandshakeHostSyncReplyPacket(vip api.VpnIP, d
 	if err != nil {
 		return nil, err
 	}
-	pv4Packet, err := packet.BuildIPv4Packet(oc.localVpnIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
+	pv4Packet, err := packet.BuildIPPacket(oc.localVpnIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
 	if err != nil {
 		return nil, err
 	}
@@ -324,7 +674,7 @@ func (oc *InboundControllers) buildHandshakeHostSyncReplyPacket(vip api.VpnIP, d
 
 // IsLighthouse 判断指定的 VPN IP 地址是否对应一个灯塔节点
 func (oc *InboundControllers) IsLighthouse(vpnIP api.VpnIP) bool {
-	for _, lh := range oc.lighthouses {
+	for _, lh := range oc.getLighthouseHosts() {
 		if lh.VpnIp == vpnIP {
 			return true
 		}
@@ -363,48 +713,44 @@ func (oc *InboundControllers) handleLighthouses(addr *udp.Addr, pk *packet.Packe
 		return
 	}
 
-	if err := oc.rules.Inbound(pk); err != nil {
-		oc.logger.WithError(err).Error("规则拒绝")
+	if err := oc.rules.Inbound(pk, oc.hosts.QueryVpnIp(pk.RemoteIP)); err != nil {
 		return
 	}
 
 	oc.lighthouse.HandleRequest(addr, pk, h, p)
 }
 
+// handleTest 处理路径 MTU 探测，探测不加密，回复只携带探测的长度
 func (oc *InboundControllers) handleTest(addr *udp.Addr, pk *packet.Packet, h *header.Header, p []byte) {
-	cleartext, err := oc.CipherState.Decrypt(p[header.Len:])
-	if err != nil {
-		oc.logger.WithError(err).Debug("解密数据包出错")
-		return
-	}
-
-	// 解析数据包
-	// 将incoming参数设置为true
-	if err := packet.ParsePacket(cleartext[header.Len:], true, pk); err != nil {
-		oc.logger.WithError(err).Debug("解析数据包出错")
+	size, ok := parsePMTUProbe(p, pk)
+	if !ok {
+		oc.logger.Debug("解析测试消息出错")
 		return
 	}
 	switch h.MessageSubtype {
 	case header.TestRequest:
-		if oc.lighthouse.IsLighthouse() {
-			return
-		}
-		oc.logger.
-			WithField("remoteIP", pk.RemoteIP).
-			WithField("addr", addr).
-			Debug("收到测试消息")
-		replyPacket, err := oc.buildTestReplyPacket(pk.RemoteIP)
-		if err != nil {
-			return
+		if oc.logger.IsLevelEnabled(logrus.DebugLevel) {
+			oc.logger.
+				WithField("remoteIP", pk.RemoteIP).
+				WithField("addr", addr).
+				WithField("size", size).
+				Debug("收到测试消息")
 		}
-		if err := oc.outside.WriteTo(replyPacket, addr); err != nil {
+		reply := buildPMTUProbe(oc.localVpnIP, pk.RemoteIP, header.TestReply, size, 0)
+		if err := oc.outside.WriteTo(reply, addr); err != nil {
 			oc.logger.WithError(err).Error("数据转发到远程")
 		}
 	case header.TestReply:
-		oc.logger.
-			WithField("remoteIP", pk.RemoteIP).
-			WithField("远程地址", addr).
-			Debug("收到测试回复消息")
+		if oc.logger.IsLevelEnabled(logrus.DebugLevel) {
+			oc.logger.
+				WithField("remoteIP", pk.RemoteIP).
+				WithField("远程地址", addr).
+				WithField("size", size).
+				Debug("收到测试回复消息")
+		}
+		if oc.pmtu != nil {
+			oc.pmtu.ack(pk.RemoteIP, size)
+		}
 	}
 }
 
@@ -456,35 +802,53 @@ func (oc *InboundControllers) buildPacket(vip api.VpnIP, mt header.MessageType,
 	return buf.Bytes(), nil
 }
 
-// Listen 监听出站连接，并根据目标地址将数据包转发到相应的目标
-func (oc *InboundControllers) Listen(internalWriter interfaces.InsideWriter) {
+// Listen 监听第 q 个套接字的出站连接，并根据目标地址将数据包转发到相应的目标
+func (oc *InboundControllers) Listen(q int, internalWriter interfaces.InsideWriter) {
+	oc.listen(oc.writers[q], internalWriter)
+}
+
+// listenProbe 监听探测套接字，SO_REUSEPORT 同样会把一部分入站数据包分给它
+func (oc *InboundControllers) listenProbe(internalWriter interfaces.InsideWriter) {
+	oc.listen(oc.probe, internalWriter)
+}
+
+func (oc *InboundControllers) listen(conn udp.Conn, internalWriter interfaces.InsideWriter) {
 	runtime.LockOSThread()
-	oc.outside.ListenOut(func(addr *udp.Addr, out []byte, p []byte, h *header.Header) {
-		oc.handlePacket(addr.Copy(), p, h, internalWriter)
+	pk := &packet.Packet{}
+	conn.ListenOut(func(addr *udp.Addr, out []byte, p []byte, h *header.Header) {
+		oc.handlePacket(addr, p, h, pk, internalWriter)
 	})
 }
 
+// conns 返回全部底层套接字，包括探测套接字
+func (oc *InboundControllers) conns() []udp.Conn {
+	if oc.probe == nil {
+		return oc.writers
+	}
+	return append(oc.writers[:len(oc.writers):len(oc.writers)], oc.probe)
+}
+
 func (oc *InboundControllers) Close() error {
+	if oc.exitNode != nil {
+		if err := oc.exitNode.Close(); err != nil {
+			oc.logger.WithError(err).Error("Failed to close exit node forwarder")
+		}
+	}
+	// writers[0] 就是 outside
+	for _, w := range oc.conns()[1:] {
+		if err := w.Close(); err != nil {
+			oc.logger.WithError(err).Error("Failed to close udp socket")
+		}
+	}
 	return oc.outside.Close()
 }
 
 func replaceAddresses(out []byte, localIP api.VpnIP, remoteIP api.VpnIP) {
-	copy(out[12:16], parseIP(localIP.String()))  // 将本地IP地址替换到目标IP地址的位置
-	copy(out[16:20], parseIP(remoteIP.String())) // 将目标IP地址替换到源IP地址的位置
-}
-
-func parseIP(ipString string) []byte {
-	// 解析 IPv4 地址字符串为 net.IP 类型
-	ip := net.ParseIP(ipString)
-	if ip == nil {
-		fmt.Println("Invalid IP address:", ipString)
-		return nil
-	}
-	// 将 net.IP 类型转换为 []byte 切片
-	ipBytes := ip.To4()
-	if ipBytes == nil {
-		fmt.Println("Invalid IPv4 address:", ipString)
-		return nil
+	if packet.HeaderLen(out) == packet.Len6 {
+		copy(out[8:24], localIP[:])   // 将本地IP地址替换到源IP地址的位置
+		copy(out[24:40], remoteIP[:]) // 将目标IP地址替换到目标IP地址的位置
+		return
 	}
-	return ipBytes
+	copy(out[12:16], localIP.ToIP())  // 将本地IP地址替换到目标IP地址的位置
+	copy(out[16:20], remoteIP.ToIP()) // 将目标IP地址替换到源IP地址的位置
 }
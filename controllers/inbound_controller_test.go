@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/qos"
+	"github.com/am6737/nexus/route"
+	"github.com/am6737/nexus/shaping"
+	"github.com/am6737/nexus/transport/buffer"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// TestInboundControllers_SpoofedSource 内层数据包的源地址必须是发送方自己的地址或者经过发送方路由的网段
+func TestInboundControllers_SpoofedSource(t *testing.T) {
+	d := newDataPath(t)
+	pk := &packet.Packet{}
+
+	// rx 冒充 192.168.100.3 发给 tx 的数据包被丢弃
+	spoofed := append([]byte(nil), d.packet...)
+	copy(spoofed[12:16], []byte{192, 168, 100, 3})
+	copy(spoofed[16:20], d.packet[12:16])
+	d.tx.consumeCleartext(d.rx(), spoofed, nil, pk, nil, d.tun)
+	assert.Zero(t, d.tun.n)
+
+	// 经过 rx 路由的网段可以使用
+	rxIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+	assert.NoError(t, d.tx.routes.Insert(route.Entry{Prefix: netip.MustParsePrefix("10.1.0.0/24"), Via: rxIP, Source: route.SourceUnsafe}))
+	copy(spoofed[12:16], []byte{10, 1, 0, 5})
+	d.tx.consumeCleartext(d.rx(), spoofed, nil, pk, nil, d.tun)
+	assert.Equal(t, 1, d.tun.n)
+
+	// 没有在握手中登记的 index 发送的消息被丢弃
+	bufs := make([]*buffer.Buffer, 0, 1)
+	vips := make([]api.VpnIP, 0, 1)
+	d.send(t, bufs, vips, pk)
+	assert.Equal(t, 2, d.tun.n)
+	d.tx.localIndex = 9
+	d.send(t, bufs, vips, pk)
+	assert.Equal(t, 2, d.tun.n)
+}
+
+// TestInboundControllers_ShapeSender 来自节点通告的网段的流量计入发送消息的节点的限额
+func TestInboundControllers_ShapeSender(t *testing.T) {
+	d := newDataPath(t)
+	pk := &packet.Packet{}
+	rxIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+	assert.NoError(t, d.tx.routes.Insert(route.Entry{Prefix: netip.MustParsePrefix("10.1.0.0/24"), Via: rxIP, Source: route.SourceUnsafe}))
+	shaper, err := shaping.New(config.ShapingConfig{
+		Peers: map[string]config.ShapingLimit{"192.168.100.2": {Rate: "1kb"}},
+	})
+	assert.NoError(t, err)
+	d.tx.shaper = shaper
+
+	reply := append([]byte(nil), d.packet...)
+	copy(reply[12:16], []byte{10, 1, 0, 5})
+	copy(reply[16:20], d.packet[12:16])
+	for i := 0; i < 100 && d.tun.n == i; i++ {
+		d.tx.consumeCleartext(d.rx(), reply, nil, pk, nil, d.tun)
+	}
+	n := d.tun.n
+	assert.Less(t, n, 100)
+
+	copy(reply[12:16], d.packet[16:20])
+	d.tx.consumeCleartext(d.rx(), reply, nil, pk, nil, d.tun)
+	assert.Equal(t, n, d.tun.n)
+}
+
+// TestInboundControllers_OuterTOS 外层数据包使用分类器给出的 TOS，分片消息也一样。DSCP 的分类与改写由 qos 包测试
+func TestInboundControllers_OuterTOS(t *testing.T) {
+	d := newDataPath(t)
+	rxIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+	classifier, err := qos.NewClassifier(config.QoSConfig{})
+	assert.NoError(t, err)
+	d.tx.qos = classifier
+	d.hosts.SetMTU(rxIP, 500)
+
+	b := buffer.Get()
+	defer b.Release()
+	d.packet[1] = 46 << 2
+	assert.NoError(t, b.Set(d.packet))
+	msgs, frags, err := d.tx.appendSealed(nil, nil, b, rxIP)
+	defer releaseAll(frags)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 3)
+	for _, m := range msgs {
+		assert.Equal(t, classifier.OuterTOS(46), m.TOS)
+	}
+}
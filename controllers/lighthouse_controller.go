@@ -9,12 +9,17 @@ import (
 	"github.com/am6737/nexus/api"
 	"github.com/am6737/nexus/api/interfaces"
 	"github.com/am6737/nexus/cipher"
+	"github.com/am6737/nexus/config"
 	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/route"
 	"github.com/am6737/nexus/transport/packet"
 	"github.com/am6737/nexus/transport/protocol/udp"
 	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"github.com/am6737/nexus/tun"
 	"github.com/sirupsen/logrus"
 	"log"
+	"net"
+	"net/netip"
 	"sync"
 	"time"
 )
@@ -54,6 +59,30 @@ type LighthouseController struct {
 	ow interfaces.OutsideWriter
 
 	isLighthouse bool
+
+	// lighthouses 灯塔节点的 VPN 地址
+	lighthouses []api.VpnIP
+	// advertiseRoutes 向灯塔通告的本节点可以转发的网段
+	advertiseRoutes []netip.Prefix
+	// acceptRoutes 是否使用其他节点通告的路由
+	acceptRoutes bool
+	routes       *route.Table
+	inside       tun.Device
+	// advertiseExitNode 是否向灯塔通告本节点为出口节点
+	advertiseExitNode bool
+	// exitNode 本节点使用的出口节点
+	exitNode api.VpnIP
+	// localIndex 本节点的 index，更新通知的头部携带该值，灯塔据此找到与发送方的握手记录
+	localIndex uint32
+	// allowedRoutes 与 allowedExitNodes 灯塔接受的节点通告，没有列出的节点通告的路由与出口节点都被忽略
+	allowedRoutes    map[api.VpnIP][]netip.Prefix
+	allowedExitNodes map[api.VpnIP]bool
+}
+
+// hostUpdateNotification 节点向灯塔发送的更新通知
+type hostUpdateNotification struct {
+	Routes   []netip.Prefix `json:"routes"`
+	ExitNode bool           `json:"exit_node"`
 }
 
 func (lc *LighthouseController) IsLighthouse() bool {
@@ -71,7 +100,7 @@ func (lc *LighthouseController) HandleRequest(rAddr *udp.Addr, pk *packet.Packet
 	case header.HostQueryReply:
 		lc.handleHostQueryReply(pk.RemoteIP, p)
 	case header.HostUpdateNotification:
-	//lc.handleHostUpdateNotification(n, vpnIp)
+		lc.handleHostUpdateNotification(rAddr, pk, h, p)
 	case header.HostPunch:
 		lc.handleHostPunch(rAddr, pk.RemoteIP, p)
 	}
@@ -121,6 +150,13 @@ func (lc *LighthouseController) handleHostQueryReply(ip api.VpnIP, p []byte) {
 
 func (lc *LighthouseController) Start(ctx context.Context) error {
 	lc.logger.Info("Starting lighthouse controller")
+	if lc.isLighthouse {
+		// 灯塔自身通告的网段直接记录在主机表中，随主机同步下发
+		lc.host.SetRoutes(lc.localVpnIP, lc.advertiseRoutes)
+		lc.host.SetExitNode(lc.localVpnIP, lc.advertiseExitNode)
+	} else {
+		lc.SendUpdate()
+	}
 	// 启动定时任务，定期发送节点更新通知
 	go lc.startUpdateWorker(ctx)
 	// 启动查询处理工作人员
@@ -137,11 +173,184 @@ func (lc *LighthouseController) startUpdateWorker(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			//lc.SendUpdate()
+			lc.SendUpdate()
+		}
+	}
+}
+
+// SetLighthouses 替换灯塔列表，下一次通告时使用
+func (lc *LighthouseController) SetLighthouses(lighthouses []api.VpnIP) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.lighthouses = lighthouses
+}
+
+// SendUpdate 向所有灯塔通告本节点可以转发的网段，没有配置时发送空列表以清除灯塔上的旧路由
+func (lc *LighthouseController) SendUpdate() {
+	if lc.isLighthouse {
+		return
+	}
+
+	data, err := json.Marshal(&hostUpdateNotification{Routes: lc.advertiseRoutes, ExitNode: lc.advertiseExitNode})
+	if err != nil {
+		lc.logger.WithError(err).Error("Failed to marshal host update notification")
+		return
+	}
+
+	lc.mu.RLock()
+	lighthouses := lc.lighthouses
+	lc.mu.RUnlock()
+	for _, vip := range lighthouses {
+		hi := lc.host.QueryVpnIp(vip)
+		if hi == nil || hi.Remote == nil {
+			continue
+		}
+		p, err := lc.buildHostUpdateNotificationPacket(vip, data)
+		if err != nil {
+			lc.logger.WithError(err).Error("Failed to build host update notification packet")
+			return
+		}
+		if err := lc.ow.WriteToAddr(p, hi.Remote); err != nil {
+			lc.logger.WithError(err).WithField("lighthouse", vip).Error("Failed to send host update notification")
 		}
 	}
 }
 
+// handleHostUpdateNotification 记录节点通告的网段与出口节点。通知只接受来自已经完成握手的节点：
+// 头部的 index 与来源地址必须与握手时登记的一致，载荷必须能够通过认证解密。
+// 通告的网段与出口节点还需要在灯塔配置的 allowed_routes 与 exit_nodes 中
+func (lc *LighthouseController) handleHostUpdateNotification(addr *udp.Addr, pk *packet.Packet, h *header.Header, p []byte) {
+	if !lc.IsLighthouse() {
+		return
+	}
+
+	from := lc.host.QueryIndex(h.RemoteIndex)
+	if from == nil || from.VpnIp != pk.RemoteIP || from.Remote == nil || !from.Remote.Equal(addr) {
+		lc.logger.WithField("remoteIP", pk.RemoteIP).WithField("addr", addr).Warn("Ignoring host update notification without a handshake")
+		return
+	}
+	payload, err := lc.CipherState.Open(p[header.Len+packet.HeaderLen(p[header.Len:]):])
+	if err != nil {
+		lc.logger.WithError(err).WithField("remoteIP", pk.RemoteIP).WithField("addr", addr).Warn("Failed to open host update notification")
+		return
+	}
+	n := &hostUpdateNotification{}
+	if err := json.Unmarshal(payload, n); err != nil {
+		lc.logger.WithError(err).WithField("addr", addr).Error("Failed to unmarshal host update notification")
+		return
+	}
+
+	routes := make([]netip.Prefix, 0, len(n.Routes))
+	for _, prefix := range n.Routes {
+		if !lc.routeAllowed(from.VpnIp, prefix) {
+			lc.logger.WithField("remoteIP", from.VpnIp).WithField("route", prefix).Warn("Ignoring route not in lighthouse.allowed_routes")
+			continue
+		}
+		routes = append(routes, prefix)
+	}
+	exitNode := n.ExitNode && lc.allowedExitNodes[from.VpnIp]
+	if n.ExitNode && !exitNode {
+		lc.logger.WithField("remoteIP", from.VpnIp).Warn("Ignoring exit node not in lighthouse.exit_nodes")
+	}
+
+	lc.logger.
+		WithField("remoteIP", from.VpnIp).
+		WithField("addr", addr).
+		WithField("routes", routes).
+		WithField("exitNode", exitNode).
+		Debug("Received host update notification")
+	lc.host.SetRoutes(from.VpnIp, routes)
+	lc.host.SetExitNode(from.VpnIp, exitNode)
+}
+
+// routeAllowed 判断 vip 是否可以通告 prefix：prefix 必须是为 vip 配置的某个网段或者其中的子网段
+func (lc *LighthouseController) routeAllowed(vip api.VpnIP, prefix netip.Prefix) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	for _, allowed := range lc.allowedRoutes[vip] {
+		if prefix.Bits() >= allowed.Bits() && allowed.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLighthouseAllowList 解析灯塔接受的节点通告，网段不能与 overlay 网络重叠
+func parseLighthouseAllowList(c config.LighthouseConfig, network *net.IPNet) (map[api.VpnIP][]netip.Prefix, map[api.VpnIP]bool, error) {
+	routes := make(map[api.VpnIP][]netip.Prefix, len(c.AllowedRoutes))
+	for ip, cidrs := range c.AllowedRoutes {
+		vip, err := api.ParseVpnIp(ip)
+		if err != nil {
+			return nil, nil, fmt.Errorf("lighthouse.allowed_routes %s: %v", ip, err)
+		}
+		prefixes, err := route.ParseAdvertisedRoutes(cidrs, network)
+		if err != nil {
+			return nil, nil, fmt.Errorf("lighthouse.allowed_routes %s: %v", ip, err)
+		}
+		routes[vip] = prefixes
+	}
+	exitNodes := make(map[api.VpnIP]bool, len(c.ExitNodes))
+	for _, ip := range c.ExitNodes {
+		vip, err := api.ParseVpnIp(ip)
+		if err != nil {
+			return nil, nil, fmt.Errorf("lighthouse.exit_nodes %s: %v", ip, err)
+		}
+		exitNodes[vip] = true
+	}
+	return routes, exitNodes, nil
+}
+
+// updateRoutes 使用灯塔同步的节点通告路由替换路由表中来源为灯塔的路由，并同步到系统路由表
+func (lc *LighthouseController) updateRoutes(hs map[api.VpnIP]*host.HostInfo) {
+	overlay, err := api.ToNetIpPrefix(*lc.inside.Cidr())
+	if err != nil {
+		lc.logger.WithError(err).Error("Failed to parse overlay network")
+		return
+	}
+
+	var entries []route.Entry
+	for vip, hi := range hs {
+		if vip == lc.localVpnIP {
+			continue
+		}
+		for _, prefix := range hi.Routes {
+			// 不接受与 overlay 网络重叠的网段与默认路由，避免劫持 overlay 或底层网络的流量
+			if !prefix.IsValid() || prefix.Bits() == 0 || prefix.Overlaps(overlay) {
+				lc.logger.WithField("vpnIp", vip).WithField("route", prefix).Warn("Ignoring advertised route")
+				continue
+			}
+			entries = append(entries, route.Entry{Prefix: prefix, Via: vip, Source: route.SourceLighthouse})
+		}
+	}
+
+	added, removed := lc.routes.ReplaceSource(route.SourceLighthouse, entries)
+	for _, e := range removed {
+		lc.logger.WithField("route", e).Info("Removing advertised route")
+		if lc.shadowed(e) {
+			continue
+		}
+		if err := lc.inside.RemoveRoute(tun.Route{Cidr: api.PrefixToIPNet(e.Prefix)}); err != nil {
+			lc.logger.WithError(err).WithField("route", e).Error("Failed to remove route")
+		}
+	}
+	for _, e := range added {
+		lc.logger.WithField("route", e).Info("Adding advertised route")
+		if lc.shadowed(e) {
+			continue
+		}
+		if err := lc.inside.AddRoute(tun.Route{Cidr: api.PrefixToIPNet(e.Prefix)}); err != nil {
+			lc.logger.WithError(err).WithField("route", e).Error("Failed to add route")
+		}
+	}
+}
+
+// shadowed 判断相同网段是否存在来自配置文件的路由，此时系统路由由配置管理，不能修改
+func (lc *LighthouseController) shadowed(e route.Entry) bool {
+	best, ok := lc.routes.Lookup(api.AddrToVpnIp(e.Prefix.Addr()))
+	return ok && best.Prefix == e.Prefix && best.Source != route.SourceLighthouse
+}
+
 func (lc *LighthouseController) startQueryWorker(ctx context.Context) {
 	for {
 		select {
@@ -279,7 +488,7 @@ func (lc *LighthouseController) handleHostSyncReply(addr *udp.Addr, pk *packet.P
 		WithField("addr", addr).
 		WithField("pk", pk).
 		Info("Received Lighthouse sync reply")
-	p = p[header.Len+20:]
+	p = p[header.Len+packet.HeaderLen(p[header.Len:]):]
 	var hs map[api.VpnIP]*host.HostInfo
 	if err := json.Unmarshal(p, &hs); err != nil {
 		lc.logger.WithError(err).Error("解析数据包出错")
@@ -290,23 +499,35 @@ func (lc *LighthouseController) handleHostSyncReply(addr *udp.Addr, pk *packet.P
 		if i == lc.localVpnIP {
 			continue
 		}
+		remotes := i2.GetRemoteAddrList()
 		lc.logger.
 			WithField("remoteIP", i).
-			WithField("addr", i2.Remote).
+			WithField("addrs", remotes).
 			Debug("Sync address information received")
 		punchPacket, err := lc.buildHandshakeHostRequestPacket(i)
 		if err != nil {
 			lc.logger.WithError(err).Error("buildTestPacket")
 			return
 		}
-		lc.logger.
-			WithField("remoteIP", i).
-			WithField("addr", i2.Remote).
-			Debug("Send handshake message")
-		if err := lc.ow.WriteToAddr(punchPacket, i2.Remote); err != nil {
-			lc.logger.WithError(err).Error("数据转发到远程")
+		// 向所有候选地址发送握手，最先回复的地址会成为该主机的路径
+		for _, remote := range remotes {
+			lc.logger.
+				WithField("remoteIP", i).
+				WithField("addr", remote).
+				Debug("Send handshake message")
+			if err := lc.ow.WriteToAddr(punchPacket, remote); err != nil {
+				lc.logger.WithError(err).Error("数据转发到远程")
+			}
+			lc.host.AddRemote(i, remote)
 		}
-		lc.host.UpdateHost(i, i2.Remote)
+	}
+
+	if lc.acceptRoutes {
+		lc.updateRoutes(hs)
+	}
+
+	if hi, ok := hs[lc.exitNode]; ok && !hi.ExitNode {
+		lc.logger.WithField("exitNode", lc.exitNode).Warn("The configured exit node does not advertise itself as an exit node")
 	}
 }
 
@@ -319,7 +540,7 @@ func (lc *LighthouseController) buildHandshakeHostSyncReplyPacket(vip api.VpnIP,
 	if err != nil {
 		return nil, err
 	}
-	pv4Packet, err := packet.BuildIPv4Packet(lc.localVpnIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
+	pv4Packet, err := packet.BuildIPPacket(lc.localVpnIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
 	if err != nil {
 		return nil, err
 	}
@@ -331,12 +552,34 @@ func (lc *LighthouseController) buildHandshakeHostSyncReplyPacket(vip api.VpnIP,
 	return buf.Bytes(), nil
 }
 
+// buildHostUpdateNotificationPacket 构建更新通知，消息布局为 头部 | IP 头部 | nonce | 密文 | 认证标签
+func (lc *LighthouseController) buildHostUpdateNotificationPacket(vip api.VpnIP, data []byte) ([]byte, error) {
+	h, err := header.BuildLightHouse(lc.localIndex, header.HostUpdateNotification, 0)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := packet.BuildIPPacket(lc.localVpnIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(h)
+	buf.Write(pk)
+	buf.Write(make([]byte, cipher.NonceSize))
+	buf.Write(data)
+	buf.Write(make([]byte, cipher.TagSize))
+	b := buf.Bytes()
+	lc.CipherState.Seal(b[len(h)+len(pk):])
+	return b, nil
+}
+
 func (lc *LighthouseController) buildHandshakePacket(vip api.VpnIP, ms header.MessageSubType) ([]byte, error) {
 	h, err := header.BuildHandshake(0, ms, 0)
 	if err != nil {
 		return nil, err
 	}
-	pk, err := packet.BuildIPv4Packet(lc.localVpnIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
+	pk, err := packet.BuildIPPacket(lc.localVpnIP.ToIP(), vip.ToIP(), packet.ProtoUDP, false)
 	if err != nil {
 		return nil, err
 	}
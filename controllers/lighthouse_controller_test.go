@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/cipher"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/am6737/nexus/transport/protocol/udp"
+	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// TestLighthouseController_HostUpdateNotification 灯塔只接受已经握手的节点发送的更新通知，
+// 并且只记录配置中允许该节点通告的网段与出口节点
+func TestLighthouseController_HostUpdateNotification(t *testing.T) {
+	logger := logrus.New()
+	_, network, _ := net.ParseCIDR("192.168.100.0/24")
+	lighthouseIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 1).To4())
+	nodeIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+	nodeAddr := &udp.Addr{IP: net.IPv4(10, 0, 0, 2), Port: 4242}
+
+	cs, err := cipher.NewNexusCipherState("test", "test@nexus", "test")
+	assert.NoError(t, err)
+
+	hosts := host.NewHostMap(logger, network, nil)
+	hosts.AddHost(nodeIP, nodeAddr, []byte("public key"))
+	assert.NoError(t, hosts.SetRemoteIndex(nodeIP, 5))
+	lighthouse := NewLighthouseController(logger, hosts, nil, true, lighthouseIP, cs)
+	lighthouse.allowedRoutes = map[api.VpnIP][]netip.Prefix{nodeIP: {netip.MustParsePrefix("10.1.0.0/16")}}
+	lighthouse.allowedExitNodes = map[api.VpnIP]bool{}
+
+	node := NewLighthouseController(logger, host.NewHostMap(logger, network, nil), nil, false, nodeIP, cs)
+	node.localIndex = 5
+
+	build := func(n hostUpdateNotification) []byte {
+		data, err := json.Marshal(n)
+		assert.NoError(t, err)
+		p, err := node.buildHostUpdateNotificationPacket(lighthouseIP, data)
+		assert.NoError(t, err)
+		return p
+	}
+	handle := func(addr *udp.Addr, p []byte) {
+		h := &header.Header{}
+		assert.NoError(t, h.Decode(p))
+		pk := &packet.Packet{}
+		assert.NoError(t, packet.ParsePacket(p[header.Len:], true, pk))
+		lighthouse.HandleRequest(addr, pk, h, p)
+	}
+
+	update := hostUpdateNotification{
+		Routes: []netip.Prefix{
+			netip.MustParsePrefix("10.1.2.0/24"),
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("172.16.0.0/12"),
+		},
+		ExitNode: true,
+	}
+	handle(nodeAddr, build(update))
+	hi := hosts.QueryVpnIp(nodeIP)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.1.2.0/24")}, hi.Routes)
+	assert.False(t, hi.ExitNode)
+
+	lighthouse.allowedExitNodes[nodeIP] = true
+	handle(nodeAddr, build(update))
+	assert.True(t, hi.ExitNode)
+
+	// 来源地址与握手时的不一致
+	handle(&udp.Addr{IP: net.IPv4(10, 0, 0, 3), Port: 4242}, build(hostUpdateNotification{}))
+	assert.True(t, hi.ExitNode)
+
+	// 密文被篡改
+	p := build(hostUpdateNotification{})
+	p[len(p)-1] ^= 0xff
+	handle(nodeAddr, p)
+	assert.True(t, hi.ExitNode)
+
+	// 没有握手记录的 index
+	node.localIndex = 6
+	handle(nodeAddr, build(hostUpdateNotification{}))
+	assert.True(t, hi.ExitNode)
+	assert.Len(t, hi.Routes, 1)
+
+	node.localIndex = 5
+	handle(nodeAddr, build(hostUpdateNotification{}))
+	assert.False(t, hi.ExitNode)
+	assert.Empty(t, hi.Routes)
+}
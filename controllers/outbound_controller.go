@@ -6,32 +6,54 @@ import (
 	"github.com/am6737/nexus/api"
 	"github.com/am6737/nexus/api/interfaces"
 	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
 	"github.com/am6737/nexus/ifce"
+	"github.com/am6737/nexus/qos"
+	"github.com/am6737/nexus/route"
+	"github.com/am6737/nexus/rules"
+	"github.com/am6737/nexus/shaping"
+	"github.com/am6737/nexus/transport/buffer"
 	"github.com/am6737/nexus/transport/packet"
 	"github.com/am6737/nexus/tun"
 	"github.com/am6737/nexus/utils"
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"io"
+	"net"
 	"os"
 	"runtime"
 	"sync/atomic"
 )
 
-const (
-	mtu = 9001
-)
-
 var _ interfaces.OutboundController = &OutboundController{}
 
+// qosQueueLen 每个优先级队列最多缓存的数据包数量，Bulk 队列超过这个数量后才会丢弃
+const qosQueueLen = 512
+
 // OutboundController 出站控制器 必须实现 interfaces.OutboundController 接口
 type OutboundController struct {
 	mtu        int
+	batch      int
 	closed     atomic.Bool
 	localVpnIP api.VpnIP
 	inside     tun.Device
 	logger     *logrus.Logger
 	cfg        *config.Config
 	rules      interfaces.RulesEngine
+
+	// splitTunnel 分流路由，没有配置时为 nil
+	splitTunnel *route.SplitTunnel
+	// readers tun 的各个队列，readers[0] 就是 inside
+	readers []io.ReadWriteCloser
+	// hosts 与 routes 用于查找下一跳节点的路径 MTU
+	hosts  *host.HostMap
+	routes *route.Table
+	// shaper 流量整形，没有配置时为 nil
+	shaper *shaping.Shaper
+	// outside 发送整形延迟的数据包
+	outside interfaces.OutsideWriter
+	// qos 按 DSCP 划分发送优先级，关闭时为 nil
+	qos *qos.Classifier
 }
 
 func (ic *OutboundController) Start(ctx context.Context) error {
@@ -41,6 +63,21 @@ func (ic *OutboundController) Start(ctx context.Context) error {
 		}
 		ic.logger.Fatal(err)
 	}
+
+	// 使用出口节点时，发往互联网的 IPv4 流量都经过 tun
+	if ic.cfg.ExitNode.Use != "" {
+		for _, r := range exitRoutes {
+			_, cidr, _ := net.ParseCIDR(r)
+			if err := ic.inside.AddRoute(tun.Route{Cidr: cidr, MTU: ic.mtu}); err != nil {
+				return err
+			}
+		}
+		ic.logger.WithField("exitNode", ic.cfg.ExitNode.Use).Info("Routing internet traffic through the exit node")
+	}
+
+	if ic.splitTunnel != nil {
+		ic.splitTunnel.Start(ctx)
+	}
 	ic.logger.
 		WithField("localVpnIP", ic.localVpnIP).
 		WithField("dev", ic.cfg.Tun.Dev).
@@ -53,28 +90,139 @@ func (ic *OutboundController) Send(p []byte) (n int, err error) {
 	return ic.inside.Write(p)
 }
 
-func (ic *OutboundController) Listen(externalWriter interfaces.OutsideWriter) {
+// Listen 读取第 q 个 tun 队列并通过同一队列的套接字发送
+func (ic *OutboundController) Listen(q int, externalWriter interfaces.OutsideWriter) {
 	runtime.LockOSThread()
+	reader := ic.readers[q]
+	batch := ic.batch
+	if batch < 1 {
+		batch = 1
+	}
+
+	// 读取 tun 的协程按优先级把数据包放入各个队列，这里一次取出所有已到达的数据包，高优先级的先取出，
+	// 通过一次批量写发送出去。数据包从读取 tun 到写入套接字一直使用池中的同一个缓冲区
+	queueLen := qosQueueLen
+	if queueLen < batch {
+		queueLen = batch
+	}
+	var queues [qos.NumClasses]chan *buffer.Buffer
+	for i := range queues {
+		queues[i] = make(chan *buffer.Buffer, queueLen)
+	}
+	go ic.readInside(reader, &queues)
+
 	p := &packet.Packet{}
-	packet := make([]byte, mtu)
+	bufs := make([]*buffer.Buffer, 0, batch)
+	sends := make([]*buffer.Buffer, 0, batch)
+	vips := make([]api.VpnIP, 0, batch)
 	for {
-		n, err := ic.inside.Read(packet)
+		b := nextPacket(&queues)
+		if b == nil {
+			return
+		}
+		bufs = append(bufs[:0], b)
+		for len(bufs) < batch {
+			if b = pollPacket(&queues); b == nil {
+				break
+			}
+			bufs = append(bufs, b)
+		}
+
+		sends, vips = sends[:0], vips[:0]
+		for _, b := range bufs {
+			if vip, ok := ic.consumeInsidePacket(b.Bytes(), p, reader); ok {
+				sends = append(sends, b)
+				vips = append(vips, vip)
+			}
+		}
+		if len(sends) > 0 {
+			if err := externalWriter.WriteBatchToVIP(q, sends, vips); err != nil {
+				ic.logger.WithError(err).Error("Error while forwarding outbound packet")
+			}
+		}
+
+		for _, b := range bufs {
+			b.Release()
+		}
+	}
+}
+
+// readInside 从 tun 队列读取数据包并按优先级放入 queues，设备关闭后关闭所有队列。
+// 套接字发送不过来时 High 与 Normal 队列阻塞读取，只有 Bulk 队列满了才丢弃数据包，
+// 避免大量的 Bulk 数据包阻塞后面的高优先级数据包。没有开启 QoS 时所有数据包都放入 Normal 队列
+func (ic *OutboundController) readInside(reader io.Reader, queues *[qos.NumClasses]chan *buffer.Buffer) {
+	// 读取 tun 的协程同样独占一个线程，与 Listen 的发送协程一样不随调度在线程间迁移
+	runtime.LockOSThread()
+	bulkDropped := metrics.GetOrRegisterCounter("qos."+qos.Bulk.String()+".dropped", nil)
+
+	for {
+		b := buffer.Get()
+		n, err := reader.Read(b.Space())
 		if err != nil {
+			b.Release()
 			if errors.Is(err, os.ErrClosed) && ic.closed.Load() {
+				for _, ch := range queues {
+					close(ch)
+				}
 				return
 			}
 			ic.logger.WithError(err).Error("Error while reading outbound packet")
 			// This only seems to happen when something fatal happens to the fd, so exit.
 			os.Exit(2)
 		}
-		ic.consumeInsidePacket(packet[:n], p, ic.inside, externalWriter)
+		b.SetLen(n)
+
+		if ic.qos == nil {
+			queues[qos.Normal] <- b
+			continue
+		}
+		c := ic.qos.Class(packet.DSCP(b.Bytes()))
+		if c != qos.Bulk {
+			queues[c] <- b
+			continue
+		}
+		select {
+		case queues[c] <- b:
+		default:
+			b.Release()
+			bulkDropped.Inc(1)
+		}
 	}
 }
 
-func (ic *OutboundController) consumeInsidePacket(data []byte, packet *packet.Packet, internalWriter io.Writer, externalWriter interfaces.OutsideWriter) {
+// pollPacket 按优先级从高到低取出一个已到达的数据包，没有时返回 nil
+func pollPacket(queues *[qos.NumClasses]chan *buffer.Buffer) *buffer.Buffer {
+	for _, ch := range queues {
+		select {
+		case b, ok := <-ch:
+			if ok {
+				return b
+			}
+		default:
+		}
+	}
+	return nil
+}
+
+// nextPacket 等待下一个数据包，多个队列都有数据包时优先返回高优先级的，队列关闭后返回 nil
+func nextPacket(queues *[qos.NumClasses]chan *buffer.Buffer) *buffer.Buffer {
+	if b := pollPacket(queues); b != nil {
+		return b
+	}
+	var b *buffer.Buffer
+	select {
+	case b = <-queues[qos.High]:
+	case b = <-queues[qos.Normal]:
+	case b = <-queues[qos.Bulk]:
+	}
+	return b
+}
+
+// consumeInsidePacket 检查从 tun 读取的数据包，返回需要发送到的 overlay 地址
+func (ic *OutboundController) consumeInsidePacket(data []byte, packet *packet.Packet, internalWriter io.Writer) (api.VpnIP, bool) {
 	if err := utils.ParsePacket(data, false, packet); err != nil {
 		//ic.logger.WithField("packet", packet).Debugf("consumeInsidePacket Error while validating outbound packet: %s", err)
-		return
+		return api.VpnIP{}, false
 	}
 
 	if packet.RemoteIP == ic.localVpnIP {
@@ -83,22 +231,97 @@ func (ic *OutboundController) consumeInsidePacket(data []byte, packet *packet.Pa
 				ic.logger.WithError(err).Error("Failed to forward to tun")
 			}
 		}
-		return
+		return api.VpnIP{}, false
 	}
 
-	// Check the rules
-	if err := ic.rules.Outbound(packet); err != nil {
-		ic.logger.WithError(err).Warn("Dropped packet due to rule")
-		return
+	// Check the rules, dropped packets are reported by the firewall events
+	next, peer := tunnelPeer(ic.routes, ic.hosts, packet.RemoteIP)
+	if err := ic.rules.Outbound(packet, peer); err != nil {
+		if rules.IsReject(err) {
+			ic.reject(data, packet, internalWriter)
+		}
+		return api.VpnIP{}, false
+	}
+
+	if ic.tooBig(data, packet, internalWriter) {
+		return api.VpnIP{}, false
+	}
+
+	if ic.shaper != nil && !ic.shape(data, packet.RemoteIP, next, peer) {
+		return api.VpnIP{}, false
+	}
+
+	return packet.RemoteIP, true
+}
+
+// shape 流量整形，返回 false 时数据包被丢弃或者需要等待令牌。queue 模式下需要等待的数据包复制一份，
+// 等待之后通过 outside 发送，不阻塞读取 tun 的协程。vip 为数据包的目标地址，next 与 peer 为隧道的对端
+func (ic *OutboundController) shape(data []byte, vip, next api.VpnIP, peer *host.HostInfo) bool {
+	wait, ok := ic.shaper.Egress(next, peer, len(data))
+	if !ok {
+		return false
+	}
+	if wait == 0 {
+		return true
+	}
+
+	b := buffer.Get()
+	if err := b.Set(data); err != nil {
+		b.Release()
+		return false
+	}
+	ic.shaper.Delay(wait, func() {
+		defer b.Release()
+		if err := ic.outside.WriteToVIP(b.Bytes(), vip); err != nil {
+			ic.logger.WithError(err).WithField("vpnIP", vip).Debug("Failed to send delayed packet")
+		}
+	})
+	return false
+}
+
+// tooBig 判断 TCP 数据包是否超过下一跳节点的路径 MTU，超过并且不允许分片时向 tun 写入 ICMP 报文，
+// 发送方会减小报文段。其他协议的数据包在发送时被切分为多个分片消息，由对端重组
+func (ic *OutboundController) tooBig(data []byte, p *packet.Packet, internalWriter io.Writer) bool {
+	if p.Protocol != packet.ProtoTCP {
+		return false
+	}
+	e, ok := ic.routes.Lookup(p.RemoteIP)
+	if !ok {
+		return false
+	}
+	mtu := ic.hosts.MTU(e.NextHop(p.RemoteIP))
+	if mtu <= 0 || len(data) <= mtu || !packet.DontFragment(data) {
+		return false
 	}
 
-	if err := externalWriter.WriteToVIP(data, packet.RemoteIP); err != nil {
-		ic.logger.WithError(err).Error("Error while forwarding outbound packet")
+	reply, err := packet.PacketTooBig(data, mtu)
+	if err != nil {
+		ic.logger.WithError(err).Debug("Failed to build packet too big message")
+		return true
+	}
+	if _, err := internalWriter.Write(reply); err != nil {
+		ic.logger.WithError(err).Error("Failed to write packet too big message to tun")
+	}
+	return true
+}
+
+// reject 向 tun 写入拒绝数据包的 TCP RST 或 ICMP 不可达，本机的应用立即得到连接失败而不是等到超时
+func (ic *OutboundController) reject(data []byte, p *packet.Packet, internalWriter io.Writer) {
+	reply, ok := packet.Reject(data, p)
+	if !ok {
 		return
 	}
+	if _, err := internalWriter.Write(reply); err != nil {
+		ic.logger.WithError(err).Error("Failed to write reject message to tun")
+	}
 }
 
 func (ic *OutboundController) Close() error {
 	ic.closed.Store(true)
+	for _, r := range ic.readers[1:] {
+		if err := r.Close(); err != nil {
+			ic.logger.WithError(err).Error("Failed to close tun queue")
+		}
+	}
 	return ic.inside.Close()
 }
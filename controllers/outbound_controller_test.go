@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"encoding/binary"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/qos"
+	"github.com/am6737/nexus/route"
+	"github.com/am6737/nexus/shaping"
+	"github.com/am6737/nexus/transport/buffer"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestOutboundController_ShapeNextHop 发往节点通告的网段的流量计入下一跳节点的限额
+func TestOutboundController_ShapeNextHop(t *testing.T) {
+	d := newDataPath(t)
+	pk := &packet.Packet{}
+	rxIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+	assert.NoError(t, d.inside.routes.Insert(route.Entry{Prefix: netip.MustParsePrefix("10.1.0.0/24"), Via: rxIP, Source: route.SourceUnsafe}))
+	shaper, err := shaping.New(config.ShapingConfig{
+		Peers: map[string]config.ShapingLimit{"192.168.100.2": {Rate: "1kb"}},
+	})
+	assert.NoError(t, err)
+	d.inside.shaper = shaper
+
+	routed := append([]byte(nil), d.packet...)
+	copy(routed[16:20], []byte{10, 1, 0, 5})
+	sent := 0
+	for ; sent < 100; sent++ {
+		if _, ok := d.inside.consumeInsidePacket(routed, pk, d.tun); !ok {
+			break
+		}
+	}
+	assert.Less(t, sent, 100)
+
+	// 令牌已经被发往网段的流量用完，直接发给 rx 的数据包同样被丢弃
+	_, ok := d.inside.consumeInsidePacket(d.packet, pk, d.tun)
+	assert.False(t, ok)
+}
+
+// TestOutboundController_ShapeQueue queue 模式下需要等待的数据包不阻塞读取 tun，等待之后发送到对端。
+// 令牌桶的速率与丢弃由 shaping 包测试
+func TestOutboundController_ShapeQueue(t *testing.T) {
+	d := newDataPath(t)
+	pk := &packet.Packet{}
+	now := time.Now()
+	shaper, err := shaping.New(config.ShapingConfig{
+		Mode:  "queue",
+		Peers: map[string]config.ShapingLimit{"192.168.100.2": {Rate: "100kb", Burst: "24kb"}},
+	}, shaping.WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.inside.shaper = shaper
+
+	// 时间静止，24kb 的突发可以直接发送 19 个数据包，之后 6 个数据包需要等待的时长都不超过 MaxDelay
+	sent := 0
+	for i := 0; i < 25; i++ {
+		if _, ok := d.inside.consumeInsidePacket(d.packet, pk, d.tun); ok {
+			sent++
+		}
+	}
+	assert.Equal(t, 19, sent)
+	done := make(chan struct{})
+	shaper.Delay(shaping.DefaultMaxDelay, func() { close(done) })
+	<-done
+	assert.Equal(t, 6, d.tun.n)
+	assert.Equal(t, d.packet, d.tun.last)
+}
+
+// TestOutboundController_TooBig 超过下一跳路径 MTU 并且设置了 DF 的 TCP 数据包向 tun 回复 ICMP，其他数据包在隧道中分片
+func TestOutboundController_TooBig(t *testing.T) {
+	d := newDataPath(t)
+	pk := &packet.Packet{}
+	rxIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+	d.hosts.SetMTU(rxIP, 1000)
+
+	// 设置了 DF 的 UDP 数据包也在隧道中分片发送
+	p := append([]byte(nil), d.packet...)
+	p[6] |= 0x40
+	_, ok := d.inside.consumeInsidePacket(p, pk, d.tun)
+	assert.True(t, ok)
+	assert.Zero(t, d.tun.n)
+
+	p[9] = packet.ProtoTCP
+	_, ok = d.inside.consumeInsidePacket(p, pk, d.tun)
+	assert.False(t, ok)
+	assert.Equal(t, 1, d.tun.n)
+
+	assert.NoError(t, packet.ParsePacket(d.tun.last, false, pk))
+	assert.Equal(t, uint8(packet.ProtoICMP), pk.Protocol)
+	assert.Equal(t, rxIP, pk.LocalIP)
+	assert.Equal(t, uint16(1000), binary.BigEndian.Uint16(d.tun.last[packet.Len+6:packet.Len+8]))
+
+	// 没有设置 DF 时交给底层网络分片
+	p[6] = 0
+	_, ok = d.inside.consumeInsidePacket(p, pk, d.tun)
+	assert.True(t, ok)
+}
+
+// sliceReader 依次返回 packets 中的数据包，之后返回 os.ErrClosed
+type sliceReader struct {
+	packets [][]byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.packets) == 0 {
+		return 0, os.ErrClosed
+	}
+	n := copy(p, r.packets[0])
+	r.packets = r.packets[1:]
+	return n, nil
+}
+
+func TestOutboundController_Priority(t *testing.T) {
+	classifier, err := qos.NewClassifier(config.QoSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic := &OutboundController{logger: logrus.New(), qos: classifier}
+	ic.closed.Store(true)
+
+	tos := func(dscp uint8) []byte {
+		return []byte{0x45, dscp << 2}
+	}
+	r := &sliceReader{}
+	for i := 0; i < 6; i++ {
+		r.packets = append(r.packets, tos(8))
+	}
+	r.packets = append(r.packets, tos(0), tos(46), tos(18))
+
+	var queues [qos.NumClasses]chan *buffer.Buffer
+	for i := range queues {
+		queues[i] = make(chan *buffer.Buffer, 4)
+	}
+	ic.readInside(r, &queues)
+
+	// 队列满了之后 Bulk 的数据包被丢弃，取出时高优先级的在前
+	var got []uint8
+	for b := nextPacket(&queues); b != nil; b = nextPacket(&queues) {
+		got = append(got, packet.DSCP(b.Bytes()))
+		b.Release()
+	}
+	assert.Equal(t, []uint8{46, 18, 0, 8, 8, 8, 8}, got)
+
+	// Normal 队列满了之后阻塞读取，不会丢弃数据包
+	r = &sliceReader{}
+	for i := 0; i < 10; i++ {
+		r.packets = append(r.packets, tos(0))
+	}
+	for i := range queues {
+		queues[i] = make(chan *buffer.Buffer, 2)
+	}
+	go ic.readInside(r, &queues)
+	n := 0
+	for b := nextPacket(&queues); b != nil; b = nextPacket(&queues) {
+		n++
+		b.Release()
+	}
+	assert.Equal(t, 10, n)
+}
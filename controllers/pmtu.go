@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/api/interfaces"
+	"github.com/am6737/nexus/cipher"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/am6737/nexus/transport/protocol/udp"
+	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"github.com/am6737/nexus/tun"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPMTUInterval 默认的重新探测间隔
+	DefaultPMTUInterval = 10 * time.Minute
+	// DefaultPMTUMin 默认的探测下限，也是 IPv6 要求每条链路至少支持的 MTU
+	DefaultPMTUMin = 1280
+
+	// pmtuOverhead 加密后的消息比内层数据包多出的长度
+	pmtuOverhead = header.Len + cipher.NonceSize + cipher.TagSize
+	// pmtuStep 二分查找的粒度
+	pmtuStep = 8
+	// pmtuTries 每个长度的探测次数，全部超时才认为该长度不可用
+	pmtuTries = 2
+	// pmtuTick 检查哪些节点需要探测的间隔
+	pmtuTick = 10 * time.Second
+)
+
+var _ interfaces.Runnable = &pmtuProber{}
+
+// pmtuProber 用填充到指定长度的 Test 消息探测到每个已握手节点的路径 MTU，结果记录在 HostInfo.MTU 上。
+// 路径 MTU 小于 tun 设备的 MTU 时为该节点安装一条带 MTU 的主机路由，内核据此限制 TCP 的 MSS
+type pmtuProber struct {
+	logger     *logrus.Logger
+	hosts      *host.HostMap
+	inside     tun.Device
+	localVpnIP api.VpnIP
+	write      func(b []byte, addr *udp.Addr) error
+
+	min      int
+	max      int
+	interval time.Duration
+	timeout  time.Duration
+
+	mu sync.Mutex
+	// pending 等待回复的探测，收到回复时关闭对应的通道
+	pending map[pmtuProbe]chan struct{}
+	// probed 每个节点上一次开始探测的时间
+	probed map[api.VpnIP]time.Time
+	// installed 已经安装了主机路由的节点及路由的 MTU
+	installed map[api.VpnIP]int
+}
+
+type pmtuProbe struct {
+	vip  api.VpnIP
+	size int
+}
+
+func newPMTUProber(c config.PMTUConfig, logger *logrus.Logger, hosts *host.HostMap, inside tun.Device, localVpnIP api.VpnIP, write func([]byte, *udp.Addr) error) *pmtuProber {
+	p := &pmtuProber{
+		logger:     logger,
+		hosts:      hosts,
+		inside:     inside,
+		localVpnIP: localVpnIP,
+		write:      write,
+		min:        c.Min,
+		max:        inside.MTU(),
+		interval:   c.Interval,
+		timeout:    time.Second,
+		pending:    make(map[pmtuProbe]chan struct{}),
+		probed:     make(map[api.VpnIP]time.Time),
+		installed:  make(map[api.VpnIP]int),
+	}
+	if p.min <= 0 {
+		p.min = DefaultPMTUMin
+	}
+	if p.min > p.max {
+		p.min = p.max
+	}
+	if p.interval <= 0 {
+		p.interval = DefaultPMTUInterval
+	}
+	return p
+}
+
+func (p *pmtuProber) Start(ctx context.Context) error {
+	p.logger.
+		WithField("min", p.min).
+		WithField("max", p.max).
+		WithField("interval", p.interval).
+		Info("Starting path MTU discovery")
+
+	go func() {
+		ticker := time.NewTicker(pmtuTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.probeDue(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// probeDue 探测所有已握手并且超过探测间隔的节点
+func (p *pmtuProber) probeDue(ctx context.Context) {
+	now := time.Now()
+	for vip, h := range p.hosts.GetAllHostMap() {
+		if h.Remote == nil || h.PublicKey == "" {
+			continue
+		}
+		p.mu.Lock()
+		due := now.Sub(p.probed[vip]) >= p.interval
+		if due {
+			p.probed[vip] = now
+		}
+		p.mu.Unlock()
+		if due {
+			go p.probe(ctx, vip)
+		}
+	}
+}
+
+// probe 先探测上限，不可用时从下限开始二分查找，连下限都没有回复时路径 MTU 保持未知
+func (p *pmtuProber) probe(ctx context.Context, vip api.VpnIP) {
+	mtu := 0
+	if p.try(ctx, vip, p.max) {
+		mtu = p.max
+	} else if p.try(ctx, vip, p.min) {
+		// lo 可用，hi 不可用
+		lo, hi := p.min, p.max
+		for {
+			mid := lo + (hi-lo)/2/pmtuStep*pmtuStep
+			if mid == lo {
+				break
+			}
+			if p.try(ctx, vip, mid) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		mtu = lo
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	p.update(vip, mtu)
+}
+
+// try 发送长度为 size 的探测并等待回复
+func (p *pmtuProber) try(ctx context.Context, vip api.VpnIP, size int) bool {
+	key := pmtuProbe{vip: vip, size: size}
+	b := buildPMTUProbe(p.localVpnIP, vip, header.TestRequest, size, pmtuOverhead+size)
+
+	for i := 0; i < pmtuTries; i++ {
+		h := p.hosts.QueryVpnIp(vip)
+		if h == nil || h.Remote == nil {
+			return false
+		}
+
+		ch := make(chan struct{})
+		p.mu.Lock()
+		p.pending[key] = ch
+		p.mu.Unlock()
+
+		// 探测套接字设置了 DF 且不在本地分片：超过本地链路 MTU 的探测直接发送失败，
+		// 超过路径 MTU 的探测被途中丢弃，都等同于没有回复
+		if err := p.write(b, h.Remote.Copy()); err != nil {
+			p.logger.WithError(err).WithField("vip", vip).WithField("size", size).Debug("发送路径 MTU 探测失败")
+		}
+
+		timer := time.NewTimer(p.timeout)
+		select {
+		case <-ch:
+			timer.Stop()
+			return true
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// ack 收到 vip 对长度为 size 的探测的回复
+func (p *pmtuProber) ack(vip api.VpnIP, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := pmtuProbe{vip: vip, size: size}
+	if ch, ok := p.pending[key]; ok {
+		close(ch)
+		delete(p.pending, key)
+	}
+}
+
+// update 记录探测结果，并按需要安装、更新或删除该节点的主机路由
+func (p *pmtuProber) update(vip api.VpnIP, mtu int) {
+	if p.hosts.MTU(vip) != mtu {
+		p.logger.WithField("vip", vip).WithField("mtu", mtu).Info("Path MTU changed")
+	}
+	p.hosts.SetMTU(vip, mtu)
+
+	want := mtu
+	if mtu >= p.max {
+		want = 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.installed[vip]
+	if old == want {
+		return
+	}
+	if old > 0 {
+		if err := p.inside.RemoveRoute(tun.Route{Cidr: hostCIDR(vip), MTU: old}); err != nil {
+			p.logger.WithError(err).WithField("vip", vip).Warn("Failed to remove path MTU route")
+		}
+		delete(p.installed, vip)
+	}
+	if want > 0 {
+		if err := p.inside.AddRoute(tun.Route{Cidr: hostCIDR(vip), MTU: want}); err != nil {
+			p.logger.WithError(err).WithField("vip", vip).Warn("Failed to install path MTU route")
+			return
+		}
+		p.installed[vip] = want
+	}
+}
+
+// hostCIDR 返回只包含 vip 的网段
+func hostCIDR(vip api.VpnIP) *net.IPNet {
+	if vip.Is4() {
+		return &net.IPNet{IP: vip.ToIP().To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: vip.ToIP(), Mask: net.CIDRMask(128, 128)}
+}
+
+// buildPMTUProbe 构建路径 MTU 探测消息：头部 | IP 头部 | 4 字节端口 | 4 字节探测长度 | 填充，
+// 消息总长度为 length，与内层数据包长度为 size 的加密消息相同。探测不加密
+func buildPMTUProbe(local, remote api.VpnIP, mst header.MessageSubType, size int, length int) []byte {
+	ip := (&packet.Packet{
+		LocalIP:  local,
+		RemoteIP: remote,
+		Protocol: packet.ProtoUDP,
+	}).Encode()
+
+	n := header.Len + len(ip) + 8
+	if length < n {
+		length = n
+	}
+	b := make([]byte, length)
+	header.Encode(b, header.Version, header.Test, mst, 0, 0)
+	copy(b[header.Len:], ip)
+	binary.BigEndian.PutUint32(b[header.Len+len(ip)+4:], uint32(size))
+	return b
+}
+
+// parsePMTUProbe 解析探测消息，返回探测的长度，pk 的 RemoteIP 为发送方
+func parsePMTUProbe(p []byte, pk *packet.Packet) (int, bool) {
+	if len(p) < header.Len {
+		return 0, false
+	}
+	data := p[header.Len:]
+	if err := packet.ParsePacket(data, true, pk); err != nil {
+		return 0, false
+	}
+	offset := packet.HeaderLen(data) + 4
+	if len(data) < offset+4 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(data[offset : offset+4])), true
+}
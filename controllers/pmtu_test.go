@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"context"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/am6737/nexus/transport/protocol/udp"
+	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"github.com/am6737/nexus/tun"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type routeDevice struct {
+	tun.Device
+	sync.Mutex
+	routes map[string]int
+}
+
+func (d *routeDevice) MTU() int {
+	return 1400
+}
+
+func (d *routeDevice) AddRoute(r tun.Route) error {
+	d.Lock()
+	defer d.Unlock()
+	d.routes[r.Cidr.String()] = r.MTU
+	return nil
+}
+
+func (d *routeDevice) RemoveRoute(r tun.Route) error {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.routes, r.Cidr.String())
+	return nil
+}
+
+// newTestProber 返回一个探测器，路径只能通过内层长度不超过 *limit 的消息
+func newTestProber(t *testing.T, limit *int) (*pmtuProber, *routeDevice, api.VpnIP) {
+	logger := logrus.New()
+	_, network, _ := net.ParseCIDR("192.168.100.0/24")
+	localIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 1).To4())
+	peerIP := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+
+	hosts := host.NewHostMap(logger, network, nil)
+	hosts.AddHost(peerIP, &udp.Addr{IP: net.IPv4(10, 0, 0, 2), Port: 4242}, []byte("public key"))
+
+	dev := &routeDevice{routes: map[string]int{}}
+	var p *pmtuProber
+	write := func(b []byte, addr *udp.Addr) error {
+		if len(b)-pmtuOverhead > *limit {
+			return nil
+		}
+		h := &header.Header{}
+		assert.NoError(t, h.Decode(b))
+		assert.Equal(t, header.TestRequest, h.MessageSubtype)
+		size, ok := parsePMTUProbe(b, &packet.Packet{})
+		assert.True(t, ok)
+		go p.ack(peerIP, size)
+		return nil
+	}
+	p = newPMTUProber(config.PMTUConfig{}, logger, hosts, dev, localIP, write)
+	p.timeout = 10 * time.Millisecond
+	return p, dev, peerIP
+}
+
+func TestPMTUProber_Probe(t *testing.T) {
+	limit := 1400
+	p, dev, peerIP := newTestProber(t, &limit)
+	ctx := context.Background()
+
+	p.probe(ctx, peerIP)
+	assert.Equal(t, 1400, p.hosts.MTU(peerIP))
+	assert.Empty(t, dev.routes)
+
+	// 路径变小后安装带 MTU 的主机路由
+	limit = 1350
+	p.probe(ctx, peerIP)
+	assert.Equal(t, 1344, p.hosts.MTU(peerIP))
+	assert.Equal(t, map[string]int{"192.168.100.2/32": 1344}, dev.routes)
+
+	limit = 1300
+	p.probe(ctx, peerIP)
+	assert.Equal(t, 1296, p.hosts.MTU(peerIP))
+	assert.Equal(t, map[string]int{"192.168.100.2/32": 1296}, dev.routes)
+
+	// 连下限都没有回复时路径 MTU 未知
+	limit = 1000
+	p.probe(ctx, peerIP)
+	assert.Zero(t, p.hosts.MTU(peerIP))
+	assert.Empty(t, dev.routes)
+}
+
+func TestPMTUProbe_Reply(t *testing.T) {
+	localIP := api.Ip2VpnIp(net.ParseIP("fd00::1"))
+	peerIP := api.Ip2VpnIp(net.ParseIP("fd00::2"))
+
+	b := buildPMTUProbe(localIP, peerIP, header.TestReply, 1400, 0)
+	pk := &packet.Packet{}
+	size, ok := parsePMTUProbe(b, pk)
+	assert.True(t, ok)
+	assert.Equal(t, 1400, size)
+	assert.Equal(t, localIP, pk.RemoteIP)
+
+	b = buildPMTUProbe(localIP, peerIP, header.TestRequest, 1400, pmtuOverhead+1400)
+	assert.Len(t, b, pmtuOverhead+1400)
+
+	_, ok = parsePMTUProbe(b[:header.Len+packet.Len6], pk)
+	assert.False(t, ok)
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/rules"
+	"github.com/sirupsen/logrus"
+	"reflect"
+)
+
+// restartSettings 修改后需要重启才能生效的配置
+var restartSettings = []struct {
+	name string
+	get  func(c *config.Config) interface{}
+}{
+	{"listen.host", func(c *config.Config) interface{} { return c.Listen.Host }},
+	{"listen.port", func(c *config.Config) interface{} { return c.Listen.Port }},
+	{"listen.batch", func(c *config.Config) interface{} { return c.Listen.Batch }},
+	{"listen.routines", func(c *config.Config) interface{} { return c.Listen.Routines }},
+	{"tun", func(c *config.Config) interface{} { return c.Tun }},
+	{"routes", func(c *config.Config) interface{} { return c.Routes }},
+	{"exit_node", func(c *config.Config) interface{} { return c.ExitNode }},
+	{"split_tunnel", func(c *config.Config) interface{} { return c.SplitTunnel }},
+	{"pmtu", func(c *config.Config) interface{} { return c.PMTU }},
+	{"compression", func(c *config.Config) interface{} { return c.Compression }},
+	{"shaping", func(c *config.Config) interface{} { return c.Shaping }},
+	{"qos", func(c *config.Config) interface{} { return c.QoS }},
+	{"conntrack", func(c *config.Config) interface{} { return c.Conntrack }},
+	{"firewall.events", func(c *config.Config) interface{} { return c.Firewall.Events }},
+	{"lighthouse.enabled", func(c *config.Config) interface{} { return c.Lighthouse.Enabled }},
+	{"lighthouse.interval", func(c *config.Config) interface{} { return c.Lighthouse.Interval }},
+	{"lighthouse.advertise_routes", func(c *config.Config) interface{} { return c.Lighthouse.AdvertiseRoutes }},
+	{"lighthouse.accept_routes", func(c *config.Config) interface{} { return c.Lighthouse.AcceptRoutes }},
+	{"lighthouse.allowed_routes", func(c *config.Config) interface{} { return c.Lighthouse.AllowedRoutes }},
+	{"lighthouse.exit_nodes", func(c *config.Config) interface{} { return c.Lighthouse.ExitNodes }},
+	{"handshake.triggerbuffer", func(c *config.Config) interface{} { return c.Handshake.TriggerBuffer }},
+	{"handshake.userelays", func(c *config.Config) interface{} { return c.Handshake.UseRelays }},
+}
+
+// ParseLogLevel 解析 logging.level，为空时使用 debug
+func ParseLogLevel(level string) (logrus.Level, error) {
+	if level == "" {
+		return logrus.DebugLevel, nil
+	}
+	return logrus.ParseLevel(level)
+}
+
+// reloadConfigFile 重新读取配置文件并应用，失败时继续使用当前配置
+func (c *ControllersManager) reloadConfigFile() {
+	cfg, err := config.Load(c.ConfigFile)
+	if err != nil {
+		c.logger.WithError(err).WithField("config", c.ConfigFile).Error("Failed to load config, keeping the current config")
+		return
+	}
+	if err := c.Reload(cfg); err != nil {
+		c.logger.WithError(err).WithField("config", c.ConfigFile).Error("Failed to reload config, keeping the current config")
+	}
+}
+
+// Reload 在不断开隧道的情况下应用新的配置：防火墙规则、灯塔列表、静态主机映射、握手间隔、
+// 套接字缓冲区与日志级别。其他配置的修改只输出警告，需要重启才能生效。
+// 配置无效时不应用任何修改
+func (c *ControllersManager) Reload(cfg *config.Config) error {
+	level, err := ParseLogLevel(cfg.Logging.Level)
+	if err != nil {
+		return fmt.Errorf("invalid logging.level: %v", err)
+	}
+	for _, action := range []string{cfg.Firewall.InboundAction, cfg.Firewall.OutboundAction} {
+		if !rules.ValidAction(action) {
+			return fmt.Errorf("invalid firewall action %q", action)
+		}
+	}
+
+	for _, s := range restartSettings {
+		if !reflect.DeepEqual(s.get(&c.cfg), s.get(cfg)) {
+			c.logger.WithField("setting", s.name).Warn("Config changed but requires a restart to take effect")
+		}
+	}
+	if removedStaticHosts(c.cfg.StaticHostMap, cfg.StaticHostMap) {
+		c.logger.WithField("setting", "static_host_map").Warn("Removed static host addresses are kept until restart")
+	}
+
+	c.logger.SetLevel(level)
+
+	if c.rules != nil {
+		c.rules.Reload(cfg.Outbound, cfg.Inbound, cfg.Firewall)
+	}
+
+	for _, w := range c.writers {
+		w.ReloadConfig(cfg)
+	}
+
+	if c.handshakeController != nil {
+		c.handshakeController.Reload(cfg.Handshake)
+	}
+
+	if c.outboundController != nil {
+		c.outboundController.configureStaticHostMap(cfg.StaticHostMap)
+		lighthouses := resolveLighthouses(cfg, c.hostMap)
+		c.outboundController.setLighthouseHosts(c.outboundController.getLighthouses(cfg.Lighthouse.Hosts))
+		c.handshakeController.SetLighthouses(lighthouses)
+		c.lighthouseController.SetLighthouses(lighthouseVpnIPs(lighthouses))
+	}
+
+	c.cfg = *cfg
+	c.logger.WithFields(logrus.Fields{
+		"level":         level,
+		"inboundRules":  len(cfg.Inbound),
+		"outboundRules": len(cfg.Outbound),
+		"lighthouses":   len(cfg.Lighthouse.Hosts),
+	}).Info("Config reloaded")
+	return nil
+}
+
+// removedStaticHosts 判断新的静态主机映射是否删除了主机或地址，已经添加到主机地图的地址不会被删除
+func removedStaticHosts(prev, next map[string][]string) bool {
+	for vip, addrs := range prev {
+		for _, addr := range addrs {
+			found := false
+			for _, a := range next[vip] {
+				if a == addr {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return true
+			}
+		}
+	}
+	return false
+}
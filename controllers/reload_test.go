@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/rules"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestControllersManager_Reload(t *testing.T) {
+	logger := logrus.New()
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/24")
+	localVpnIP := api.Ip2VpnIp([]byte{10, 0, 0, 2})
+	hosts := host.NewHostMap(logger, cidr, nil)
+	outbound := &InboundControllers{logger: logger, hosts: hosts}
+	c := &ControllersManager{
+		logger:               logger,
+		hostMap:              hosts,
+		rules:                rules.NewRules(nil, nil),
+		handshakeController:  NewHandshakeController(logger, hosts, &struct{}{}, nil, config.HandshakeConfig{}, localVpnIP, nil, 0, nil),
+		lighthouseController: NewLighthouseController(logger, hosts, nil, false, localVpnIP, nil),
+		outboundController:   outbound,
+	}
+
+	p := &packet.Packet{
+		LocalIP:   localVpnIP,
+		RemoteIP:  api.Ip2VpnIp([]byte{10, 0, 0, 3}),
+		LocalPort: 22,
+		Protocol:  packet.ProtoTCP,
+	}
+	assert.Error(t, c.rules.Inbound(p, nil))
+
+	lighthouse := api.Ip2VpnIp([]byte{10, 0, 0, 1})
+	cfg := &config.Config{
+		StaticHostMap: map[string][]string{"10.0.0.1": {"127.0.0.1:4242"}},
+		Lighthouse:    config.LighthouseConfig{Hosts: []string{"10.0.0.1"}},
+		Handshake:     config.HandshakeConfig{TryInterval: 5 * time.Second},
+		Inbound:       []config.InboundRule{{Port: "22", Proto: "tcp", Action: "allow"}},
+		Logging:       config.LoggingConfig{Level: "info"},
+	}
+	assert.NoError(t, c.Reload(cfg))
+
+	assert.NoError(t, c.rules.Inbound(p, nil))
+	assert.Equal(t, logrus.InfoLevel, logger.GetLevel())
+	assert.Equal(t, 5*time.Second, c.handshakeController.config.Load().TryInterval)
+	assert.True(t, outbound.IsLighthouse(lighthouse))
+	assert.Equal(t, "127.0.0.1:4242", outbound.remoteFor(api.Ip2VpnIp([]byte{10, 0, 0, 9})).String())
+	assert.Equal(t, []api.VpnIP{lighthouse}, c.lighthouseController.lighthouses)
+
+	// 配置无效时不应用任何修改
+	invalid := *cfg
+	invalid.Inbound = nil
+	invalid.Logging.Level = "warn"
+	invalid.Firewall.InboundAction = "drop"
+	assert.Error(t, c.Reload(&invalid))
+	assert.NoError(t, c.rules.Inbound(p, nil))
+	assert.Equal(t, logrus.InfoLevel, logger.GetLevel())
+
+	invalid.Firewall.InboundAction = ""
+	invalid.Logging.Level = "verbose"
+	assert.Error(t, c.Reload(&invalid))
+	assert.NoError(t, c.rules.Inbound(p, nil))
+}
+
+func TestRemovedStaticHosts(t *testing.T) {
+	prev := map[string][]string{"10.0.0.1": {"1.1.1.1:4242", "2.2.2.2:4242"}}
+	assert.False(t, removedStaticHosts(prev, map[string][]string{"10.0.0.1": {"2.2.2.2:4242", "1.1.1.1:4242", "3.3.3.3:4242"}}))
+	assert.True(t, removedStaticHosts(prev, map[string][]string{"10.0.0.1": {"1.1.1.1:4242"}}))
+	assert.True(t, removedStaticHosts(prev, nil))
+}
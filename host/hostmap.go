@@ -4,13 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/api/cert"
 	"github.com/am6737/nexus/transport/protocol/udp"
 	"github.com/am6737/nexus/transport/protocol/udp/header"
 	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type CachedPacket struct {
@@ -63,65 +66,122 @@ func (hm *HostMap) PrintHosts() {
 func (hm *HostMap) DeleteHost(vip api.VpnIP) {
 	hm.Lock()
 	defer hm.Unlock()
+	if h, ok := hm.hosts[vip]; ok && hm.RemoteIndexes[h.RemoteIndexId] == h {
+		delete(hm.RemoteIndexes, h.RemoteIndexId)
+	}
 	delete(hm.hosts, vip)
 }
 
+// UpdateHost 记录从 udpAddr 收到了 vip 的数据包，udpAddr 会成为候选地址，
+// 并在当前路径失效时被提升为主机的远程地址
 func (hm *HostMap) UpdateHost(vip api.VpnIP, udpAddr *udp.Addr) {
 	hm.Lock()
 	defer hm.Unlock()
-	if hostInfo, ok := hm.hosts[vip]; ok {
-		hostInfo.Remote = &udp.Addr{
-			IP:   udpAddr.IP,
-			Port: uint16(udpAddr.Port),
-		}
-	} else {
-		hm.hosts[vip] = &HostInfo{
-			Remote: &udp.Addr{
-				IP:   udpAddr.IP,
-				Port: uint16(udpAddr.Port),
-			},
-			Remotes: RemoteList{},
-			VpnIp:   vip,
-		}
-	}
+	hm.getOrCreate(vip).promote(udpAddr)
 }
 
-func (hm *HostMap) AddHost(vpnIP api.VpnIP, udpAddr *udp.Addr, publicKey []byte) {
+// AddRemote 为 vip 添加一个候选地址，但不认为它已经可达
+func (hm *HostMap) AddRemote(vip api.VpnIP, udpAddr *udp.Addr) {
 	hm.Lock()
 	defer hm.Unlock()
+	hm.getOrCreate(vip).addCandidate(udpAddr)
+}
 
-	newAddr := udpAddr.Copy()
+func (hm *HostMap) AddHost(vpnIP api.VpnIP, udpAddr *udp.Addr, publicKey []byte) {
+	hm.Lock()
+	defer hm.Unlock()
 
 	hm.logger.WithFields(logrus.Fields{
 		"vpnIP": vpnIP,
-		"addr":  newAddr,
+		"addr":  udpAddr,
 		//"publicKey": string(publicKey),
 	}).Info("Add new host")
 
-	host, ok := hm.hosts[vpnIP]
-	if !ok {
-		hm.hosts[vpnIP] = &HostInfo{
-			Remote:    newAddr,
-			VpnIp:     vpnIP,
-			PublicKey: string(publicKey),
-		}
-		return
-	}
-	host.Remote = udpAddr
+	host := hm.getOrCreate(vpnIP)
+	host.promote(udpAddr)
 	host.PublicKey = string(publicKey)
+}
+
+// SetRoutes 记录 vip 通告的网段
+func (hm *HostMap) SetRoutes(vip api.VpnIP, routes []netip.Prefix) {
+	hm.Lock()
+	defer hm.Unlock()
+	hm.getOrCreate(vip).Routes = routes
+}
+
+// SetExitNode 记录 vip 是否为出口节点
+func (hm *HostMap) SetExitNode(vip api.VpnIP, exitNode bool) {
+	hm.Lock()
+	defer hm.Unlock()
+	hm.getOrCreate(vip).ExitNode = exitNode
+}
 
-	//if host.Remote == nil {
-	//	host.Remote = newAddr
-	//} else {
-	//	if host.Remote.IP.String() != newAddr.IP.String() || host.Remote.Port != newAddr.Port {
-	//		hm.logger.WithFields(logrus.Fields{
-	//			"vpnIP":    vpnIP,
-	//			"old addr": host.Remote,
-	//			"new addr": newAddr,
-	//		}).Info("Update host addr")
-	//		host.Remote = newAddr
-	//	}
-	//}
+// SetMTU 记录到 vip 的路径 MTU，为 0 表示未知
+func (hm *HostMap) SetMTU(vip api.VpnIP, mtu int) {
+	hm.Lock()
+	defer hm.Unlock()
+	hm.getOrCreate(vip).MTU = mtu
+}
+
+// MTU 返回到 vip 的路径 MTU，未知时返回 0
+func (hm *HostMap) MTU(vip api.VpnIP) int {
+	hm.RLock()
+	defer hm.RUnlock()
+	if h, ok := hm.hosts[vip]; ok {
+		return h.MTU
+	}
+	return 0
+}
+
+// SetCompression 记录 vip 在握手时通告的可以解压的算法的位图
+func (hm *HostMap) SetCompression(vip api.VpnIP, supported uint16) {
+	hm.Lock()
+	defer hm.Unlock()
+	hm.getOrCreate(vip).Compression = supported
+}
+
+// Compression 返回 vip 可以解压的算法的位图，未知的主机返回 0
+func (hm *HostMap) Compression(vip api.VpnIP) uint16 {
+	hm.RLock()
+	defer hm.RUnlock()
+	if h, ok := hm.hosts[vip]; ok {
+		return h.Compression
+	}
+	return 0
+}
+
+// SetRemoteIndex 记录 vip 在握手时发送的 index，之后收到的数据消息按头部的 index 找到发送方。
+// index 已经属于另一个主机时返回错误，不覆盖该主机的记录
+func (hm *HostMap) SetRemoteIndex(vip api.VpnIP, index uint32) error {
+	hm.Lock()
+	defer hm.Unlock()
+	if other, ok := hm.RemoteIndexes[index]; ok && other.VpnIp != vip {
+		return fmt.Errorf("index %d is already used by %s", index, other.VpnIp)
+	}
+	h := hm.getOrCreate(vip)
+	if hm.RemoteIndexes[h.RemoteIndexId] == h {
+		delete(hm.RemoteIndexes, h.RemoteIndexId)
+	}
+	h.RemoteIndexId = index
+	hm.RemoteIndexes[index] = h
+	return nil
+}
+
+// QueryIndex 返回在握手时发送了 index 的主机，没有时返回 nil
+func (hm *HostMap) QueryIndex(index uint32) *HostInfo {
+	hm.RLock()
+	defer hm.RUnlock()
+	return hm.RemoteIndexes[index]
+}
+
+// getOrCreate 调用方必须持有写锁
+func (hm *HostMap) getOrCreate(vip api.VpnIP) *HostInfo {
+	host, ok := hm.hosts[vip]
+	if !ok {
+		host = &HostInfo{VpnIp: vip}
+		hm.hosts[vip] = host
+	}
+	return host
 }
 
 func (hm *HostMap) QueryVpnIp(vpnIp api.VpnIP) *HostInfo {
@@ -175,18 +235,56 @@ func (hm *HostMap) GetRemoteAddrList(vpnIP api.VpnIP) []*udp.Addr {
 	return nil
 }
 
-// GetRemoteAddrList 返回主机的远程地址列表
+// GetRemoteAddrList 返回主机的远程地址列表，当前使用的地址排在最前面，
+// 其余候选地址（可能混合 IPv4 与 IPv6）按添加顺序排列
 func (h *HostInfo) GetRemoteAddrList() []*udp.Addr {
 	h.Remotes.RLock()
 	defer h.Remotes.RUnlock()
 
-	// 检查主机是否有单个远程地址
+	addrs := make([]*udp.Addr, 0, len(h.Remotes.addrs)+1)
 	if h.Remote != nil {
-		return []*udp.Addr{h.Remote}
+		addrs = append(addrs, h.Remote)
+	}
+	for _, addr := range h.Remotes.addrs {
+		if h.Remote == nil || !addr.Equal(h.Remote) {
+			addrs = append(addrs, addr)
+		}
 	}
+	return addrs
+}
+
+// addCandidate 添加候选地址，如果主机还没有远程地址则先使用它
+func (h *HostInfo) addCandidate(addr *udp.Addr) {
+	h.Remotes.Lock()
+	defer h.Remotes.Unlock()
 
-	// 返回 RemoteList 中的地址列表
-	return h.Remotes.addrs
+	h.Remotes.add(addr)
+	if h.Remote == nil {
+		h.Remote = addr.Copy()
+	}
+}
+
+// promote 记录 addr 可达。当前路径仍然有效时保持不变，避免在两个可用的地址族之间来回切换；
+// 当前路径长时间没有收到数据时切换到 addr
+func (h *HostInfo) promote(addr *udp.Addr) {
+	h.Remotes.Lock()
+	defer h.Remotes.Unlock()
+
+	now := time.Now()
+	h.Remotes.lastSeen[h.Remotes.add(addr)] = now
+
+	if h.Remote != nil && h.Remote.Equal(addr) {
+		return
+	}
+	if h.Remote == nil || now.Sub(h.Remotes.seen(h.Remote)) > RemoteStaleAfter {
+		h.Remote = addr.Copy()
+	}
+}
+
+// Seen 记录从 addr 收到了该主机经过认证的消息，数据路径上的每个消息都会刷新所在路径的时间，
+// 已有的地址不会分配内存
+func (h *HostInfo) Seen(addr *udp.Addr) {
+	h.promote(addr)
 }
 
 type HostInfo struct {
@@ -196,6 +294,16 @@ type HostInfo struct {
 	RemoteIndexId uint32
 	LocalIndexId  uint32
 	VpnIp         api.VpnIP
+	// Routes 该节点通过灯塔通告的、可以由它转发的网段
+	Routes []netip.Prefix
+	// ExitNode 该节点是否通告自己为出口节点
+	ExitNode bool
+	// MTU 探测到的到该节点的路径 MTU（内层数据包的最大长度），为 0 表示未知
+	MTU int `json:"-"`
+	// Compression 该节点在握手时通告的可以解压的算法的位图
+	Compression uint16 `json:"-"`
+	// Cert 该节点的主机证书，防火墙按证书中的名称与组匹配规则。握手目前不交换证书，没有证书时为 nil
+	Cert *cert.NebulaCertificate `json:"-"`
 }
 
 func (h *HostInfo) String() string {
@@ -206,6 +314,9 @@ func (h *HostInfo) String() string {
 	return string(marshal)
 }
 
+// RemoteStaleAfter 当前路径超过该时长没有收到数据时，允许切换到其他可达的候选地址
+var RemoteStaleAfter = 2 * time.Minute
+
 // RemoteList is a unifying concept for lighthouse servers and clients as well as hostinfos.
 // It serves as a local cache of query replies, host update notifications, and locally learned addresses
 type RemoteList struct {
@@ -214,6 +325,57 @@ type RemoteList struct {
 
 	// A deduplicated set of addresses. Any accessor should lock beforehand.
 	addrs []*udp.Addr
+
+	// lastSeen 与 addrs 一一对应，最后一次从该地址收到经过认证的消息的时间，零值表示还没有收到过
+	lastSeen []time.Time
+}
+
+// add 添加地址并返回它在 addrs 中的序号，调用方必须持有写锁
+func (r *RemoteList) add(addr *udp.Addr) int {
+	for i, a := range r.addrs {
+		if a.Equal(addr) {
+			return i
+		}
+	}
+	r.addrs = append(r.addrs, addr.Copy())
+	r.lastSeen = append(r.lastSeen, time.Time{})
+	return len(r.addrs) - 1
+}
+
+// seen 返回最后一次从 addr 收到消息的时间，调用方必须持有锁
+func (r *RemoteList) seen(addr *udp.Addr) time.Time {
+	for i, a := range r.addrs {
+		if a.Equal(addr) {
+			return r.lastSeen[i]
+		}
+	}
+	return time.Time{}
+}
+
+// MarshalJSON 只导出候选地址，灯塔通过它把对端的全部地址同步给其他节点
+func (r *RemoteList) MarshalJSON() ([]byte, error) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.addrs == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(r.addrs)
+}
+
+func (r *RemoteList) UnmarshalJSON(data []byte) error {
+	var addrs []*udp.Addr
+	if err := json.Unmarshal(data, &addrs); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, addr := range addrs {
+		if addr != nil {
+			r.add(addr)
+		}
+	}
+	return nil
 }
 
 type ConnectionState struct {
@@ -0,0 +1,91 @@
+package host
+
+import (
+	"encoding/json"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/transport/protocol/udp"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostMap_MixedFamilyRemotes(t *testing.T) {
+	hm := NewHostMap(logrus.New(), nil, nil)
+	vip, _ := api.ParseVpnIp("192.168.100.2")
+
+	v4 := &udp.Addr{IP: net.ParseIP("203.0.113.10"), Port: 4242}
+	v6 := &udp.Addr{IP: net.ParseIP("2001:db8::10"), Port: 4242}
+
+	hm.AddRemote(vip, v4)
+	hm.AddRemote(vip, v6)
+	hm.AddRemote(vip, &udp.Addr{IP: net.ParseIP("203.0.113.10").To16(), Port: 4242})
+
+	addrs := hm.GetRemoteAddrList(vip)
+	assert.Len(t, addrs, 2)
+	assert.True(t, addrs[0].Equal(v4))
+	assert.True(t, addrs[1].Equal(v6))
+
+	// 当前路径仍然有效时，收到另一个地址族的数据包不会切换路径
+	hm.UpdateHost(vip, v4)
+	hm.UpdateHost(vip, v6)
+	assert.True(t, hm.QueryVpnIp(vip).Remote.Equal(v4))
+
+	// 当前路径失效后切换到新的地址
+	info := hm.QueryVpnIp(vip)
+	info.Remotes.lastSeen[0] = time.Now().Add(-2 * RemoteStaleAfter)
+	hm.UpdateHost(vip, v6)
+	assert.True(t, hm.QueryVpnIp(vip).Remote.Equal(v6))
+	assert.True(t, hm.GetRemoteAddrList(vip)[1].Equal(v4))
+
+	// 灯塔同步时需要携带全部候选地址
+	data, err := json.Marshal(hm.GetAllHostMap())
+	assert.NoError(t, err)
+	var synced map[api.VpnIP]*HostInfo
+	assert.NoError(t, json.Unmarshal(data, &synced))
+	assert.Len(t, synced[vip].GetRemoteAddrList(), 2)
+}
+
+// TestHostInfo_Seen 数据路径上收到的消息使当前路径保持有效，与灯塔同步的时间无关
+func TestHostInfo_Seen(t *testing.T) {
+	hm := NewHostMap(logrus.New(), nil, nil)
+	vip, _ := api.ParseVpnIp("192.168.100.2")
+	v4 := &udp.Addr{IP: net.ParseIP("203.0.113.10"), Port: 4242}
+	v6 := &udp.Addr{IP: net.ParseIP("2001:db8::10"), Port: 4242}
+
+	hm.UpdateHost(vip, v4)
+	info := hm.QueryVpnIp(vip)
+	info.Remotes.lastSeen[0] = time.Now().Add(-2 * RemoteStaleAfter)
+
+	info.Seen(v4)
+	hm.UpdateHost(vip, v6)
+	assert.True(t, info.Remote.Equal(v4))
+
+	allocs := testing.AllocsPerRun(100, func() { info.Seen(v4) })
+	assert.Zero(t, allocs)
+}
+
+func TestHostMap_RemoteIndex(t *testing.T) {
+	hm := NewHostMap(logrus.New(), nil, nil)
+	a, _ := api.ParseVpnIp("192.168.100.2")
+	b, _ := api.ParseVpnIp("192.168.100.3")
+
+	assert.Nil(t, hm.QueryIndex(1))
+	assert.NoError(t, hm.SetRemoteIndex(a, 1))
+	assert.Equal(t, a, hm.QueryIndex(1).VpnIp)
+
+	// 其他主机不能使用已经属于 a 的 index
+	assert.Error(t, hm.SetRemoteIndex(b, 1))
+	assert.Equal(t, a, hm.QueryIndex(1).VpnIp)
+
+	// 重新握手后旧的 index 不再对应 a
+	assert.NoError(t, hm.SetRemoteIndex(a, 2))
+	assert.Nil(t, hm.QueryIndex(1))
+	assert.Equal(t, a, hm.QueryIndex(2).VpnIp)
+	assert.NoError(t, hm.SetRemoteIndex(b, 1))
+
+	hm.DeleteHost(a)
+	assert.Nil(t, hm.QueryIndex(2))
+	assert.Equal(t, b, hm.QueryIndex(1).VpnIp)
+}
@@ -0,0 +1,8 @@
+package nat
+
+import (
+	"github.com/am6737/nexus/api"
+)
+
+// WriteFunc 把转换回客户端地址的数据包发送给 peer
+type WriteFunc func(peer api.VpnIP, p []byte) error
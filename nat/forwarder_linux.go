@@ -0,0 +1,194 @@
+//go:build linux && !android
+// +build linux,!android
+
+package nat
+
+import (
+	"errors"
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Forwarder 出口节点的转发器。经过 NAT 的数据包通过原始套接字从物理网卡发出，
+// 互联网返回的数据包同样从原始套接字读取，转换回客户端地址后交给 WriteFunc
+type Forwarder struct {
+	table   *Table
+	l       *logrus.Logger
+	sendFd  int
+	recvFds []int
+	closed  atomic.Bool
+
+	// UDP 映射占用的本地端口，避免内核对返回的数据包回复 ICMP 端口不可达
+	udpMu    sync.Mutex
+	udpPorts map[uint16]int
+
+	resetRule []string
+}
+
+func NewForwarder(l *logrus.Logger, table *Table) (*Forwarder, error) {
+	// IPPROTO_RAW 隐含 IP_HDRINCL，发送的数据包需要带有完整的 IP 头
+	sendFd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create raw socket: %w", err)
+	}
+
+	f := &Forwarder{
+		table:    table,
+		l:        l,
+		sendFd:   sendFd,
+		udpPorts: make(map[uint16]int),
+	}
+	for _, proto := range []int{unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_ICMP} {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, proto)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("unable to create raw socket for protocol %d: %w", proto, err)
+		}
+		f.recvFds = append(f.recvFds, fd)
+	}
+
+	f.suppressResets()
+	return f, nil
+}
+
+// suppressResets 内核不知道 NAT 分配的 TCP 端口，收到返回的数据包时会回复 RST 中断连接，
+// 这里通过 iptables 丢弃这些端口发出的 RST
+func (f *Forwarder) suppressResets() {
+	min, max := f.table.Ports()
+	f.resetRule = []string{
+		"OUTPUT",
+		"-s", f.table.External().String(),
+		"-p", "tcp", "--sport", fmt.Sprintf("%d:%d", min, max),
+		"--tcp-flags", "RST", "RST",
+		"-j", "DROP",
+	}
+	args := append([]string{"-w", "-I"}, f.resetRule...)
+	if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		f.l.WithError(err).
+			WithField("output", string(out)).
+			Warn("Failed to install iptables rule, TCP connections through the exit node will be reset by the kernel")
+		f.resetRule = nil
+	}
+}
+
+// Send 对 peer 发来的数据包做源地址转换并发往互联网
+func (f *Forwarder) Send(peer api.VpnIP, p []byte) error {
+	m, created, err := f.table.Outbound(peer, p)
+	if err != nil {
+		return err
+	}
+	if created && m.Proto == packet.ProtoUDP {
+		f.reserveUDP(m)
+	}
+
+	sa := &unix.SockaddrInet4{}
+	copy(sa.Addr[:], p[16:20])
+	return unix.Sendto(f.sendFd, p, 0, sa)
+}
+
+// Start 开始接收互联网返回的数据包并定期清理超时的映射
+func (f *Forwarder) Start(w WriteFunc) {
+	for _, fd := range f.recvFds {
+		go f.listen(fd, w)
+	}
+	go f.expire()
+}
+
+func (f *Forwarder) listen(fd int, w WriteFunc) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if f.closed.Load() {
+				return
+			}
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			f.l.WithError(err).Error("Failed to read from raw socket")
+			return
+		}
+
+		m, err := f.table.Inbound(buf[:n])
+		if err != nil {
+			continue
+		}
+		if err := w(m.Peer, buf[:n]); err != nil {
+			f.l.WithError(err).WithField("peer", m.Peer).Debug("Failed to forward nat reply")
+		}
+	}
+}
+
+func (f *Forwarder) expire() {
+	ticker := time.NewTicker(ICMPTimeout)
+	defer ticker.Stop()
+	for range ticker.C {
+		if f.closed.Load() {
+			return
+		}
+		for _, m := range f.table.Expire() {
+			if m.Proto == packet.ProtoUDP {
+				f.releaseUDP(m)
+			}
+		}
+	}
+}
+
+func (f *Forwarder) reserveUDP(m *Mapping) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		f.l.WithError(err).Debug("Failed to reserve nat udp port")
+		return
+	}
+	sa := &unix.SockaddrInet4{Port: int(m.External.Port()), Addr: m.External.Addr().As4()}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		f.l.WithError(err).WithField("port", m.External.Port()).Debug("Failed to reserve nat udp port")
+		return
+	}
+	// 原始套接字会收到数据包的副本，这里的套接字只用来占用端口
+	_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, 0)
+
+	f.udpMu.Lock()
+	f.udpPorts[m.External.Port()] = fd
+	f.udpMu.Unlock()
+}
+
+func (f *Forwarder) releaseUDP(m *Mapping) {
+	f.udpMu.Lock()
+	defer f.udpMu.Unlock()
+	if fd, ok := f.udpPorts[m.External.Port()]; ok {
+		unix.Close(fd)
+		delete(f.udpPorts, m.External.Port())
+	}
+}
+
+func (f *Forwarder) Close() error {
+	f.closed.Store(true)
+
+	if f.resetRule != nil {
+		args := append([]string{"-w", "-D"}, f.resetRule...)
+		if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+			f.l.WithError(err).WithField("output", string(out)).Warn("Failed to remove iptables rule")
+		}
+	}
+
+	f.udpMu.Lock()
+	for port, fd := range f.udpPorts {
+		unix.Close(fd)
+		delete(f.udpPorts, port)
+	}
+	f.udpMu.Unlock()
+
+	for _, fd := range f.recvFds {
+		unix.Close(fd)
+	}
+	return unix.Close(f.sendFd)
+}
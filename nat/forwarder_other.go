@@ -0,0 +1,27 @@
+//go:build !linux || android
+// +build !linux android
+
+package nat
+
+import (
+	"errors"
+	"github.com/am6737/nexus/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Forwarder 出口节点目前仅支持 Linux
+type Forwarder struct{}
+
+func NewForwarder(l *logrus.Logger, table *Table) (*Forwarder, error) {
+	return nil, errors.New("exit node mode is only supported on linux")
+}
+
+func (f *Forwarder) Send(peer api.VpnIP, p []byte) error {
+	return errors.New("exit node mode is only supported on linux")
+}
+
+func (f *Forwarder) Start(w WriteFunc) {}
+
+func (f *Forwarder) Close() error {
+	return nil
+}
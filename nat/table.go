@@ -0,0 +1,329 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/transport/packet"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnsupported = errors.New("unsupported packet")
+	ErrNoMapping   = errors.New("no nat mapping")
+	ErrPortsFull   = errors.New("nat port range exhausted")
+)
+
+// DefaultPorts 默认的 NAT 端口范围，位于 Linux 默认临时端口范围（32768-60999）之外
+const DefaultPorts = "61000-65535"
+
+var (
+	TCPTimeout  = 30 * time.Minute
+	UDPTimeout  = 2 * time.Minute
+	ICMPTimeout = 30 * time.Second
+)
+
+const (
+	tcpHeaderLen    = 20
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+)
+
+type internalKey struct {
+	proto    uint8
+	peer     api.VpnIP
+	internal netip.AddrPort
+}
+
+type externalKey struct {
+	proto uint8
+	port  uint16
+}
+
+// Mapping 一条 NAT 映射，ICMP echo 使用 identifier 作为端口
+type Mapping struct {
+	Proto uint8
+	// Peer 发出数据包的节点，回复会发送给它
+	Peer     api.VpnIP
+	Internal netip.AddrPort
+	External netip.AddrPort
+
+	lastSeen time.Time
+}
+
+// Table 类似 conntrack 的 IPv4 源地址转换表。
+// 客户端的每个 (协议, 源地址, 源端口) 分配一个出口端口，回复按 (协议, 出口端口) 转换回客户端
+type Table struct {
+	mu       sync.Mutex
+	external netip.Addr
+	portMin  uint16
+	portMax  uint16
+	next     uint16
+
+	byInternal map[internalKey]*Mapping
+	byExternal map[externalKey]*Mapping
+
+	now func() time.Time
+}
+
+func NewTable(external netip.Addr, portMin, portMax uint16) (*Table, error) {
+	if !external.Is4() {
+		return nil, fmt.Errorf("nat address %s is not an IPv4 address", external)
+	}
+	if portMin == 0 || portMin > portMax {
+		return nil, fmt.Errorf("invalid nat port range %d-%d", portMin, portMax)
+	}
+	return &Table{
+		external:   external,
+		portMin:    portMin,
+		portMax:    portMax,
+		next:       portMin,
+		byInternal: make(map[internalKey]*Mapping),
+		byExternal: make(map[externalKey]*Mapping),
+		now:        time.Now,
+	}, nil
+}
+
+// ParsePorts 解析 "61000-65535" 形式的端口范围
+func ParsePorts(s string) (uint16, uint16, error) {
+	if s == "" {
+		s = DefaultPorts
+	}
+	lo, hi, _ := strings.Cut(s, "-")
+	min, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid nat port range %s: %v", s, err)
+	}
+	max := min
+	if hi != "" {
+		if max, err = strconv.ParseUint(strings.TrimSpace(hi), 10, 16); err != nil {
+			return 0, 0, fmt.Errorf("invalid nat port range %s: %v", s, err)
+		}
+	}
+	if min == 0 || min > max {
+		return 0, 0, fmt.Errorf("invalid nat port range %s", s)
+	}
+	return uint16(min), uint16(max), nil
+}
+
+// External 返回 NAT 使用的出口地址
+func (t *Table) External() netip.Addr {
+	return t.external
+}
+
+// Ports 返回 NAT 分配的端口范围
+func (t *Table) Ports() (uint16, uint16) {
+	return t.portMin, t.portMax
+}
+
+// Outbound 把 peer 发往互联网的 IPv4 数据包的源地址改写为出口地址，
+// created 表示是否为该数据包新建了映射
+func (t *Table) Outbound(peer api.VpnIP, p []byte) (m *Mapping, created bool, err error) {
+	ihl, proto, err := parseHeader(p)
+	if err != nil {
+		return nil, false, err
+	}
+	port, ok := localPort(p, ihl, proto, true)
+	if !ok {
+		return nil, false, ErrUnsupported
+	}
+
+	src := netip.AddrFrom4([4]byte(p[12:16]))
+	key := internalKey{proto: proto, peer: peer, internal: netip.AddrPortFrom(src, port)}
+
+	t.mu.Lock()
+	m, ok = t.byInternal[key]
+	if !ok {
+		ext, err := t.allocate(proto)
+		if err != nil {
+			t.mu.Unlock()
+			return nil, false, err
+		}
+		m = &Mapping{Proto: proto, Peer: peer, Internal: key.internal, External: netip.AddrPortFrom(t.external, ext)}
+		t.byInternal[key] = m
+		t.byExternal[externalKey{proto: proto, port: ext}] = m
+		created = true
+	}
+	m.lastSeen = t.now()
+	t.mu.Unlock()
+
+	rewrite(p, ihl, proto, 12, m.External, true)
+	return m, created, nil
+}
+
+// Inbound 把互联网返回的 IPv4 数据包的目的地址改写回客户端地址，返回对应的映射
+func (t *Table) Inbound(p []byte) (*Mapping, error) {
+	ihl, proto, err := parseHeader(p)
+	if err != nil {
+		return nil, err
+	}
+	if netip.AddrFrom4([4]byte(p[16:20])) != t.external {
+		return nil, ErrNoMapping
+	}
+	port, ok := localPort(p, ihl, proto, false)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	t.mu.Lock()
+	m, ok := t.byExternal[externalKey{proto: proto, port: port}]
+	if ok {
+		m.lastSeen = t.now()
+	}
+	t.mu.Unlock()
+	if !ok {
+		return nil, ErrNoMapping
+	}
+
+	rewrite(p, ihl, proto, 16, m.Internal, false)
+	return m, nil
+}
+
+// Expire 删除超时的映射并返回它们
+func (t *Table) Expire() []*Mapping {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var expired []*Mapping
+	for k, m := range t.byInternal {
+		if now.Sub(m.lastSeen) < timeout(m.Proto) {
+			continue
+		}
+		delete(t.byInternal, k)
+		delete(t.byExternal, externalKey{proto: m.Proto, port: m.External.Port()})
+		expired = append(expired, m)
+	}
+	return expired
+}
+
+// Len 返回当前的映射数量
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byInternal)
+}
+
+// allocate 调用方必须持有锁
+func (t *Table) allocate(proto uint8) (uint16, error) {
+	size := int(t.portMax-t.portMin) + 1
+	for i := 0; i < size; i++ {
+		port := t.next
+		if t.next == t.portMax {
+			t.next = t.portMin
+		} else {
+			t.next++
+		}
+		if _, ok := t.byExternal[externalKey{proto: proto, port: port}]; !ok {
+			return port, nil
+		}
+	}
+	return 0, ErrPortsFull
+}
+
+func timeout(proto uint8) time.Duration {
+	switch proto {
+	case packet.ProtoTCP:
+		return TCPTimeout
+	case packet.ProtoUDP:
+		return UDPTimeout
+	}
+	return ICMPTimeout
+}
+
+// parseHeader 返回 IPv4 头部的长度与协议。改写时需要访问的头部必须完整地位于数据包内，
+// 数据包的长度以总长度字段与实际长度中较小的为准
+func parseHeader(p []byte) (int, uint8, error) {
+	if len(p) < packet.Len || p[0]>>4 != 4 {
+		return 0, 0, ErrUnsupported
+	}
+	ihl := int(p[0]&0x0f) << 2
+	total := int(binary.BigEndian.Uint16(p[2:4]))
+	if total > len(p) {
+		total = len(p)
+	}
+	need := ihl + 8
+	if p[9] == packet.ProtoTCP {
+		need = ihl + tcpHeaderLen
+	}
+	// 分片只有第一个分片带有端口，无法转换
+	if ihl < packet.Len || total < need || binary.BigEndian.Uint16(p[6:8])&0x3fff != 0 {
+		return 0, 0, ErrUnsupported
+	}
+	return ihl, p[9], nil
+}
+
+// localPort 返回 NAT 一侧的端口：出站为源端口，入站为目的端口，ICMP echo 为 identifier
+func localPort(p []byte, ihl int, proto uint8, outbound bool) (uint16, bool) {
+	switch proto {
+	case packet.ProtoTCP, packet.ProtoUDP:
+		if outbound {
+			return binary.BigEndian.Uint16(p[ihl : ihl+2]), true
+		}
+		return binary.BigEndian.Uint16(p[ihl+2 : ihl+4]), true
+	case packet.ProtoICMP:
+		want := byte(icmpEchoRequest)
+		if !outbound {
+			want = icmpEchoReply
+		}
+		if p[ihl] != want {
+			return 0, false
+		}
+		return binary.BigEndian.Uint16(p[ihl+4 : ihl+6]), true
+	}
+	return 0, false
+}
+
+// rewrite 把 addrOff 处的地址与对应的端口改写为 to，并增量更新校验和（RFC 1624）
+func rewrite(p []byte, ihl int, proto uint8, addrOff int, to netip.AddrPort, outbound bool) {
+	var old [6]byte
+	copy(old[:4], p[addrOff:addrOff+4])
+
+	portOff := ihl + 2
+	if outbound {
+		portOff = ihl
+	}
+	if proto == packet.ProtoICMP {
+		portOff = ihl + 4
+	}
+	copy(old[4:], p[portOff:portOff+2])
+
+	var next [6]byte
+	addr := to.Addr().As4()
+	copy(next[:4], addr[:])
+	binary.BigEndian.PutUint16(next[4:], to.Port())
+
+	copy(p[addrOff:addrOff+4], next[:4])
+	copy(p[portOff:portOff+2], next[4:])
+	updateChecksum(p[10:12], old[:4], next[:4])
+
+	switch proto {
+	case packet.ProtoTCP:
+		updateChecksum(p[ihl+16:ihl+18], old[:], next[:])
+	case packet.ProtoUDP:
+		// 校验和为 0 表示没有计算校验和
+		if binary.BigEndian.Uint16(p[ihl+6:ihl+8]) != 0 {
+			updateChecksum(p[ihl+6:ihl+8], old[:], next[:])
+		}
+	case packet.ProtoICMP:
+		// ICMP 校验和不包含伪首部
+		updateChecksum(p[ihl+2:ihl+4], old[4:], next[4:])
+	}
+}
+
+func updateChecksum(sum []byte, old, next []byte) {
+	acc := uint32(^binary.BigEndian.Uint16(sum))
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:]))
+		acc += uint32(binary.BigEndian.Uint16(next[i:]))
+	}
+	for acc > 0xffff {
+		acc = acc>>16 + acc&0xffff
+	}
+	binary.BigEndian.PutUint16(sum, ^uint16(acc))
+}
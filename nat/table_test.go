@@ -0,0 +1,194 @@
+package nat
+
+import (
+	"encoding/binary"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func pseudoHeader(p []byte, proto uint8, length int) uint32 {
+	var sum uint32
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(p[i:]))
+	}
+	return sum + uint32(proto) + uint32(length)
+}
+
+// buildPacket 构造带有正确校验和的 IPv4 数据包，ICMP 使用 echo 请求/回复
+func buildPacket(proto uint8, src, dst netip.AddrPort, icmpType byte) []byte {
+	l4 := 8
+	if proto == packet.ProtoTCP {
+		l4 = 20
+	}
+	p := make([]byte, 20+l4+4)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[8] = 64
+	p[9] = proto
+	s, d := src.Addr().As4(), dst.Addr().As4()
+	copy(p[12:16], s[:])
+	copy(p[16:20], d[:])
+	copy(p[20+l4:], "ping")
+
+	b := p[20:]
+	switch proto {
+	case packet.ProtoTCP, packet.ProtoUDP:
+		binary.BigEndian.PutUint16(b[0:], src.Port())
+		binary.BigEndian.PutUint16(b[2:], dst.Port())
+		off := 6
+		if proto == packet.ProtoTCP {
+			b[12] = 5 << 4
+			off = 16
+		} else {
+			binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+		}
+		binary.BigEndian.PutUint16(b[off:], checksum(b, pseudoHeader(p, proto, len(b))))
+	case packet.ProtoICMP:
+		b[0] = icmpType
+		binary.BigEndian.PutUint16(b[4:], src.Port()|dst.Port())
+		binary.BigEndian.PutUint16(b[2:], checksum(b, 0))
+	}
+	binary.BigEndian.PutUint16(p[10:], checksum(p[:20], 0))
+	return p
+}
+
+func assertChecksums(t *testing.T, p []byte) {
+	assert.Equal(t, uint16(0), checksum(p[:20], 0), "ip checksum")
+	b := p[20:]
+	switch p[9] {
+	case packet.ProtoTCP, packet.ProtoUDP:
+		assert.Equal(t, uint16(0), checksum(b, pseudoHeader(p, p[9], len(b))), "l4 checksum")
+	case packet.ProtoICMP:
+		assert.Equal(t, uint16(0), checksum(b, 0), "icmp checksum")
+	}
+}
+
+func TestTable_OutboundInbound(t *testing.T) {
+	external := netip.MustParseAddr("203.0.113.1")
+	table, err := NewTable(external, 61000, 61001)
+	assert.NoError(t, err)
+
+	peer, _ := api.ParseVpnIp("192.168.100.2")
+	client := netip.MustParseAddrPort("192.168.100.2:40000")
+	server := netip.MustParseAddrPort("1.1.1.1:443")
+
+	for _, proto := range []uint8{packet.ProtoTCP, packet.ProtoUDP, packet.ProtoICMP} {
+		p := buildPacket(proto, client, server, icmpEchoRequest)
+		m, created, err := table.Outbound(peer, p)
+		assert.NoError(t, err)
+		assert.True(t, created)
+		assert.Equal(t, external, netip.AddrFrom4([4]byte(p[12:16])))
+		assertChecksums(t, p)
+
+		// 同一个流复用映射
+		p = buildPacket(proto, client, server, icmpEchoRequest)
+		m2, created, err := table.Outbound(peer, p)
+		assert.NoError(t, err)
+		assert.False(t, created)
+		assert.Same(t, m, m2)
+
+		reply := buildPacket(proto, server, m.External, icmpEchoReply)
+		if proto == packet.ProtoICMP {
+			reply = buildPacket(proto, netip.AddrPortFrom(server.Addr(), 0), m.External, icmpEchoReply)
+		}
+		rm, err := table.Inbound(reply)
+		assert.NoError(t, err)
+		assert.Equal(t, peer, rm.Peer)
+		assert.Equal(t, client.Addr(), netip.AddrFrom4([4]byte(reply[16:20])))
+		if proto != packet.ProtoICMP {
+			assert.Equal(t, client.Port(), binary.BigEndian.Uint16(reply[22:24]))
+		}
+		assertChecksums(t, reply)
+	}
+
+	// 端口范围耗尽
+	other := netip.MustParseAddrPort("192.168.100.2:40001")
+	_, _, err = table.Outbound(peer, buildPacket(packet.ProtoUDP, other, server, 0))
+	assert.NoError(t, err)
+	_, _, err = table.Outbound(peer, buildPacket(packet.ProtoUDP, netip.MustParseAddrPort("192.168.100.2:40002"), server, 0))
+	assert.ErrorIs(t, err, ErrPortsFull)
+
+	// 没有映射的数据包
+	_, err = table.Inbound(buildPacket(packet.ProtoTCP, server, netip.AddrPortFrom(external, 61001), 0))
+	assert.ErrorIs(t, err, ErrNoMapping)
+}
+
+func TestTable_Expire(t *testing.T) {
+	table, err := NewTable(netip.MustParseAddr("203.0.113.1"), 61000, 65535)
+	assert.NoError(t, err)
+	now := time.Now()
+	table.now = func() time.Time { return now }
+
+	peer, _ := api.ParseVpnIp("192.168.100.2")
+	server := netip.MustParseAddrPort("1.1.1.1:53")
+	_, _, err = table.Outbound(peer, buildPacket(packet.ProtoUDP, netip.MustParseAddrPort("192.168.100.2:40000"), server, 0))
+	assert.NoError(t, err)
+	_, _, err = table.Outbound(peer, buildPacket(packet.ProtoTCP, netip.MustParseAddrPort("192.168.100.2:40000"), server, 0))
+	assert.NoError(t, err)
+
+	now = now.Add(UDPTimeout)
+	expired := table.Expire()
+	assert.Len(t, expired, 1)
+	assert.Equal(t, uint8(packet.ProtoUDP), expired[0].Proto)
+	assert.Equal(t, 1, table.Len())
+}
+
+func TestParsePorts(t *testing.T) {
+	min, max, err := ParsePorts("")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(61000), min)
+	assert.Equal(t, uint16(65535), max)
+
+	for _, s := range []string{"0-10", "20-10", "a-b", "70000"} {
+		_, _, err := ParsePorts(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// TestTable_Truncated 被截断或者总长度字段不足的数据包不改写，也不越界写入
+func TestTable_Truncated(t *testing.T) {
+	table, err := NewTable(netip.MustParseAddr("203.0.113.1"), 61000, 65535)
+	assert.NoError(t, err)
+	peer, _ := api.ParseVpnIp("192.168.100.2")
+	client := netip.MustParseAddrPort("192.168.100.2:40000")
+	server := netip.MustParseAddrPort("1.1.1.1:443")
+
+	// 只有 28 个字节的 TCP 数据包
+	p := buildPacket(packet.ProtoTCP, client, server, 0)[:28]
+	_, _, err = table.Outbound(peer, p)
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	// 总长度字段小于 TCP 头部，后面的空间不属于数据包
+	p = buildPacket(packet.ProtoTCP, client, server, 0)
+	orig := append([]byte(nil), p...)
+	binary.BigEndian.PutUint16(p[2:4], 28)
+	binary.BigEndian.PutUint16(orig[2:4], 28)
+	_, _, err = table.Outbound(peer, p)
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.Equal(t, orig, p)
+
+	p = buildPacket(packet.ProtoUDP, client, server, 0)
+	binary.BigEndian.PutUint16(p[2:4], 27)
+	_, _, err = table.Outbound(peer, p)
+	assert.ErrorIs(t, err, ErrUnsupported)
+	_, err = table.Inbound(buildPacket(packet.ProtoTCP, server, client, 0)[:30])
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
@@ -0,0 +1,114 @@
+package qos
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/config"
+	"strconv"
+)
+
+// Class 优先级，值越小优先级越高
+type Class uint8
+
+const (
+	High Class = iota
+	Normal
+	Bulk
+
+	// NumClasses 优先级的数量
+	NumClasses = 3
+)
+
+func (c Class) String() string {
+	switch c {
+	case High:
+		return "high"
+	case Normal:
+		return "normal"
+	case Bulk:
+		return "bulk"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// 默认的分类，EF 与 CS5 通常用于语音与视频，AF2x 为 OpenSSH 交互式会话的默认值，
+// CS1 为 OpenSSH 非交互式会话（scp、rsync）的默认值，LE 见 RFC 8622
+var (
+	defaultHigh = []int{46, 40, 48, 56, 34, 36, 38, 18, 20, 22}
+	defaultBulk = []int{8, 1}
+)
+
+// Classifier 把 DSCP 映射为优先级与外层数据包的 DSCP
+type Classifier struct {
+	classes [64]Class
+	// outer[dscp] 为外层数据包的 TOS，为 0 时不设置
+	outer [64]uint8
+}
+
+// NewClassifier 根据配置创建 Classifier，关闭时返回 nil
+func NewClassifier(c config.QoSConfig) (*Classifier, error) {
+	if c.Disabled {
+		return nil, nil
+	}
+
+	q := &Classifier{}
+	for i := range q.classes {
+		q.classes[i] = Normal
+	}
+	high, bulk := defaultHigh, defaultBulk
+	if c.High != nil {
+		high = c.High
+	}
+	if c.Bulk != nil {
+		bulk = c.Bulk
+	}
+	for _, d := range high {
+		if !validDSCP(d) {
+			return nil, fmt.Errorf("qos.high: invalid dscp %d", d)
+		}
+		q.classes[d] = High
+	}
+	for _, d := range bulk {
+		if !validDSCP(d) {
+			return nil, fmt.Errorf("qos.bulk: invalid dscp %d", d)
+		}
+		q.classes[d] = Bulk
+	}
+
+	switch c.OuterDSCP {
+	case "", "preserve":
+		for i := range q.outer {
+			q.outer[i] = uint8(i) << 2
+		}
+		for from, to := range c.Remap {
+			if !validDSCP(from) || !validDSCP(to) {
+				return nil, fmt.Errorf("qos.remap: invalid dscp %d: %d", from, to)
+			}
+			q.outer[from] = uint8(to) << 2
+		}
+	case "none":
+	default:
+		d, err := strconv.Atoi(c.OuterDSCP)
+		if err != nil || !validDSCP(d) {
+			return nil, fmt.Errorf("qos.outer_dscp must be preserve, none or 0-63, got %q", c.OuterDSCP)
+		}
+		for i := range q.outer {
+			q.outer[i] = uint8(d) << 2
+		}
+	}
+	return q, nil
+}
+
+// Class 返回 dscp 的优先级
+func (q *Classifier) Class(dscp uint8) Class {
+	return q.classes[dscp&0x3f]
+}
+
+// OuterTOS 返回内层 DSCP 为 dscp 的数据包在外层 IP 头部使用的 TOS（IPv6 为 Traffic Class），
+// 为 0 时使用套接字的默认值
+func (q *Classifier) OuterTOS(dscp uint8) uint8 {
+	return q.outer[dscp&0x3f]
+}
+
+func validDSCP(d int) bool {
+	return d >= 0 && d < 64
+}
@@ -0,0 +1,53 @@
+package qos
+
+import (
+	"github.com/am6737/nexus/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestClassifier(t *testing.T) {
+	q, err := NewClassifier(config.QoSConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, High, q.Class(46))
+	assert.Equal(t, High, q.Class(18))
+	assert.Equal(t, Bulk, q.Class(8))
+	assert.Equal(t, Normal, q.Class(0))
+	assert.Equal(t, uint8(46<<2), q.OuterTOS(46))
+	assert.Zero(t, q.OuterTOS(0))
+
+	q, err = NewClassifier(config.QoSConfig{
+		High:  []int{10},
+		Bulk:  []int{},
+		Remap: map[int]int{46: 40},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, High, q.Class(10))
+	assert.Equal(t, Normal, q.Class(46))
+	assert.Equal(t, Normal, q.Class(8))
+	assert.Equal(t, uint8(40<<2), q.OuterTOS(46))
+
+	q, err = NewClassifier(config.QoSConfig{OuterDSCP: "none"})
+	assert.NoError(t, err)
+	assert.Zero(t, q.OuterTOS(46))
+
+	q, err = NewClassifier(config.QoSConfig{OuterDSCP: "10"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(10<<2), q.OuterTOS(46))
+	assert.Equal(t, uint8(10<<2), q.OuterTOS(0))
+
+	q, err = NewClassifier(config.QoSConfig{Disabled: true})
+	assert.NoError(t, err)
+	assert.Nil(t, q)
+
+	for _, c := range []config.QoSConfig{
+		{OuterDSCP: "ef"},
+		{OuterDSCP: "64"},
+		{High: []int{64}},
+		{Bulk: []int{-1}},
+		{Remap: map[int]int{46: 70}},
+	} {
+		_, err := NewClassifier(c)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,93 @@
+package route
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/tun"
+	"net"
+	"net/netip"
+)
+
+// NewTableFromConfig 使用 overlay 网络、配置文件中的 routes 与 tun.unsafe_routes 创建路由表
+func NewTableFromConfig(c *config.Config, network *net.IPNet, unsafeRoutes []tun.Route) (*Table, error) {
+	overlay, err := api.ToNetIpPrefix(*network)
+	if err != nil {
+		return nil, err
+	}
+	overlay = overlay.Masked()
+
+	t := NewTable()
+	if err := t.Insert(Entry{Prefix: overlay, Source: SourceLocal}); err != nil {
+		return nil, err
+	}
+
+	for i, r := range c.Routes {
+		prefix, err := netip.ParsePrefix(r.Route)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d.route in routes failed to parse: %v", i+1, err)
+		}
+		via, err := api.ParseVpnIp(r.Via)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d.via in routes failed to parse: %v", i+1, err)
+		}
+		if !overlay.Contains(via.ToNetIpAddr()) {
+			return nil, fmt.Errorf("entry %d.via in routes is not contained within the overlay network %s", i+1, overlay)
+		}
+		if err := t.Insert(Entry{Prefix: prefix, Via: via, Source: SourceConfig}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range unsafeRoutes {
+		if r.Via == nil {
+			continue
+		}
+		prefix, err := api.ToNetIpPrefix(*r.Cidr)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.Insert(Entry{Prefix: prefix, Via: *r.Via, Source: SourceUnsafe}); err != nil {
+			return nil, err
+		}
+	}
+
+	// 使用出口节点时，不属于其他路由的 IPv4 流量都发送给出口节点
+	if c.ExitNode.Use != "" {
+		via, err := api.ParseVpnIp(c.ExitNode.Use)
+		if err != nil {
+			return nil, fmt.Errorf("exit_node.use failed to parse: %v", err)
+		}
+		if !overlay.Contains(via.ToNetIpAddr()) {
+			return nil, fmt.Errorf("exit_node.use is not contained within the overlay network %s", overlay)
+		}
+		defaultRoute := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if err := t.Insert(Entry{Prefix: defaultRoute, Via: via, Source: SourceConfig}); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// ParseAdvertisedRoutes 解析节点通告的网段，通告的网段不能与 overlay 网络重叠
+func ParseAdvertisedRoutes(routes []string, network *net.IPNet) ([]netip.Prefix, error) {
+	overlay, err := api.ToNetIpPrefix(*network)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(routes))
+	for _, r := range routes {
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("advertised route %s failed to parse: %v", r, err)
+		}
+		prefix = prefix.Masked()
+		if prefix.Overlaps(overlay) {
+			return nil, fmt.Errorf("advertised route %s overlaps the overlay network %s", r, overlay.Masked())
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
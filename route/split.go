@@ -0,0 +1,297 @@
+package route
+
+import (
+	"context"
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/tun"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSplitTunnelRefresh 默认的域名重新解析间隔
+const DefaultSplitTunnelRefresh = 5 * time.Minute
+
+// Resolver 解析分流域名，默认使用 net.DefaultResolver
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// SplitTunnel 根据 include 与 exclude 列表计算进入 overlay 网络的网段，
+// 同步到路由表与系统路由表，并定期重新解析域名以跟踪地址的变化
+type SplitTunnel struct {
+	mu sync.Mutex
+
+	logger   *logrus.Logger
+	inside   tun.Device
+	table    *Table
+	resolver Resolver
+
+	via     api.VpnIP
+	overlay netip.Prefix
+	metric  int
+	refresh time.Duration
+
+	include        []netip.Prefix
+	exclude        []netip.Prefix
+	includeDomains []string
+	excludeDomains []string
+
+	// resolved 域名解析出的地址与最后一次解析到它的时间，
+	// 地址在两个刷新周期内没有再次出现才会被删除，避免打断仍在使用旧地址的连接
+	resolved  map[string]map[netip.Addr]time.Time
+	installed map[netip.Prefix]struct{}
+
+	metricRoutes        metrics.Gauge
+	metricInstalled     metrics.Counter
+	metricRemoved       metrics.Counter
+	metricResolveErrors metrics.Counter
+
+	now func() time.Time
+}
+
+// NewSplitTunnel 解析 split_tunnel 配置，没有配置 include 时返回 nil
+func NewSplitTunnel(c config.SplitTunnelConfig, logger *logrus.Logger, inside tun.Device, table *Table) (*SplitTunnel, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+
+	overlay, err := api.ToNetIpPrefix(*inside.Cidr())
+	if err != nil {
+		return nil, err
+	}
+	overlay = overlay.Masked()
+
+	if c.Via == "" {
+		return nil, fmt.Errorf("split_tunnel.via is not present")
+	}
+	via, err := api.ParseVpnIp(c.Via)
+	if err != nil {
+		return nil, fmt.Errorf("split_tunnel.via failed to parse: %v", err)
+	}
+	if !overlay.Contains(via.ToNetIpAddr()) {
+		return nil, fmt.Errorf("split_tunnel.via is not contained within the overlay network %s", overlay)
+	}
+
+	include, err := parsePrefixes("split_tunnel.include.cidrs", c.Include.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range include {
+		if p.Overlaps(overlay) {
+			return nil, fmt.Errorf("split_tunnel.include.cidrs entry %s overlaps the overlay network %s", p, overlay)
+		}
+	}
+	exclude, err := parsePrefixes("split_tunnel.exclude.cidrs", c.Exclude.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := c.Refresh
+	if refresh <= 0 {
+		refresh = DefaultSplitTunnelRefresh
+	}
+
+	return &SplitTunnel{
+		logger:              logger,
+		inside:              inside,
+		table:               table,
+		resolver:            net.DefaultResolver,
+		via:                 via,
+		overlay:             overlay,
+		metric:              c.Metric,
+		refresh:             refresh,
+		include:             include,
+		exclude:             exclude,
+		includeDomains:      c.Include.Domains,
+		excludeDomains:      c.Exclude.Domains,
+		resolved:            make(map[string]map[netip.Addr]time.Time),
+		installed:           make(map[netip.Prefix]struct{}),
+		metricRoutes:        metrics.GetOrRegisterGauge("split_tunnel.routes", nil),
+		metricInstalled:     metrics.GetOrRegisterCounter("split_tunnel.installed", nil),
+		metricRemoved:       metrics.GetOrRegisterCounter("split_tunnel.removed", nil),
+		metricResolveErrors: metrics.GetOrRegisterCounter("split_tunnel.resolve_errors", nil),
+		now:                 time.Now,
+	}, nil
+}
+
+// Start 在后台安装分流路由，并在 ctx 结束前定期重新解析域名，必须在 tun 设备启动后调用
+func (s *SplitTunnel) Start(ctx context.Context) {
+	go func() {
+		s.Update(ctx)
+		if len(s.includeDomains) == 0 && len(s.excludeDomains) == 0 {
+			return
+		}
+
+		ticker := time.NewTicker(s.refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Update(ctx)
+			}
+		}
+	}()
+}
+
+// Update 重新解析域名，并把计算出的网段与已安装的路由做差异同步
+func (s *SplitTunnel) Update(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	include := append(append([]netip.Prefix{}, s.include...), s.resolve(ctx, s.includeDomains)...)
+	exclude := append(append([]netip.Prefix{}, s.exclude...), s.resolve(ctx, s.excludeDomains)...)
+	want := subtractPrefixes(include, exclude)
+
+	entries := make([]Entry, 0, len(want))
+	wanted := make(map[netip.Prefix]struct{}, len(want))
+	for _, p := range want {
+		entries = append(entries, Entry{Prefix: p, Via: s.via, Source: SourceSplitTunnel})
+		wanted[p] = struct{}{}
+	}
+	s.table.ReplaceSource(SourceSplitTunnel, entries)
+
+	for p := range s.installed {
+		if _, ok := wanted[p]; ok {
+			continue
+		}
+		if err := s.inside.RemoveRoute(s.route(p)); err != nil {
+			s.logger.WithError(err).WithField("route", p).Warn("Failed to remove split tunnel route")
+		}
+		delete(s.installed, p)
+		s.metricRemoved.Inc(1)
+		s.logger.WithField("route", p).Info("Removed split tunnel route")
+	}
+	for _, p := range want {
+		if _, ok := s.installed[p]; ok {
+			continue
+		}
+		if err := s.inside.AddRoute(s.route(p)); err != nil {
+			s.logger.WithError(err).WithField("route", p).Error("Failed to install split tunnel route")
+			continue
+		}
+		s.installed[p] = struct{}{}
+		s.metricInstalled.Inc(1)
+		s.logger.WithField("route", p).Info("Installed split tunnel route")
+	}
+	s.metricRoutes.Update(int64(len(s.installed)))
+}
+
+func (s *SplitTunnel) route(p netip.Prefix) tun.Route {
+	return tun.Route{Cidr: api.PrefixToIPNet(p), Metric: s.metric, Via: &s.via, Install: true}
+}
+
+// resolve 解析域名并返回仍然有效的地址，调用方必须持有锁
+func (s *SplitTunnel) resolve(ctx context.Context, domains []string) []netip.Prefix {
+	now := s.now()
+	var prefixes []netip.Prefix
+	for _, domain := range domains {
+		seen, ok := s.resolved[domain]
+		if !ok {
+			seen = make(map[netip.Addr]time.Time)
+			s.resolved[domain] = seen
+		}
+
+		lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		addrs, err := s.resolver.LookupNetIP(lctx, "ip", domain)
+		cancel()
+		if err != nil {
+			// 解析失败时保留之前的地址
+			s.metricResolveErrors.Inc(1)
+			s.logger.WithError(err).WithField("domain", domain).Warn("Failed to resolve split tunnel domain")
+		}
+		for _, addr := range addrs {
+			seen[addr.Unmap()] = now
+		}
+
+		for addr, last := range seen {
+			if now.Sub(last) > 2*s.refresh {
+				delete(seen, addr)
+				continue
+			}
+			// overlay 网络中的地址不需要分流
+			if s.overlay.Contains(addr) {
+				continue
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes
+}
+
+func parsePrefixes(name string, cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s entry %s failed to parse: %v", name, c, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// subtractPrefixes 返回 include 覆盖但 exclude 不覆盖的最少网段集合
+func subtractPrefixes(include, exclude []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, in := range include {
+		result = append(result, subtract(in.Masked(), exclude)...)
+	}
+
+	// 去掉被其他网段覆盖的重复网段
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bits() != result[j].Bits() {
+			return result[i].Bits() < result[j].Bits()
+		}
+		return result[i].Addr().Less(result[j].Addr())
+	})
+	var merged []netip.Prefix
+	for _, p := range result {
+		covered := false
+		for _, m := range merged {
+			if m.Bits() <= p.Bits() && m.Contains(p.Addr()) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+func subtract(p netip.Prefix, exclude []netip.Prefix) []netip.Prefix {
+	for _, ex := range exclude {
+		if !ex.Overlaps(p) {
+			continue
+		}
+		// exclude 覆盖了整个网段
+		if ex.Bits() <= p.Bits() {
+			return nil
+		}
+		// 网段包含 exclude，拆成两半分别处理
+		lo, hi := split(p)
+		return append(subtract(lo, exclude), subtract(hi, exclude)...)
+	}
+	return []netip.Prefix{p}
+}
+
+// split 把网段拆分为两个长度加一的子网段
+func split(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := p.Bits() + 1
+	lo := netip.PrefixFrom(p.Addr(), bits)
+
+	b := p.Addr().AsSlice()
+	b[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+	addr, _ := netip.AddrFromSlice(b)
+	return lo, netip.PrefixFrom(addr, bits)
+}
@@ -0,0 +1,102 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/tun"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type fakeDevice struct {
+	tun.Device
+	cidr   *net.IPNet
+	routes map[string]tun.Route
+}
+
+func (d *fakeDevice) Cidr() *net.IPNet {
+	return d.cidr
+}
+
+func (d *fakeDevice) AddRoute(r tun.Route) error {
+	d.routes[r.Cidr.String()] = r
+	return nil
+}
+
+func (d *fakeDevice) RemoveRoute(r tun.Route) error {
+	delete(d.routes, r.Cidr.String())
+	return nil
+}
+
+type fakeResolver map[string][]netip.Addr
+
+func (r fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestSubtractPrefixes(t *testing.T) {
+	got := subtractPrefixes(
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("172.16.0.0/12")},
+		[]netip.Prefix{netip.MustParsePrefix("10.128.0.0/9"), netip.MustParsePrefix("10.64.0.0/10"), netip.MustParsePrefix("172.16.0.0/12")},
+	)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/10")}, got)
+
+	got = subtractPrefixes([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/30")}, []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")})
+	assert.ElementsMatch(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/32"), netip.MustParsePrefix("10.0.0.2/31")}, got)
+}
+
+func TestSplitTunnel_Update(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.100.1/24")
+	dev := &fakeDevice{cidr: network, routes: map[string]tun.Route{}}
+	table := NewTable()
+
+	st, err := NewSplitTunnel(config.SplitTunnelConfig{
+		Via:     "192.168.100.5",
+		Include: config.SplitTunnelList{CIDRs: []string{"10.0.0.0/16"}, Domains: []string{"saas.example"}},
+		Exclude: config.SplitTunnelList{CIDRs: []string{"10.0.128.0/17"}},
+		Metric:  50,
+	}, logrus.New(), dev, table)
+	assert.NoError(t, err)
+
+	resolver := fakeResolver{"saas.example": {netip.MustParseAddr("203.0.113.7")}}
+	st.resolver = resolver
+	now := time.Now()
+	st.now = func() time.Time { return now }
+
+	st.Update(context.Background())
+	assert.Len(t, dev.routes, 2)
+	assert.Equal(t, 50, dev.routes["10.0.0.0/17"].Metric)
+	assert.Contains(t, dev.routes, "203.0.113.7/32")
+
+	e, ok := table.Lookup(mustVpnIp("203.0.113.7"))
+	assert.True(t, ok)
+	assert.Equal(t, mustVpnIp("192.168.100.5"), e.Via)
+	_, ok = table.Lookup(mustVpnIp("10.0.200.1"))
+	assert.False(t, ok)
+
+	// 域名地址变化后，旧地址在两个刷新周期后才会被删除
+	resolver["saas.example"] = []netip.Addr{netip.MustParseAddr("203.0.113.8")}
+	now = now.Add(st.refresh)
+	st.Update(context.Background())
+	assert.Len(t, dev.routes, 3)
+
+	now = now.Add(2 * st.refresh)
+	st.Update(context.Background())
+	assert.Len(t, dev.routes, 2)
+	assert.NotContains(t, dev.routes, "203.0.113.7/32")
+
+	_, err = NewSplitTunnel(config.SplitTunnelConfig{
+		Via:     "192.168.100.5",
+		Include: config.SplitTunnelList{CIDRs: []string{"192.168.0.0/16"}},
+	}, logrus.New(), dev, table)
+	assert.Error(t, err)
+}
@@ -0,0 +1,245 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// Source 路由的来源，同一个网段存在多个来源的路由时，值越小优先级越高
+type Source uint8
+
+const (
+	// SourceLocal overlay 网络本身，目标地址就是下一跳
+	SourceLocal Source = iota
+	// SourceConfig 配置文件中的 routes
+	SourceConfig
+	// SourceUnsafe 配置文件中的 tun.unsafe_routes
+	SourceUnsafe
+	// SourceSplitTunnel 配置文件中的 split_tunnel
+	SourceSplitTunnel
+	// SourceLighthouse 其他节点通过灯塔通告的路由
+	SourceLighthouse
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceLocal:
+		return "local"
+	case SourceConfig:
+		return "config"
+	case SourceUnsafe:
+		return "unsafe"
+	case SourceSplitTunnel:
+		return "split_tunnel"
+	case SourceLighthouse:
+		return "lighthouse"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// Entry 路由表项
+type Entry struct {
+	Prefix netip.Prefix
+	// Via 下一跳节点的 overlay 地址，为零值时直接发送给目标地址
+	Via    api.VpnIP
+	Source Source
+}
+
+func (e Entry) String() string {
+	if e.Via.IsZero() {
+		return fmt.Sprintf("%s direct (%s)", e.Prefix, e.Source)
+	}
+	return fmt.Sprintf("%s via %s (%s)", e.Prefix, e.Via, e.Source)
+}
+
+// NextHop 返回发往 ip 的数据包应该发送给哪个节点
+func (e Entry) NextHop(ip api.VpnIP) api.VpnIP {
+	if e.Via.IsZero() {
+		return ip
+	}
+	return e.Via
+}
+
+// Table 以 128 位二叉前缀树实现的路由表，IPv4 网段按 IPv4-mapped IPv6 地址存储，查询时使用最长前缀匹配
+type Table struct {
+	mu   sync.RWMutex
+	root *node
+}
+
+type node struct {
+	children [2]*node
+	// 同一网段不同来源的路由，按 Source 排序
+	entries []Entry
+}
+
+func NewTable() *Table {
+	return &Table{root: &node{}}
+}
+
+// Insert 添加一条路由，已存在相同网段与来源的路由时会被替换
+func (t *Table) Insert(e Entry) error {
+	if !e.Prefix.IsValid() {
+		return fmt.Errorf("invalid route prefix %s", e.Prefix)
+	}
+	e.Prefix = e.Prefix.Masked()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.insert(e)
+	return nil
+}
+
+// Delete 删除指定网段与来源的路由
+func (t *Table) Delete(prefix netip.Prefix, source Source) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.delete(prefix.Masked(), source)
+}
+
+// ReplaceSource 使用 entries 替换某个来源的全部路由，返回新增与被删除的路由。
+// entries 中来源不是 source 的路由会被忽略
+func (t *Table) ReplaceSource(source Source, entries []Entry) (added, removed []Entry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	want := make(map[netip.Prefix]Entry, len(entries))
+	for _, e := range entries {
+		if e.Source != source || !e.Prefix.IsValid() {
+			continue
+		}
+		e.Prefix = e.Prefix.Masked()
+		// 多个节点通告同一个网段时选择地址最小的节点，保证结果稳定
+		if old, ok := want[e.Prefix]; ok && bytes.Compare(old.Via[:], e.Via[:]) <= 0 {
+			continue
+		}
+		want[e.Prefix] = e
+	}
+
+	for _, e := range t.entries() {
+		if e.Source != source {
+			continue
+		}
+		if n, ok := want[e.Prefix]; ok && n.Via == e.Via {
+			delete(want, e.Prefix)
+			continue
+		}
+		t.delete(e.Prefix, source)
+		removed = append(removed, e)
+	}
+
+	for _, e := range want {
+		t.insert(e)
+		added = append(added, e)
+	}
+	sortEntries(added)
+	sortEntries(removed)
+	return added, removed
+}
+
+// Lookup 返回最长前缀匹配 ip 的路由
+func (t *Table) Lookup(ip api.VpnIP) (Entry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var (
+		best  Entry
+		found bool
+	)
+	n := t.root
+	for i := 0; n != nil; i++ {
+		if len(n.entries) > 0 {
+			best, found = n.entries[0], true
+		}
+		if i == 128 {
+			break
+		}
+		n = n.children[bit(ip, i)]
+	}
+	return best, found
+}
+
+// Entries 返回路由表中的全部路由
+func (t *Table) Entries() []Entry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.entries()
+}
+
+func (t *Table) insert(e Entry) {
+	key, bits := prefixKey(e.Prefix)
+	n := t.root
+	for i := 0; i < bits; i++ {
+		b := bit(key, i)
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		n = n.children[b]
+	}
+
+	for i := range n.entries {
+		if n.entries[i].Source == e.Source {
+			n.entries[i] = e
+			return
+		}
+	}
+	n.entries = append(n.entries, e)
+	sort.Slice(n.entries, func(i, j int) bool {
+		return n.entries[i].Source < n.entries[j].Source
+	})
+}
+
+func (t *Table) delete(prefix netip.Prefix, source Source) bool {
+	key, bits := prefixKey(prefix)
+	n := t.root
+	for i := 0; i < bits && n != nil; i++ {
+		n = n.children[bit(key, i)]
+	}
+	if n == nil {
+		return false
+	}
+	for i := range n.entries {
+		if n.entries[i].Source == source {
+			n.entries = append(n.entries[:i], n.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Table) entries() []Entry {
+	var entries []Entry
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n == nil {
+			return
+		}
+		entries = append(entries, n.entries...)
+		walk(n.children[0])
+		walk(n.children[1])
+	}
+	walk(t.root)
+	return entries
+}
+
+// prefixKey 把网段转换为前缀树中的 128 位键与前缀长度
+func prefixKey(prefix netip.Prefix) (api.VpnIP, int) {
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	return api.AddrToVpnIp(prefix.Addr()), bits
+}
+
+func bit(ip api.VpnIP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+func sortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Prefix.String() < entries[j].Prefix.String()
+	})
+}
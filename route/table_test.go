@@ -0,0 +1,97 @@
+package route
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/tun"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func mustVpnIp(s string) api.VpnIP {
+	ip, err := api.ParseVpnIp(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip
+}
+
+func TestTable_Lookup(t *testing.T) {
+	table := NewTable()
+	assert.NoError(t, table.Insert(Entry{Prefix: netip.MustParsePrefix("192.168.100.0/24"), Source: SourceLocal}))
+	assert.NoError(t, table.Insert(Entry{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Via: mustVpnIp("192.168.100.2"), Source: SourceConfig}))
+	assert.NoError(t, table.Insert(Entry{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Via: mustVpnIp("192.168.100.3"), Source: SourceUnsafe}))
+	assert.NoError(t, table.Insert(Entry{Prefix: netip.MustParsePrefix("fd00::/64"), Via: mustVpnIp("192.168.100.4"), Source: SourceConfig}))
+
+	tests := []struct {
+		ip      string
+		nextHop string
+		found   bool
+	}{
+		{"192.168.100.9", "192.168.100.9", true},
+		{"10.2.3.4", "192.168.100.2", true},
+		{"10.1.3.4", "192.168.100.3", true},
+		{"fd00::1", "192.168.100.4", true},
+		{"172.16.0.1", "", false},
+		{"fd01::1", "", false},
+	}
+	for _, tt := range tests {
+		e, ok := table.Lookup(mustVpnIp(tt.ip))
+		assert.Equal(t, tt.found, ok, tt.ip)
+		if ok {
+			assert.Equal(t, mustVpnIp(tt.nextHop), e.NextHop(mustVpnIp(tt.ip)), tt.ip)
+		}
+	}
+
+	// 同一网段的多个来源按优先级选择
+	assert.NoError(t, table.Insert(Entry{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Via: mustVpnIp("192.168.100.5"), Source: SourceLighthouse}))
+	e, _ := table.Lookup(mustVpnIp("10.1.3.4"))
+	assert.Equal(t, SourceUnsafe, e.Source)
+	assert.True(t, table.Delete(netip.MustParsePrefix("10.1.0.0/16"), SourceUnsafe))
+	e, _ = table.Lookup(mustVpnIp("10.1.3.4"))
+	assert.Equal(t, mustVpnIp("192.168.100.5"), e.Via)
+}
+
+func TestTable_ReplaceSource(t *testing.T) {
+	table := NewTable()
+	a := Entry{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Via: mustVpnIp("192.168.100.2"), Source: SourceLighthouse}
+	b := Entry{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Via: mustVpnIp("192.168.100.3"), Source: SourceLighthouse}
+
+	added, removed := table.ReplaceSource(SourceLighthouse, []Entry{a, b})
+	assert.Equal(t, []Entry{a, b}, added)
+	assert.Empty(t, removed)
+
+	moved := b
+	moved.Via = mustVpnIp("192.168.100.4")
+	added, removed = table.ReplaceSource(SourceLighthouse, []Entry{a, moved})
+	assert.Equal(t, []Entry{moved}, added)
+	assert.Equal(t, []Entry{b}, removed)
+
+	added, removed = table.ReplaceSource(SourceLighthouse, nil)
+	assert.Empty(t, added)
+	assert.Equal(t, []Entry{a, moved}, removed)
+	assert.Empty(t, table.Entries())
+}
+
+func TestNewTableFromConfig(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.100.0/24")
+	via := mustVpnIp("192.168.100.3")
+	_, unsafeCidr, _ := net.ParseCIDR("10.1.0.0/16")
+
+	c := &config.Config{Routes: []config.StaticRoute{{Route: "10.0.0.0/8", Via: "192.168.100.2"}}}
+	table, err := NewTableFromConfig(c, network, []tun.Route{{Cidr: unsafeCidr, Via: &via}})
+	assert.NoError(t, err)
+	assert.Len(t, table.Entries(), 3)
+
+	c.Routes[0].Via = "10.0.0.1"
+	_, err = NewTableFromConfig(c, network, nil)
+	assert.Error(t, err)
+
+	_, err = ParseAdvertisedRoutes([]string{"192.168.0.0/16"}, network)
+	assert.Error(t, err)
+	prefixes, err := ParseAdvertisedRoutes([]string{"10.0.0.1/24"}, network)
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, prefixes)
+}
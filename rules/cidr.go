@@ -0,0 +1,84 @@
+package rules
+
+import (
+	"github.com/am6737/nexus/api"
+	"net/netip"
+)
+
+// cidrTree 以二叉前缀树存储的一组网段，IPv4 与 IPv6 网段分别存储，IPv4 地址只查找 32 位
+type cidrTree struct {
+	roots [2]cidrNode
+}
+
+type cidrNode struct {
+	children [2]*cidrNode
+	// leaf 从根到该节点的路径是一个完整的网段，更长的网段都被它包含
+	leaf bool
+}
+
+func (t *cidrTree) Insert(prefix netip.Prefix) {
+	key, start, end := prefixKey(prefix)
+
+	n := &t.roots[start/96]
+	for i := start; i < end; i++ {
+		if n.leaf {
+			return
+		}
+		b := bit(key, i)
+		if n.children[b] == nil {
+			n.children[b] = &cidrNode{}
+		}
+		n = n.children[b]
+	}
+	n.leaf = true
+	n.children = [2]*cidrNode{}
+}
+
+// Contains 判断 ip 是否在任意一个网段中
+func (t *cidrTree) Contains(ip api.VpnIP) bool {
+	start := addrStart(ip)
+	n := &t.roots[start/96]
+	for i := start; ; i++ {
+		if n.leaf {
+			return true
+		}
+		if i == 128 {
+			return false
+		}
+		if n = n.children[bit(ip, i)]; n == nil {
+			return false
+		}
+	}
+}
+
+// parseHost 解析规则中的网段或地址，两者都不是时返回 false
+func parseHost(s string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix, true
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+// prefixKey 把网段转换为前缀树中的 128 位键与起止位，IPv4 网段从第 96 位开始
+func prefixKey(prefix netip.Prefix) (api.VpnIP, int, int) {
+	prefix = prefix.Masked()
+	if prefix.Addr().Is4() {
+		return api.AddrToVpnIp(prefix.Addr()), 96, 96 + prefix.Bits()
+	}
+	return api.AddrToVpnIp(prefix.Addr()), 0, prefix.Bits()
+}
+
+// addrStart 返回地址在前缀树中的起始位
+func addrStart(ip api.VpnIP) int {
+	if ip.Is4() {
+		return 96
+	}
+	return 0
+}
+
+func bit(ip api.VpnIP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,185 @@
+package rules
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/rcrowley/go-metrics"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTCPTimeout  = 12 * time.Minute
+	DefaultUDPTimeout  = 3 * time.Minute
+	DefaultICMPTimeout = 30 * time.Second
+	DefaultMaxEntries  = 65536
+
+	// conntrackSweep 清理过期连接的最小间隔，两次清理之间过期的连接在查找时被忽略
+	conntrackSweep = 10 * time.Second
+)
+
+// Conntrack 连接跟踪表。Packet 中的地址与端口都以本节点为视角，同一个连接的出站与入站数据包的五元组相同，
+// 所以任一方向被规则允许的连接，另一方向的数据包都可以直接放行
+type Conntrack struct {
+	mu    sync.Mutex
+	conns map[connKey]conn
+	max   int
+	tcp   time.Duration
+	udp   time.Duration
+	icmp  time.Duration
+	// swept 上一次清理过期连接的时间
+	swept int64
+	now   func() time.Time
+
+	metricEntries metrics.Gauge
+	metricEvicted metrics.Counter
+}
+
+type conn struct {
+	// expires 过期时间（UnixNano）
+	expires int64
+	// gen 允许该连接的规则的版本，inbound 连接是否由入站数据包建立
+	gen     uint64
+	inbound bool
+}
+
+type connKey struct {
+	local      api.VpnIP
+	remote     api.VpnIP
+	localPort  uint16
+	remotePort uint16
+	proto      uint8
+}
+
+func NewConntrack(c config.ConntrackConfig) *Conntrack {
+	ct := &Conntrack{
+		conns:         make(map[connKey]conn),
+		max:           c.MaxEntries,
+		tcp:           c.TCPTimeout,
+		udp:           c.UDPTimeout,
+		icmp:          c.ICMPTimeout,
+		now:           time.Now,
+		metricEntries: metrics.GetOrRegisterGauge("firewall.conntrack.entries", nil),
+		metricEvicted: metrics.GetOrRegisterCounter("firewall.conntrack.evicted", nil),
+	}
+	if ct.max <= 0 {
+		ct.max = DefaultMaxEntries
+	}
+	if ct.tcp <= 0 {
+		ct.tcp = DefaultTCPTimeout
+	}
+	if ct.udp <= 0 {
+		ct.udp = DefaultUDPTimeout
+	}
+	if ct.icmp <= 0 {
+		ct.icmp = DefaultICMPTimeout
+	}
+	return ct
+}
+
+// Contains 判断数据包是否属于已跟踪的连接，是则刷新连接的过期时间
+func (c *Conntrack) Contains(p *packet.Packet) bool {
+	_, _, ok := c.lookup(p)
+	return ok
+}
+
+// Add 跟踪数据包所属的连接
+func (c *Conntrack) Add(p *packet.Packet) {
+	c.add(p, false, 0)
+}
+
+// lookup 查找数据包所属的连接，返回建立连接的方向与允许该连接的规则的版本，找到时刷新连接的过期时间
+func (c *Conntrack) lookup(p *packet.Packet) (bool, uint64, bool) {
+	if !trackable(p) {
+		return false, 0, false
+	}
+	k := keyOf(p)
+	now := c.now().UnixNano()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.conns[k]
+	if !ok || e.expires <= now {
+		return false, 0, false
+	}
+	e.expires = now + int64(c.timeout(p.Protocol))
+	c.conns[k] = e
+	return e.inbound, e.gen, true
+}
+
+func (c *Conntrack) add(p *packet.Packet, inbound bool, gen uint64) {
+	if !trackable(p) {
+		return
+	}
+	k := keyOf(p)
+	now := c.now().UnixNano()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now-c.swept >= int64(conntrackSweep) {
+		c.sweep(now)
+	}
+	if _, ok := c.conns[k]; !ok && len(c.conns) >= c.max {
+		// 表满时删除任意一个连接，被删除的连接之后的数据包重新检查规则
+		for old := range c.conns {
+			delete(c.conns, old)
+			c.metricEvicted.Inc(1)
+			break
+		}
+	}
+	c.conns[k] = conn{expires: now + int64(c.timeout(p.Protocol)), gen: gen, inbound: inbound}
+	c.metricEntries.Update(int64(len(c.conns)))
+}
+
+// Len 返回跟踪的连接数量，包括已过期但还没有被清理的连接
+func (c *Conntrack) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+// sweep 删除所有过期的连接，调用方需要持有锁
+func (c *Conntrack) sweep(now int64) {
+	for k, e := range c.conns {
+		if e.expires <= now {
+			delete(c.conns, k)
+		}
+	}
+	c.swept = now
+}
+
+func (c *Conntrack) timeout(proto uint8) time.Duration {
+	switch proto {
+	case packet.ProtoTCP:
+		return c.tcp
+	case packet.ProtoICMP, packet.ProtoICMPv6:
+		return c.icmp
+	}
+	return c.udp
+}
+
+// trackable 后续分片没有端口，无法确定所属的连接。ICMP 只跟踪 echo 请求与回复，
+// 重定向等其他报文即使来自有连接的节点也要检查规则
+func trackable(p *packet.Packet) bool {
+	if p.Fragment {
+		return false
+	}
+	switch p.Protocol {
+	case packet.ProtoICMP:
+		return p.ICMPType == 8 || p.ICMPType == 0
+	case packet.ProtoICMPv6:
+		return p.ICMPType == 128 || p.ICMPType == 129
+	}
+	return true
+}
+
+func keyOf(p *packet.Packet) connKey {
+	return connKey{
+		local:      p.LocalIP,
+		remote:     p.RemoteIP,
+		localPort:  p.LocalPort,
+		remotePort: p.RemotePort,
+		proto:      p.Protocol,
+	}
+}
@@ -0,0 +1,102 @@
+package rules
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConntrack_ReplyAllowed(t *testing.T) {
+	ct := NewConntrack(config.ConntrackConfig{})
+	r := NewRules(
+		[]config.OutboundRule{{Port: "443", Proto: "tcp", Action: "allow"}},
+		nil,
+		WithConntrack(ct),
+	)
+
+	// 出站与入站的数据包都以本节点为视角解析
+	p := &packet.Packet{
+		LocalIP:    api.Ip2VpnIp([]byte{192, 168, 1, 1}),
+		RemoteIP:   api.Ip2VpnIp([]byte{192, 168, 1, 2}),
+		LocalPort:  40000,
+		RemotePort: 443,
+		Protocol:   packet.ProtoTCP,
+	}
+	assert.Error(t, r.Inbound(p, nil), "Expected default deny before the connection is established")
+	assert.NoError(t, r.Outbound(p, nil))
+	assert.NoError(t, r.Inbound(p, nil), "Expected the reply to be allowed by conntrack")
+	assert.Equal(t, 1, ct.Len())
+
+	// 其他连接仍然检查规则
+	other := p.Copy()
+	other.LocalPort = 40001
+	assert.Error(t, r.Inbound(other, nil))
+
+	udp := p.Copy()
+	udp.Protocol = packet.ProtoUDP
+	assert.Error(t, r.Inbound(udp, nil))
+
+	// ICMP 只有 echo 被跟踪
+	ping := &packet.Packet{LocalIP: p.LocalIP, RemoteIP: p.RemoteIP, Protocol: packet.ProtoICMP, ICMPType: 8}
+	redirect := &packet.Packet{LocalIP: p.LocalIP, RemoteIP: p.RemoteIP, Protocol: packet.ProtoICMP, ICMPType: 5}
+	assert.Error(t, r.Outbound(ping, nil))
+	ct.Add(ping)
+	assert.NoError(t, r.Inbound(ping, nil))
+	assert.Error(t, r.Inbound(redirect, nil))
+
+	// 后续分片无法确定所属的连接
+	frag := p.Copy()
+	frag.Fragment = true
+	assert.Error(t, r.Inbound(frag, nil))
+}
+
+func TestConntrack_Timeout(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ct := NewConntrack(config.ConntrackConfig{UDPTimeout: time.Minute})
+	ct.now = func() time.Time { return now }
+
+	tcp := &packet.Packet{LocalPort: 1, RemotePort: 2, Protocol: packet.ProtoTCP}
+	udp := &packet.Packet{LocalPort: 1, RemotePort: 2, Protocol: packet.ProtoUDP}
+	icmp := &packet.Packet{Protocol: packet.ProtoICMP, ICMPType: 8}
+	ct.Add(tcp)
+	ct.Add(udp)
+	ct.Add(icmp)
+
+	now = now.Add(DefaultICMPTimeout)
+	assert.False(t, ct.Contains(icmp))
+	assert.True(t, ct.Contains(udp))
+
+	// 有数据包时刷新过期时间
+	now = now.Add(50 * time.Second)
+	assert.True(t, ct.Contains(udp))
+	now = now.Add(50 * time.Second)
+	assert.True(t, ct.Contains(udp))
+	now = now.Add(time.Minute)
+	assert.False(t, ct.Contains(udp))
+	assert.True(t, ct.Contains(tcp))
+
+	// 过期的连接在下一次添加时被清理
+	ct.Add(&packet.Packet{LocalPort: 3, RemotePort: 4, Protocol: packet.ProtoUDP})
+	assert.Equal(t, 2, ct.Len())
+}
+
+func TestConntrack_MaxEntries(t *testing.T) {
+	ct := NewConntrack(config.ConntrackConfig{MaxEntries: 4})
+	evicted := ct.metricEvicted.Count()
+
+	for i := 0; i < 10; i++ {
+		ct.Add(&packet.Packet{LocalPort: uint16(i), Protocol: packet.ProtoUDP})
+	}
+	assert.Equal(t, 4, ct.Len())
+	assert.Equal(t, int64(4), ct.metricEntries.Value())
+	assert.Equal(t, int64(6), ct.metricEvicted.Count()-evicted)
+
+	// 已跟踪的连接刷新时不会删除其他连接
+	last := &packet.Packet{LocalPort: 9, Protocol: packet.ProtoUDP}
+	assert.True(t, ct.Contains(last))
+	ct.Add(last)
+	assert.Equal(t, int64(6), ct.metricEvicted.Count()-evicted)
+}
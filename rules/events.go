@@ -0,0 +1,149 @@
+package rules
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEventInterval = 10 * time.Second
+	DefaultEventFlows    = 4096
+
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// Event 防火墙拒绝数据包的事件，地址与端口以本节点为视角
+type Event struct {
+	Direction  string
+	Protocol   uint8
+	LocalIP    api.VpnIP
+	RemoteIP   api.VpnIP
+	LocalPort  uint16
+	RemotePort uint16
+	// Rule 匹配的规则在该方向的规则中的序号，使用默认动作时为 -1
+	Rule   int
+	Action string
+	// Suppressed 上一个事件之后同一个流被限速或采样丢弃的事件数量
+	Suppressed int
+}
+
+// Events 按流限速与采样后把事件交给 handler
+type Events struct {
+	mu       sync.Mutex
+	flows    map[flowKey]*flowState
+	interval time.Duration
+	max      int
+	rate     float64
+	// sampled 采样的累加值，每个事件增加 rate，达到 1 时输出
+	sampled float64
+	now     func() time.Time
+	handler func(Event)
+}
+
+type flowKey struct {
+	conn    connKey
+	inbound bool
+}
+
+type flowState struct {
+	// last 上一次输出事件的时间（UnixNano）
+	last       int64
+	suppressed int
+}
+
+func NewEvents(c config.FirewallEventsConfig, handler func(Event)) *Events {
+	e := &Events{
+		flows:    make(map[flowKey]*flowState),
+		interval: c.FlowInterval,
+		max:      c.MaxFlows,
+		rate:     c.SampleRate,
+		now:      time.Now,
+		handler:  handler,
+	}
+	if e.interval <= 0 {
+		e.interval = DefaultEventInterval
+	}
+	if e.max <= 0 {
+		e.max = DefaultEventFlows
+	}
+	if e.rate <= 0 || e.rate > 1 {
+		e.rate = 1
+	}
+	return e
+}
+
+// LogEvents 以结构化日志输出事件
+func LogEvents(logger *logrus.Logger) func(Event) {
+	return func(e Event) {
+		logger.WithFields(logrus.Fields{
+			"direction":   e.Direction,
+			"proto":       packet.TypeName(e.Protocol),
+			"local_ip":    e.LocalIP,
+			"local_port":  e.LocalPort,
+			"remote_ip":   e.RemoteIP,
+			"remote_port": e.RemotePort,
+			"rule":        e.Rule,
+			"action":      e.Action,
+			"suppressed":  e.Suppressed,
+		}).Info("Firewall event")
+	}
+}
+
+// Emit 记录数据包的事件，同一个流在间隔内的事件与没有被采样的事件只计数
+func (e *Events) Emit(direction string, p *packet.Packet, rule int, action string) {
+	k := flowKey{conn: keyOf(p), inbound: direction == DirectionInbound}
+	now := e.now().UnixNano()
+
+	e.mu.Lock()
+	f, ok := e.flows[k]
+	if !ok {
+		if len(e.flows) >= e.max {
+			e.expire(now)
+		}
+		f = &flowState{last: now - int64(e.interval)}
+		e.flows[k] = f
+	}
+	if now-f.last < int64(e.interval) {
+		f.suppressed++
+		e.mu.Unlock()
+		return
+	}
+	if e.sampled += e.rate; e.sampled < 1 {
+		f.suppressed++
+		e.mu.Unlock()
+		return
+	}
+	e.sampled--
+	suppressed := f.suppressed
+	f.last, f.suppressed = now, 0
+	e.mu.Unlock()
+
+	e.handler(Event{
+		Direction:  direction,
+		Protocol:   p.Protocol,
+		LocalIP:    p.LocalIP,
+		RemoteIP:   p.RemoteIP,
+		LocalPort:  p.LocalPort,
+		RemotePort: p.RemotePort,
+		Rule:       rule,
+		Action:     action,
+		Suppressed: suppressed,
+	})
+}
+
+// expire 删除间隔内没有事件的流，仍然超过上限时清空，调用方需要持有锁
+func (e *Events) expire(now int64) {
+	for k, f := range e.flows {
+		if now-f.last >= int64(e.interval) {
+			delete(e.flows, k)
+		}
+	}
+	if len(e.flows) >= e.max {
+		e.flows = make(map[flowKey]*flowState)
+	}
+}
@@ -0,0 +1,109 @@
+package rules
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEvents_RuleAndAction(t *testing.T) {
+	var events []Event
+	e := NewEvents(config.FirewallEventsConfig{}, func(ev Event) { events = append(events, ev) })
+	r := NewRules(
+		[]config.OutboundRule{{Port: "22", Proto: "tcp", Action: "allow"}},
+		[]config.InboundRule{
+			{Port: "22", Proto: "tcp", Action: "allow"},
+			{Port: "23", Proto: "tcp", Action: "reject"},
+		},
+		WithEvents(e),
+	)
+
+	p := &packet.Packet{
+		LocalIP:    api.Ip2VpnIp([]byte{192, 168, 1, 1}),
+		RemoteIP:   api.Ip2VpnIp([]byte{192, 168, 1, 2}),
+		LocalPort:  23,
+		RemotePort: 40000,
+		Protocol:   packet.ProtoTCP,
+	}
+	assert.Error(t, r.Inbound(p, nil))
+	assert.Error(t, r.Outbound(p, nil))
+
+	// 允许的数据包没有事件
+	p.LocalPort = 22
+	assert.NoError(t, r.Inbound(p, nil))
+
+	assert.Equal(t, []Event{
+		{Direction: DirectionInbound, Protocol: packet.ProtoTCP, LocalIP: p.LocalIP, RemoteIP: p.RemoteIP, LocalPort: 23, RemotePort: 40000, Rule: 1, Action: ActionReject},
+		{Direction: DirectionOutbound, Protocol: packet.ProtoTCP, LocalIP: p.LocalIP, RemoteIP: p.RemoteIP, LocalPort: 23, RemotePort: 40000, Rule: -1, Action: ActionDeny},
+	}, events)
+}
+
+func TestEvents_FlowRateLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var events []Event
+	e := NewEvents(config.FirewallEventsConfig{FlowInterval: time.Second, MaxFlows: 2}, func(ev Event) { events = append(events, ev) })
+	e.now = func() time.Time { return now }
+
+	p := &packet.Packet{RemoteIP: api.Ip2VpnIp([]byte{192, 168, 1, 2}), LocalPort: 22, Protocol: packet.ProtoTCP}
+	for i := 0; i < 5; i++ {
+		e.Emit(DirectionInbound, p, 0, ActionDeny)
+	}
+	assert.Len(t, events, 1)
+
+	// 另一个流不受影响
+	other := p.Copy()
+	other.LocalPort = 23
+	e.Emit(DirectionInbound, other, 0, ActionDeny)
+	assert.Len(t, events, 2)
+
+	// 间隔之后输出下一个事件，并记录被抑制的数量
+	now = now.Add(time.Second)
+	e.Emit(DirectionInbound, p, 0, ActionDeny)
+	assert.Len(t, events, 3)
+	assert.Equal(t, 4, events[2].Suppressed)
+
+	// 超过流的数量上限时删除过期的流
+	third := p.Copy()
+	third.LocalPort = 24
+	e.Emit(DirectionInbound, third, 0, ActionDeny)
+	assert.Len(t, events, 4)
+	assert.Len(t, e.flows, 2)
+}
+
+func TestEvents_Sampling(t *testing.T) {
+	n := 0
+	e := NewEvents(config.FirewallEventsConfig{SampleRate: 0.25}, func(Event) { n++ })
+	for port := uint16(1); port <= 100; port++ {
+		e.Emit(DirectionOutbound, &packet.Packet{RemotePort: port, Protocol: packet.ProtoUDP}, -1, ActionDeny)
+	}
+	assert.Equal(t, 25, n)
+}
+
+func TestRules_HitCounters(t *testing.T) {
+	r := NewRules(nil, []config.InboundRule{
+		{Port: "22", Proto: "tcp", Action: "allow"},
+		{Port: "80", Proto: "tcp", Action: "deny"},
+	})
+	hits := metrics.GetOrRegisterCounter("firewall.inbound.rule.0.hits", nil)
+	defaultHits := metrics.GetOrRegisterCounter("firewall.inbound.default.hits", nil)
+	before, beforeDefault := hits.Count(), defaultHits.Count()
+
+	p := &packet.Packet{LocalPort: 22, Protocol: packet.ProtoTCP}
+	assert.NoError(t, r.Inbound(p, nil))
+	assert.NoError(t, r.Inbound(p, nil))
+	p.LocalPort = 443
+	assert.Error(t, r.Inbound(p, nil))
+
+	assert.Equal(t, before+2, hits.Count())
+	assert.Equal(t, beforeDefault+1, defaultHits.Count())
+
+	// 重新加载后第 0 条规则是另一条规则，从零开始计数
+	r.Reload(nil, []config.InboundRule{{Port: "443", Proto: "tcp", Action: "allow"}}, config.FirewallConfig{})
+	assert.NoError(t, r.Inbound(p, nil))
+	assert.Equal(t, int64(1), metrics.GetOrRegisterCounter("firewall.inbound.rule.0.hits", nil).Count())
+	assert.Nil(t, metrics.Get("firewall.inbound.rule.1.hits"))
+}
@@ -0,0 +1,108 @@
+package rules
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/rcrowley/go-metrics"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFragmentTimeout 与 Linux 的 ipfrag_time 相同，超过该时间还没有到达的分片不会被重组
+	DefaultFragmentTimeout = 30 * time.Second
+	DefaultMaxFragments    = 4096
+)
+
+// fragments 记录分片数据包的第一个分片的检查结果。后续分片没有端口，无法按规则检查，
+// 使用同一个数据包的第一个分片的结果
+type fragments struct {
+	mu       sync.Mutex
+	verdicts map[fragmentKey]fragmentVerdict
+	max      int
+	timeout  time.Duration
+	// swept 上一次清理过期记录的时间
+	swept int64
+	now   func() time.Time
+
+	metricEvicted metrics.Counter
+}
+
+type fragmentKey struct {
+	local   api.VpnIP
+	remote  api.VpnIP
+	id      uint32
+	proto   uint8
+	inbound bool
+}
+
+type fragmentVerdict struct {
+	err     error
+	expires int64
+}
+
+func newFragments() *fragments {
+	return &fragments{
+		verdicts:      make(map[fragmentKey]fragmentVerdict),
+		max:           DefaultMaxFragments,
+		timeout:       DefaultFragmentTimeout,
+		now:           time.Now,
+		metricEvicted: metrics.GetOrRegisterCounter("firewall.fragments.evicted", nil),
+	}
+}
+
+// Get 返回后续分片所属的数据包的第一个分片的结果，第一个分片没有经过本节点或已经过期时返回 false
+func (f *fragments) Get(p *packet.Packet, inbound bool) (error, bool) {
+	k := fragmentKeyOf(p, inbound)
+	now := f.now().UnixNano()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.verdicts[k]
+	if !ok || v.expires <= now {
+		return nil, false
+	}
+	return v.err, true
+}
+
+// Add 记录第一个分片的结果
+func (f *fragments) Add(p *packet.Packet, inbound bool, err error) {
+	k := fragmentKeyOf(p, inbound)
+	now := f.now().UnixNano()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now-f.swept >= int64(conntrackSweep) {
+		for k, v := range f.verdicts {
+			if v.expires <= now {
+				delete(f.verdicts, k)
+			}
+		}
+		f.swept = now
+	}
+	if _, ok := f.verdicts[k]; !ok && len(f.verdicts) >= f.max {
+		for old := range f.verdicts {
+			delete(f.verdicts, old)
+			f.metricEvicted.Inc(1)
+			break
+		}
+	}
+	f.verdicts[k] = fragmentVerdict{err: err, expires: now + int64(f.timeout)}
+}
+
+// Clear 删除所有记录，规则重新加载后后续分片按新的规则检查
+func (f *fragments) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.verdicts = make(map[fragmentKey]fragmentVerdict)
+}
+
+func fragmentKeyOf(p *packet.Packet, inbound bool) fragmentKey {
+	return fragmentKey{
+		local:   p.LocalIP,
+		remote:  p.RemoteIP,
+		id:      p.FragmentID,
+		proto:   p.Protocol,
+		inbound: inbound,
+	}
+}
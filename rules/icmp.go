@@ -0,0 +1,77 @@
+package rules
+
+import (
+	"github.com/am6737/nexus/transport/packet"
+	"strconv"
+)
+
+// anyICMP 不限制 ICMP 类型或代码
+const anyICMP = -2
+
+// icmpTypes ICMP 类型的名称，值分别为 ICMP 与 ICMPv6 中的类型，-1 表示该协议中没有这个类型
+var icmpTypes = map[string][2]int{
+	"echo-reply":              {0, 129},
+	"destination-unreachable": {3, 1},
+	"unreachable":             {3, 1},
+	"source-quench":           {4, -1},
+	"redirect":                {5, 137},
+	"echo-request":            {8, 128},
+	"router-advertisement":    {9, 134},
+	"router-solicitation":     {10, 133},
+	"time-exceeded":           {11, 3},
+	"parameter-problem":       {12, 4},
+	"timestamp-request":       {13, -1},
+	"timestamp-reply":         {14, -1},
+	"packet-too-big":          {-1, 2},
+	"neighbor-solicitation":   {-1, 135},
+	"neighbor-advertisement":  {-1, 136},
+}
+
+// icmpMatch 规则中的 ICMP 类型与代码，types 分别为 ICMP 与 ICMPv6 的类型
+type icmpMatch struct {
+	types [2]int
+	code  int
+}
+
+// parseICMP 解析规则中的 icmp_type 与 icmp_code，都为空时返回 nil。
+// 无法解析的值不匹配任何报文，与无法解析的端口一样
+func parseICMP(icmpType, icmpCode string) *icmpMatch {
+	if icmpType == "" && icmpCode == "" {
+		return nil
+	}
+	m := &icmpMatch{types: [2]int{anyICMP, anyICMP}, code: anyICMP}
+	if icmpType != "" {
+		if t, ok := icmpTypes[icmpType]; ok {
+			m.types = t
+		} else if n, err := strconv.Atoi(icmpType); err == nil && n >= 0 && n < 256 {
+			m.types = [2]int{n, n}
+		} else {
+			m.types = [2]int{-1, -1}
+		}
+	}
+	if icmpCode != "" {
+		if n, err := strconv.Atoi(icmpCode); err == nil && n >= 0 && n < 256 {
+			m.code = n
+		} else {
+			m.code = -1
+		}
+	}
+	return m
+}
+
+// match 只匹配 ICMP 与 ICMPv6 报文
+func (m *icmpMatch) match(p *packet.Packet) bool {
+	var t int
+	switch p.Protocol {
+	case packet.ProtoICMP:
+		t = m.types[0]
+	case packet.ProtoICMPv6:
+		t = m.types[1]
+	default:
+		return false
+	}
+	if t != anyICMP && t != int(p.ICMPType) {
+		return false
+	}
+	return m.code == anyICMP || m.code == int(p.ICMPCode)
+}
@@ -5,7 +5,9 @@ import (
 	"testing"
 
 	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/api/cert"
 	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
 	"github.com/am6737/nexus/transport/packet"
 	"github.com/stretchr/testify/assert"
 )
@@ -26,7 +28,7 @@ func TestMatchPort(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result := matchPort(test.port, test.rulePort)
+		result := matchPortSpec(test.rulePort, uint16(test.port), false)
 		assert.Equal(t, test.expected, result, "Port %d match rule %s: expected %v, got %v", test.port, test.rulePort, test.expected, result)
 	}
 }
@@ -73,19 +75,19 @@ func TestRules_Outbound(t *testing.T) {
 		RemoteIP:   api.Ip2VpnIp([]byte{192, 168, 1, 1}),
 	}
 
-	err := rules.Outbound(packet)
+	err := rules.Outbound(packet, nil)
 
 	fmt.Println("Packet:", packet)
-	fmt.Println("Rule Applied:", rules.outbound)
+	fmt.Println("Rule Applied:", rules.policy.Load().outbound.rules)
 	fmt.Println("Error:", err)
 
 	assert.NoError(t, err, "Expected no error for allowed rule")
 
 	packet.RemotePort = 443
-	err = rules.Outbound(packet)
+	err = rules.Outbound(packet, nil)
 
 	fmt.Println("Packet:", packet)
-	fmt.Println("Rule Applied:", rules.outbound)
+	fmt.Println("Rule Applied:", rules.policy.Load().outbound.rules)
 	fmt.Println("Error:", err)
 
 	assert.Error(t, err, "Expected error for denied rule")
@@ -105,16 +107,259 @@ func TestRules_Inbound(t *testing.T) {
 	fmt.Println(" api.Ip2VpnIp([]byte(\"192.168.1.1\")) => ", api.Ip2VpnIp([]byte("192.168.1.1")))
 
 	packet := &packet.Packet{
-		RemotePort: 80,
-		Protocol:   packet.ProtoTCP,
-		RemoteIP:   api.Ip2VpnIp([]byte{192, 168, 1, 1}),
+		LocalPort: 80,
+		Protocol:  packet.ProtoTCP,
+		RemoteIP:  api.Ip2VpnIp([]byte{192, 168, 1, 1}),
 	}
 
-	err := rules.Inbound(packet)
+	err := rules.Inbound(packet, nil)
 	assert.NoError(t, err, "Expected no error for allowed rule")
 
-	packet.RemotePort = 443
-	err = rules.Inbound(packet)
+	packet.LocalPort = 443
+	err = rules.Inbound(packet, nil)
 	assert.Error(t, err, "Expected error for denied rule")
 	assert.Contains(t, err.Error(), ErrDrop)
 }
+
+func TestRules_InboundIPv6(t *testing.T) {
+	rules := NewRules(
+		nil,
+		[]config.InboundRule{
+			{Port: "22", Proto: "tcp", Host: []string{"fd00:1::/64"}, Action: "allow"},
+			{Port: "any", Proto: "icmp", Host: nil, Action: "allow"},
+		},
+	)
+
+	remote, err := api.ParseVpnIp("fd00:1::5")
+	assert.NoError(t, err)
+
+	p := &packet.Packet{
+		LocalPort: 22,
+		Protocol:  packet.ProtoTCP,
+		RemoteIP:  remote,
+	}
+	assert.NoError(t, rules.Inbound(p, nil), "Expected v6 cidr to match")
+
+	p.RemoteIP, _ = api.ParseVpnIp("fd00:2::5")
+	assert.Error(t, rules.Inbound(p, nil), "Expected default deny outside of the v6 cidr")
+
+	p.Protocol = packet.ProtoICMPv6
+	p.LocalPort = 0
+	assert.NoError(t, rules.Inbound(p, nil), "Expected icmp rule to match icmpv6")
+}
+
+func TestRules_InboundIdentity(t *testing.T) {
+	rules := NewRules(
+		nil,
+		[]config.InboundRule{
+			{Port: "22", Proto: "tcp", Groups: []string{"ops"}, Action: "allow"},
+			{Port: "443", Proto: "tcp", Name: "web-1", CAName: "corp", Action: "allow"},
+			{Port: "8080", Proto: "tcp", Groups: []string{"ops", "admin"}, Action: "allow"},
+		},
+	)
+
+	p := &packet.Packet{
+		LocalPort: 22,
+		Protocol:  packet.ProtoTCP,
+		RemoteIP:  api.Ip2VpnIp([]byte{192, 168, 1, 5}),
+	}
+	ops := &host.HostInfo{Cert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name: "laptop", Groups: []string{"ops"}, Issuer: "corp",
+	}}}
+	web := &host.HostInfo{Cert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+		Name: "web-1", Groups: []string{"servers"}, Issuer: "corp",
+	}}}
+
+	assert.NoError(t, rules.Inbound(p, ops), "Expected group to match regardless of the address")
+	assert.Error(t, rules.Inbound(p, web), "Expected a peer outside the group to be denied")
+	assert.Error(t, rules.Inbound(p, nil), "Expected a peer without a certificate to be denied")
+	assert.Error(t, rules.Inbound(p, &host.HostInfo{}), "Expected a peer without a certificate to be denied")
+
+	p.LocalPort = 443
+	assert.NoError(t, rules.Inbound(p, web))
+	assert.Error(t, rules.Inbound(p, ops))
+	web.Cert.Details.Issuer = "other"
+	assert.Error(t, rules.Inbound(p, web), "Expected ca_name to match the issuer")
+
+	// groups 要求属于所有的组
+	p.LocalPort = 8080
+	assert.Error(t, rules.Inbound(p, ops))
+	ops.Cert.Details.Groups = append(ops.Cert.Details.Groups, "admin")
+	assert.NoError(t, rules.Inbound(p, ops))
+}
+
+func TestRules_LocalCIDR(t *testing.T) {
+	rules := NewRules(
+		[]config.OutboundRule{
+			{Port: "any", Proto: "any", LocalCIDR: "192.168.100.1", Action: "allow"},
+		},
+		[]config.InboundRule{
+			{Port: "any", Proto: "any", Host: []string{"192.168.100.0/24"}, LocalCIDR: "10.1.0.0/24", Action: "allow"},
+		},
+	)
+
+	// 本节点为 10.1.0.0/24 与 10.2.0.0/24 转发流量
+	p := &packet.Packet{
+		Protocol: packet.ProtoTCP,
+		LocalIP:  api.Ip2VpnIp([]byte{10, 1, 0, 5}),
+		RemoteIP: api.Ip2VpnIp([]byte{192, 168, 100, 2}),
+	}
+	assert.NoError(t, rules.Inbound(p, nil), "Expected peers to reach the allowed subnet")
+
+	p.LocalIP = api.Ip2VpnIp([]byte{10, 2, 0, 5})
+	assert.Error(t, rules.Inbound(p, nil), "Expected other local subnets to be denied")
+
+	// 出站时 LocalIP 为源地址
+	assert.Error(t, rules.Outbound(p, nil))
+	p.LocalIP = api.Ip2VpnIp([]byte{192, 168, 100, 1})
+	assert.NoError(t, rules.Outbound(p, nil))
+}
+
+func TestRules_ICMPType(t *testing.T) {
+	rules := NewRules(
+		nil,
+		[]config.InboundRule{
+			{Port: "any", Proto: "icmp", ICMPType: "redirect", Action: "deny"},
+			{Port: "any", Proto: "icmp", ICMPType: "echo-request", Action: "allow"},
+			{Port: "any", Proto: "icmp", ICMPType: "3", ICMPCode: "4", Action: "allow"},
+			{Port: "any", Proto: "icmp", ICMPType: "no-such-type", Action: "allow"},
+		},
+		WithDefaultAction("deny"),
+	)
+
+	p := &packet.Packet{Protocol: packet.ProtoICMP, ICMPType: 8}
+	assert.NoError(t, rules.Inbound(p, nil), "Expected ping to be allowed")
+
+	// 同一个名称匹配 ICMPv6 中对应的类型
+	p.Protocol, p.ICMPType = packet.ProtoICMPv6, 128
+	assert.NoError(t, rules.Inbound(p, nil), "Expected icmpv6 ping to be allowed")
+	p.ICMPType = 137
+	assert.Error(t, rules.Inbound(p, nil), "Expected icmpv6 redirect to be denied")
+
+	p.Protocol, p.ICMPType = packet.ProtoICMP, 5
+	assert.Error(t, rules.Inbound(p, nil), "Expected redirect to be denied")
+	p.ICMPType = 13
+	assert.Error(t, rules.Inbound(p, nil), "Expected timestamp request to be denied")
+
+	p.ICMPType, p.ICMPCode = 3, 4
+	assert.NoError(t, rules.Inbound(p, nil), "Expected fragmentation needed to be allowed")
+	p.ICMPCode = 1
+	assert.Error(t, rules.Inbound(p, nil))
+
+	// ICMP 类型只匹配 ICMP 报文
+	p.Protocol, p.ICMPType, p.ICMPCode = packet.ProtoUDP, 8, 0
+	assert.Error(t, rules.Inbound(p, nil))
+}
+
+func TestRules_NumericProto(t *testing.T) {
+	rules := NewRules(
+		[]config.OutboundRule{
+			{Port: "any", Proto: "gre", Action: "allow"},
+			{Port: "any", Proto: "50", Action: "allow"},
+		},
+		nil,
+	)
+
+	p := &packet.Packet{Protocol: packet.ProtoGRE}
+	assert.NoError(t, rules.Outbound(p, nil))
+	p.Protocol = packet.ProtoESP
+	assert.NoError(t, rules.Outbound(p, nil))
+	p.Protocol = packet.ProtoAH
+	assert.Error(t, rules.Outbound(p, nil))
+	p.Protocol = packet.ProtoTCP
+	assert.Error(t, rules.Outbound(p, nil))
+}
+
+func TestRules_Reject(t *testing.T) {
+	rules := NewRules(
+		[]config.OutboundRule{{Port: "22", Proto: "tcp", Action: "reject"}},
+		[]config.InboundRule{{Port: "22", Proto: "tcp", Action: "deny"}},
+		WithOutboundAction("allow"),
+		WithInboundAction("reject"),
+	)
+
+	p := &packet.Packet{Protocol: packet.ProtoTCP, LocalPort: 22, RemotePort: 22}
+	err := rules.Outbound(p, nil)
+	assert.Error(t, err)
+	assert.True(t, IsReject(err))
+	err = rules.Inbound(p, nil)
+	assert.Error(t, err)
+	assert.False(t, IsReject(err))
+
+	// 没有匹配的规则时各方向使用自己的默认动作
+	p.LocalPort, p.RemotePort = 80, 80
+	assert.NoError(t, rules.Outbound(p, nil))
+	err = rules.Inbound(p, nil)
+	assert.Error(t, err)
+	assert.True(t, IsReject(err))
+
+	assert.True(t, ValidAction(""))
+	assert.False(t, ValidAction("drop"))
+}
+
+func TestRules_Fragment(t *testing.T) {
+	rules := NewRules(
+		nil,
+		[]config.InboundRule{
+			{Port: "22", Proto: "tcp", Action: "allow"},
+			{Port: "fragment", Proto: "udp", Action: "allow"},
+		},
+	)
+
+	local := api.Ip2VpnIp([]byte{192, 168, 1, 1})
+	remote := api.Ip2VpnIp([]byte{192, 168, 1, 2})
+	first := &packet.Packet{LocalIP: local, RemoteIP: remote, LocalPort: 22, Protocol: packet.ProtoTCP, Fragmented: true, FragmentID: 7}
+	later := &packet.Packet{LocalIP: local, RemoteIP: remote, Protocol: packet.ProtoTCP, Fragment: true, Fragmented: true, FragmentID: 7}
+
+	// 第一个分片没有经过本节点时后续分片被拒绝
+	assert.Error(t, rules.Inbound(later, nil))
+
+	// 后续分片使用第一个分片的结果
+	assert.NoError(t, rules.Inbound(first, nil))
+	assert.NoError(t, rules.Inbound(later, nil))
+
+	denied := first.Copy()
+	denied.LocalPort, denied.FragmentID = 23, 8
+	assert.Error(t, rules.Inbound(denied, nil))
+	later.FragmentID = 8
+	assert.Error(t, rules.Inbound(later, nil))
+
+	// 另一个方向没有记录
+	later.FragmentID = 7
+	assert.Error(t, rules.Outbound(later, nil))
+
+	// port: fragment 只匹配后续分片
+	udp := &packet.Packet{LocalIP: local, RemoteIP: remote, Protocol: packet.ProtoUDP, Fragment: true, Fragmented: true, FragmentID: 9}
+	assert.NoError(t, rules.Inbound(udp, nil))
+	udp.Fragment, udp.LocalPort = false, 53
+	assert.Error(t, rules.Inbound(udp, nil))
+}
+
+func TestRules_Reload(t *testing.T) {
+	outbound := []config.OutboundRule{{Port: "443", Proto: "tcp", Action: "allow"}}
+	rules := NewRules(outbound, nil, WithConntrack(NewConntrack(config.ConntrackConfig{})))
+
+	p := &packet.Packet{
+		LocalIP:    api.Ip2VpnIp([]byte{192, 168, 1, 1}),
+		RemoteIP:   api.Ip2VpnIp([]byte{192, 168, 1, 2}),
+		LocalPort:  40000,
+		RemotePort: 443,
+		Protocol:   packet.ProtoTCP,
+	}
+	assert.NoError(t, rules.Outbound(p, nil))
+
+	// 新的规则仍然允许该连接时，回复不受重新加载影响
+	rules.Reload(append(outbound, config.OutboundRule{Port: "80", Proto: "tcp", Action: "allow"}), nil, config.FirewallConfig{})
+	assert.NoError(t, rules.Inbound(p, nil))
+	other := p.Copy()
+	other.RemotePort = 80
+	assert.NoError(t, rules.Outbound(other, nil))
+
+	// 新的规则不再允许该连接
+	rules.Reload(nil, nil, config.FirewallConfig{OutboundAction: "reject"})
+	err := rules.Inbound(p, nil)
+	assert.Error(t, err)
+	assert.False(t, IsReject(err))
+	assert.True(t, IsReject(rules.Outbound(p, nil)))
+	assert.Empty(t, rules.policy.Load().outbound.rules)
+}
@@ -1,227 +1,293 @@
 package rules
 
 import (
+	"errors"
 	"fmt"
 	"github.com/am6737/nexus/api/interfaces"
 	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
 	"github.com/am6737/nexus/transport/packet"
-	"net"
 	"strconv"
-	"strings"
+	"sync/atomic"
 )
 
 var _ interfaces.RulesEngine = &Rules{}
 
 var (
-	AnyPort        = "1-65535"
-	ErrDrop        = "dropped packet due to rule"
-	defaultErrDrop = "default action is deny"
+	AnyPort          = "1-65535"
+	ErrDrop          = "dropped packet due to rule"
+	ErrReject        = "rejected packet due to rule"
+	defaultErrDrop   = "default action is deny"
+	errDefaultDrop   = fmt.Errorf("%s: %v", ErrDrop, defaultErrDrop)
+	errDefaultReject = &RejectError{msg: fmt.Sprintf("%s: default action is reject", ErrReject)}
 )
 
+const (
+	ActionAllow  = "allow"
+	ActionDeny   = "deny"
+	ActionReject = "reject"
+)
+
+// RejectError 以 reject 动作拒绝数据包时返回的错误，调用方应向发送方回复 TCP RST 或 ICMP 不可达
+type RejectError struct {
+	msg string
+}
+
+func (e *RejectError) Error() string {
+	return e.msg
+}
+
+// IsReject 判断数据包是否以 reject 动作被拒绝
+func IsReject(err error) bool {
+	var r *RejectError
+	return errors.As(err, &r)
+}
+
+// ValidAction 判断 action 是否为支持的动作，为空时使用默认动作
+func ValidAction(action string) bool {
+	switch action {
+	case "", ActionAllow, ActionDeny, ActionReject:
+		return true
+	}
+	return false
+}
+
 func NewRules(outboundRules []config.OutboundRule, inboundRules []config.InboundRule, opts ...RuleOption) *Rules {
 	r := &Rules{
-		outbound:      outboundRules,
-		inbound:       inboundRules,
-		defaultAction: "deny", // 默认设置为拒绝
+		outboundAction: ActionDeny, // 默认设置为拒绝
+		inboundAction:  ActionDeny,
+		fragments:      newFragments(),
 	}
 
 	for _, opt := range opts {
 		opt(r)
 	}
 
+	r.policy.Store(&policy{
+		outbound:       compileOutbound(outboundRules),
+		inbound:        compileInbound(inboundRules),
+		outboundAction: r.outboundAction,
+		inboundAction:  r.inboundAction,
+	})
 	return r
 }
 
+// WithDefaultAction 设置两个方向的默认动作
 func WithDefaultAction(action string) RuleOption {
 	return func(r *Rules) {
-		r.defaultAction = action
+		r.outboundAction = action
+		r.inboundAction = action
+	}
+}
+
+// WithOutboundAction 设置出站方向的默认动作，为空时不修改
+func WithOutboundAction(action string) RuleOption {
+	return func(r *Rules) {
+		if action != "" {
+			r.outboundAction = action
+		}
+	}
+}
+
+// WithInboundAction 设置入站方向的默认动作，为空时不修改
+func WithInboundAction(action string) RuleOption {
+	return func(r *Rules) {
+		if action != "" {
+			r.inboundAction = action
+		}
+	}
+}
+
+// WithEvents 输出被拒绝的数据包的事件
+func WithEvents(e *Events) RuleOption {
+	return func(r *Rules) {
+		r.events = e
+	}
+}
+
+// WithConntrack 开启连接跟踪，规则允许的连接在两个方向上的后续数据包都不再检查规则
+func WithConntrack(c *Conntrack) RuleOption {
+	return func(r *Rules) {
+		r.conntrack = c
 	}
 }
 
 type RuleOption func(*Rules)
 
 type Rules struct {
-	outbound []config.OutboundRule
-	inbound  []config.InboundRule
+	// policy 当前使用的规则，重新加载时整体替换，正在检查的数据包继续使用旧的规则
+	policy atomic.Pointer[policy]
+	// outboundAction 与 inboundAction 选项设置的默认动作
+	outboundAction string
+	inboundAction  string
+	// conntrack 连接跟踪，没有开启时为 nil
+	conntrack *Conntrack
+	// events 被拒绝的数据包的事件，没有开启时为 nil
+	events *Events
+	// fragments 分片数据包的第一个分片的检查结果
+	fragments *fragments
+}
+
+// policy 加载时编译的两个方向的规则与默认动作，检查数据包时不再解析规则
+type policy struct {
+	outbound *table
+	inbound  *table
 	// Default action when no matching rule is found
-	defaultAction string
+	outboundAction string
+	inboundAction  string
+	// gen 规则的版本，每次重新加载加一，连接跟踪据此发现需要用新的规则重新检查的连接
+	gen uint64
 }
 
-func (r *Rules) Outbound(p *packet.Packet) error {
-	for _, rule := range r.outbound {
-		if rule.Proto != "any" && rule.Proto != packet.TypeName(p.Protocol) {
-			continue // Protocol doesn't match
-		}
+// Reload 替换两个方向的规则与默认动作，默认动作为空时为 deny。
+// 重新加载前建立的连接在下一个数据包到达时按建立连接的方向用新的规则重新检查，仍然允许的连接不会中断
+func (r *Rules) Reload(outboundRules []config.OutboundRule, inboundRules []config.InboundRule, fw config.FirewallConfig) {
+	old := r.policy.Load()
+	old.outbound.unregister()
+	old.inbound.unregister()
+	pol := &policy{
+		outbound:       compileOutbound(outboundRules),
+		inbound:        compileInbound(inboundRules),
+		outboundAction: ActionDeny,
+		inboundAction:  ActionDeny,
+		gen:            old.gen + 1,
+	}
+	if fw.OutboundAction != "" {
+		pol.outboundAction = fw.OutboundAction
+	}
+	if fw.InboundAction != "" {
+		pol.inboundAction = fw.InboundAction
+	}
+	r.policy.Store(pol)
+	r.fragments.Clear()
+}
 
-		if rule.Port != "any" && rule.Port != AnyPort && !matchPort(int(p.RemotePort), rule.Port) {
-			continue // Port doesn't match
-		}
+func (r *Rules) Outbound(p *packet.Packet, h *host.HostInfo) error {
+	return r.fragment(r.policy.Load(), p, h, false)
+}
 
-		matched := false
-		if len(rule.Host) > 0 {
-			for _, host := range rule.Host {
-				_, network, err := net.ParseCIDR(host)
-				if err == nil && network.Contains(p.RemoteIP.ToNetIP()) {
-					matched = true
-					break
-				} else if host == p.RemoteIP.String() {
-					matched = true
-					break
-				}
-			}
-		} else {
-			matched = true
-		}
-		if !matched {
-			continue // Host doesn't match
-		}
+func (r *Rules) Inbound(p *packet.Packet, h *host.HostInfo) error {
+	return r.fragment(r.policy.Load(), p, h, true)
+}
 
-		if rule.Action == "deny" {
-			return fmt.Errorf("%s: %v", ErrDrop, rule)
+// fragment 后续分片使用第一个分片的结果，第一个分片没有经过本节点时只有 port 为 fragment 或 any 的规则可以匹配
+func (r *Rules) fragment(pol *policy, p *packet.Packet, h *host.HostInfo, inbound bool) error {
+	if p.Fragment {
+		if err, ok := r.fragments.Get(p, inbound); ok {
+			return err
 		}
-
-		return nil // Packet should be allowed
+		return r.match(pol, p, h, inbound)
 	}
+	err := r.track(pol, p, h, inbound)
+	if p.Fragmented {
+		r.fragments.Add(p, inbound, err)
+	}
+	return err
+}
 
-	if r.defaultAction == "deny" {
-		return fmt.Errorf("%s: %v", ErrDrop, defaultErrDrop)
+// track 已跟踪的连接直接放行，否则检查规则，允许时跟踪该连接。
+// 规则重新加载前建立的连接按建立连接的方向用新的规则重新检查，仍然允许时继续跟踪
+func (r *Rules) track(pol *policy, p *packet.Packet, h *host.HostInfo, inbound bool) error {
+	if r.conntrack == nil {
+		return r.match(pol, p, h, inbound)
 	}
+	established, gen, ok := r.conntrack.lookup(p)
+	if ok && gen == pol.gen {
+		return nil
+	}
+	if ok && pol.result(p, h, established) == nil {
+		r.conntrack.add(p, established, pol.gen)
+		return nil
+	}
+	if err := r.match(pol, p, h, inbound); err != nil {
+		return err
+	}
+	r.conntrack.add(p, inbound, pol.gen)
 	return nil
 }
 
-func (r *Rules) Inbound(p *packet.Packet) error {
-	for _, rule := range r.inbound {
-		if rule.Proto != "any" && rule.Proto != packet.TypeName(p.Protocol) {
-			continue // Protocol doesn't match
-		}
-
-		if rule.Port != "any" && rule.Port != AnyPort && !matchPort(int(p.RemotePort), rule.Port) {
-			continue // Port doesn't match
-		}
-
-		matched := false
-		if len(rule.Host) > 0 {
-			for _, host := range rule.Host {
-				_, network, err := net.ParseCIDR(host)
-				if err == nil && network.Contains(p.RemoteIP.ToNetIP()) {
-					matched = true
-					break
-				} else if host == p.RemoteIP.String() {
-					matched = true
-					break
-				}
-			}
-		} else {
-			matched = true
-		}
-		if !matched {
-			continue // Host doesn't match
-		}
-
-		if rule.Action == "deny" {
-			return fmt.Errorf("%s: %v", ErrDrop, rule)
-		}
+// match 检查规则，计数并在拒绝时输出事件
+func (r *Rules) match(pol *policy, p *packet.Packet, h *host.HostInfo, inbound bool) error {
+	t, i, action := pol.lookup(p, h, inbound)
+	return r.verdict(t, i, action, p)
+}
 
-		return nil // Packet should be allowed
+// lookup 返回数据包所在方向的规则、匹配的规则的序号与该方向的默认动作。
+// 入站数据包以本节点为视角，规则的端口是本节点的端口，出站规则的端口是对端的端口
+func (pol *policy) lookup(p *packet.Packet, h *host.HostInfo, inbound bool) (*table, int, string) {
+	if inbound {
+		return pol.inbound, pol.inbound.lookup(p.LocalPort, p, h), pol.inboundAction
 	}
+	return pol.outbound, pol.outbound.lookup(p.RemotePort, p, h), pol.outboundAction
+}
 
-	// 根据 defaultAction 决定是否拒绝或允许
-	if r.defaultAction == "deny" {
-		return fmt.Errorf("%s: %v", ErrDrop, defaultErrDrop)
+// result 检查规则，不计数也不输出事件
+func (pol *policy) result(p *packet.Packet, h *host.HostInfo, inbound bool) error {
+	t, i, action := pol.lookup(p, h, inbound)
+	if i < 0 {
+		return defaultVerdict(action)
 	}
-	return nil
+	return t.rules[i].err
 }
 
-func parsePortRule(rule string) ([]int, [][2]int, error) {
-	var ports []int
-	var ranges [][2]int
-	parts := strings.Split(rule, ",")
-	for _, part := range parts {
-		if strings.Contains(part, "-") {
-			rangeParts := strings.Split(part, "-")
-			if len(rangeParts) != 2 {
-				return nil, nil, fmt.Errorf("invalid port range format: %s", part)
-			}
-			start, err := strconv.Atoi(rangeParts[0])
-			if err != nil {
-				return nil, nil, err
-			}
-			end, err := strconv.Atoi(rangeParts[1])
-			if err != nil {
-				return nil, nil, err
-			}
-			if start > end {
-				return nil, nil, fmt.Errorf("start port greater than end port: %s", part)
-			}
-			ranges = append(ranges, [2]int{start, end})
-		} else {
-			port, err := strconv.Atoi(part)
-			if err != nil {
-				return nil, nil, err
-			}
-			ports = append(ports, port)
-		}
+// verdict 返回第 i 条规则的结果，i 为 -1 时使用默认动作。拒绝时输出事件
+func (r *Rules) verdict(t *table, i int, defaultAction string, p *packet.Packet) error {
+	var err error
+	action := defaultAction
+	if i < 0 {
+		t.defaultHits.Inc(1)
+		err = defaultVerdict(defaultAction)
+	} else {
+		t.rules[i].hits.Inc(1)
+		action, err = t.rules[i].action, t.rules[i].err
+	}
+	if err != nil && r.events != nil {
+		r.events.Emit(t.direction, p, i, action)
 	}
-	return ports, ranges, nil
+	return err
 }
 
-func portInRanges(port int, ranges [][2]int) bool {
-	for _, r := range ranges {
-		if port >= r[0] && port <= r[1] {
-			return true
-		}
+// defaultVerdict 根据默认动作决定是否拒绝或允许
+func defaultVerdict(action string) error {
+	switch action {
+	case ActionDeny:
+		return errDefaultDrop
+	case ActionReject:
+		return errDefaultReject
 	}
-	return false
+	return nil
 }
 
-func (r *Rules) matchPort(rulePort string, packetPort int) (bool, error) {
-	ports, ranges, err := parsePortRule(rulePort)
-	if err != nil {
-		return false, err
+// matchPeer 检查对端的主机证书是否符合规则中的 name、groups 与 ca_name，没有配置时总是符合
+func matchPeer(name string, groups []string, caName string, h *host.HostInfo) bool {
+	if name == "" && len(groups) == 0 && caName == "" {
+		return true
 	}
-
-	for _, port := range ports {
-		if packetPort == port {
-			return true, nil
+	if h == nil || h.Cert == nil {
+		return false
+	}
+	d := h.Cert.Details
+	if name != "" && name != d.Name {
+		return false
+	}
+	if caName != "" && caName != d.Issuer {
+		return false
+	}
+	for _, g := range groups {
+		if !d.InGroup(g) {
+			return false
 		}
 	}
+	return true
+}
 
-	if portInRanges(packetPort, ranges) {
-		return true, nil
-	}
-
-	return false, nil
-}
-
-// matchPort 检查给定的端口是否符合规则字符串中的任意规则。
-func matchPort(port int, rulePort string) bool {
-	// 规则字符串可以是单个端口，逗号分隔的端口列表，或者范围
-	rules := strings.Split(rulePort, ",")
-	for _, r := range rules {
-		if strings.Contains(r, "-") {
-			// 处理范围
-			bounds := strings.Split(r, "-")
-			if len(bounds) != 2 {
-				continue
-			}
-			lower, err1 := strconv.Atoi(bounds[0])
-			upper, err2 := strconv.Atoi(bounds[1])
-			if err1 != nil || err2 != nil {
-				continue
-			}
-			if port >= lower && port <= upper {
-				return true
-			}
-		} else {
-			// 处理单个端口
-			p, err := strconv.Atoi(r)
-			if err != nil {
-				continue
-			}
-			if port == p {
-				return true
-			}
-		}
+// matchProto 检查数据包的协议是否符合规则中的协议，icmp 同时匹配 ICMPv6，也可以使用协议号
+func matchProto(ruleProto string, proto uint8) bool {
+	if ruleProto == "any" || ruleProto == packet.TypeName(proto) {
+		return true
 	}
-	return false
+	if n, err := strconv.Atoi(ruleProto); err == nil {
+		return n == int(proto)
+	}
+	return ruleProto == "icmp" && proto == packet.ProtoICMPv6
 }
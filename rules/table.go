@@ -0,0 +1,372 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/rcrowley/go-metrics"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// maxExpandedRange 不超过该长度的端口范围在编译时展开为单个端口，更长的范围在查找时逐个检查
+const maxExpandedRange = 256
+
+// table 编译后的一个方向的规则。规则依次按协议、端口与对端地址建立索引，每个索引中的规则按配置中的顺序排列，
+// 查找时在所有候选列表中取顺序最靠前的完全匹配的规则，与逐条检查的结果相同
+type table struct {
+	rules    []rule
+	protos   map[uint8]*portIndex
+	anyProto portIndex
+
+	direction string
+	// defaultHits 没有规则匹配、使用默认动作的次数
+	defaultHits metrics.Counter
+}
+
+// rule 编译后的规则，hosts 与 local 为 nil 时不限制地址
+type rule struct {
+	action string
+	hosts  *cidrTree
+	local  *cidrTree
+	// icmp 规则中的 ICMP 类型与代码，没有配置时为 nil
+	icmp *icmpMatch
+	// prefixes hosts 中的网段，用于建立对端地址的索引
+	prefixes []netip.Prefix
+	name     string
+	groups   []string
+	caName   string
+	// err 拒绝时返回的错误，编译时生成，检查数据包时不再格式化
+	err error
+	// hits 规则匹配的次数，已跟踪的连接的数据包不检查规则，不计入
+	hits metrics.Counter
+	// spec 配置中的规则，用于 Trace 说明不匹配的原因
+	spec ruleSpec
+}
+
+// portIndex 同一协议的规则按端口建立的索引，fragment 为 port 中包含 fragment 的规则，只匹配后续分片
+type portIndex struct {
+	ports    map[uint16]*ruleSet
+	ranges   []portRange
+	any      ruleSet
+	fragment ruleSet
+}
+
+// ruleSet 同一端口的规则按对端地址建立的前缀树，列表中为规则的序号
+type ruleSet struct {
+	// any 不限制对端地址的规则，hosts 为 IPv6 与 IPv4 地址的前缀树
+	any   []int
+	hosts [2]*hostNode
+}
+
+type hostNode struct {
+	children [2]*hostNode
+	// rules hosts 中包含从根到该节点的网段的规则
+	rules []int
+}
+
+type portRange struct {
+	lo, hi uint16
+	rule   int
+}
+
+// ruleSpec 出站与入站规则共同的字段
+type ruleSpec struct {
+	port, proto        string
+	icmpType, icmpCode string
+	hosts              []string
+	localCIDR          string
+	name               string
+	groups             []string
+	caName             string
+	action             string
+	desc               fmt.Stringer
+}
+
+func compileOutbound(rules []config.OutboundRule) *table {
+	specs := make([]ruleSpec, len(rules))
+	for i, r := range rules {
+		specs[i] = ruleSpec{r.Port, r.Proto, r.ICMPType, r.ICMPCode, r.Host, r.LocalCIDR, r.Name, r.Groups, r.CAName, r.Action, r}
+	}
+	return compile(specs, DirectionOutbound)
+}
+
+func compileInbound(rules []config.InboundRule) *table {
+	specs := make([]ruleSpec, len(rules))
+	for i, r := range rules {
+		specs[i] = ruleSpec{r.Port, r.Proto, r.ICMPType, r.ICMPCode, r.Host, r.LocalCIDR, r.Name, r.Groups, r.CAName, r.Action, r}
+	}
+	return compile(specs, DirectionInbound)
+}
+
+// ruleHitsName 第 i 条规则的计数的名称
+func ruleHitsName(direction string, i int) string {
+	return fmt.Sprintf("firewall.%s.rule.%d.hits", direction, i)
+}
+
+// unregister 删除每条规则的计数。计数按规则的序号命名，重新加载后同一序号可能是另一条规则，
+// 新的规则从零开始计数
+func (t *table) unregister() {
+	for i := range t.rules {
+		metrics.Unregister(ruleHitsName(t.direction, i))
+	}
+}
+
+// compile 编译规则。与逐条检查时一样，无法解析的端口与地址被忽略，只包含这些值的规则不会匹配任何数据包
+func compile(specs []ruleSpec, direction string) *table {
+	t := &table{
+		protos:      make(map[uint8]*portIndex),
+		direction:   direction,
+		defaultHits: metrics.GetOrRegisterCounter(fmt.Sprintf("firewall.%s.default.hits", direction), nil),
+	}
+	for i, s := range specs {
+		r := rule{
+			action: s.action,
+			hits:   metrics.GetOrRegisterCounter(ruleHitsName(direction, i), nil),
+			name:   s.name,
+			groups: s.groups,
+			caName: s.caName,
+			icmp:   parseICMP(s.icmpType, s.icmpCode),
+			spec:   s,
+		}
+		switch s.action {
+		case ActionDeny:
+			r.err = fmt.Errorf("%s: %v", ErrDrop, s.desc)
+		case ActionReject:
+			r.err = &RejectError{msg: fmt.Sprintf("%s: %v", ErrReject, s.desc)}
+		}
+		if len(s.hosts) > 0 {
+			r.hosts = &cidrTree{}
+			for _, h := range s.hosts {
+				if prefix, ok := parseHost(h); ok {
+					r.hosts.Insert(prefix)
+					r.prefixes = append(r.prefixes, prefix)
+				}
+			}
+		}
+		if s.localCIDR != "" {
+			r.local = &cidrTree{}
+			if prefix, ok := parseHost(s.localCIDR); ok {
+				r.local.Insert(prefix)
+			}
+		}
+		t.rules = append(t.rules, r)
+
+		if s.proto == "any" {
+			t.anyProto.add(s.port, &t.rules[i], i)
+			continue
+		}
+		for proto := 0; proto < 256; proto++ {
+			if !matchProto(s.proto, uint8(proto)) {
+				continue
+			}
+			idx, ok := t.protos[uint8(proto)]
+			if !ok {
+				idx = &portIndex{}
+				t.protos[uint8(proto)] = idx
+			}
+			idx.add(s.port, &t.rules[i], i)
+		}
+	}
+	return t
+}
+
+func (idx *portIndex) add(port string, r *rule, i int) {
+	if port == "any" || port == AnyPort {
+		idx.any.add(r, i)
+		return
+	}
+	for _, part := range strings.Split(port, ",") {
+		if part == "fragment" {
+			idx.fragment.add(r, i)
+			continue
+		}
+		ports, ranges, err := parsePortRule(part)
+		if err != nil {
+			continue
+		}
+		for _, p := range ports {
+			idx.addPort(p, r, i)
+		}
+		for _, pr := range ranges {
+			lo, hi := pr[0], pr[1]
+			if lo < 0 {
+				lo = 0
+			}
+			if hi > 65535 {
+				hi = 65535
+			}
+			if lo > hi {
+				continue
+			}
+			if hi-lo < maxExpandedRange {
+				for p := lo; p <= hi; p++ {
+					idx.addPort(p, r, i)
+				}
+				continue
+			}
+			idx.ranges = append(idx.ranges, portRange{lo: uint16(lo), hi: uint16(hi), rule: i})
+		}
+	}
+}
+
+func (idx *portIndex) addPort(port int, r *rule, i int) {
+	if port < 0 || port > 65535 {
+		return
+	}
+	if idx.ports == nil {
+		idx.ports = make(map[uint16]*ruleSet)
+	}
+	s, ok := idx.ports[uint16(port)]
+	if !ok {
+		s = &ruleSet{}
+		idx.ports[uint16(port)] = s
+	}
+	s.add(r, i)
+}
+
+func (s *ruleSet) add(r *rule, i int) {
+	if r.hosts == nil {
+		s.any = appendRule(s.any, i)
+		return
+	}
+	for _, prefix := range r.prefixes {
+		key, start, end := prefixKey(prefix)
+		if s.hosts[start/96] == nil {
+			s.hosts[start/96] = &hostNode{}
+		}
+		n := s.hosts[start/96]
+		for b := start; b < end; b++ {
+			c := bit(key, b)
+			if n.children[c] == nil {
+				n.children[c] = &hostNode{}
+			}
+			n = n.children[c]
+		}
+		n.rules = appendRule(n.rules, i)
+	}
+}
+
+// appendRule 同一条规则可能多次列出同一个端口或网段，只记录一次
+func appendRule(list []int, i int) []int {
+	if n := len(list); n > 0 && list[n-1] == i {
+		return list
+	}
+	return append(list, i)
+}
+
+// lookup 返回第一条匹配数据包的规则的序号，port 为规则要检查的端口，没有匹配的规则时返回 -1
+func (t *table) lookup(port uint16, p *packet.Packet, h *host.HostInfo) int {
+	best := -1
+	if idx, ok := t.protos[p.Protocol]; ok {
+		best = idx.lookup(t, best, port, p, h)
+	}
+	return t.anyProto.lookup(t, best, port, p, h)
+}
+
+// lookup 在索引中查找序号小于 best 的匹配规则。后续分片没有端口，只匹配 fragment 与 any
+func (idx *portIndex) lookup(t *table, best int, port uint16, p *packet.Packet, h *host.HostInfo) int {
+	if p.Fragment {
+		best = idx.fragment.lookup(t, best, p, h)
+		return idx.any.lookup(t, best, p, h)
+	}
+	if s, ok := idx.ports[port]; ok {
+		best = s.lookup(t, best, p, h)
+	}
+	best = idx.any.lookup(t, best, p, h)
+	for _, r := range idx.ranges {
+		if best >= 0 && r.rule >= best {
+			break
+		}
+		rule := &t.rules[r.rule]
+		if port >= r.lo && port <= r.hi && (rule.hosts == nil || rule.hosts.Contains(p.RemoteIP)) && rule.match(p, h) {
+			best = r.rule
+			break
+		}
+	}
+	return best
+}
+
+// lookup 沿对端地址在前缀树中的路径查找，路径上每个节点的规则都包含该地址
+func (s *ruleSet) lookup(t *table, best int, p *packet.Packet, h *host.HostInfo) int {
+	best = t.first(s.any, best, p, h)
+	start := addrStart(p.RemoteIP)
+	n := s.hosts[start/96]
+	for i := start; n != nil; i++ {
+		best = t.first(n.rules, best, p, h)
+		if i == 128 {
+			break
+		}
+		n = n.children[bit(p.RemoteIP, i)]
+	}
+	return best
+}
+
+// first 返回 list 中第一条匹配并且序号小于 best 的规则，没有时返回 best
+func (t *table) first(list []int, best int, p *packet.Packet, h *host.HostInfo) int {
+	for _, i := range list {
+		if best >= 0 && i >= best {
+			break
+		}
+		if t.rules[i].match(p, h) {
+			return i
+		}
+	}
+	return best
+}
+
+// match 检查协议、端口与对端地址之外的条件
+func (r *rule) match(p *packet.Packet, h *host.HostInfo) bool {
+	if r.local != nil && !r.local.Contains(p.LocalIP) {
+		return false
+	}
+	if r.icmp != nil && !r.icmp.match(p) {
+		return false
+	}
+	return matchPeer(r.name, r.groups, r.caName, h)
+}
+
+// parsePortRule 解析端口列表与端口范围
+func parsePortRule(rule string) ([]int, [][2]int, error) {
+	var ports []int
+	var ranges [][2]int
+	parts := strings.Split(rule, ",")
+	for _, part := range parts {
+		if strings.Contains(part, "-") {
+			rangeParts := strings.Split(part, "-")
+			if len(rangeParts) != 2 {
+				return nil, nil, fmt.Errorf("invalid port range format: %s", part)
+			}
+			start, err := strconv.Atoi(rangeParts[0])
+			if err != nil {
+				return nil, nil, err
+			}
+			end, err := strconv.Atoi(rangeParts[1])
+			if err != nil {
+				return nil, nil, err
+			}
+			if start > end {
+				return nil, nil, fmt.Errorf("start port greater than end port: %s", part)
+			}
+			ranges = append(ranges, [2]int{start, end})
+		} else {
+			port, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, nil, err
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports, ranges, nil
+}
+
+func portInRanges(port int, ranges [][2]int) bool {
+	for _, r := range ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
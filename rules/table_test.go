@@ -0,0 +1,203 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestCIDRTree(t *testing.T) {
+	tree := &cidrTree{}
+	tree.Insert(netip.MustParsePrefix("10.1.0.0/16"))
+	tree.Insert(netip.MustParsePrefix("10.1.2.0/24"))
+	tree.Insert(netip.MustParsePrefix("192.168.1.7/32"))
+	tree.Insert(netip.MustParsePrefix("fd00::/64"))
+
+	for ip, want := range map[string]bool{
+		"10.1.2.3":     true,
+		"10.1.200.3":   true,
+		"10.2.0.1":     false,
+		"192.168.1.7":  true,
+		"192.168.1.8":  false,
+		"fd00::1":      true,
+		"fd00:0:0:1::": false,
+	} {
+		vip, err := api.ParseVpnIp(ip)
+		assert.NoError(t, err)
+		assert.Equal(t, want, tree.Contains(vip), ip)
+	}
+
+	// 0.0.0.0/0 只包含 IPv4 地址
+	all := &cidrTree{}
+	all.Insert(netip.MustParsePrefix("0.0.0.0/0"))
+	assert.True(t, all.Contains(api.Ip2VpnIp([]byte{8, 8, 8, 8})))
+	assert.False(t, all.Contains(api.Ip2VpnIp(net.ParseIP("fd00::1"))))
+}
+
+// linearMatch 逐条检查规则的参考实现，返回第一条匹配的规则的序号
+func linearMatch(rules []config.InboundRule, p *packet.Packet) int {
+	for i, rule := range rules {
+		if !matchProto(rule.Proto, p.Protocol) {
+			continue
+		}
+		if !matchPortSpec(rule.Port, p.LocalPort, false) {
+			continue
+		}
+		matched := len(rule.Host) == 0
+		for _, host := range rule.Host {
+			_, network, err := net.ParseCIDR(host)
+			if (err == nil && network.Contains(p.RemoteIP.ToNetIP())) || host == p.RemoteIP.String() {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if rule.LocalCIDR != "" {
+			_, network, err := net.ParseCIDR(rule.LocalCIDR)
+			if err != nil || !network.Contains(p.LocalIP.ToNetIP()) {
+				continue
+			}
+		}
+		return i
+	}
+	return -1
+}
+
+var (
+	testProtos = []string{"tcp", "udp", "icmp", "any"}
+	testPorts  = []string{"any", "22", "80,443", "1000-2000", "1-65535", "8000-9000,53", "5-300", "x,25"}
+)
+
+func randomRules(r *rand.Rand, n int) []config.InboundRule {
+	rules := make([]config.InboundRule, n)
+	for i := range rules {
+		rule := config.InboundRule{
+			Proto:  testProtos[r.Intn(len(testProtos))],
+			Port:   testPorts[r.Intn(len(testPorts))],
+			Action: "allow",
+		}
+		if r.Intn(3) == 0 {
+			rule.Action = "deny"
+		}
+		for j := r.Intn(3); j > 0; j-- {
+			switch r.Intn(3) {
+			case 0:
+				rule.Host = append(rule.Host, fmt.Sprintf("10.%d.0.0/16", r.Intn(4)))
+			case 1:
+				rule.Host = append(rule.Host, fmt.Sprintf("10.%d.%d.0/24", r.Intn(4), r.Intn(4)))
+			default:
+				rule.Host = append(rule.Host, fmt.Sprintf("10.%d.%d.%d", r.Intn(4), r.Intn(4), r.Intn(4)))
+			}
+		}
+		if r.Intn(4) == 0 {
+			rule.LocalCIDR = fmt.Sprintf("192.168.%d.0/24", r.Intn(2))
+		}
+		rules[i] = rule
+	}
+	return rules
+}
+
+func randomPacket(r *rand.Rand) *packet.Packet {
+	protos := []uint8{packet.ProtoTCP, packet.ProtoUDP, packet.ProtoICMP, packet.ProtoICMPv6, 47}
+	ports := []uint16{0, 22, 25, 53, 80, 300, 443, 1500, 8500, 40000}
+	return &packet.Packet{
+		Protocol:  protos[r.Intn(len(protos))],
+		LocalPort: ports[r.Intn(len(ports))],
+		LocalIP:   api.Ip2VpnIp([]byte{192, 168, byte(r.Intn(2)), 1}),
+		RemoteIP:  api.Ip2VpnIp([]byte{10, byte(r.Intn(4)), byte(r.Intn(4)), byte(r.Intn(4))}),
+	}
+}
+
+func TestTable_MatchesLinear(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		rules := randomRules(r, 50)
+		tbl := compileInbound(rules)
+		for i := 0; i < 500; i++ {
+			p := randomPacket(r)
+			if !assert.Equal(t, linearMatch(rules, p), tbl.lookup(p.LocalPort, p, nil), "packet %s", p) {
+				return
+			}
+		}
+	}
+}
+
+// policyRules 生成类似实际策略的规则：每条规则允许一个主机或网段访问一个常用端口，其中夹杂少量拒绝规则
+func policyRules(r *rand.Rand, n int) []config.InboundRule {
+	ports := []string{"22", "80,443", "3306", "5432", "6379", "8000-8100", "9090", "any"}
+	rules := make([]config.InboundRule, n)
+	for i := range rules {
+		rule := config.InboundRule{
+			Proto:  testProtos[r.Intn(2)],
+			Port:   ports[r.Intn(len(ports))],
+			Host:   []string{fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff)},
+			Action: "allow",
+		}
+		if r.Intn(10) == 0 {
+			rule.Host[0] = fmt.Sprintf("10.%d.%d.0/24", i>>16, i>>8&0xff)
+			rule.Action = "deny"
+		}
+		rules[i] = rule
+	}
+	return rules
+}
+
+// policyPackets 生成访问规则中的主机的数据包，大约一半不匹配任何规则
+func policyPackets(r *rand.Rand, n int) []*packet.Packet {
+	ports := []uint16{22, 80, 443, 3306, 5432, 6379, 8050, 9090, 12345}
+	packets := make([]*packet.Packet, 1024)
+	for i := range packets {
+		host := r.Intn(2 * n)
+		packets[i] = &packet.Packet{
+			Protocol:  []uint8{packet.ProtoTCP, packet.ProtoUDP}[r.Intn(2)],
+			LocalPort: ports[r.Intn(len(ports))],
+			RemoteIP:  api.Ip2VpnIp([]byte{10, byte(host >> 16), byte(host >> 8), byte(host)}),
+		}
+	}
+	return packets
+}
+
+func TestTable_PolicyMatchesLinear(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	rules := policyRules(r, 1000)
+	tbl := compileInbound(rules)
+	for _, p := range policyPackets(r, 1000) {
+		assert.Equal(t, linearMatch(rules, p), tbl.lookup(p.LocalPort, p, nil), "packet %s", p)
+	}
+}
+
+func benchmarkInbound(b *testing.B, n int) {
+	r := rand.New(rand.NewSource(1))
+	rules := NewRules(nil, policyRules(r, n), WithDefaultAction("allow"))
+	packets := policyPackets(r, n)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = rules.match(rules.policy.Load(), packets[i%len(packets)], nil, true)
+	}
+}
+
+func BenchmarkRules_Inbound100(b *testing.B)  { benchmarkInbound(b, 100) }
+func BenchmarkRules_Inbound1000(b *testing.B) { benchmarkInbound(b, 1000) }
+func BenchmarkRules_Inbound5000(b *testing.B) { benchmarkInbound(b, 5000) }
+
+// BenchmarkLinear_Inbound1000 逐条检查的参考实现，作为对比
+func BenchmarkLinear_Inbound1000(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	rules := policyRules(r, 1000)
+	packets := policyPackets(r, 1000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearMatch(rules, packets[i%len(packets)])
+	}
+}
@@ -0,0 +1,123 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/host"
+	"github.com/am6737/nexus/transport/packet"
+	"strings"
+)
+
+// Trace 数据包在一个方向上逐条检查规则的过程
+type Trace struct {
+	Direction string
+	// Rule 匹配的规则的序号，Desc 为规则的描述，没有规则匹配时 Rule 为 -1，使用默认动作
+	Rule   int
+	Desc   string
+	Action string
+	// Mismatches 匹配的规则之前每条规则不匹配的原因
+	Mismatches []Mismatch
+}
+
+// Mismatch 一条规则不匹配数据包的原因
+type Mismatch struct {
+	Rule   int
+	Desc   string
+	Reason string
+}
+
+// Trace 逐条检查规则并记录每条规则不匹配的原因，结果与 Inbound、Outbound 检查规则的结果相同。
+// 不使用连接跟踪与分片记录，也不输出事件与计数，用于离线验证规则
+func (r *Rules) Trace(p *packet.Packet, h *host.HostInfo, direction string) Trace {
+	pol := r.policy.Load()
+	t, port, action := pol.outbound, p.RemotePort, pol.outboundAction
+	if direction == DirectionInbound {
+		t, port, action = pol.inbound, p.LocalPort, pol.inboundAction
+	}
+
+	tr := Trace{Direction: direction, Rule: -1, Action: actionOf(defaultVerdict(action))}
+	for i := range t.rules {
+		rule := &t.rules[i]
+		desc := rule.spec.desc.String()
+		if reason := rule.mismatch(port, p, h); reason != "" {
+			tr.Mismatches = append(tr.Mismatches, Mismatch{Rule: i, Desc: desc, Reason: reason})
+			continue
+		}
+		tr.Rule, tr.Desc, tr.Action = i, desc, actionOf(rule.err)
+		break
+	}
+	return tr
+}
+
+// actionOf 返回检查结果对应的动作，不认识的动作与 allow 一样放行
+func actionOf(err error) string {
+	switch {
+	case err == nil:
+		return ActionAllow
+	case IsReject(err):
+		return ActionReject
+	}
+	return ActionDeny
+}
+
+// mismatch 返回规则不匹配数据包的原因，匹配时返回空字符串
+func (r *rule) mismatch(port uint16, p *packet.Packet, h *host.HostInfo) string {
+	s := r.spec
+	if !matchProto(s.proto, p.Protocol) {
+		return fmt.Sprintf("proto %s does not match %s", packet.TypeName(p.Protocol), s.proto)
+	}
+	if !matchPortSpec(s.port, port, p.Fragment) {
+		if p.Fragment {
+			return fmt.Sprintf("later fragment does not match port %s", s.port)
+		}
+		return fmt.Sprintf("port %d does not match %s", port, s.port)
+	}
+	if r.hosts != nil && !r.hosts.Contains(p.RemoteIP) {
+		return fmt.Sprintf("remote %s is not in host %v", p.RemoteIP, s.hosts)
+	}
+	if r.local != nil && !r.local.Contains(p.LocalIP) {
+		return fmt.Sprintf("local %s is not in local_cidr %s", p.LocalIP, s.localCIDR)
+	}
+	if r.icmp != nil && !r.icmp.match(p) {
+		return fmt.Sprintf("icmp type %d code %d does not match icmp_type=%q icmp_code=%q", p.ICMPType, p.ICMPCode, s.icmpType, s.icmpCode)
+	}
+	if !matchPeer(r.name, r.groups, r.caName, h) {
+		if h == nil || h.Cert == nil {
+			return "peer has no certificate to match name, groups or ca_name"
+		}
+		d := h.Cert.Details
+		return fmt.Sprintf("peer certificate name=%s groups=%v ca_name=%s does not match name=%s groups=%v ca_name=%s",
+			d.Name, d.Groups, d.Issuer, r.name, r.groups, r.caName)
+	}
+	return ""
+}
+
+// matchPortSpec 与编译后的端口索引的匹配方式相同：后续分片只匹配 fragment 与 any，无法解析的部分被忽略
+func matchPortSpec(spec string, port uint16, fragment bool) bool {
+	if spec == "any" || spec == AnyPort {
+		return true
+	}
+	for _, part := range strings.Split(spec, ",") {
+		if part == "fragment" {
+			if fragment {
+				return true
+			}
+			continue
+		}
+		if fragment {
+			continue
+		}
+		ports, ranges, err := parsePortRule(part)
+		if err != nil {
+			continue
+		}
+		for _, p := range ports {
+			if p == int(port) {
+				return true
+			}
+		}
+		if portInRanges(int(port), ranges) {
+			return true
+		}
+	}
+	return false
+}
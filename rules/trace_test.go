@@ -0,0 +1,74 @@
+package rules
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/transport/packet"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestRules_Trace(t *testing.T) {
+	r := NewRules(
+		nil,
+		[]config.InboundRule{
+			{Port: "80", Proto: "tcp", Action: "allow"},
+			{Port: "22", Proto: "udp", Action: "allow"},
+			{Port: "22", Proto: "tcp", Host: []string{"10.1.0.0/16"}, Action: "allow"},
+			{Port: "22", Proto: "tcp", Groups: []string{"ops"}, Action: "allow"},
+			{Port: "22", Proto: "tcp", Action: "reject"},
+		},
+	)
+
+	p := &packet.Packet{
+		LocalIP:   api.Ip2VpnIp([]byte{10, 0, 0, 3}),
+		RemoteIP:  api.Ip2VpnIp([]byte{10, 0, 0, 2}),
+		LocalPort: 22,
+		Protocol:  packet.ProtoTCP,
+	}
+	tr := r.Trace(p, nil, DirectionInbound)
+	assert.Equal(t, 4, tr.Rule)
+	assert.Equal(t, ActionReject, tr.Action)
+	assert.Equal(t, []string{
+		"port 22 does not match 80",
+		"proto tcp does not match udp",
+		"remote 10.0.0.2 is not in host [10.1.0.0/16]",
+		"peer has no certificate to match name, groups or ca_name",
+	}, reasons(tr))
+
+	// 没有规则匹配时使用默认动作
+	p.LocalPort = 443
+	tr = r.Trace(p, nil, DirectionInbound)
+	assert.Equal(t, -1, tr.Rule)
+	assert.Equal(t, ActionDeny, tr.Action)
+	assert.Len(t, tr.Mismatches, 5)
+
+	tr = r.Trace(p, nil, DirectionOutbound)
+	assert.Equal(t, -1, tr.Rule)
+	assert.Empty(t, tr.Mismatches)
+}
+
+func reasons(tr Trace) []string {
+	var s []string
+	for _, m := range tr.Mismatches {
+		s = append(s, m.Reason)
+	}
+	return s
+}
+
+// TestRules_TraceMatchesTable Trace 逐条检查的结果与编译后的索引相同
+func TestRules_TraceMatchesTable(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		r := NewRules(nil, randomRules(rnd, 50))
+		for i := 0; i < 500; i++ {
+			p := randomPacket(rnd)
+			p.Fragment = rnd.Intn(10) == 0
+			want := r.policy.Load().inbound.lookup(p.LocalPort, p, nil)
+			if !assert.Equal(t, want, r.Trace(p, nil, DirectionInbound).Rule, "packet %s", p) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package shaping
+
+import (
+	"fmt"
+	"github.com/rcrowley/go-metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket 令牌桶，令牌以字节为单位按 rate 的速率补充，最多积累 burst 个
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	metricBytes   metrics.Counter
+	metricDropped metrics.Counter
+	metricDelayed metrics.Counter
+}
+
+// NewBucket 创建一个满的令牌桶，name 为指标的前缀
+func NewBucket(name string, rate, burst float64) *Bucket {
+	return &Bucket{
+		rate:          rate,
+		burst:         burst,
+		tokens:        burst,
+		metricBytes:   metrics.GetOrRegisterCounter(name+".bytes", nil),
+		metricDropped: metrics.GetOrRegisterCounter(name+".dropped", nil),
+		metricDelayed: metrics.GetOrRegisterCounter(name+".delayed", nil),
+	}
+}
+
+// take 取出 n 个令牌，令牌不足时计算需要等待的时长。等待超过 maxWait 时不取出令牌并返回 false，
+// 否则令牌可以透支，之后的数据包需要等待透支的部分补充回来
+func (b *Bucket) take(n int, now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	need := float64(n)
+	if b.tokens >= need {
+		b.tokens -= need
+		return 0, true
+	}
+	wait := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens -= need
+	return wait, true
+}
+
+// refund 退回 take 取出的令牌
+func (b *Bucket) refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// ParseRate 解析速率，返回每秒的字节数。以 bit 结尾的单位为比特，k、m、g 为 1000 的倍数，
+// 没有单位时为字节
+func ParseRate(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	bits := strings.HasSuffix(s, "bit")
+	if bits {
+		s = strings.TrimSuffix(s, "bit")
+	} else {
+		s = strings.TrimSuffix(s, "b")
+	}
+
+	v, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	if bits {
+		v /= 8
+	}
+	return v, nil
+}
+
+// ParseSize 解析以字节为单位的大小，例如 "64kb"
+func ParseSize(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	v, err := parseSize(strings.TrimSuffix(s, "b"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v, nil
+}
+
+func parseSize(s string) (float64, error) {
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1e3
+	case strings.HasSuffix(s, "m"):
+		mult = 1e6
+	case strings.HasSuffix(s, "g"):
+		mult = 1e9
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return v * mult, nil
+}
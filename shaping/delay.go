@@ -0,0 +1,100 @@
+package shaping
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// delayQueue 在到期后依次执行 queue 模式下需要等待令牌的数据包，所有数据包由同一个协程按到期时间执行，
+// 到期时间相同时按加入的顺序执行。同一个令牌桶的数据包透支令牌后等待的时长递增，不会乱序
+type delayQueue struct {
+	mu    sync.Mutex
+	items delayHeap
+	seq   uint64
+	// wake 有新的数据包排在最前面时唤醒执行的协程，第一次加入数据包时创建
+	wake chan struct{}
+}
+
+type delayed struct {
+	at  time.Time
+	seq uint64
+	f   func()
+}
+
+// push 在 at 之后执行 f
+func (q *delayQueue) push(at time.Time, f func()) {
+	q.mu.Lock()
+	if q.wake == nil {
+		q.wake = make(chan struct{}, 1)
+		go q.run()
+	}
+	q.seq++
+	heap.Push(&q.items, delayed{at: at, seq: q.seq, f: f})
+	first := q.items[0].seq == q.seq
+	q.mu.Unlock()
+
+	if first {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *delayQueue) run() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		q.mu.Lock()
+		wait := time.Duration(-1)
+		for len(q.items) > 0 {
+			if d := time.Until(q.items[0].at); d > 0 {
+				wait = d
+				break
+			}
+			it := heap.Pop(&q.items).(delayed)
+			q.mu.Unlock()
+			it.f()
+			q.mu.Lock()
+		}
+		q.mu.Unlock()
+
+		if wait < 0 {
+			<-q.wake
+			continue
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-q.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+	}
+}
+
+// delayHeap 按到期时间与加入顺序排列的最小堆
+type delayHeap []delayed
+
+func (h delayHeap) Len() int { return len(h) }
+
+func (h delayHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h delayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(delayed)) }
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = delayed{}
+	*h = old[:len(old)-1]
+	return it
+}
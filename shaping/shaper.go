@@ -0,0 +1,253 @@
+package shaping
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxDelay queue 模式下数据包默认最多等待的时长
+	DefaultMaxDelay = 100 * time.Millisecond
+	// minBurst 令牌桶至少可以容纳的字节数，避免无法通过一个最大的数据包
+	minBurst = 16 * 1500
+)
+
+// Shaper 按配置的全局、节点与证书组速率限制发出与收到的 overlay 流量，
+// 一个数据包需要同时从所有匹配的令牌桶中取出令牌
+type Shaper struct {
+	egress  *Bucket
+	ingress *Bucket
+	peers   map[api.VpnIP]direction
+	groups  []group
+
+	queue    bool
+	maxDelay time.Duration
+	delays   delayQueue
+
+	now func() time.Time
+}
+
+type direction struct {
+	egress  *Bucket
+	ingress *Bucket
+}
+
+type group struct {
+	groups []string
+	direction
+}
+
+// ShaperOption 修改 Shaper 的默认设置
+type ShaperOption func(*Shaper)
+
+// WithClock 使用 now 代替 time.Now 计算令牌的补充，等待令牌的数据包仍然按实际时间延迟执行
+func WithClock(now func() time.Time) ShaperOption {
+	return func(s *Shaper) {
+		s.now = now
+	}
+}
+
+// New 根据配置创建 Shaper，没有配置任何速率时返回 nil
+func New(c config.ShapingConfig, opts ...ShaperOption) (*Shaper, error) {
+	s := &Shaper{
+		peers:    make(map[api.VpnIP]direction),
+		maxDelay: c.MaxDelay,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	switch c.Mode {
+	case "", "drop":
+	case "queue":
+		s.queue = true
+		if s.maxDelay <= 0 {
+			s.maxDelay = DefaultMaxDelay
+		}
+	default:
+		return nil, fmt.Errorf("shaping.mode must be drop or queue, got %q", c.Mode)
+	}
+
+	var err error
+	if s.egress, err = newBucket("shaping.egress", c.Egress); err != nil {
+		return nil, err
+	}
+	if s.ingress, err = newBucket("shaping.ingress", c.Ingress); err != nil {
+		return nil, err
+	}
+
+	for ip, l := range c.Peers {
+		vip, err := api.ParseVpnIp(ip)
+		if err != nil {
+			return nil, fmt.Errorf("shaping.peers %s: %v", ip, err)
+		}
+		d, err := newDirection("shaping.peer."+vip.String(), l)
+		if err != nil {
+			return nil, fmt.Errorf("shaping.peers %s: %v", ip, err)
+		}
+		if d.egress != nil {
+			s.peers[vip] = d
+		}
+	}
+
+	for i, gc := range c.Groups {
+		name := gc.Name
+		if name == "" {
+			name = strings.Join(gc.Groups, "+")
+		}
+		if len(gc.Groups) == 0 {
+			return nil, fmt.Errorf("shaping.groups %d: groups must not be empty", i)
+		}
+		d, err := newDirection("shaping.group."+name, gc.ShapingLimit)
+		if err != nil {
+			return nil, fmt.Errorf("shaping.groups %s: %v", name, err)
+		}
+		if d.egress != nil {
+			s.groups = append(s.groups, group{groups: gc.Groups, direction: d})
+		}
+	}
+
+	if s.egress == nil && s.ingress == nil && len(s.peers) == 0 && len(s.groups) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Egress 判断经过隧道发往节点 vip 的长度为 n 的数据包是否可以发送。vip 为隧道的对端，即下一跳节点，
+// 而不是数据包的目标地址，发往节点通告的网段的流量计入该节点的限额。h 为该节点的主机信息，按证书中的组匹配主机组的限额。
+// queue 模式下令牌不足时返回需要等待的时长，调用方通过 Delay 在等待之后发送，不阻塞读取数据包的协程
+func (s *Shaper) Egress(vip api.VpnIP, h *host.HostInfo, n int) (time.Duration, bool) {
+	var buckets [8]*Bucket
+	bs := append(buckets[:0], s.egress)
+	bs = s.match(bs, vip, h, true)
+	return s.take(bs, n)
+}
+
+// Ingress 判断经过隧道从节点 vip 收到的长度为 n 的数据包是否可以接收，vip 为发送消息的节点而不是数据包的源地址，
+// 参数与返回值与 Egress 相同
+func (s *Shaper) Ingress(vip api.VpnIP, h *host.HostInfo, n int) (time.Duration, bool) {
+	var buckets [8]*Bucket
+	bs := append(buckets[:0], s.ingress)
+	bs = s.match(bs, vip, h, false)
+	return s.take(bs, n)
+}
+
+// Delay 在 d 之后调用 f，f 在 Shaper 的协程中执行。先取出令牌的数据包先执行，同一个令牌桶的数据包不会乱序
+func (s *Shaper) Delay(d time.Duration, f func()) {
+	s.delays.push(time.Now().Add(d), f)
+}
+
+// match 把隧道的对端 vip 匹配的节点与主机组的令牌桶追加到 bs
+func (s *Shaper) match(bs []*Bucket, vip api.VpnIP, h *host.HostInfo, egress bool) []*Bucket {
+	if d, ok := s.peers[vip]; ok {
+		bs = append(bs, d.pick(egress))
+	}
+	if len(s.groups) == 0 || h == nil || h.Cert == nil {
+		return bs
+	}
+	for _, g := range s.groups {
+		if inGroups(h, g.groups) {
+			bs = append(bs, g.pick(egress))
+		}
+	}
+	return bs
+}
+
+// inGroups 与防火墙规则的 groups 相同，对端需要属于其中所有的组
+func inGroups(h *host.HostInfo, groups []string) bool {
+	for _, g := range groups {
+		if !h.Cert.Details.InGroup(g) {
+			return false
+		}
+	}
+	return true
+}
+
+// take 从所有令牌桶中取出 n 个令牌，任何一个不足时退回已经取出的令牌。
+// 返回数据包需要等待的时长，drop 模式下总是为 0
+func (s *Shaper) take(bs []*Bucket, n int) (time.Duration, bool) {
+	var maxWait time.Duration
+	if s.queue {
+		maxWait = s.maxDelay
+	}
+
+	now := s.now()
+	var wait time.Duration
+	for i, b := range bs {
+		if b == nil {
+			continue
+		}
+		w, ok := b.take(n, now, maxWait)
+		if !ok {
+			for _, taken := range bs[:i] {
+				if taken != nil {
+					taken.refund(n)
+				}
+			}
+			b.metricDropped.Inc(1)
+			return 0, false
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+
+	for _, b := range bs {
+		if b != nil {
+			b.metricBytes.Inc(int64(n))
+			if wait > 0 {
+				b.metricDelayed.Inc(1)
+			}
+		}
+	}
+	return wait, true
+}
+
+func (d direction) pick(egress bool) *Bucket {
+	if egress {
+		return d.egress
+	}
+	return d.ingress
+}
+
+// newDirection 为发出与收到的流量分别创建令牌桶，没有配置速率时两者都为 nil
+func newDirection(name string, l config.ShapingLimit) (direction, error) {
+	egress, err := newBucket(name+".egress", l)
+	if err != nil || egress == nil {
+		return direction{}, err
+	}
+	ingress, err := newBucket(name+".ingress", l)
+	if err != nil {
+		return direction{}, err
+	}
+	return direction{egress: egress, ingress: ingress}, nil
+}
+
+// newBucket 没有配置速率时返回 nil
+func newBucket(name string, l config.ShapingLimit) (*Bucket, error) {
+	if l.Rate == "" {
+		return nil, nil
+	}
+	rate, err := ParseRate(l.Rate)
+	if err != nil {
+		return nil, err
+	}
+	if rate <= 0 {
+		return nil, nil
+	}
+
+	burst := rate / 10
+	if l.Burst != "" {
+		if burst, err = ParseSize(l.Burst); err != nil {
+			return nil, err
+		}
+	}
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return NewBucket(name, rate, burst), nil
+}
@@ -0,0 +1,169 @@
+package shaping
+
+import (
+	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/api/cert"
+	"github.com/am6737/nexus/config"
+	"github.com/am6737/nexus/host"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]float64{
+		"8bit":     1,
+		"20mbit":   2.5e6,
+		"500kbit":  62500,
+		"2MB":      2e6,
+		"100kb":    1e5,
+		"1024":     1024,
+		"1.5gbit ": 1.875e8,
+	}
+	for s, want := range tests {
+		got, err := ParseRate(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{"fast", "-1mbit", "mbit"} {
+		_, err := ParseRate(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestNew(t *testing.T) {
+	s, err := New(config.ShapingConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	_, err = New(config.ShapingConfig{Mode: "shape"})
+	assert.Error(t, err)
+
+	_, err = New(config.ShapingConfig{Peers: map[string]config.ShapingLimit{"peer": {Rate: "1mbit"}}})
+	assert.Error(t, err)
+
+	_, err = New(config.ShapingConfig{Groups: []config.ShapingGroup{{Name: "g", ShapingLimit: config.ShapingLimit{Rate: "1mbit"}}}})
+	assert.Error(t, err)
+}
+
+// newTestShaper 返回时间静止的 Shaper，修改 elapsed 推进时间
+func newTestShaper(t *testing.T, c config.ShapingConfig) (*Shaper, *time.Duration) {
+	now := time.Now()
+	var elapsed time.Duration
+	s, err := New(c, WithClock(func() time.Time { return now.Add(elapsed) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, &elapsed
+}
+
+// allowed 只返回数据包是否可以发送
+func allowed(_ time.Duration, ok bool) bool {
+	return ok
+}
+
+func TestShaper_Drop(t *testing.T) {
+	peer := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+	other := api.Ip2VpnIp(net.IPv4(192, 168, 100, 3).To4())
+	s, _ := newTestShaper(t, config.ShapingConfig{
+		Peers: map[string]config.ShapingLimit{
+			"192.168.100.2": {Rate: "1mb", Burst: "30kb"},
+		},
+	})
+
+	// 突发用完后丢弃
+	for i := 0; i < 20; i++ {
+		assert.True(t, allowed(s.Egress(peer, nil, 1500)))
+	}
+	assert.False(t, allowed(s.Egress(peer, nil, 1500)))
+	// 其他节点与收到的流量不受影响
+	assert.True(t, allowed(s.Egress(other, nil, 1500)))
+	assert.True(t, allowed(s.Ingress(peer, nil, 1500)))
+}
+
+func TestShaper_Group(t *testing.T) {
+	a := api.Ip2VpnIp(net.IPv4(10, 1, 0, 1).To4())
+	b := api.Ip2VpnIp(net.IPv4(10, 1, 0, 2).To4())
+	c := api.Ip2VpnIp(net.IPv4(10, 1, 0, 3).To4())
+	peer := func(groups ...string) *host.HostInfo {
+		return &host.HostInfo{Cert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Groups: groups}}}
+	}
+	ha, hb, hc := peer("branch", "dev"), peer("branch"), peer("dev")
+	s, _ := newTestShaper(t, config.ShapingConfig{
+		Egress: config.ShapingLimit{Rate: "10mb", Burst: "1mb"},
+		Groups: []config.ShapingGroup{
+			{Groups: []string{"branch"}, ShapingLimit: config.ShapingLimit{Rate: "1mb", Burst: "30kb"}},
+		},
+	})
+
+	// 证书属于同一组的主机共享限额
+	for i := 0; i < 10; i++ {
+		assert.True(t, allowed(s.Egress(a, ha, 1500)))
+		assert.True(t, allowed(s.Egress(b, hb, 1500)))
+	}
+	assert.False(t, allowed(s.Egress(a, ha, 1500)))
+	assert.False(t, allowed(s.Egress(b, hb, 1500)))
+	// 不属于该组或者没有证书的主机不受影响
+	assert.True(t, allowed(s.Egress(c, hc, 1500)))
+	assert.True(t, allowed(s.Egress(c, nil, 1500)))
+	assert.True(t, allowed(s.Egress(c, &host.HostInfo{}, 1500)))
+
+	// 被组丢弃的数据包不占用全局限额
+	assert.InDelta(t, 1e6-23*1500, s.egress.tokens, 1)
+}
+
+func TestShaper_Queue(t *testing.T) {
+	s, elapsed := newTestShaper(t, config.ShapingConfig{
+		Mode:     "queue",
+		MaxDelay: 50 * time.Millisecond,
+		Egress:   config.ShapingLimit{Rate: "1mb", Burst: "24kb"},
+	})
+	vip := api.Ip2VpnIp(net.IPv4(192, 168, 100, 2).To4())
+
+	for i := 0; i < 16; i++ {
+		wait, ok := s.Egress(vip, nil, 1500)
+		assert.True(t, ok)
+		assert.Zero(t, wait)
+	}
+
+	// 令牌不足时返回需要等待的时长，之后的数据包等待透支的部分补充回来
+	wait, ok := s.Egress(vip, nil, 10000)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Millisecond, wait)
+	wait, ok = s.Egress(vip, nil, 10000)
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Millisecond, wait)
+
+	// 需要等待的时长超过 MaxDelay 时丢弃
+	_, ok = s.Egress(vip, nil, 40000)
+	assert.False(t, ok)
+
+	*elapsed = 20 * time.Millisecond
+	wait, ok = s.Egress(vip, nil, 1500)
+	assert.True(t, ok)
+	assert.Equal(t, 1500*time.Microsecond, wait)
+}
+
+func TestShaper_Delay(t *testing.T) {
+	s, err := New(config.ShapingConfig{Mode: "queue", Egress: config.ShapingLimit{Rate: "1mb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 按到期时间执行，到期时间相同时按加入的顺序执行
+	done := make(chan int, 4)
+	start := time.Now()
+	s.delays.push(start.Add(30*time.Millisecond), func() { done <- 3 })
+	s.delays.push(start.Add(10*time.Millisecond), func() { done <- 1 })
+	s.delays.push(start.Add(10*time.Millisecond), func() { done <- 2 })
+	s.Delay(0, func() { done <- 0 })
+
+	var got []int
+	for i := 0; i < 4; i++ {
+		got = append(got, <-done)
+	}
+	assert.Equal(t, []int{0, 1, 2, 3}, got)
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+}
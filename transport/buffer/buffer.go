@@ -0,0 +1,85 @@
+package buffer
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// Headroom 数据包前预留的空间，用于就地写入消息头部与 nonce
+	Headroom = 64
+	// MaxPacket 缓冲区可以容纳的最大数据包
+	MaxPacket = 9001
+	// Tailroom 数据包后预留的空间，用于就地写入认证标签
+	Tailroom = 64
+
+	Size = Headroom + MaxPacket + Tailroom
+)
+
+var pool = sync.Pool{
+	New: func() any {
+		return &Buffer{buf: make([]byte, Size)}
+	},
+}
+
+// Buffer 数据路径上传递的数据包缓冲区，从 tun 读取、规则检查、加密到 UDP 写出都使用同一块内存，
+// 数据包前后预留了空间，加密时不需要复制数据包
+type Buffer struct {
+	buf []byte
+	// start 与 end 为当前数据包在 buf 中的位置
+	start int
+	end   int
+}
+
+// Get 从池中取出一个空的缓冲区
+func Get() *Buffer {
+	b := pool.Get().(*Buffer)
+	b.start, b.end = Headroom, Headroom
+	return b
+}
+
+// Release 把缓冲区放回池中，之后不能再使用 b 以及从 b 得到的切片
+func (b *Buffer) Release() {
+	pool.Put(b)
+}
+
+// Bytes 返回当前的数据包
+func (b *Buffer) Bytes() []byte {
+	return b.buf[b.start:b.end]
+}
+
+// Len 返回当前数据包的长度
+func (b *Buffer) Len() int {
+	return b.end - b.start
+}
+
+// Space 返回可以写入数据包的空间，例如作为读取 tun 的缓冲区，写入后调用 SetLen
+func (b *Buffer) Space() []byte {
+	return b.buf[Headroom : Headroom+MaxPacket]
+}
+
+// SetLen 把当前数据包设置为 Space 的前 n 个字节
+func (b *Buffer) SetLen(n int) {
+	b.start, b.end = Headroom, Headroom+n
+}
+
+// Set 把 p 复制到缓冲区作为当前数据包
+func (b *Buffer) Set(p []byte) error {
+	if len(p) > MaxPacket {
+		return fmt.Errorf("packet of %d bytes exceeds the buffer size %d", len(p), MaxPacket)
+	}
+	b.SetLen(copy(b.Space(), p))
+	return nil
+}
+
+// Prepend 把数据包向前扩展 n 个字节并返回扩展出的部分，超出 Headroom 时 panic
+func (b *Buffer) Prepend(n int) []byte {
+	b.start -= n
+	return b.buf[b.start : b.start+n]
+}
+
+// Append 把数据包向后扩展 n 个字节并返回扩展出的部分，超出 Tailroom 时 panic
+func (b *Buffer) Append(n int) []byte {
+	b.end += n
+	return b.buf[b.end-n : b.end]
+}
@@ -0,0 +1,38 @@
+package buffer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBuffer(t *testing.T) {
+	b := Get()
+	defer b.Release()
+	assert.Equal(t, 0, b.Len())
+
+	n := copy(b.Space(), "payload")
+	b.SetLen(n)
+	assert.Equal(t, []byte("payload"), b.Bytes())
+
+	copy(b.Prepend(4), "head")
+	copy(b.Append(4), "tail")
+	assert.Equal(t, []byte("headpayloadtail"), b.Bytes())
+
+	assert.NoError(t, b.Set([]byte("other")))
+	assert.Equal(t, []byte("other"), b.Bytes())
+	assert.Error(t, b.Set(make([]byte, MaxPacket+1)))
+
+	assert.Panics(t, func() { b.Prepend(Headroom + 1) })
+}
+
+func TestBuffer_Allocations(t *testing.T) {
+	Get().Release()
+	allocs := testing.AllocsPerRun(100, func() {
+		b := Get()
+		b.SetLen(copy(b.Space(), "payload"))
+		b.Prepend(16)
+		b.Append(16)
+		b.Release()
+	})
+	assert.Zero(t, allocs)
+}
@@ -0,0 +1,142 @@
+package compress
+
+import (
+	"fmt"
+	"github.com/am6737/nexus/transport/buffer"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"runtime"
+	"sync"
+)
+
+// Algorithm 载荷的压缩算法，记录在消息头部 Reserved 的低 4 位
+type Algorithm uint8
+
+const (
+	None Algorithm = iota
+	Zstd
+	S2
+)
+
+// Supported 本节点可以解压的算法的位图，握手时通告给对端，对端只会使用其中的算法压缩发给本节点的消息
+const Supported uint16 = 1<<Zstd | 1<<S2
+
+// minSize 小于该长度的载荷不压缩
+const minSize = 64
+
+var (
+	// zstdEncoder 与 zstdDecoder 的 EncodeAll 与 DecodeAll 可以并发调用
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+
+	scratchPool = sync.Pool{
+		New: func() any {
+			b := make([]byte, s2.MaxEncodedLen(buffer.MaxPacket))
+			return &b
+		},
+	}
+)
+
+func init() {
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0)),
+		zstd.WithZeroFrames(true),
+	)
+	if err != nil {
+		panic(err)
+	}
+	zstdDecoder, err = zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(runtime.GOMAXPROCS(0)),
+		zstd.WithDecoderMaxMemory(buffer.MaxPacket),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Parse 解析配置中的算法名称，空字符串表示不压缩
+func Parse(s string) (Algorithm, error) {
+	switch s {
+	case "", "none":
+		return None, nil
+	case "zstd":
+		return Zstd, nil
+	case "s2":
+		return S2, nil
+	}
+	return None, fmt.Errorf("unknown compression %q", s)
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case None:
+		return "none"
+	case Zstd:
+		return "zstd"
+	case S2:
+		return "s2"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(a))
+}
+
+// Negotiate 返回发给可以解压 supported 中算法的对端时使用的算法，对端不支持 a 时不压缩
+func (a Algorithm) Negotiate(supported uint16) Algorithm {
+	if a == None || supported&(1<<a) == 0 {
+		return None
+	}
+	return a
+}
+
+// Compress 用算法 a 就地压缩 b 中的载荷，载荷太小或者压缩后没有变小时保持不变并返回 false
+func Compress(a Algorithm, b *buffer.Buffer) bool {
+	if a == None || b.Len() < minSize {
+		return false
+	}
+
+	s := scratchPool.Get().(*[]byte)
+	defer scratchPool.Put(s)
+
+	var out []byte
+	switch a {
+	case Zstd:
+		out = zstdEncoder.EncodeAll(b.Bytes(), (*s)[:0])
+	case S2:
+		out = s2.Encode(*s, b.Bytes())
+	default:
+		return false
+	}
+	if len(out) >= b.Len() {
+		return false
+	}
+	return b.Set(out) == nil
+}
+
+// Decompress 用算法 a 把 src 解压到 dst，解压后的数据包不能超过 buffer.MaxPacket
+func Decompress(a Algorithm, dst *buffer.Buffer, src []byte) error {
+	space := dst.Space()
+	switch a {
+	case Zstd:
+		out, err := zstdDecoder.DecodeAll(src, space[:0])
+		if err != nil {
+			return err
+		}
+		return dst.Set(out)
+	case S2:
+		n, err := s2.DecodedLen(src)
+		if err != nil {
+			return err
+		}
+		if n > len(space) {
+			return fmt.Errorf("decompressed packet of %d bytes is too large", n)
+		}
+		out, err := s2.Decode(space, src)
+		if err != nil {
+			return err
+		}
+		dst.SetLen(len(out))
+		return nil
+	}
+	return fmt.Errorf("unsupported compression %s", a)
+}
@@ -0,0 +1,63 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/am6737/nexus/transport/buffer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n"), 30)
+	for _, a := range []Algorithm{Zstd, S2} {
+		t.Run(a.String(), func(t *testing.T) {
+			b := buffer.Get()
+			defer b.Release()
+			assert.NoError(t, b.Set(text))
+			assert.True(t, Compress(a, b))
+			assert.Less(t, b.Len(), len(text))
+
+			out := buffer.Get()
+			defer out.Release()
+			assert.NoError(t, Decompress(a, out, b.Bytes()))
+			assert.Equal(t, text, out.Bytes())
+
+			assert.Error(t, Decompress(a, out, []byte("not compressed")))
+		})
+	}
+}
+
+func TestCompress_Incompressible(t *testing.T) {
+	random := make([]byte, 1400)
+	_, _ = rand.Read(random)
+
+	b := buffer.Get()
+	defer b.Release()
+	for _, a := range []Algorithm{None, Zstd, S2} {
+		assert.NoError(t, b.Set(random))
+		assert.False(t, Compress(a, b))
+		assert.Equal(t, random, b.Bytes())
+	}
+
+	// 太小的载荷不压缩
+	assert.NoError(t, b.Set(make([]byte, minSize-1)))
+	assert.False(t, Compress(S2, b))
+}
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, Zstd, Zstd.Negotiate(Supported))
+	assert.Equal(t, S2, S2.Negotiate(1<<S2))
+	assert.Equal(t, None, Zstd.Negotiate(1<<S2))
+	assert.Equal(t, None, Zstd.Negotiate(0))
+	assert.Equal(t, None, None.Negotiate(Supported))
+
+	a, err := Parse("zstd")
+	assert.NoError(t, err)
+	assert.Equal(t, Zstd, a)
+	a, err = Parse("")
+	assert.NoError(t, err)
+	assert.Equal(t, None, a)
+	_, err = Parse("lz4")
+	assert.Error(t, err)
+}
@@ -0,0 +1,204 @@
+package fragment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderLen 分片头部长度：4 字节编号 | 1 字节序号 | 1 字节分片数 | 2 字节保留
+	HeaderLen = 8
+	// MaxFragments 一个数据包最多切分的分片数
+	MaxFragments = 64
+
+	// DefaultBudget 默认用于重组的内存上限
+	DefaultBudget = 4 << 20
+	// DefaultTimeout 默认的重组超时，超时后已收到的分片被丢弃
+	DefaultTimeout = 5 * time.Second
+)
+
+var (
+	ErrHeaderTooShort = errors.New("fragment header is too short")
+	ErrOverBudget     = errors.New("fragment reassembly is over budget")
+)
+
+// Header 分片头部，位于加密的载荷之前，整个分片消息都被加密
+type Header struct {
+	ID    uint32
+	Index uint8
+	Count uint8
+}
+
+// Encode 把头部写入 b，b 至少需要 HeaderLen 字节
+func (h Header) Encode(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], h.ID)
+	b[4] = h.Index
+	b[5] = h.Count
+	b[6], b[7] = 0, 0
+}
+
+// Decode 解析 b 开头的分片头部
+func Decode(b []byte) (Header, error) {
+	if len(b) < HeaderLen {
+		return Header{}, ErrHeaderTooShort
+	}
+	h := Header{
+		ID:    binary.BigEndian.Uint32(b[0:4]),
+		Index: b[4],
+		Count: b[5],
+	}
+	if h.Count == 0 || h.Count > MaxFragments || h.Index >= h.Count {
+		return Header{}, fmt.Errorf("invalid fragment %d/%d", h.Index, h.Count)
+	}
+	return h, nil
+}
+
+// Split 计算把长度为 n 的数据包切分为载荷不超过 max 的分片时的分片数与每个分片的载荷长度，
+// 除最后一个分片外各分片长度相同
+func Split(n, max int) (count, size int, err error) {
+	if max <= 0 {
+		return 0, 0, fmt.Errorf("invalid fragment size %d", max)
+	}
+	count = (n + max - 1) / max
+	if count > MaxFragments {
+		return 0, 0, fmt.Errorf("packet of %d bytes needs more than %d fragments", n, MaxFragments)
+	}
+	size = (n + count - 1) / count
+	return count, size, nil
+}
+
+type key struct {
+	src netip.AddrPort
+	id  uint32
+}
+
+type entry struct {
+	parts    [][]byte
+	received int
+	size     int
+	created  time.Time
+}
+
+// Reassembler 按来源地址与编号重组分片，缓存的分片总长度不超过 budget，
+// 超过 timeout 仍未收齐的数据包被丢弃
+type Reassembler struct {
+	mu      sync.Mutex
+	budget  int
+	used    int
+	timeout time.Duration
+	pending map[key]*entry
+	swept   time.Time
+
+	now func() time.Time
+}
+
+func NewReassembler(budget int, timeout time.Duration) *Reassembler {
+	if budget <= 0 {
+		budget = DefaultBudget
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Reassembler{
+		budget:  budget,
+		timeout: timeout,
+		pending: make(map[key]*entry),
+		now:     time.Now,
+	}
+}
+
+// Add 记录从 src 收到的一个分片，p 在返回后可以被复用。
+// 收齐全部分片时返回重组后的数据包
+func (r *Reassembler) Add(src netip.AddrPort, h Header, p []byte) ([]byte, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if now.Sub(r.swept) > r.timeout/2 {
+		r.sweep(now)
+	}
+
+	k := key{src: src, id: h.ID}
+	e, ok := r.pending[k]
+	if !ok {
+		if h.Count == 1 {
+			return append([]byte(nil), p...), true, nil
+		}
+		e = &entry{parts: make([][]byte, h.Count), created: now}
+		r.pending[k] = e
+	}
+	if int(h.Count) != len(e.parts) {
+		r.drop(k, e)
+		return nil, false, fmt.Errorf("fragment count changed from %d to %d", len(e.parts), h.Count)
+	}
+	if e.parts[h.Index] != nil {
+		return nil, false, nil
+	}
+
+	for r.used+len(p) > r.budget {
+		if !r.evictOldest(k) {
+			r.drop(k, e)
+			return nil, false, ErrOverBudget
+		}
+	}
+
+	e.parts[h.Index] = append([]byte(nil), p...)
+	e.received++
+	e.size += len(p)
+	r.used += len(p)
+	if e.received < len(e.parts) {
+		return nil, false, nil
+	}
+
+	out := make([]byte, 0, e.size)
+	for _, part := range e.parts {
+		out = append(out, part...)
+	}
+	r.drop(k, e)
+	return out, true, nil
+}
+
+// Len 返回正在重组的数据包数量
+func (r *Reassembler) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+// sweep 丢弃超时的数据包，调用方必须持有锁
+func (r *Reassembler) sweep(now time.Time) {
+	r.swept = now
+	for k, e := range r.pending {
+		if now.Sub(e.created) > r.timeout {
+			r.drop(k, e)
+		}
+	}
+}
+
+// evictOldest 丢弃除 keep 之外最早的数据包，调用方必须持有锁
+func (r *Reassembler) evictOldest(keep key) bool {
+	var (
+		oldest key
+		found  *entry
+	)
+	for k, e := range r.pending {
+		if k != keep && e.size > 0 && (found == nil || e.created.Before(found.created)) {
+			oldest, found = k, e
+		}
+	}
+	if found == nil {
+		return false
+	}
+	r.drop(oldest, found)
+	return true
+}
+
+// drop 调用方必须持有锁
+func (r *Reassembler) drop(k key, e *entry) {
+	r.used -= e.size
+	delete(r.pending, k)
+}
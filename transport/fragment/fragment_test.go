@@ -0,0 +1,105 @@
+package fragment
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	b := make([]byte, HeaderLen)
+	Header{ID: 0xdeadbeef, Index: 2, Count: 3}.Encode(b)
+	h, err := Decode(b)
+	assert.NoError(t, err)
+	assert.Equal(t, Header{ID: 0xdeadbeef, Index: 2, Count: 3}, h)
+
+	_, err = Decode(b[:4])
+	assert.ErrorIs(t, err, ErrHeaderTooShort)
+
+	Header{Index: 3, Count: 3}.Encode(b)
+	_, err = Decode(b)
+	assert.Error(t, err)
+}
+
+func TestSplit(t *testing.T) {
+	count, size, err := Split(1400, 1292)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 700, size)
+
+	count, size, err = Split(1000, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 1000, size)
+
+	_, _, err = Split(9000, 100)
+	assert.Error(t, err)
+}
+
+func TestReassembler(t *testing.T) {
+	r := NewReassembler(0, 0)
+	src := netip.MustParseAddrPort("10.0.0.1:4242")
+	p := bytes.Repeat([]byte("0123456789"), 140)
+
+	// 乱序到达，重复的分片被忽略
+	_, done, err := r.Add(src, Header{ID: 1, Index: 1, Count: 2}, p[700:])
+	assert.NoError(t, err)
+	assert.False(t, done)
+	_, done, err = r.Add(src, Header{ID: 1, Index: 1, Count: 2}, p[700:])
+	assert.NoError(t, err)
+	assert.False(t, done)
+
+	out, done, err := r.Add(src, Header{ID: 1, Index: 0, Count: 2}, p[:700])
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, p, out)
+	assert.Zero(t, r.Len())
+	assert.Zero(t, r.used)
+
+	// 相同编号的分片来自不同地址时不会混在一起
+	other := netip.MustParseAddrPort("10.0.0.2:4242")
+	_, _, _ = r.Add(src, Header{ID: 2, Index: 0, Count: 2}, p[:700])
+	_, done, _ = r.Add(other, Header{ID: 2, Index: 1, Count: 2}, p[700:])
+	assert.False(t, done)
+	assert.Equal(t, 2, r.Len())
+}
+
+func TestReassembler_Timeout(t *testing.T) {
+	r := NewReassembler(0, time.Second)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	src := netip.MustParseAddrPort("10.0.0.1:4242")
+
+	_, _, _ = r.Add(src, Header{ID: 1, Index: 0, Count: 2}, make([]byte, 100))
+	assert.Equal(t, 1, r.Len())
+
+	now = now.Add(2 * time.Second)
+	_, _, _ = r.Add(src, Header{ID: 2, Index: 0, Count: 2}, make([]byte, 100))
+	assert.Equal(t, 1, r.Len())
+	assert.Equal(t, 100, r.used)
+
+	// 超时后迟到的分片不能和新的分片拼在一起
+	_, done, _ := r.Add(src, Header{ID: 1, Index: 1, Count: 2}, make([]byte, 100))
+	assert.False(t, done)
+}
+
+func TestReassembler_Budget(t *testing.T) {
+	r := NewReassembler(250, 0)
+	src := netip.MustParseAddrPort("10.0.0.1:4242")
+
+	_, _, _ = r.Add(src, Header{ID: 1, Index: 0, Count: 2}, make([]byte, 100))
+	_, _, _ = r.Add(src, Header{ID: 2, Index: 0, Count: 2}, make([]byte, 100))
+	// 超出上限时丢弃最早的数据包
+	_, _, err := r.Add(src, Header{ID: 3, Index: 0, Count: 2}, make([]byte, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, r.Len())
+	assert.Equal(t, 200, r.used)
+
+	// 单个数据包超过上限时丢弃
+	_, _, err = r.Add(src, Header{ID: 4, Index: 0, Count: 2}, make([]byte, 300))
+	assert.ErrorIs(t, err, ErrOverBudget)
+	assert.Equal(t, 0, r.used)
+	assert.Zero(t, r.Len())
+}
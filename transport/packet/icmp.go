@@ -0,0 +1,120 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	icmpDestUnreachable = 3
+	icmpFragNeeded      = 4
+	icmpv6PacketTooBig  = 2
+
+	// minIPv6MTU IPv6 要求每条链路至少支持的 MTU，ICMPv6 报文不能超过它
+	minIPv6MTU = 1280
+)
+
+// DontFragment 判断 IPv4 数据包是否设置了 DF 标志，IPv6 数据包在路径上都不能分片
+func DontFragment(data []byte) bool {
+	if len(data) < Len || data[0]>>4 != 4 {
+		return true
+	}
+	return data[6]&0x40 != 0
+}
+
+// PacketTooBig 构建通知 orig 的发送方路径 MTU 为 mtu 的 ICMP 报文，
+// IPv4 为 "fragmentation needed"（类型 3 代码 4），IPv6 为 "packet too big"（类型 2）。
+// 报文的源地址为 orig 的目标地址，目标地址为 orig 的源地址
+func PacketTooBig(orig []byte, mtu int) ([]byte, error) {
+	if len(orig) < 1 {
+		return nil, fmt.Errorf("packet is empty")
+	}
+	switch orig[0] >> 4 {
+	case 4:
+		return icmpError4(orig, icmpDestUnreachable, icmpFragNeeded, uint32(mtu))
+	case 6:
+		return icmpError6(orig, icmpv6PacketTooBig, 0, uint32(mtu))
+	}
+	return nil, fmt.Errorf("packet is not ipv4 or ipv6")
+}
+
+// icmpError4 构建引用 orig 的 ICMP 差错报文，rest 为 ICMP 头部的后 4 个字节
+func icmpError4(orig []byte, typ, code uint8, rest uint32) ([]byte, error) {
+	if len(orig) < Len {
+		return nil, fmt.Errorf("packet is less than %v bytes", Len)
+	}
+	// 引用原数据包的 IP 头部与之后的 8 个字节
+	quote := int(orig[0]&0x0f)<<2 + 8
+	if quote > len(orig) {
+		quote = len(orig)
+	}
+
+	b := make([]byte, Len+8+quote)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 0x40
+	b[9] = ProtoICMP
+	copy(b[12:16], orig[16:20])
+	copy(b[16:20], orig[12:16])
+	binary.BigEndian.PutUint16(b[10:12], calculateChecksum(b))
+
+	icmp := b[Len:]
+	icmp[0] = typ
+	icmp[1] = code
+	binary.BigEndian.PutUint32(icmp[4:8], rest)
+	copy(icmp[8:], orig[:quote])
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+	return b, nil
+}
+
+// icmpError6 构建引用 orig 的 ICMPv6 差错报文，rest 为 ICMPv6 头部的后 4 个字节
+func icmpError6(orig []byte, typ, code uint8, rest uint32) ([]byte, error) {
+	if len(orig) < Len6 {
+		return nil, fmt.Errorf("packet is less than %v bytes", Len6)
+	}
+	// 尽可能多地引用原数据包，但整个报文不能超过 IPv6 的最小 MTU
+	quote := len(orig)
+	if quote > minIPv6MTU-Len6-8 {
+		quote = minIPv6MTU - Len6 - 8
+	}
+
+	b := make([]byte, Len6+8+quote)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+quote))
+	b[6] = ProtoICMPv6
+	b[7] = 0x40
+	copy(b[8:24], orig[24:40])
+	copy(b[24:40], orig[8:24])
+
+	icmp := b[Len6:]
+	icmp[0] = typ
+	icmp[1] = code
+	binary.BigEndian.PutUint32(icmp[4:8], rest)
+	copy(icmp[8:], orig[:quote])
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, pseudoHeaderSum6(b, len(icmp))))
+	return b, nil
+}
+
+// pseudoHeaderSum6 IPv6 上层协议校验和的伪首部：源地址、目标地址、上层长度与下一个头部
+func pseudoHeaderSum6(b []byte, length int) uint32 {
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	return sum + uint32(length) + uint32(b[6])
+}
+
+// checksum 计算 b 的互联网校验和，initial 为伪首部的累加和
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,76 @@
+package packet
+
+import (
+	"encoding/binary"
+	"github.com/am6737/nexus/api"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"testing"
+)
+
+func TestPacketTooBig4(t *testing.T) {
+	orig := make([]byte, 1400)
+	orig[0] = 0x45
+	orig[6] = 0x40
+	orig[9] = ProtoTCP
+	copy(orig[12:16], []byte{10, 1, 0, 5})
+	copy(orig[16:20], []byte{192, 168, 100, 2})
+	assert.True(t, DontFragment(orig))
+
+	b, err := PacketTooBig(orig, 1200)
+	assert.NoError(t, err)
+	assert.Len(t, b, Len+8+Len+8)
+	assert.Zero(t, checksum(b[:Len], 0))
+
+	p := &Packet{}
+	assert.NoError(t, ParsePacket(b, false, p))
+	assert.Equal(t, uint8(ProtoICMP), p.Protocol)
+	assert.Equal(t, api.Ip2VpnIp([]byte{192, 168, 100, 2}), p.LocalIP)
+	assert.Equal(t, api.Ip2VpnIp([]byte{10, 1, 0, 5}), p.RemoteIP)
+
+	m, err := icmp.ParseMessage(1, b[Len:])
+	assert.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeDestinationUnreachable, m.Type)
+	assert.Equal(t, icmpFragNeeded, m.Code)
+	assert.Equal(t, uint16(1200), binary.BigEndian.Uint16(b[Len+6:Len+8]))
+	assert.Zero(t, checksum(b[Len:], 0))
+
+	orig[6] = 0
+	assert.False(t, DontFragment(orig))
+}
+
+func TestPacketTooBig6(t *testing.T) {
+	src, dst := net.ParseIP("fd00::5"), net.ParseIP("fd00::2")
+	orig := make([]byte, 1500)
+	orig[0] = 0x60
+	orig[6] = ProtoUDP
+	copy(orig[8:24], src)
+	copy(orig[24:40], dst)
+	assert.True(t, DontFragment(orig))
+
+	b, err := PacketTooBig(orig, 1280)
+	assert.NoError(t, err)
+	assert.Len(t, b, minIPv6MTU)
+
+	p := &Packet{}
+	assert.NoError(t, ParsePacket(b, false, p))
+	assert.Equal(t, uint8(ProtoICMPv6), p.Protocol)
+	assert.Equal(t, api.Ip2VpnIp(dst), p.LocalIP)
+	assert.Equal(t, api.Ip2VpnIp(src), p.RemoteIP)
+
+	m, err := icmp.ParseMessage(ProtoICMPv6, b[Len6:])
+	assert.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypePacketTooBig, m.Type)
+	assert.Equal(t, 1280, m.Body.(*icmp.PacketTooBig).MTU)
+
+	// 使用标准库的伪首部校验和验证
+	expected, err := (&icmp.Message{Type: ipv6.ICMPTypePacketTooBig, Body: m.Body}).Marshal(icmp.IPv6PseudoHeader(dst, src))
+	assert.NoError(t, err)
+	assert.Equal(t, expected[2:4], b[Len6+2:Len6+4])
+
+	_, err = PacketTooBig(orig[:10], 1280)
+	assert.Error(t, err)
+}
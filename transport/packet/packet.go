@@ -6,13 +6,17 @@ import (
 	"fmt"
 	"github.com/am6737/nexus/api"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"net"
 )
 
 type m map[string]interface{}
 
 const (
+	// Len IPv4 头部长度（不含选项）
 	Len = 20
+	// Len6 IPv6 固定头部长度
+	Len6 = 40
 )
 
 const (
@@ -21,17 +25,37 @@ const (
 	ProtoUDP  = 17
 	ProtoICMP = 1
 
+	ProtoICMPv6 = 58
+	ProtoGRE    = 47
+	ProtoESP    = 50
+	ProtoAH     = 51
+
 	PortAny      = 0  // Special value for matching `port: any`
 	PortFragment = -1 // Special value for matching `port: fragment`
 )
 
 var protocolMap = map[uint8]string{
-	ProtoTCP:  "tcp",
-	ProtoUDP:  "udp",
-	ProtoICMP: "icmp",
-	ProtoAny:  "any",
+	ProtoTCP:    "tcp",
+	ProtoUDP:    "udp",
+	ProtoICMP:   "icmp",
+	ProtoICMPv6: "icmpv6",
+	ProtoGRE:    "gre",
+	ProtoESP:    "esp",
+	ProtoAH:     "ah",
+	ProtoAny:    "any",
 }
 
+// IPv6 extension headers that we walk over to find the upper layer protocol
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6ESP         = 50
+	ipv6AH          = 51
+	ipv6NoNext      = 59
+	ipv6DestOptions = 60
+)
+
 func TypeName(t uint8) string {
 	if n, ok := protocolMap[t]; ok {
 		return n
@@ -46,7 +70,16 @@ type Packet struct {
 	LocalPort  uint16
 	RemotePort uint16
 	Protocol   uint8
-	Fragment   bool
+	// Fragment 是否为分片数据包的后续分片，后续分片没有上层协议头部
+	Fragment bool
+	// Fragmented 是否属于一个被分片的数据包（包括第一个分片），FragmentID 为 IPv4 头部的标识或 IPv6 分片头部的标识
+	Fragmented bool
+	FragmentID uint32
+	// DSCP IP 头部中的 Differentiated Services Code Point
+	DSCP uint8
+	// ICMPType 与 ICMPCode ICMP 与 ICMPv6 报文的类型与代码，其他协议与后续分片为 0
+	ICMPType uint8
+	ICMPCode uint8
 }
 
 func (p *Packet) String() string {
@@ -66,6 +99,11 @@ func (p *Packet) Copy() *Packet {
 		RemotePort: p.RemotePort,
 		Protocol:   p.Protocol,
 		Fragment:   p.Fragment,
+		Fragmented: p.Fragmented,
+		FragmentID: p.FragmentID,
+		DSCP:       p.DSCP,
+		ICMPType:   p.ICMPType,
+		ICMPCode:   p.ICMPCode,
 	}
 }
 
@@ -78,6 +116,8 @@ func (p Packet) MarshalJSON() ([]byte, error) {
 		proto = "icmp"
 	case ProtoUDP:
 		proto = "udp"
+	case ProtoICMPv6:
+		proto = "icmpv6"
 	default:
 		proto = fmt.Sprintf("unknown %v", p.Protocol)
 	}
@@ -95,19 +135,40 @@ const (
 	minPacketLen = 4
 )
 
+// DSCP 返回 IPv4 头部 TOS 或 IPv6 头部 Traffic Class 的高 6 位，不需要完整解析数据包
+func DSCP(data []byte) uint8 {
+	if len(data) < 2 {
+		return 0
+	}
+	if data[0]>>4 == 6 {
+		return (data[0]&0x0f)<<2 | data[1]>>6
+	}
+	return data[1] >> 2
+}
+
 // ParsePacket 函数用于解析数据包并返回解析后的信息
 // incoming true 时表示数据包是从conn流入tun，false 表示数据包从tun流出
 func ParsePacket(data []byte, incoming bool, p *Packet) error {
+	if len(data) < 1 {
+		return fmt.Errorf("packet is empty")
+	}
+
+	switch version := int((data[0] >> 4) & 0x0f); version {
+	case 4:
+		return parseV4(data, incoming, p)
+	case 6:
+		return parseV6(data, incoming, p)
+	default:
+		return fmt.Errorf("packet is not ipv4 or ipv6, type: %v", version)
+	}
+}
+
+func parseV4(data []byte, incoming bool, p *Packet) error {
 	// Do we at least have an ipv4 header worth of data?
 	if len(data) < ipv4.HeaderLen {
 		return fmt.Errorf("packet is less than %v bytes", ipv4.HeaderLen)
 	}
 
-	// Is it an ipv4 packet?
-	if int((data[0]>>4)&0x0f) != 4 {
-		return fmt.Errorf("packet is not ipv4, type: %v", int((data[0]>>4)&0x0f))
-	}
-
 	// Adjust our start position based on the advertised ip header length
 	ihl := int(data[0]&0x0f) << 2
 
@@ -119,13 +180,16 @@ func ParsePacket(data []byte, incoming bool, p *Packet) error {
 	// Check if this is the second or further fragment of a fragmented packet.
 	flagsfrags := binary.BigEndian.Uint16(data[6:8])
 	p.Fragment = (flagsfrags & 0x1FFF) != 0
+	p.Fragmented = p.Fragment || flagsfrags&0x2000 != 0
+	p.FragmentID = uint32(binary.BigEndian.Uint16(data[4:6]))
 
 	// Firewall handles protocol checks
 	p.Protocol = data[9]
+	p.DSCP = data[1] >> 2
 
 	// Accounting for a variable header length, do we have enough data for our src/dst tuples?
 	minLen := ihl
-	if !p.Fragment && p.Protocol != ProtoICMP {
+	if hasPorts(p) {
 		minLen += minPacketLen
 	}
 
@@ -137,29 +201,143 @@ func ParsePacket(data []byte, incoming bool, p *Packet) error {
 	if incoming {
 		p.RemoteIP = api.Ip2VpnIp(data[12:16])
 		p.LocalIP = api.Ip2VpnIp(data[16:20])
-		if p.Fragment || p.Protocol == ProtoICMP {
-			p.RemotePort = 0
-			p.LocalPort = 0
-		} else {
-			p.RemotePort = binary.BigEndian.Uint16(data[ihl : ihl+2])
-			p.LocalPort = binary.BigEndian.Uint16(data[ihl+2 : ihl+4])
-		}
 	} else {
 		p.LocalIP = api.Ip2VpnIp(data[12:16])
 		p.RemoteIP = api.Ip2VpnIp(data[16:20])
-		if p.Fragment || p.Protocol == ProtoICMP {
-			p.RemotePort = 0
-			p.LocalPort = 0
-		} else {
-			p.LocalPort = binary.BigEndian.Uint16(data[ihl : ihl+2])
-			p.RemotePort = binary.BigEndian.Uint16(data[ihl+2 : ihl+4])
+	}
+	parsePorts(data, ihl, incoming, p)
+	parseICMP(data, ihl, p)
+
+	return nil
+}
+
+func parseV6(data []byte, incoming bool, p *Packet) error {
+	if len(data) < ipv6.HeaderLen {
+		return fmt.Errorf("packet is less than %v bytes", ipv6.HeaderLen)
+	}
+
+	// Walk the extension header chain until we reach the upper layer protocol
+	offset := ipv6.HeaderLen
+	next := data[6]
+	p.Fragment = false
+	p.Fragmented = false
+	p.FragmentID = 0
+	p.DSCP = DSCP(data)
+
+walk:
+	for {
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(data) < offset+2 {
+				return fmt.Errorf("packet is too short for ipv6 extension header %v at offset %v", next, offset)
+			}
+			next = data[offset]
+			offset += (int(data[offset+1]) + 1) << 3
+
+		case ipv6AH:
+			if len(data) < offset+2 {
+				return fmt.Errorf("packet is too short for ipv6 authentication header at offset %v", offset)
+			}
+			next = data[offset]
+			offset += (int(data[offset+1]) + 2) << 2
+
+		case ipv6Fragment:
+			if len(data) < offset+8 {
+				return fmt.Errorf("packet is too short for ipv6 fragment header at offset %v", offset)
+			}
+			// Only the first fragment carries the upper layer header
+			offsetFlags := binary.BigEndian.Uint16(data[offset+2 : offset+4])
+			if offsetFlags&0xfff8 != 0 {
+				p.Fragment = true
+			}
+			// 偏移为 0 并且没有后续分片的是完整的数据包（atomic fragment）
+			if p.Fragment || offsetFlags&0x1 != 0 {
+				p.Fragmented = true
+				p.FragmentID = binary.BigEndian.Uint32(data[offset+4 : offset+8])
+			}
+			next = data[offset]
+			offset += 8
+
+		default:
+			break walk
 		}
 	}
 
+	p.Protocol = next
+
+	minLen := offset
+	if hasPorts(p) {
+		minLen += minPacketLen
+	}
+
+	if len(data) < minLen {
+		return fmt.Errorf("packet is less than %v bytes, ip header len: %v", minLen, offset)
+	}
+
+	if incoming {
+		p.RemoteIP = api.Ip2VpnIp(data[8:24])
+		p.LocalIP = api.Ip2VpnIp(data[24:40])
+	} else {
+		p.LocalIP = api.Ip2VpnIp(data[8:24])
+		p.RemoteIP = api.Ip2VpnIp(data[24:40])
+	}
+	parsePorts(data, offset, incoming, p)
+	parseICMP(data, offset, p)
+
 	return nil
 }
 
+// hasPorts 判断数据包的上层协议头部是否包含端口
+func hasPorts(p *Packet) bool {
+	if p.Fragment {
+		return false
+	}
+	switch p.Protocol {
+	case ProtoICMP, ProtoICMPv6, ipv6ESP, ipv6NoNext, ProtoGRE, ProtoAH:
+		return false
+	}
+	return true
+}
+
+func parsePorts(data []byte, offset int, incoming bool, p *Packet) {
+	if !hasPorts(p) {
+		p.RemotePort = 0
+		p.LocalPort = 0
+		return
+	}
+
+	if incoming {
+		p.RemotePort = binary.BigEndian.Uint16(data[offset : offset+2])
+		p.LocalPort = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+	} else {
+		p.LocalPort = binary.BigEndian.Uint16(data[offset : offset+2])
+		p.RemotePort = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+	}
+}
+
+// parseICMP 读取 ICMP 与 ICMPv6 报文的类型与代码，报文不完整时为 0
+func parseICMP(data []byte, offset int, p *Packet) {
+	p.ICMPType, p.ICMPCode = 0, 0
+	if p.Fragment || (p.Protocol != ProtoICMP && p.Protocol != ProtoICMPv6) || len(data) < offset+2 {
+		return
+	}
+	p.ICMPType = data[offset]
+	p.ICMPCode = data[offset+1]
+}
+
+// HeaderLen 返回由本程序构建的数据包的 IP 头部长度（IPv4 不含选项，IPv6 不含扩展头）
+func HeaderLen(data []byte) int {
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return Len6
+	}
+	return Len
+}
+
 func (p *Packet) Encode() []byte {
+	if !p.LocalIP.Is4() || !p.RemoteIP.Is4() {
+		return p.encodeV6()
+	}
+
 	//data := make([]byte, 20)
 	// IPv4 header format:
 	// 0-3 bits: Version
@@ -198,66 +376,39 @@ func (p *Packet) Encode() []byte {
 	return ipHeader
 }
 
-func (p *Packet) Decode(data []byte, incoming bool) error {
-	// Do we at least have an ipv4 header worth of data?
-	if len(data) < ipv4.HeaderLen {
-		return fmt.Errorf("packet is less than %v bytes", ipv4.HeaderLen)
-	}
-
-	// Is it an ipv4 packet?
-	if int((data[0]>>4)&0x0f) != 4 {
-		return fmt.Errorf("packet is not ipv4, type: %v", int((data[0]>>4)&0x0f))
-	}
-
-	// Adjust our start position based on the advertised ip header length
-	ihl := int(data[0]&0x0f) << 2
-
-	// Well formed ip header length?
-	if ihl < ipv4.HeaderLen {
-		return fmt.Errorf("packet had an invalid header length: %v", ihl)
-	}
-
-	// Check if this is the second or further fragment of a fragmented packet.
-	flagsfrags := binary.BigEndian.Uint16(data[6:8])
-	p.Fragment = (flagsfrags & 0x1FFF) != 0
-
-	// Firewall handles protocol checks
-	p.Protocol = data[9]
+// encodeV6 构建一个 IPv6 固定头部
+func (p *Packet) encodeV6() []byte {
+	ipHeader := make([]byte, Len6)
+	// 版本号
+	ipHeader[0] = 0x60
+	// 下一个头部即上层协议
+	ipHeader[6] = p.Protocol
+	// Hop Limit 设置为 64
+	ipHeader[7] = 0x40
+	copy(ipHeader[8:24], p.LocalIP[:])
+	copy(ipHeader[24:40], p.RemoteIP[:])
+	return ipHeader
+}
 
-	// Accounting for a variable header length, do we have enough data for our src/dst tuples?
-	minLen := ihl
-	if !p.Fragment && p.Protocol != ProtoICMP {
-		minLen += minPacketLen
-	}
+func (p *Packet) Decode(data []byte, incoming bool) error {
+	return ParsePacket(data, incoming, p)
+}
 
-	if len(data) < minLen {
-		return fmt.Errorf("packet is less than %v bytes, ip header len: %v", minLen, ihl)
+// BuildIPPacket 根据地址族构建 IPv4 或 IPv6 头部
+func BuildIPPacket(srcIP, dstIP net.IP, protocol uint8, isFragment bool) ([]byte, error) {
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		return BuildIPv4Packet(srcIP, dstIP, protocol, isFragment)
 	}
-
-	// Firewall packets are locally oriented
-	if incoming {
-		p.RemoteIP = api.Ip2VpnIp(data[12:16])
-		p.LocalIP = api.Ip2VpnIp(data[16:20])
-		if p.Fragment || p.Protocol == ProtoICMP {
-			p.RemotePort = 0
-			p.LocalPort = 0
-		} else {
-			p.RemotePort = binary.BigEndian.Uint16(data[ihl : ihl+2])
-			p.LocalPort = binary.BigEndian.Uint16(data[ihl+2 : ihl+4])
-		}
-	} else {
-		p.LocalIP = api.Ip2VpnIp(data[12:16])
-		p.RemoteIP = api.Ip2VpnIp(data[16:20])
-		if p.Fragment || p.Protocol == ProtoICMP {
-			p.RemotePort = 0
-			p.LocalPort = 0
-		} else {
-			p.LocalPort = binary.BigEndian.Uint16(data[ihl : ihl+2])
-			p.RemotePort = binary.BigEndian.Uint16(data[ihl+2 : ihl+4])
-		}
+	src, dst := srcIP.To16(), dstIP.To16()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("invalid address pair: %v -> %v", srcIP, dstIP)
 	}
 
-	return nil
+	return (&Packet{
+		LocalIP:  api.Ip2VpnIp(src),
+		RemoteIP: api.Ip2VpnIp(dst),
+		Protocol: protocol,
+	}).encodeV6(), nil
 }
 
 // BuildIPv4Packet 构建一个符合 ParsePacket 函数逻辑的 IPv4 数据包
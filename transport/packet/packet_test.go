@@ -75,3 +75,203 @@ func TestPacketEncodeDecode(t *testing.T) {
 		})
 	}
 }
+
+func TestPacketEncodeDecodeV6(t *testing.T) {
+	local, _ := api.ParseVpnIp("fd00::1")
+	remote, _ := api.ParseVpnIp("fd00::2")
+	p := &Packet{
+		LocalIP:  local,
+		RemoteIP: remote,
+		Protocol: ProtoUDP,
+	}
+
+	encoded := p.Encode()
+	if len(encoded) != Len6 {
+		t.Fatalf("Encode() len = %d, want %d", len(encoded), Len6)
+	}
+	encoded = append(encoded, make([]byte, 4)...)
+
+	decoded := &Packet{}
+	if err := decoded.Decode(encoded, false); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !reflect.DeepEqual(p, decoded) {
+		t.Errorf("Encode/Decode roundtrip failed:\nExpected: %+v\nGot: %+v", p, decoded)
+	}
+}
+
+func TestParsePacketV6ExtensionHeaders(t *testing.T) {
+	local, _ := api.ParseVpnIp("fd00::1")
+	remote, _ := api.ParseVpnIp("fd00::2")
+
+	build := func(fragOffset uint16) []byte {
+		data := (&Packet{LocalIP: local, RemoteIP: remote, Protocol: ipv6HopByHop}).Encode()
+		// Hop-by-hop options, 8 bytes, next is a fragment header
+		data = append(data, ipv6Fragment, 0, 0, 0, 0, 0, 0, 0)
+		// Fragment header, next is TCP
+		data = append(data, ProtoTCP, 0, byte(fragOffset>>8), byte(fragOffset), 0, 0, 0, 1)
+		// TCP source and destination ports
+		return append(data, 0x1f, 0x90, 0x00, 0x16)
+	}
+
+	p := &Packet{}
+	if err := ParsePacket(build(0), false, p); err != nil {
+		t.Fatalf("ParsePacket() error = %v", err)
+	}
+	if p.Protocol != ProtoTCP || p.Fragment || p.LocalPort != 8080 || p.RemotePort != 22 {
+		t.Errorf("unexpected first fragment parse result: %+v", p)
+	}
+	if p.LocalIP != local || p.RemoteIP != remote {
+		t.Errorf("unexpected addresses: %+v", p)
+	}
+
+	p = &Packet{}
+	if err := ParsePacket(build(8<<3), true, p); err != nil {
+		t.Fatalf("ParsePacket() error = %v", err)
+	}
+	if !p.Fragment || p.LocalPort != 0 || p.RemotePort != 0 {
+		t.Errorf("unexpected later fragment parse result: %+v", p)
+	}
+	if p.LocalIP != remote || p.RemoteIP != local {
+		t.Errorf("incoming packet addresses were not swapped: %+v", p)
+	}
+
+	if err := ParsePacket(build(0)[:Len6+4], false, &Packet{}); err == nil {
+		t.Errorf("expected error for truncated extension header")
+	}
+}
+
+func TestParsePacketDSCP(t *testing.T) {
+	p := &Packet{}
+
+	v4 := make([]byte, Len+8)
+	v4[0] = 0x45
+	v4[1] = 46<<2 | 1 // EF，ECN 位不影响 DSCP
+	v4[9] = ProtoUDP
+	if err := ParsePacket(v4, false, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.DSCP != 46 || DSCP(v4) != 46 {
+		t.Errorf("ipv4 DSCP = %d, %d, want 46", p.DSCP, DSCP(v4))
+	}
+
+	v6 := make([]byte, Len6+8)
+	// Traffic Class 跨越第一与第二个字节
+	v6[0] = 0x60 | 34>>2
+	v6[1] = (34 & 0x03) << 6
+	v6[6] = ProtoUDP
+	if err := ParsePacket(v6, false, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.DSCP != 34 {
+		t.Errorf("ipv6 DSCP = %d, want 34", p.DSCP)
+	}
+
+	if DSCP(nil) != 0 {
+		t.Error("DSCP of an empty packet should be 0")
+	}
+}
+
+func TestParsePacketICMP(t *testing.T) {
+	p := &Packet{}
+
+	v4 := make([]byte, Len+8)
+	v4[0] = 0x45
+	v4[9] = ProtoICMP
+	v4[Len] = 5 // redirect
+	v4[Len+1] = 1
+	if err := ParsePacket(v4, true, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ICMPType != 5 || p.ICMPCode != 1 || p.LocalPort != 0 || p.RemotePort != 0 {
+		t.Errorf("ipv4 icmp type=%d code=%d ports=%d,%d, want 5 1 0 0", p.ICMPType, p.ICMPCode, p.LocalPort, p.RemotePort)
+	}
+
+	// 后续分片没有 ICMP 头部
+	v4[7] = 1
+	if err := ParsePacket(v4, true, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ICMPType != 0 || p.ICMPCode != 0 {
+		t.Errorf("fragment icmp type=%d code=%d, want 0 0", p.ICMPType, p.ICMPCode)
+	}
+
+	v6 := make([]byte, Len6+8)
+	v6[0] = 0x60
+	v6[6] = ProtoICMPv6
+	v6[Len6] = 128 // echo request
+	if err := ParsePacket(v6, true, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ICMPType != 128 || p.ICMPCode != 0 {
+		t.Errorf("ipv6 icmp type=%d code=%d, want 128 0", p.ICMPType, p.ICMPCode)
+	}
+
+	// GRE 没有端口
+	v4 = make([]byte, Len+8)
+	v4[0] = 0x45
+	v4[9] = ProtoGRE
+	v4[Len+2] = 0x08
+	if err := ParsePacket(v4, true, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.LocalPort != 0 || p.RemotePort != 0 || TypeName(p.Protocol) != "gre" {
+		t.Errorf("gre ports=%d,%d name=%s, want 0 0 gre", p.LocalPort, p.RemotePort, TypeName(p.Protocol))
+	}
+}
+
+func TestParsePacketFragmentID(t *testing.T) {
+	p := &Packet{}
+
+	// 第一个分片：偏移为 0，设置了 MF
+	v4 := make([]byte, Len+8)
+	v4[0] = 0x45
+	v4[4], v4[5] = 0x12, 0x34
+	v4[6] = 0x20
+	v4[9] = ProtoUDP
+	if err := ParsePacket(v4, false, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Fragment || !p.Fragmented || p.FragmentID != 0x1234 {
+		t.Errorf("unexpected first fragment parse result: %+v", p)
+	}
+
+	// 后续分片
+	v4[6], v4[7] = 0, 100
+	if err := ParsePacket(v4, false, p); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Fragment || !p.Fragmented || p.FragmentID != 0x1234 {
+		t.Errorf("unexpected later fragment parse result: %+v", p)
+	}
+
+	// 没有分片的数据包
+	v4[7] = 0
+	if err := ParsePacket(v4, false, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Fragment || p.Fragmented {
+		t.Errorf("unexpected unfragmented parse result: %+v", p)
+	}
+
+	local, _ := api.ParseVpnIp("fd00::1")
+	remote, _ := api.ParseVpnIp("fd00::2")
+	v6 := (&Packet{LocalIP: local, RemoteIP: remote, Protocol: ipv6Fragment}).Encode()
+	v6 = append(v6, ProtoUDP, 0, 0, 1, 0xde, 0xad, 0xbe, 0xef)
+	v6 = append(v6, make([]byte, 8)...)
+	if err := ParsePacket(v6, false, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Fragment || !p.Fragmented || p.FragmentID != 0xdeadbeef {
+		t.Errorf("unexpected ipv6 first fragment parse result: %+v", p)
+	}
+
+	// atomic fragment 是完整的数据包
+	v6[Len6+3] = 0
+	if err := ParsePacket(v6, false, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Fragment || p.Fragmented {
+		t.Errorf("unexpected ipv6 atomic fragment parse result: %+v", p)
+	}
+}
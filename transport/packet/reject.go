@@ -0,0 +1,153 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	icmpAdminProhibited   = 13
+	icmpv6DestUnreachable = 1
+	icmpv6AdminProhibited = 1
+
+	tcpHeaderLen = 20
+	tcpFin       = 0x01
+	tcpSyn       = 0x02
+	tcpRst       = 0x04
+	tcpAck       = 0x10
+)
+
+// Reject 构建拒绝 orig 时回复给发送方的数据包：TCP 数据包回复 RST，其他数据包回复
+// "administratively prohibited" 的 ICMP 不可达（IPv4 类型 3 代码 13，IPv6 类型 1 代码 1）。
+// p 为 orig 解析后的结果。RST、ICMP 差错报文、后续分片与发往组播或广播地址的数据包不回复，返回 false
+func Reject(orig []byte, p *Packet) ([]byte, bool) {
+	if len(orig) < 1 || p.Fragment {
+		return nil, false
+	}
+	switch orig[0] >> 4 {
+	case 4:
+		return reject4(orig, p)
+	case 6:
+		return reject6(orig, p)
+	}
+	return nil, false
+}
+
+func reject4(orig []byte, p *Packet) ([]byte, bool) {
+	if len(orig) < Len {
+		return nil, false
+	}
+	dst := net.IP(orig[16:20])
+	if dst.IsMulticast() || dst.Equal(net.IPv4bcast) {
+		return nil, false
+	}
+	switch p.Protocol {
+	case ProtoTCP:
+		ihl := int(orig[0]&0x0f) << 2
+		total := int(binary.BigEndian.Uint16(orig[2:4]))
+		if total > len(orig) {
+			total = len(orig)
+		}
+		// 长度字段可能由发送方任意填写，头部与 TCP 头部必须都在数据包内
+		if ihl < Len || total < ihl+tcpHeaderLen {
+			return nil, false
+		}
+		b := make([]byte, Len+tcpHeaderLen)
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+		b[8] = 0x40
+		b[9] = ProtoTCP
+		copy(b[12:16], orig[16:20])
+		copy(b[16:20], orig[12:16])
+		binary.BigEndian.PutUint16(b[10:12], calculateChecksum(b[:Len]))
+		if !tcpReset(b[Len:], orig[ihl:total]) {
+			return nil, false
+		}
+		var sum uint32
+		for i := 12; i < 20; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		sum += ProtoTCP + tcpHeaderLen
+		binary.BigEndian.PutUint16(b[Len+16:Len+18], checksum(b[Len:], sum))
+		return b, true
+
+	case ProtoICMP:
+		// 只回复 ICMP 查询报文，不回复差错报文
+		switch p.ICMPType {
+		case icmpDestUnreachable, 4, 5, 11, 12:
+			return nil, false
+		}
+	}
+	b, err := icmpError4(orig, icmpDestUnreachable, icmpAdminProhibited, 0)
+	return b, err == nil
+}
+
+func reject6(orig []byte, p *Packet) ([]byte, bool) {
+	if len(orig) < Len6 || net.IP(orig[24:40]).IsMulticast() {
+		return nil, false
+	}
+	switch p.Protocol {
+	case ProtoTCP:
+		// 有扩展头部时无法直接定位 TCP 头部，改为回复 ICMPv6 不可达
+		if orig[6] != ProtoTCP {
+			break
+		}
+		total := Len6 + int(binary.BigEndian.Uint16(orig[4:6]))
+		if total > len(orig) {
+			total = len(orig)
+		}
+		if total < Len6+tcpHeaderLen {
+			return nil, false
+		}
+		b := make([]byte, Len6+tcpHeaderLen)
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[4:6], tcpHeaderLen)
+		b[6] = ProtoTCP
+		b[7] = 0x40
+		copy(b[8:24], orig[24:40])
+		copy(b[24:40], orig[8:24])
+		if !tcpReset(b[Len6:], orig[Len6:total]) {
+			return nil, false
+		}
+		binary.BigEndian.PutUint16(b[Len6+16:Len6+18], checksum(b[Len6:], pseudoHeaderSum6(b, tcpHeaderLen)))
+		return b, true
+
+	case ProtoICMPv6:
+		// 类型小于 128 的是差错报文
+		if p.ICMPType < 128 {
+			return nil, false
+		}
+	}
+	b, err := icmpError6(orig, icmpv6DestUnreachable, icmpv6AdminProhibited, 0)
+	return b, err == nil
+}
+
+// tcpReset 在 b 中写入回复 seg 的 RST 头部（校验和除外），seg 本身是 RST 时返回 false。
+// seg 带有 ACK 时 RST 的序列号为 seg 的确认号，否则确认 seg 占用的所有序列号
+func tcpReset(b, seg []byte) bool {
+	flags := seg[13]
+	if flags&tcpRst != 0 {
+		return false
+	}
+	copy(b[0:2], seg[2:4])
+	copy(b[2:4], seg[0:2])
+	if flags&tcpAck != 0 {
+		copy(b[4:8], seg[8:12])
+		b[13] = tcpRst
+	} else {
+		n := len(seg) - int(seg[12]>>4)<<2
+		if n < 0 {
+			n = 0
+		}
+		if flags&tcpSyn != 0 {
+			n++
+		}
+		if flags&tcpFin != 0 {
+			n++
+		}
+		binary.BigEndian.PutUint32(b[8:12], binary.BigEndian.Uint32(seg[4:8])+uint32(n))
+		b[13] = tcpRst | tcpAck
+	}
+	b[12] = tcpHeaderLen / 4 << 4
+	return true
+}
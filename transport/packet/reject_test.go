@@ -0,0 +1,167 @@
+package packet
+
+import (
+	"encoding/binary"
+	"github.com/am6737/nexus/api"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"testing"
+)
+
+// tcp4 构建一个从 10.1.0.5:40000 发往 192.168.100.2:22 的 TCP 数据包
+func tcp4(flags uint8, seq, ack uint32, payload int) []byte {
+	b := make([]byte, Len+tcpHeaderLen+payload)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[9] = ProtoTCP
+	copy(b[12:16], []byte{10, 1, 0, 5})
+	copy(b[16:20], []byte{192, 168, 100, 2})
+	binary.BigEndian.PutUint16(b[Len:], 40000)
+	binary.BigEndian.PutUint16(b[Len+2:], 22)
+	binary.BigEndian.PutUint32(b[Len+4:], seq)
+	binary.BigEndian.PutUint32(b[Len+8:], ack)
+	b[Len+12] = 5 << 4
+	b[Len+13] = flags
+	return b
+}
+
+func TestReject_TCP4(t *testing.T) {
+	orig := tcp4(tcpSyn, 1000, 0, 0)
+	p := &Packet{}
+	assert.NoError(t, ParsePacket(orig, false, p))
+
+	b, ok := Reject(orig, p)
+	assert.True(t, ok)
+	assert.Len(t, b, Len+tcpHeaderLen)
+	assert.Zero(t, checksum(b[:Len], 0))
+
+	reply := &Packet{}
+	assert.NoError(t, ParsePacket(b, true, reply))
+	assert.Equal(t, uint8(ProtoTCP), reply.Protocol)
+	assert.Equal(t, p.LocalIP, reply.LocalIP)
+	assert.Equal(t, p.RemoteIP, reply.RemoteIP)
+	assert.Equal(t, p.LocalPort, reply.LocalPort)
+	assert.Equal(t, p.RemotePort, reply.RemotePort)
+
+	// SYN 没有 ACK，RST 确认 SYN 占用的序列号
+	tcp := b[Len:]
+	assert.Equal(t, uint8(tcpRst|tcpAck), tcp[13])
+	assert.Zero(t, binary.BigEndian.Uint32(tcp[4:8]))
+	assert.Equal(t, uint32(1001), binary.BigEndian.Uint32(tcp[8:12]))
+	var sum uint32
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	assert.Zero(t, checksum(tcp, sum+ProtoTCP+tcpHeaderLen))
+
+	// 带 ACK 的数据包，RST 的序列号为对方的确认号
+	orig = tcp4(tcpAck, 1000, 5000, 100)
+	b, ok = Reject(orig, p)
+	assert.True(t, ok)
+	assert.Equal(t, uint8(tcpRst), b[Len+13])
+	assert.Equal(t, uint32(5000), binary.BigEndian.Uint32(b[Len+4:Len+8]))
+
+	// 不回复 RST
+	orig = tcp4(tcpRst, 1000, 0, 0)
+	_, ok = Reject(orig, p)
+	assert.False(t, ok)
+}
+
+func TestReject_UDP6(t *testing.T) {
+	src, dst := net.ParseIP("fd00::5"), net.ParseIP("fd00::2")
+	orig := make([]byte, Len6+8+32)
+	orig[0] = 0x60
+	binary.BigEndian.PutUint16(orig[4:6], 8+32)
+	orig[6] = ProtoUDP
+	copy(orig[8:24], src)
+	copy(orig[24:40], dst)
+	p := &Packet{}
+	assert.NoError(t, ParsePacket(orig, false, p))
+
+	b, ok := Reject(orig, p)
+	assert.True(t, ok)
+	reply := &Packet{}
+	assert.NoError(t, ParsePacket(b, false, reply))
+	assert.Equal(t, api.Ip2VpnIp(dst), reply.LocalIP)
+	assert.Equal(t, api.Ip2VpnIp(src), reply.RemoteIP)
+
+	m, err := icmp.ParseMessage(ProtoICMPv6, b[Len6:])
+	assert.NoError(t, err)
+	assert.Equal(t, ipv6.ICMPTypeDestinationUnreachable, m.Type)
+	assert.Equal(t, icmpv6AdminProhibited, m.Code)
+	expected, err := (&icmp.Message{Type: m.Type, Code: m.Code, Body: m.Body}).Marshal(icmp.IPv6PseudoHeader(dst, src))
+	assert.NoError(t, err)
+	assert.Equal(t, expected[2:4], b[Len6+2:Len6+4])
+
+	// 不回复 ICMPv6 差错报文
+	_, ok = Reject(b, reply)
+	assert.False(t, ok)
+
+	// 不回复组播
+	copy(orig[24:40], net.ParseIP("ff02::1"))
+	_, ok = Reject(orig, p)
+	assert.False(t, ok)
+}
+
+func TestReject_ICMP4(t *testing.T) {
+	orig := tcp4(0, 0, 0, 0)
+	orig[9] = ProtoUDP
+	p := &Packet{}
+	assert.NoError(t, ParsePacket(orig, false, p))
+
+	b, ok := Reject(orig, p)
+	assert.True(t, ok)
+	m, err := icmp.ParseMessage(1, b[Len:])
+	assert.NoError(t, err)
+	assert.Equal(t, ipv4.ICMPTypeDestinationUnreachable, m.Type)
+	assert.Equal(t, icmpAdminProhibited, m.Code)
+	assert.Zero(t, checksum(b[Len:], 0))
+
+	// 不回复 ICMP 差错报文与后续分片
+	reply := &Packet{}
+	assert.NoError(t, ParsePacket(b, false, reply))
+	_, ok = Reject(b, reply)
+	assert.False(t, ok)
+
+	binary.BigEndian.PutUint16(orig[6:8], 100)
+	assert.NoError(t, ParsePacket(orig, false, p))
+	_, ok = Reject(orig, p)
+	assert.False(t, ok)
+}
+
+// TestReject_MalformedTCP 长度字段与实际长度不符的 TCP 数据包不回复，也不越界读取
+func TestReject_MalformedTCP(t *testing.T) {
+	p := &Packet{Protocol: ProtoTCP}
+	for _, total := range []uint16{0, Len, Len + tcpHeaderLen - 1} {
+		orig := tcp4(tcpSyn, 1000, 0, 0)
+		binary.BigEndian.PutUint16(orig[2:4], total)
+		_, ok := Reject(orig, p)
+		assert.False(t, ok, total)
+	}
+
+	// 头部长度小于 20
+	orig := tcp4(tcpSyn, 1000, 0, 0)
+	orig[0] = 0x44
+	_, ok := Reject(orig, p)
+	assert.False(t, ok)
+
+	// 被截断的数据包
+	_, ok = Reject(tcp4(tcpSyn, 1000, 0, 0)[:Len+10], p)
+	assert.False(t, ok)
+
+	for _, payload := range []uint16{0, tcpHeaderLen - 1} {
+		orig := make([]byte, Len6+tcpHeaderLen)
+		orig[0] = 0x60
+		binary.BigEndian.PutUint16(orig[4:6], payload)
+		orig[6] = ProtoTCP
+		copy(orig[8:24], net.ParseIP("fd00::5"))
+		copy(orig[24:40], net.ParseIP("fd00::2"))
+		orig[Len6+12] = 5 << 4
+		orig[Len6+13] = tcpSyn
+		_, ok := Reject(orig, p)
+		assert.False(t, ok, payload)
+	}
+}
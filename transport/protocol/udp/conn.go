@@ -3,18 +3,35 @@ package udp
 import (
 	"github.com/am6737/nexus/config"
 	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"net"
 )
 
 const MTU = 9001
 
 type EncReader func(addr *Addr, out []byte, packet []byte, h *header.Header)
 
+// Message 批量发送的一个数据包
+type Message struct {
+	Buf  []byte
+	Addr *Addr
+	// TOS 外层 IP 头部的 TOS（IPv6 为 Traffic Class），为 0 时使用套接字的默认值，目前仅 Linux 支持
+	TOS uint8
+}
+
 type Conn interface {
 	Rebind() error
 	LocalAddr() (*Addr, error)
 	ListenOut(r EncReader)
 	WriteTo(b []byte, addr *Addr) error
+	// WriteBatch 发送全部数据包，发送失败的数据包会被跳过，返回成功发送的数量与遇到的第一个错误
+	WriteBatch(msgs []Message) (int, error)
 	ReloadConfig(c *config.Config)
+	// BindToInterface 让发出的数据包始终经过指定网卡，不受经过 tun 的路由影响
+	BindToInterface(ifi *net.Interface) error
+	// EnablePMTUProbe 发出的数据包设置 DF 且不在本地分片，超过本地链路 MTU 的数据包直接发送失败，
+	// 超过路径 MTU 的数据包被途中的路由器丢弃，用于路径 MTU 探测
+	// 设置作用于整个套接字，只应在专门发送探测的套接字上开启
+	EnablePMTUProbe() error
 	Close() error
 }
 
@@ -40,11 +57,26 @@ func (n NoopConn) WriteTo(b []byte, addr *Addr) error {
 	panic("implement me")
 }
 
+func (n NoopConn) WriteBatch(msgs []Message) (int, error) {
+	//TODO implement me
+	panic("implement me")
+}
+
 func (n NoopConn) ReloadConfig(c *config.Config) {
 	//TODO implement me
 	panic("implement me")
 }
 
+func (n NoopConn) BindToInterface(ifi *net.Interface) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (n NoopConn) EnablePMTUProbe() error {
+	//TODO implement me
+	panic("implement me")
+}
+
 func (n NoopConn) Close() error {
 	//TODO implement me
 	panic("implement me")
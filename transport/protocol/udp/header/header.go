@@ -21,8 +21,14 @@ const (
 	Close
 	Control
 	Test
+	// Fragment 超过路径 MTU 的数据包的一个分片，载荷为 fragment.Header 与数据包的一部分
+	Fragment
 )
 
+// CompressionMask Message 与 Fragment 消息的 Reserved 中表示载荷压缩算法的位，
+// 握手消息的 Reserved 为节点可以解压的算法的位图
+const CompressionMask uint16 = 0x000f
+
 const (
 	TestRequest MessageSubType = 0
 	TestReply   MessageSubType = 1
@@ -61,6 +67,7 @@ var typeMap = map[MessageType]string{
 	LightHouse: "lightHouse",
 	Close:      "close",
 	Control:    "control",
+	Fragment:   "fragment",
 }
 
 type Header struct {
@@ -128,7 +135,14 @@ func (h *Header) Encode(b []byte) ([]byte, error) {
 		return nil, errors.New("nil header")
 	}
 
-	return Encode(b, h.Version, h.MessageType, h.MessageSubtype, h.RemoteIndex, h.MessageCounter), nil
+	b = Encode(b, h.Version, h.MessageType, h.MessageSubtype, h.RemoteIndex, h.MessageCounter)
+	SetReserved(b, h.Reserved)
+	return b, nil
+}
+
+// SetReserved 设置已编码的头部 b 中的 Reserved
+func SetReserved(b []byte, r uint16) {
+	binary.BigEndian.PutUint16(b[2:4], r)
 }
 
 func Encode(b []byte, v uint8, mt MessageType, mst MessageSubType, ri uint32, mc uint64) []byte {
@@ -26,7 +26,7 @@ func TestEncodeDecode(t *testing.T) {
 		t.Fatal("decode error:", err)
 	}
 
-	assert.Equal(t, h, decoded, "decoded header does not match original")
+	assert.Equal(t, *h, decoded, "decoded header does not match original")
 }
 
 func TestEncode(t *testing.T) {
@@ -65,3 +65,27 @@ func TestDecode(t *testing.T) {
 		MessageCounter: 9,
 	}, header, "decoded header does not match expected")
 }
+
+func TestSetReserved(t *testing.T) {
+	b := Encode(make([]byte, Len), Version, Message, 0, 10, 9)
+	SetReserved(b, 2)
+
+	h, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint16(2), h.Reserved&CompressionMask)
+	assert.Equal(t, Message, h.MessageType)
+
+	// Header.Encode 保留 Reserved
+	h.Reserved = 0x06
+	encoded, err := h.Encode(make([]byte, Len))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, h, decoded)
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package udp
+
+// raceEnabled 开启竞态检测时内存分配的数量不准确，统计分配的测试需要跳过
+const raceEnabled = true
@@ -1,8 +1,8 @@
 package udp
 
 import (
-	"fmt"
 	"net"
+	"strconv"
 )
 
 type Addr struct {
@@ -15,7 +15,12 @@ func (a Addr) Network() string {
 }
 
 func (a Addr) String() string {
-	return fmt.Sprintf("%s:%d", a.IP.String(), a.Port)
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
+}
+
+// Equal 判断两个地址是否相同，IPv4 与 IPv4-mapped IPv6 形式视为相同
+func (a Addr) Equal(other *Addr) bool {
+	return other != nil && a.Port == other.Port && a.IP.Equal(other.IP)
 }
 
 func (a Addr) NetAddr() net.Addr {
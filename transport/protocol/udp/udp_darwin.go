@@ -55,3 +55,44 @@ func (u *GenericConn) Rebind() error {
 		}
 	})
 }
+
+func (u *GenericConn) BindToInterface(ifi *net.Interface) error {
+	rc, err := u.UDPConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var bindErr error
+	err = rc.Control(func(fd uintptr) {
+		// 双栈套接字使用 IPV6_BOUND_IF，仅 IPv4 的套接字使用 IP_BOUND_IF
+		bindErr = syscall.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, ifi.Index)
+		if bindErr != nil {
+			bindErr = syscall.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, ifi.Index)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return bindErr
+}
+
+// EnablePMTUProbe 设置 DF，macOS 不会在本地对设置了 DF 的数据包分片
+func (u *GenericConn) EnablePMTUProbe() error {
+	rc, err := u.UDPConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var setErr error
+	err = rc.Control(func(fd uintptr) {
+		// 双栈套接字使用 IPV6_DONTFRAG，仅 IPv4 的套接字使用 IP_DONTFRAG
+		setErr = syscall.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1)
+		if setErr != nil {
+			setErr = syscall.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_DONTFRAG, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
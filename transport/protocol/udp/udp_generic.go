@@ -58,6 +58,23 @@ func (u *GenericConn) WriteTo(b []byte, addr *Addr) error {
 	return err
 }
 
+func (u *GenericConn) WriteBatch(msgs []Message) (int, error) {
+	var (
+		sent     int
+		firstErr error
+	)
+	for _, m := range msgs {
+		if err := u.WriteTo(m.Buf, m.Addr); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, firstErr
+}
+
 func (u *GenericConn) ReloadConfig(c *config.Config) {
 
 }
@@ -2,12 +2,15 @@ package udp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/am6737/nexus/config"
 	"github.com/am6737/nexus/transport/protocol/udp/header"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
@@ -25,11 +28,68 @@ type StdConn struct {
 	isV4  bool
 	l     *logrus.Logger
 	batch int
+
+	// gso 发送时使用 UDP_SEGMENT 把发往同一地址、大小相同的数据包合并为一个超大数据包，
+	// 网卡不支持校验和卸载时内核返回 EIO，此时关闭 gso
+	gso atomic.Bool
+	// gro 接收时内核通过 UDP_GRO 把同一条流的数据包合并后交给我们
+	gro bool
+
+	// sendPool 缓存 WriteBatch 使用的 sendScratch，避免每次批量写都分配内存
+	sendPool sync.Pool
+}
+
+// sendScratch 一次 sendmmsg 调用需要的内存
+type sendScratch struct {
+	raw []rawMessage
+	// groups[i] 为 raw[i] 包含的数据包在 msgs 中的起始位置与数量
+	groups   [][2]int
+	iovs     []iovec
+	names    []unix.RawSockaddrInet6
+	controls []byte
 }
 
+func (s *sendScratch) reset(n int) {
+	if cap(s.iovs) < n {
+		s.raw = make([]rawMessage, 0, n)
+		s.groups = make([][2]int, 0, n)
+		s.iovs = make([]iovec, n)
+		s.names = make([]unix.RawSockaddrInet6, n)
+		s.controls = make([]byte, n*sendControlSize)
+	}
+	s.raw = s.raw[:0]
+	s.groups = s.groups[:0]
+	s.iovs = s.iovs[:n]
+	s.names = s.names[:n]
+	s.controls = s.controls[:n*sendControlSize]
+}
+
+// sendControlSize 每个发送的消息最多携带 UDP_SEGMENT 与 IP_TOS（或 IPV6_TCLASS）两个控制消息
+var sendControlSize = unix.CmsgSpace(2) + unix.CmsgSpace(4)
+
+// appendCmsg 在 control 之后追加一个数据长度为 n 的控制消息，返回追加后的 control 与控制消息的数据部分
+func appendCmsg(control []byte, level, typ int32, n int) ([]byte, []byte) {
+	off := len(control)
+	control = control[:off+unix.CmsgSpace(n)]
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&control[off]))
+	hdr.Level = level
+	hdr.Type = typ
+	hdr.SetLen(unix.CmsgLen(n))
+	return control, control[off+unix.CmsgLen(0) : off+unix.CmsgLen(n)]
+}
+
+const (
+	// maxGSOSegments 内核允许一次发送的最大分段数量（UDP_MAX_SEGMENTS）
+	maxGSOSegments = 64
+	// maxGSOSize 一个 UDP 数据包的最大负载
+	maxGSOSize = 65507
+	// groBufferSize 开启 UDP_GRO 后每个接收缓冲区的大小
+	groBufferSize = 65535
+)
+
 // NewListener 创建一个新的 UDP 监听器。
 // l 是用于记录日志的 logrus.Logger 实例。
-// ip 是要绑定的 IP 地址。
+// ip 是要绑定的 IP 地址，IPv6 地址（例如 ::）会创建同时收发 IPv4 与 IPv6 的双栈套接字。
 // port 是要监听的端口号。
 // multi 指定是否启用多地址复用。
 // batch 指定每次读取的数据包数量。
@@ -53,14 +113,28 @@ func NewListener(l *logrus.Logger, ip net.IP, port int, multi bool, batch int) (
 	syscall.ForkLock.RUnlock()
 
 	if err != nil {
+		// 系统未启用 IPv6 时，通配地址退回到仅 IPv4 的监听。
+		if !isV4 && ip.IsUnspecified() && errors.Is(err, unix.EAFNOSUPPORT) {
+			l.Warn("IPv6 is not supported on this host, falling back to an IPv4 only listener")
+			return NewListener(l, net.IPv4zero, port, multi, batch)
+		}
 		// 如果创建套接字失败，则关闭文件描述符并返回错误。
 		unix.Close(fd)
 		return nil, fmt.Errorf("unable to open socket: %s", err)
 	}
 
+	// 关闭 IPV6_V6ONLY，IPv4 对端会以 IPv4-mapped IPv6 地址出现在同一个套接字上。
+	if !isV4 {
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("unable to clear IPV6_V6ONLY: %s", err)
+		}
+	}
+
 	// 如果启用了多地址复用，设置套接字选项。
 	if multi {
 		if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			unix.Close(fd)
 			return nil, fmt.Errorf("unable to set SO_REUSEPORT: %s", err)
 		}
 	}
@@ -81,17 +155,49 @@ func NewListener(l *logrus.Logger, ip net.IP, port int, multi bool, batch int) (
 
 	// 绑定套接字和地址。
 	if err = unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
 		return nil, fmt.Errorf("unable to bind to socket: %s", err)
 	}
 
 	// 创建一个新的 StdConn 实例并返回。
-	return &StdConn{sysFd: fd, isV4: isV4, l: l, batch: batch}, err
+	c := &StdConn{sysFd: fd, isV4: isV4, l: l, batch: batch}
+	c.enableOffload()
+	return c, err
+}
+
+// enableOffload 探测内核是否支持 UDP_SEGMENT 与 UDP_GRO（Linux 4.18 / 5.0 之后）
+func (s *StdConn) enableOffload() {
+	if _, err := unix.GetsockoptInt(s.sysFd, unix.IPPROTO_UDP, unix.UDP_SEGMENT); err == nil {
+		s.gso.Store(true)
+	}
+	if err := unix.SetsockoptInt(s.sysFd, unix.IPPROTO_UDP, unix.UDP_GRO, 1); err == nil {
+		s.gro = true
+	}
+	s.l.WithField("gso", s.gso.Load()).WithField("gro", s.gro).Debug("UDP offload")
 }
 
 func (s *StdConn) Rebind() error {
 	return nil
 }
 
+func (s *StdConn) BindToInterface(ifi *net.Interface) error {
+	return unix.SetsockoptString(s.sysFd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifi.Name)
+}
+
+// EnablePMTUProbe 使用 IP_PMTUDISC_PROBE：设置 DF 并忽略内核记录的路径 MTU。
+// 默认的 IP_PMTUDISC_WANT 在内核收到 ICMP 需要分片的报文后会在本地分片，超过路径 MTU 的探测仍然能到达对端
+func (s *StdConn) EnablePMTUProbe() error {
+	if err := unix.SetsockoptInt(s.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE); err != nil {
+		return fmt.Errorf("unable to set IP_MTU_DISCOVER: %s", err)
+	}
+	if !s.isV4 {
+		if err := unix.SetsockoptInt(s.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE); err != nil {
+			return fmt.Errorf("unable to set IPV6_MTU_DISCOVER: %s", err)
+		}
+	}
+	return nil
+}
+
 func (s *StdConn) SetRecvBuffer(n int) error {
 	return unix.SetsockoptInt(s.sysFd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, n)
 }
@@ -135,13 +241,18 @@ func (s *StdConn) ListenOut(r EncReader) {
 
 	//TODO: should we track this?
 	//metric := metrics.GetOrRegisterHistogram("test.batch_read", nil, metrics.NewExpDecaySample(1028, 0.015))
-	msgs, buffers, names := s.PrepareRawMessages(s.batch)
+	msgs, buffers, names, controls := s.PrepareRawMessages(s.batch)
 	read := s.ReadMulti
 	if s.batch == 1 {
 		read = s.ReadSingle
 	}
 
 	for {
+		// 内核会改写 Controllen，每次读取前都需要恢复
+		for i := range controls {
+			msgs[i].Hdr.Controllen = uint64(len(controls[i]))
+		}
+
 		n, err := read(msgs)
 		if err != nil {
 			s.l.WithError(err).Debug("udp socket is closed, exiting read loop")
@@ -156,11 +267,42 @@ func (s *StdConn) ListenOut(r EncReader) {
 				udpAddr.IP = names[i][8:24]
 			}
 			udpAddr.Port = binary.BigEndian.Uint16(names[i][2:4])
-			r(udpAddr, plaintext[:0], buffers[i][:msgs[i].Len], h)
+
+			b := buffers[i][:msgs[i].Len]
+			segment := len(b)
+			if controls != nil {
+				if size := groSegmentSize(controls[i][:msgs[i].Hdr.Controllen]); size > 0 {
+					segment = size
+				}
+			}
+			// 把 GRO 合并的数据包按分段大小拆分开
+			for len(b) > 0 {
+				end := segment
+				if end > len(b) {
+					end = len(b)
+				}
+				r(udpAddr, plaintext[:0], b[:end], h)
+				b = b[end:]
+			}
 		}
 	}
 }
 
+// groSegmentSize 从控制消息中取出 UDP_GRO 的分段大小，没有时返回 0
+func groSegmentSize(control []byte) int {
+	for len(control) >= unix.SizeofCmsghdr {
+		hdr := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+		if hdr.Len < unix.SizeofCmsghdr || int(hdr.Len) > len(control) {
+			return 0
+		}
+		if hdr.Level == unix.SOL_UDP && hdr.Type == unix.UDP_GRO && int(hdr.Len) >= unix.CmsgLen(4) {
+			return int(*(*int32)(unsafe.Pointer(&control[unix.CmsgLen(0)])))
+		}
+		control = control[unix.CmsgSpace(int(hdr.Len)-unix.CmsgLen(0)):]
+	}
+	return 0
+}
+
 func (s *StdConn) ReadSingle(msgs []rawMessage) (int, error) {
 	for {
 		n, _, err := unix.Syscall6(
@@ -225,13 +367,21 @@ type rawMessage struct {
 	Pad0 [4]byte
 }
 
-func (s *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
+// PrepareRawMessages 准备 n 个接收缓冲区，开启 UDP_GRO 时每个缓冲区都带有控制消息缓冲区
+func (s *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte, [][]byte) {
 	msgs := make([]rawMessage, n)
 	buffers := make([][]byte, n)
 	names := make([][]byte, n)
 
+	size := MTU
+	var controls [][]byte
+	if s.gro {
+		size = groBufferSize
+		controls = make([][]byte, n)
+	}
+
 	for i := range msgs {
-		buffers[i] = make([]byte, MTU)
+		buffers[i] = make([]byte, size)
 		names[i] = make([]byte, unix.SizeofSockaddrInet6)
 
 		//TODO: this is still silly, no need for an array
@@ -244,9 +394,15 @@ func (s *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
 
 		msgs[i].Hdr.Name = &names[i][0]
 		msgs[i].Hdr.Namelen = uint32(len(names[i]))
+
+		if controls != nil {
+			controls[i] = make([]byte, unix.CmsgSpace(4))
+			msgs[i].Hdr.Control = &controls[i][0]
+			msgs[i].Hdr.Controllen = uint64(len(controls[i]))
+		}
 	}
 
-	return msgs, buffers, names
+	return msgs, buffers, names, controls
 }
 
 func (s *StdConn) WriteTo(b []byte, addr *Addr) error {
@@ -256,6 +412,153 @@ func (s *StdConn) WriteTo(b []byte, addr *Addr) error {
 	return s.writeTo6(b, addr)
 }
 
+// WriteBatch 使用 sendmmsg 在一次系统调用中发送多个数据包，
+// 支持 UDP_SEGMENT 时发往同一地址的连续数据包会合并为一个超大数据包，由内核或网卡完成分段
+func (s *StdConn) WriteBatch(msgs []Message) (int, error) {
+	if len(msgs) == 1 && msgs[0].TOS == 0 {
+		if err := s.WriteTo(msgs[0].Buf, msgs[0].Addr); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	gso := s.gso.Load()
+
+	scratch, _ := s.sendPool.Get().(*sendScratch)
+	if scratch == nil {
+		scratch = &sendScratch{}
+	}
+	defer s.sendPool.Put(scratch)
+	scratch.reset(len(msgs))
+	iovs, names, controls := scratch.iovs, scratch.names, scratch.controls
+
+	var firstErr error
+
+	for i := 0; i < len(msgs); i++ {
+		m := msgs[i]
+		if len(m.Buf) == 0 {
+			continue
+		}
+		namelen, err := s.fillSockaddr(&names[i], m.Addr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		iovs[i] = iovec{Base: &m.Buf[0], Len: uint64(len(m.Buf))}
+
+		// 合并后续发往同一地址的数据包，除最后一个外每个分段的大小必须相同
+		count, total := 1, len(m.Buf)
+		if gso {
+			for j := i + 1; j < len(msgs) && count < maxGSOSegments; j++ {
+				next := msgs[j].Buf
+				if len(next) == 0 || len(next) > len(m.Buf) || total+len(next) > maxGSOSize || !m.Addr.Equal(msgs[j].Addr) || msgs[j].TOS != m.TOS {
+					break
+				}
+				iovs[j] = iovec{Base: &next[0], Len: uint64(len(next))}
+				count++
+				total += len(next)
+				if len(next) < len(m.Buf) {
+					break
+				}
+			}
+		}
+
+		var rm rawMessage
+		rm.Hdr.Iov = &iovs[i]
+		rm.Hdr.Iovlen = uint64(count)
+		rm.Hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		rm.Hdr.Namelen = namelen
+		control := controls[i*sendControlSize : i*sendControlSize]
+		if count > 1 {
+			var data []byte
+			control, data = appendCmsg(control, unix.SOL_UDP, unix.UDP_SEGMENT, 2)
+			*(*uint16)(unsafe.Pointer(&data[0])) = uint16(len(m.Buf))
+		}
+		if m.TOS != 0 {
+			// 发往 IPv4（包括双栈套接字上的 IPv4 映射地址）使用 IP_TOS，发往 IPv6 使用 IPV6_TCLASS
+			level, typ := int32(unix.SOL_IP), int32(unix.IP_TOS)
+			if !s.isV4 && m.Addr.IP.To4() == nil {
+				level, typ = unix.SOL_IPV6, unix.IPV6_TCLASS
+			}
+			var data []byte
+			control, data = appendCmsg(control, level, typ, 4)
+			*(*int32)(unsafe.Pointer(&data[0])) = int32(m.TOS)
+		}
+		if len(control) > 0 {
+			rm.Hdr.Control = &control[0]
+			rm.Hdr.Controllen = uint64(len(control))
+		}
+		scratch.raw = append(scratch.raw, rm)
+		scratch.groups = append(scratch.groups, [2]int{i, count})
+		i += count - 1
+	}
+	raw, groups := scratch.raw, scratch.groups
+
+	sent := 0
+	for i := 0; i < len(raw); {
+		n, _, errno := unix.Syscall6(
+			unix.SYS_SENDMMSG,
+			uintptr(s.sysFd),
+			uintptr(unsafe.Pointer(&raw[i])),
+			uintptr(len(raw)-i),
+			0,
+			0,
+			0,
+		)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno == unix.EIO && groups[i][1] > 1 {
+			// 网卡不支持 UDP 分段卸载，关闭 gso 后逐个重新发送剩余的数据包
+			s.gso.Store(false)
+			s.l.WithError(errno).Warn("UDP GSO is not supported by the interface, disabling it")
+			n, err := s.WriteBatch(msgs[groups[i][0]:])
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			return sent + n, firstErr
+		}
+		if errno != 0 {
+			// sendmmsg 只有在第一个数据包发送失败时才返回错误，跳过它继续发送剩余的数据包
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "sendmmsg", Err: errno}
+			}
+			i++
+			continue
+		}
+		for _, g := range groups[i : i+int(n)] {
+			sent += g[1]
+		}
+		i += int(n)
+	}
+
+	return sent, firstErr
+}
+
+// fillSockaddr 把 addr 写入 rsa，IPv4 套接字会写入 RawSockaddrInet4，返回地址的长度
+func (s *StdConn) fillSockaddr(rsa *unix.RawSockaddrInet6, addr *Addr) (uint32, error) {
+	if s.isV4 {
+		addrV4, isAddrV4 := maybeIPV4(addr.IP)
+		if !isAddrV4 {
+			return 0, fmt.Errorf("Listener is IPv4, but writing to IPv6 remote")
+		}
+		rsa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		rsa4.Family = unix.AF_INET
+		// Little Endian -> Network Endian
+		rsa4.Port = (addr.Port >> 8) | ((addr.Port & 0xff) << 8)
+		copy(rsa4.Addr[:], addrV4)
+		return unix.SizeofSockaddrInet4, nil
+	}
+
+	rsa.Family = unix.AF_INET6
+	// Little Endian -> Network Endian
+	rsa.Port = (addr.Port >> 8) | ((addr.Port & 0xff) << 8)
+	copy(rsa.Addr[:], addr.IP.To16())
+	return unix.SizeofSockaddrInet6, nil
+}
+
 func (s *StdConn) ReloadConfig(c *config.Config) {
 	b := c.Listen.ReadBuffer
 	if b > 0 {
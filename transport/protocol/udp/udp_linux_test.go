@@ -0,0 +1,226 @@
+package udp
+
+import (
+	"bytes"
+	"github.com/am6737/nexus/transport/protocol/udp/header"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestStdConn_WriteBatch(t *testing.T) {
+	for _, listen := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6zero} {
+		conn, err := NewListener(logrus.New(), listen, 0, false, 1)
+		assert.NoError(t, err)
+
+		rc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		remote := &Addr{IP: net.IPv4(127, 0, 0, 1), Port: uint16(rc.LocalAddr().(*net.UDPAddr).Port)}
+
+		n, err := conn.WriteBatch([]Message{
+			{Buf: []byte("one"), Addr: remote},
+			{Buf: []byte("two"), Addr: remote},
+			{Buf: []byte("three"), Addr: remote},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+
+		buf := make([]byte, 16)
+		for _, want := range []string{"one", "two", "three"} {
+			assert.NoError(t, rc.SetReadDeadline(time.Now().Add(time.Second)))
+			n, _, err := rc.ReadFromUDP(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, want, string(buf[:n]))
+		}
+
+		rc.Close()
+		conn.Close()
+	}
+}
+
+func TestStdConn_WriteBatchSkipsInvalid(t *testing.T) {
+	conn, err := NewListener(logrus.New(), net.IPv4(127, 0, 0, 1), 0, false, 1)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	rc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer rc.Close()
+	remote := &Addr{IP: net.IPv4(127, 0, 0, 1), Port: uint16(rc.LocalAddr().(*net.UDPAddr).Port)}
+
+	// IPv4 套接字无法发送到 IPv6 地址，该数据包会被跳过
+	n, err := conn.WriteBatch([]Message{
+		{Buf: []byte("one"), Addr: &Addr{IP: net.ParseIP("2001:db8::1"), Port: 4242}},
+		{Buf: []byte("two"), Addr: remote},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, n)
+
+	buf := make([]byte, 16)
+	assert.NoError(t, rc.SetReadDeadline(time.Now().Add(time.Second)))
+	m, _, err := rc.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", string(buf[:m]))
+}
+
+func TestStdConn_GSOAndGRO(t *testing.T) {
+	rx, err := NewListener(logrus.New(), net.IPv4(127, 0, 0, 1), 0, false, 4)
+	assert.NoError(t, err)
+	defer rx.Close()
+	tx, err := NewListener(logrus.New(), net.IPv4(127, 0, 0, 1), 0, false, 1)
+	assert.NoError(t, err)
+	defer tx.Close()
+
+	received := make(chan string, 16)
+	go rx.ListenOut(func(addr *Addr, out []byte, p []byte, h *header.Header) {
+		received <- string(p)
+	})
+
+	local, err := rx.LocalAddr()
+	assert.NoError(t, err)
+	remote := &Addr{IP: net.IPv4(127, 0, 0, 1), Port: local.Port}
+
+	// 大小相同的连续数据包会合并为一个超大数据包，最后一个分段可以更小
+	var msgs []Message
+	var want []string
+	for i := 0; i < 8; i++ {
+		b := bytes.Repeat([]byte{byte('a' + i)}, 100)
+		if i == 7 {
+			b = b[:10]
+		}
+		msgs = append(msgs, Message{Buf: b, Addr: remote})
+		want = append(want, string(b))
+	}
+	n, err := tx.WriteBatch(msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, len(msgs), n)
+
+	for _, w := range want {
+		select {
+		case got := <-received:
+			assert.Equal(t, w, got)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for packet")
+		}
+	}
+}
+
+func TestGroSegmentSize(t *testing.T) {
+	control := make([]byte, unix.CmsgSpace(4))
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+	hdr.Level = unix.SOL_UDP
+	hdr.Type = unix.UDP_GRO
+	hdr.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&control[unix.CmsgLen(0)])) = 1200
+
+	assert.Equal(t, 1200, groSegmentSize(control))
+	assert.Equal(t, 0, groSegmentSize(nil))
+
+	hdr.Type = unix.UDP_SEGMENT
+	assert.Equal(t, 0, groSegmentSize(control))
+}
+
+func TestStdConn_WriteBatchAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("race detector allocates")
+	}
+	conn, err := NewListener(logrus.New(), net.IPv4(127, 0, 0, 1), 0, false, 1)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	rc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer rc.Close()
+	remote := &Addr{IP: net.IPv4(127, 0, 0, 1), Port: uint16(rc.LocalAddr().(*net.UDPAddr).Port)}
+
+	msgs := make([]Message, 8)
+	for i := range msgs {
+		msgs[i] = Message{Buf: make([]byte, 100), Addr: remote}
+	}
+	allocs := testing.AllocsPerRun(50, func() {
+		if _, err := conn.WriteBatch(msgs); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestStdConn_WriteBatchTOS(t *testing.T) {
+	for _, listen := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6zero} {
+		conn, err := NewListener(logrus.New(), listen, 0, false, 1)
+		assert.NoError(t, err)
+
+		rc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		raw, err := rc.SyscallConn()
+		assert.NoError(t, err)
+		assert.NoError(t, raw.Control(func(fd uintptr) {
+			assert.NoError(t, unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1))
+		}))
+		remote := &Addr{IP: net.IPv4(127, 0, 0, 1), Port: uint16(rc.LocalAddr().(*net.UDPAddr).Port)}
+
+		// TOS 不同的数据包不会被 GSO 合并
+		n, err := conn.WriteBatch([]Message{
+			{Buf: []byte("voice"), Addr: remote, TOS: 46 << 2},
+			{Buf: []byte("bulk!"), Addr: remote, TOS: 8 << 2},
+			{Buf: []byte("plain"), Addr: remote},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+
+		buf, oob := make([]byte, 16), make([]byte, 64)
+		for _, want := range []uint8{46 << 2, 8 << 2, 0} {
+			assert.NoError(t, rc.SetReadDeadline(time.Now().Add(time.Second)))
+			_, oobn, _, _, err := rc.ReadMsgUDP(buf, oob)
+			assert.NoError(t, err)
+			msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+			assert.NoError(t, err)
+			if assert.Len(t, msgs, 1) {
+				assert.Equal(t, want, msgs[0].Data[0])
+			}
+		}
+
+		rc.Close()
+		conn.Close()
+	}
+}
+
+// TestStdConn_EnablePMTUProbe 超过链路 MTU 的探测不会在本地分片，直接发送失败，
+// 复用同一个端口的其他套接字不受影响
+func TestStdConn_EnablePMTUProbe(t *testing.T) {
+	conn, err := NewListener(logrus.New(), net.IPv6loopback, 0, true, 1)
+	if err != nil {
+		t.Skip("IPv6 loopback is not available:", err)
+	}
+	defer conn.Close()
+	addr, err := conn.LocalAddr()
+	assert.NoError(t, err)
+	probe, err := NewListener(logrus.New(), net.IPv6loopback, int(addr.Port), true, 1)
+	assert.NoError(t, err)
+	defer probe.Close()
+
+	rc, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	assert.NoError(t, err)
+	defer rc.Close()
+	remote := &Addr{IP: net.IPv6loopback, Port: uint16(rc.LocalAddr().(*net.UDPAddr).Port)}
+
+	lo, err := net.InterfaceByName("lo")
+	assert.NoError(t, err)
+	// IPv6 头部不计入载荷长度，最大的 UDP 数据包超过回环网卡 65536 字节的 MTU
+	big := make([]byte, 65535-8)
+	if 40+8+len(big) <= lo.MTU {
+		t.Skip("loopback MTU is larger than the largest UDP datagram")
+	}
+
+	// 默认在本地分片，可以发送
+	assert.NoError(t, probe.WriteTo(big, remote))
+
+	assert.NoError(t, probe.EnablePMTUProbe())
+	assert.Error(t, probe.WriteTo(big, remote))
+	assert.NoError(t, probe.WriteTo(big[:1200], remote))
+	assert.NoError(t, conn.WriteTo(big, remote))
+}
@@ -13,6 +13,19 @@ type Device interface {
 
 	Cidr() *net.IPNet
 
+	// UnsafeRoutes returns the routes configured in tun.unsafe_routes.
+	UnsafeRoutes() []Route
+
+	// AddRoute installs a route through the Device in the system routing table.
+	AddRoute(r Route) error
+
+	// RemoveRoute removes a route installed by AddRoute.
+	RemoveRoute(r Route) error
+
+	// NewMultiQueueReader opens another queue of a multi-queue Device,
+	// packets are spread across the queues by the kernel.
+	NewMultiQueueReader() (io.ReadWriteCloser, error)
+
 	// Name returns the current device of the Device.
 	Name() string
 
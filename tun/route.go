@@ -1,7 +1,9 @@
 package tun
 
 import (
+	"fmt"
 	"github.com/am6737/nexus/api"
+	"github.com/am6737/nexus/config"
 	"net"
 )
 
@@ -12,3 +14,47 @@ type Route struct {
 	Via     *api.VpnIP
 	Install bool
 }
+
+// parseUnsafeRoutes 解析 tun.unsafe_routes 配置，
+// 路由的网段必须在 overlay 网络之外，via 必须是 overlay 网络中的地址
+func parseUnsafeRoutes(c *config.Config, network *net.IPNet) ([]Route, error) {
+	routes := make([]Route, 0, len(c.Tun.UnsafeRoutes))
+	for i, ur := range c.Tun.UnsafeRoutes {
+		_, cidr, err := net.ParseCIDR(ur.Route)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d.route in tun.unsafe_routes failed to parse: %v", i+1, err)
+		}
+		if cidr.Contains(network.IP) || network.Contains(cidr.IP) {
+			return nil, fmt.Errorf("entry %d.route in tun.unsafe_routes overlaps the overlay network %s", i+1, network)
+		}
+
+		if ur.Via == "" {
+			return nil, fmt.Errorf("entry %d.via in tun.unsafe_routes is not present", i+1)
+		}
+		via, err := api.ParseVpnIp(ur.Via)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d.via in tun.unsafe_routes failed to parse: %v", i+1, err)
+		}
+		if !network.Contains(via.ToIP()) {
+			return nil, fmt.Errorf("entry %d.via in tun.unsafe_routes is not contained within the overlay network %s", i+1, network)
+		}
+
+		if ur.MTU < 0 || ur.MTU > 0 && ur.MTU < 500 {
+			return nil, fmt.Errorf("entry %d.mtu in tun.unsafe_routes is below 500: %v", i+1, ur.MTU)
+		}
+
+		install := true
+		if ur.Install != nil {
+			install = *ur.Install
+		}
+
+		routes = append(routes, Route{
+			MTU:     ur.MTU,
+			Metric:  ur.Metric,
+			Cidr:    cidr,
+			Via:     &via,
+			Install: install,
+		})
+	}
+	return routes, nil
+}
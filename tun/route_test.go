@@ -0,0 +1,36 @@
+package tun
+
+import (
+	"github.com/am6737/nexus/config"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestParseUnsafeRoutes(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.100.0/24")
+	noInstall := false
+
+	c := &config.Config{Tun: config.TunConfig{UnsafeRoutes: []config.UnsafeRoute{
+		{Route: "10.0.0.0/16", Via: "192.168.100.2"},
+		{Route: "10.0.1.0/24", Via: "192.168.100.3", MTU: 1200, Install: &noInstall},
+	}}}
+	routes, err := parseUnsafeRoutes(c, network)
+	assert.NoError(t, err)
+	assert.Len(t, routes, 2)
+	assert.True(t, routes[0].Install)
+	assert.False(t, routes[1].Install)
+	assert.Equal(t, 1200, routes[1].MTU)
+
+	for _, ur := range []config.UnsafeRoute{
+		{Route: "192.168.0.0/16", Via: "192.168.100.2"},
+		{Route: "10.0.0.0/16", Via: "10.0.0.1"},
+		{Route: "10.0.0.0/16"},
+		{Route: "10.0.0.0", Via: "192.168.100.2"},
+		{Route: "10.0.0.0/16", Via: "192.168.100.2", MTU: 100},
+	} {
+		c.Tun.UnsafeRoutes = []config.UnsafeRoute{ur}
+		_, err := parseUnsafeRoutes(c, network)
+		assert.Error(t, err, ur.Route)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/am6737/nexus/config"
 	"github.com/sirupsen/logrus"
 	"net"
+	"strconv"
+	"strings"
 )
 
 type DeviceFactory func(c *config.Config, l *logrus.Logger, tunCidr *net.IPNet) (Device, error)
@@ -16,6 +18,11 @@ func NewDeviceFromConfig(c *config.Config, l *logrus.Logger) (Device, error) {
 		return nil, err
 	}
 
+	routes, err := parseUnsafeRoutes(c, tunCidr)
+	if err != nil {
+		return nil, err
+	}
+
 	switch {
 	case c.Tun.Disabled:
 		//tun := newDisabledTun(tunCidr, c.GetInt("tun.tx_queue", 500), c.GetBool("stats.message_metrics", false), l)
@@ -27,30 +34,54 @@ func NewDeviceFromConfig(c *config.Config, l *logrus.Logger) (Device, error) {
 			tunCidr,
 			c.Tun.MTU,
 			500,
-			false,
+			c.Listen.Routines > 1,
+			routes,
 		)
 	}
 }
 
+// parseIPNet 解析 tun 设备的地址与掩码，支持 IPv4 与 IPv6。
+// 掩码可以是点分十进制（255.255.255.0）、IPv6 形式（ffff:ffff::）或前缀长度（24、/64）。
 func parseIPNet(ipAddress, subnetMask string) (*net.IPNet, error) {
 	ip := net.ParseIP(ipAddress)
 	if ip == nil {
 		return nil, fmt.Errorf("invalid IP address: %s", ipAddress)
 	}
 
-	mask := net.ParseIP(subnetMask)
-	if mask == nil {
-		return nil, fmt.Errorf("invalid subnet mask: %s", subnetMask)
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
 	}
 
-	// Convert mask to IPMask type
-	ones, _ := mask.DefaultMask().Size()
-	ipMask := net.CIDRMask(ones, 32)
+	var ones int
+	if n, err := strconv.Atoi(strings.TrimPrefix(subnetMask, "/")); err == nil {
+		if n < 0 || n > bits {
+			return nil, fmt.Errorf("invalid prefix length %d for %s", n, ipAddress)
+		}
+		ones = n
+	} else {
+		mask := net.ParseIP(subnetMask)
+		if mask == nil {
+			return nil, fmt.Errorf("invalid subnet mask: %s", subnetMask)
+		}
+		if bits == 8*net.IPv4len {
+			mask = mask.To4()
+		}
+		if mask == nil {
+			return nil, fmt.Errorf("subnet mask %s does not match the address family of %s", subnetMask, ipAddress)
+		}
+		var maskBits int
+		ones, maskBits = net.IPMask(mask).Size()
+		if maskBits == 0 {
+			return nil, fmt.Errorf("non-canonical subnet mask: %s", subnetMask)
+		}
+	}
 
 	// Create IPNet struct
 	ipNet := &net.IPNet{
 		IP:   ip,
-		Mask: ipMask,
+		Mask: net.CIDRMask(ones, bits),
 	}
 	return ipNet, nil
 }
@@ -25,6 +25,11 @@ const (
 
 	appleCTLIOCGINFO = 3227799043
 
+	// _IOW('i', 26, struct in6_aliasreq)
+	appleSIOCAIFADDRIN6  = 2155899162
+	appleIN6IFFNODAD     = 0x0020
+	appleND6InfiniteLife = 0xffffffff
+
 	defaultMTU = 1500
 )
 
@@ -51,6 +56,8 @@ type tun struct {
 	ifra       ifreqAddr
 	cidr       *net.IPNet
 
+	Routes []Route
+
 	// cache out buffer since we need to prepend 4 bytes for tun metadata
 	out []byte
 }
@@ -61,6 +68,24 @@ type ifreqAddr struct {
 	pad  [8]byte
 }
 
+// ifreqAlias6 mirrors struct in6_aliasreq
+type ifreqAlias6 struct {
+	Name       [16]byte
+	Addr       unix.RawSockaddrInet6
+	DstAddr    unix.RawSockaddrInet6
+	PrefixMask unix.RawSockaddrInet6
+	Flags      uint32
+	Lifetime   addrLifetime6
+}
+
+// addrLifetime6 mirrors struct in6_addrlifetime
+type addrLifetime6 struct {
+	Expire    float64
+	Preferred float64
+	Vltime    uint32
+	Pltime    uint32
+}
+
 type ifReq struct {
 	Name  [16]byte
 	Flags uint16
@@ -78,8 +103,9 @@ type ifreqMTU struct {
 // name is the name of the device.
 // cidr is the network CIDR of the device.
 // defaultMTU is the default Maximum Transmission Unit (MTU) of the device.
+// routes are the unsafe routes reachable through other peers.
 // It returns a Device ifce and an error if any.
-func newTun(name string, cidr *net.IPNet, mtu int, txQueueLen int, multiqueue bool) (Device, error) {
+func newTun(name string, cidr *net.IPNet, mtu int, txQueueLen int, multiqueue bool, routes []Route) (Device, error) {
 	var fd int
 	var err error
 	ifIndex := -1
@@ -161,6 +187,7 @@ func newTun(name string, cidr *net.IPNet, mtu int, txQueueLen int, multiqueue bo
 		device:          devName,
 		defaultMTU:      mtu,
 		cidr:            cidr,
+		Routes:          routes,
 	}, nil
 }
 
@@ -168,6 +195,43 @@ func (t *tun) MTU() int {
 	return t.defaultMTU
 }
 
+func (t *tun) UnsafeRoutes() []Route {
+	return t.Routes
+}
+
+func (t *tun) AddRoute(r Route) error {
+	return t.writeRoute(unix.RTM_ADD, r)
+}
+
+func (t *tun) RemoveRoute(r Route) error {
+	return t.writeRoute(unix.RTM_DELETE, r)
+}
+
+// writeRoute sends a route message of the given type for r through the device
+func (t *tun) writeRoute(typ int, r Route) error {
+	routeSock, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("unable to create route socket: %w", err)
+	}
+	defer func() {
+		unix.Shutdown(routeSock, unix.SHUT_RDWR)
+		if err := unix.Close(routeSock); err != nil {
+			log.Printf("unable to close route socket: %v", err)
+		}
+	}()
+
+	linkAddr, err := getLinkAddr(t.device)
+	if err != nil {
+		return err
+	}
+	if linkAddr == nil {
+		return errors.New("unable to get link address")
+	}
+
+	routeAddr, maskAddr := routeAddrs(r.Cidr)
+	return routeMessage(routeSock, typ, routeAddr, maskAddr, linkAddr)
+}
+
 func (t *tun) Cidr() *net.IPNet {
 	return t.cidr
 }
@@ -183,12 +247,6 @@ func (t *tun) Name() string {
 func (t *tun) Up() error {
 	devName := t.deviceBytes()
 
-	var addr, mask [4]byte
-
-	// Copy the IP address and subnet mask to their respective arrays
-	copy(addr[:], t.cidr.IP.To4())
-	copy(mask[:], t.cidr.Mask)
-
 	// Create a socket to configure the network ifce
 	s, err := unix.Socket(
 		unix.AF_INET,
@@ -202,25 +260,13 @@ func (t *tun) Up() error {
 
 	fd := uintptr(s)
 
-	// Construct the device's IP address structure
-	ifra := ifreqAddr{
-		Name: devName,
-		Addr: unix.RawSockaddrInet4{
-			Family: unix.AF_INET,
-			Addr:   addr,
-		},
-	}
-
-	// Set the device's IP address
-	if err := ioctl(fd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		log.Printf("unable to set device IP address: %v", err)
-		return err
+	// Set the device's IP address and subnet mask
+	if t.cidr.IP.To4() != nil {
+		err = t.setAddr4(fd, devName)
+	} else {
+		err = t.setAddr6(devName)
 	}
-
-	// Set the device's subnet mask
-	ifra.Addr.Addr = mask
-	if err := ioctl(fd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		log.Printf("unable to set device network: %v", err)
+	if err != nil {
 		return err
 	}
 
@@ -259,8 +305,6 @@ func (t *tun) Up() error {
 	}()
 
 	// Get the link address of the device
-	routeAddr := &netroute.Inet4Addr{}
-	maskAddr := &netroute.Inet4Addr{}
 	linkAddr, err := getLinkAddr(t.device)
 	if err != nil {
 		log.Printf("unable to get link address: %v", err)
@@ -270,11 +314,8 @@ func (t *tun) Up() error {
 		return errors.New("unable to get link address")
 	}
 
-	// Copy the addresses to the route address structures
-	copy(routeAddr.IP[:], addr[:])
-	copy(maskAddr.IP[:], mask[:])
-
 	// Add the route to the routing table
+	routeAddr, maskAddr := routeAddrs(t.cidr)
 	if err = addRoute(routeSock, routeAddr, maskAddr, linkAddr); err != nil {
 		if errors.Is(err, unix.EEXIST) {
 			err = fmt.Errorf("unable to add tun route, identical route already exists")
@@ -282,6 +323,21 @@ func (t *tun) Up() error {
 		//return err
 	}
 
+	// Unsafe routes
+	for _, r := range t.Routes {
+		if !r.Install {
+			continue
+		}
+
+		routeAddr, maskAddr := routeAddrs(r.Cidr)
+		if err = addRoute(routeSock, routeAddr, maskAddr, linkAddr); err != nil {
+			if errors.Is(err, unix.EEXIST) {
+				return fmt.Errorf("unable to add unsafe route %v, identical route already exists", r.Cidr)
+			}
+			return err
+		}
+	}
+
 	// Flag the ifce as up and running
 	ifrf.Flags = ifrf.Flags | unix.IFF_UP | unix.IFF_RUNNING
 	if err := ioctl(uintptr(fd), unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifrf))); err != nil {
@@ -292,6 +348,91 @@ func (t *tun) Up() error {
 	return nil
 }
 
+// setAddr4 sets the IPv4 address and netmask of the device
+func (t *tun) setAddr4(fd uintptr, devName [16]byte) error {
+	var addr, mask [4]byte
+
+	// Copy the IP address and subnet mask to their respective arrays
+	copy(addr[:], t.cidr.IP.To4())
+	copy(mask[:], t.cidr.Mask)
+
+	// Construct the device's IP address structure
+	ifra := ifreqAddr{
+		Name: devName,
+		Addr: unix.RawSockaddrInet4{
+			Family: unix.AF_INET,
+			Addr:   addr,
+		},
+	}
+
+	// Set the device's IP address
+	if err := ioctl(fd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
+		log.Printf("unable to set device IP address: %v", err)
+		return err
+	}
+
+	// Set the device's subnet mask
+	ifra.Addr.Addr = mask
+	if err := ioctl(fd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
+		log.Printf("unable to set device network: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// setAddr6 adds the IPv6 address and prefix of the device, this needs an AF_INET6 socket
+func (t *tun) setAddr6(devName [16]byte) error {
+	s, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_IP)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(s)
+
+	ifra := ifreqAlias6{
+		Name: devName,
+		Addr: unix.RawSockaddrInet6{
+			Len:    unix.SizeofSockaddrInet6,
+			Family: unix.AF_INET6,
+		},
+		PrefixMask: unix.RawSockaddrInet6{
+			Len:    unix.SizeofSockaddrInet6,
+			Family: unix.AF_INET6,
+		},
+		Flags: appleIN6IFFNODAD,
+		Lifetime: addrLifetime6{
+			Vltime: appleND6InfiniteLife,
+			Pltime: appleND6InfiniteLife,
+		},
+	}
+	copy(ifra.Addr.Addr[:], t.cidr.IP.To16())
+	copy(ifra.PrefixMask.Addr[:], t.cidr.Mask)
+
+	if err := ioctl(uintptr(s), appleSIOCAIFADDRIN6, uintptr(unsafe.Pointer(&ifra))); err != nil {
+		log.Printf("unable to set device IPv6 address: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// routeAddrs converts a cidr into the destination and netmask addresses of a route message
+func routeAddrs(cidr *net.IPNet) (netroute.Addr, netroute.Addr) {
+	if ip4 := cidr.IP.To4(); ip4 != nil {
+		routeAddr := &netroute.Inet4Addr{}
+		maskAddr := &netroute.Inet4Addr{}
+		copy(routeAddr.IP[:], ip4.Mask(cidr.Mask))
+		copy(maskAddr.IP[:], cidr.Mask)
+		return routeAddr, maskAddr
+	}
+
+	routeAddr := &netroute.Inet6Addr{}
+	maskAddr := &netroute.Inet6Addr{}
+	copy(routeAddr.IP[:], cidr.IP.Mask(cidr.Mask))
+	copy(maskAddr.IP[:], cidr.Mask)
+	return routeAddr, maskAddr
+}
+
 func (t *tun) Down() error {
 	// TODO: Implement shutting down the ifce
 	return nil
@@ -333,6 +474,10 @@ func (t *tun) Write(from []byte) (int, error) {
 	return n - 4, err
 }
 
+func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("multi-queue is not supported on darwin")
+}
+
 func (t *tun) Close() error {
 	return t.ReadWriteCloser.Close()
 }
@@ -372,10 +517,42 @@ func getLinkAddr(name string) (*netroute.LinkAddr, error) {
 	return nil, nil
 }
 
-func addRoute(sock int, addr, mask *netroute.Inet4Addr, link *netroute.LinkAddr) error {
+// DefaultRouteInterface returns the interface of the IPv4 default route
+func DefaultRouteInterface() (*net.Interface, error) {
+	rib, err := netroute.FetchRIB(unix.AF_INET, unix.NET_RT_DUMP, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := netroute.ParseRIB(unix.NET_RT_DUMP, rib)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range msgs {
+		m, ok := msg.(*netroute.RouteMessage)
+		if !ok || m.Flags&unix.RTF_GATEWAY == 0 || len(m.Addrs) <= unix.RTAX_NETMASK {
+			continue
+		}
+		dst, ok := m.Addrs[unix.RTAX_DST].(*netroute.Inet4Addr)
+		if !ok || dst.IP != [4]byte{} {
+			continue
+		}
+		if mask, ok := m.Addrs[unix.RTAX_NETMASK].(*netroute.Inet4Addr); ok && mask.IP != [4]byte{} {
+			continue
+		}
+		return net.InterfaceByIndex(m.Index)
+	}
+	return nil, errors.New("no default route found")
+}
+
+func addRoute(sock int, addr, mask netroute.Addr, link *netroute.LinkAddr) error {
+	return routeMessage(sock, unix.RTM_ADD, addr, mask, link)
+}
+
+func routeMessage(sock int, typ int, addr, mask netroute.Addr, link *netroute.LinkAddr) error {
 	r := netroute.RouteMessage{
 		Version: unix.RTM_VERSION,
-		Type:    unix.RTM_ADD,
+		Type:    typ,
 		Flags:   unix.RTF_UP,
 		Seq:     1,
 		Addrs: []netroute.Addr{
@@ -4,6 +4,7 @@
 package tun
 
 import (
+	"errors"
 	"fmt"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
@@ -59,7 +60,7 @@ type tun struct {
 	TXQueueLen int
 }
 
-func newTun(deviceName string, cidr *net.IPNet, defaultMTU int, txQueueLen int, multiqueue bool) (Device, error) {
+func newTun(deviceName string, cidr *net.IPNet, defaultMTU int, txQueueLen int, multiqueue bool, routes []Route) (Device, error) {
 	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
 		return nil, err
@@ -83,12 +84,18 @@ func newTun(deviceName string, cidr *net.IPNet, defaultMTU int, txQueueLen int,
 	}
 
 	maxMTU := defaultMTU
+	for _, r := range routes {
+		if r.MTU > maxMTU {
+			maxMTU = r.MTU
+		}
+	}
 
 	t := &tun{
 		ReadWriteCloser: file,
 		fd:              int(file.Fd()),
 		device:          name,
 		cidr:            cidr,
+		Routes:          routes,
 		MaxMTU:          maxMTU,
 		DefaultMTU:      defaultMTU,
 		TXQueueLen:      txQueueLen,
@@ -150,6 +157,24 @@ func (t *tun) Write(b []byte) (int, error) {
 	}
 }
 
+// NewMultiQueueReader 以 IFF_MULTI_QUEUE 再次打开同名设备，得到一个新的队列
+func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
+	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var req ifReq
+	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_MULTI_QUEUE)
+	copy(req.Name[:], t.device)
+	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
 func (t *tun) Close() error {
 	if t.ReadWriteCloser != nil {
 		t.ReadWriteCloser.Close()
@@ -162,6 +187,73 @@ func (t *tun) MTU() int {
 	return t.defaultMTU
 }
 
+func (t *tun) UnsafeRoutes() []Route {
+	return t.Routes
+}
+
+func (t *tun) AddRoute(r Route) error {
+	link, err := netlink.LinkByName(t.device)
+	if err != nil {
+		return fmt.Errorf("failed to get tun device link: %s", err)
+	}
+
+	nr := t.netlinkRoute(link, r)
+	if err := netlink.RouteReplace(&nr); err != nil {
+		return fmt.Errorf("failed to add route %v; %v", r.Cidr, err)
+	}
+	return nil
+}
+
+func (t *tun) RemoveRoute(r Route) error {
+	link, err := netlink.LinkByName(t.device)
+	if err != nil {
+		return fmt.Errorf("failed to get tun device link: %s", err)
+	}
+
+	nr := t.netlinkRoute(link, r)
+	if err := netlink.RouteDel(&nr); err != nil {
+		return fmt.Errorf("failed to remove route %v; %v", r.Cidr, err)
+	}
+	return nil
+}
+
+// DefaultRouteInterface returns the interface of the IPv4 default route with the lowest metric
+func DefaultRouteInterface() (*net.Interface, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *netlink.Route
+	for i, r := range routes {
+		if r.Dst != nil && !r.Dst.IP.IsUnspecified() {
+			continue
+		}
+		if best == nil || r.Priority < best.Priority {
+			best = &routes[i]
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no default route found")
+	}
+	return net.InterfaceByIndex(best.LinkIndex)
+}
+
+func (t *tun) netlinkRoute(link netlink.Link, r Route) netlink.Route {
+	nr := netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       r.Cidr,
+		MTU:       r.MTU,
+		AdvMSS:    t.advMSS(r),
+		Scope:     unix.RT_SCOPE_LINK,
+	}
+
+	if r.Metric > 0 {
+		nr.Priority = r.Metric
+	}
+	return nr
+}
+
 func (t *tun) Cidr() *net.IPNet {
 	return t.cidr
 }
@@ -195,23 +287,26 @@ func (t *tun) Up() error {
 	}
 	fd := uintptr(s)
 
-	ifra := ifreqAddr{
-		Name: devName,
-		Addr: unix.RawSockaddrInet4{
-			Family: unix.AF_INET,
-			Addr:   addr,
-		},
-	}
+	// IPv6 addresses are assigned through netlink once we have the link below
+	if t.isV4() {
+		ifra := ifreqAddr{
+			Name: devName,
+			Addr: unix.RawSockaddrInet4{
+				Family: unix.AF_INET,
+				Addr:   addr,
+			},
+		}
 
-	// Set the device ip address
-	if err = ioctl(fd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		return fmt.Errorf("failed to set tun address: %s", err)
-	}
+		// Set the device ip address
+		if err = ioctl(fd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
+			return fmt.Errorf("failed to set tun address: %s", err)
+		}
 
-	// Set the device network
-	ifra.Addr.Addr = mask
-	if err = ioctl(fd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		return fmt.Errorf("failed to set tun netmask: %s", err)
+		// Set the device network
+		ifra.Addr.Addr = mask
+		if err = ioctl(fd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
+			return fmt.Errorf("failed to set tun netmask: %s", err)
+		}
 	}
 
 	// Set the device name
@@ -248,6 +343,14 @@ func (t *tun) Up() error {
 		return fmt.Errorf("failed to get tun device link: %s", err)
 	}
 
+	if !t.isV4() {
+		// Skip duplicate address detection, nobody else lives on this link
+		nlAddr := &netlink.Addr{IPNet: t.cidr, Flags: unix.IFA_F_NODAD}
+		if err = netlink.AddrReplace(link, nlAddr); err != nil {
+			return fmt.Errorf("failed to set tun address: %s", err)
+		}
+	}
+
 	// Default route
 	dr := &net.IPNet{IP: t.cidr.IP.Mask(t.cidr.Mask), Mask: t.cidr.Mask}
 	nr := netlink.Route{
@@ -272,18 +375,7 @@ func (t *tun) Up() error {
 			continue
 		}
 
-		nr := netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Dst:       r.Cidr,
-			MTU:       r.MTU,
-			AdvMSS:    t.advMSS(r),
-			Scope:     unix.RT_SCOPE_LINK,
-		}
-
-		if r.Metric > 0 {
-			nr.Priority = r.Metric
-		}
-
+		nr := t.netlinkRoute(link, r)
 		err = netlink.RouteAdd(&nr)
 		if err != nil {
 			return fmt.Errorf("failed to set mtu %v on route %v; %v", r.MTU, r.Cidr, err)
@@ -307,11 +399,20 @@ func (t *tun) advMSS(r Route) int {
 
 	// We only need to set advmss if the route MTU does not match the device MTU
 	if mtu != t.MaxMTU {
+		// IPv6 + TCP headers take 60 bytes, IPv4 + TCP take 40
+		if r.Cidr != nil && r.Cidr.IP.To4() == nil || r.Cidr == nil && !t.isV4() {
+			return mtu - 60
+		}
 		return mtu - 40
 	}
 	return 0
 }
 
+// isV4 reports whether the device carries an IPv4 overlay address
+func (t *tun) isV4() bool {
+	return t.cidr.IP.To4() != nil
+}
+
 func (t *tun) Down() error {
 	if t.ReadWriteCloser != nil {
 		return t.ReadWriteCloser.Close()